@@ -0,0 +1,212 @@
+// tsbs_compare compares the results files of two benchmark runs, e.g., of two
+// builds of a database, written as JSON by the --results-file of the load or
+// query benchmarkers. It reports the change of the metrics of each query type
+// (mean, p99 and throughput), or of the insert rates, and exits with a
+// non-zero code if any got worse by more than the threshold, for CI gating.
+// With --significance, it also runs Welch's t-test on the mean of each query
+// type, to tell the changes from run-to-run noise. With --matrix, it instead writes a metric of each query type in the results
+// files of any number of query runs side by side.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/timescale/tsbs/load"
+	"github.com/timescale/tsbs/query"
+)
+
+// The exit codes of the program, besides 0 when nothing regressed.
+const (
+	exitRegression = 1 // exitRegression is the exit code when a metric regressed
+	exitError      = 2 // exitError is the exit code when the results cannot be compared
+)
+
+// errMixedResults is returned when comparing the results of a load run to
+// those of a query run.
+var errMixedResults = errors.New("cannot compare the results of a load run to those of a query run")
+
+// labelLoad is the label the insert rates of load runs are compared under.
+const labelLoad = "load"
+
+func main() {
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] BASELINE CANDIDATE\n       %s --matrix=METRIC RESULTS...\n", os.Args[0], os.Args[0])
+		pflag.PrintDefaults()
+	}
+	threshold := pflag.Float64("threshold", 0.1, "Relative change beyond which a metric that got worse is a regression (e.g., 0.1 for 10%)")
+	matrix := pflag.String("matrix", "", "Write this metric (count, total, mean, max or p99) of each query type in each of the results files of query runs side by side, the best of each query type marked, rather than comparing two runs")
+	significance := pflag.Float64("significance", 0, "Also run Welch's t-test on the mean of each query type of two query runs, and report the differences whose p-value is below this significance level (e.g., 0.05) as significant (0 to disable)")
+	pflag.Parse()
+	if *significance < 0 || *significance >= 1 {
+		log.Printf("--significance of %v is not a significance level, between 0 and 1", *significance)
+		os.Exit(exitError)
+	}
+	if len(*matrix) > 0 {
+		if pflag.NArg() == 0 {
+			pflag.Usage()
+			os.Exit(exitError)
+		}
+		if err := writeMatrix(os.Stdout, pflag.Args(), *matrix); err != nil {
+			log.Printf("cannot write the matrix: %v", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+	if pflag.NArg() != 2 {
+		pflag.Usage()
+		os.Exit(exitError)
+	}
+
+	comparison, err := compareFiles(pflag.Arg(0), pflag.Arg(1), *threshold)
+	if err != nil {
+		log.Printf("cannot compare %s to %s: %v", pflag.Arg(1), pflag.Arg(0), err)
+		os.Exit(exitError)
+	}
+	if err := query.WriteComparison(os.Stdout, comparison); err != nil {
+		log.Printf("cannot write the comparison: %v", err)
+		os.Exit(exitError)
+	}
+	if *significance > 0 {
+		if err := writeMeanComparisons(os.Stdout, pflag.Arg(0), pflag.Arg(1), *significance); err != nil {
+			log.Printf("cannot compare the means of %s to those of %s: %v", pflag.Arg(1), pflag.Arg(0), err)
+			os.Exit(exitError)
+		}
+	}
+	if regressions := comparison.Regressions(); len(regressions) > 0 {
+		fmt.Printf("%d metrics regressed by more than %0.2f%%\n", len(regressions), 100**threshold)
+		os.Exit(exitRegression)
+	}
+}
+
+// compareFiles compares the results file of the candidate run to that of the
+// baseline run, both of query runs or both of load runs.
+func compareFiles(baselinePath, candidatePath string, threshold float64) (query.ResultComparison, error) {
+	baseline, err := ioutil.ReadFile(baselinePath)
+	if err != nil {
+		return query.ResultComparison{}, err
+	}
+	candidate, err := ioutil.ReadFile(candidatePath)
+	if err != nil {
+		return query.ResultComparison{}, err
+	}
+	baselineIsQuery, err := isQueryResult(baseline)
+	if err != nil {
+		return query.ResultComparison{}, fmt.Errorf("%s: %v", baselinePath, err)
+	}
+	candidateIsQuery, err := isQueryResult(candidate)
+	if err != nil {
+		return query.ResultComparison{}, fmt.Errorf("%s: %v", candidatePath, err)
+	}
+	if baselineIsQuery != candidateIsQuery {
+		return query.ResultComparison{}, errMixedResults
+	}
+	if baselineIsQuery {
+		return compareQueryResults(bytes.NewReader(baseline), bytes.NewReader(candidate), threshold)
+	}
+	return compareLoadResults(bytes.NewReader(baseline), bytes.NewReader(candidate), threshold)
+}
+
+// writeMatrix writes the comparison matrix of metric of the results files of
+// query runs at paths, the column of each run named by its path (see
+// query.WriteComparisonMatrix).
+func writeMatrix(w io.Writer, paths []string, metric string) error {
+	runs := make(map[string]query.BenchmarkResult, len(paths))
+	for _, path := range paths {
+		r, err := readQueryResult(path)
+		if err != nil {
+			return err
+		}
+		runs[path] = r.Result
+	}
+	return query.WriteComparisonMatrix(w, runs, metric)
+}
+
+// writeMeanComparisons writes the results of Welch's t-test on the means of
+// the query types of the results files of two query runs, at the
+// significance level alpha (see query.CompareMeans).
+func writeMeanComparisons(w io.Writer, baselinePath, candidatePath string, alpha float64) error {
+	runs := make([]query.RunResult, 0, 2)
+	for _, path := range []string{baselinePath, candidatePath} {
+		r, err := readQueryResult(path)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, r)
+	}
+	if _, err := fmt.Fprintf(w, "\nWelch's t-test of the means (significance level %v):\n", alpha); err != nil {
+		return err
+	}
+	return query.WriteMeanComparisons(w, query.CompareMeans(runs[0], runs[1], alpha))
+}
+
+// readQueryResult reads the results file of a query run at path.
+func readQueryResult(path string) (query.RunResult, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return query.RunResult{}, err
+	}
+	isQuery, err := isQueryResult(data)
+	if err != nil {
+		return query.RunResult{}, fmt.Errorf("%s: %v", path, err)
+	}
+	if !isQuery {
+		return query.RunResult{}, fmt.Errorf("%s: not the results file of a query run", path)
+	}
+	r, err := query.ReadRunResult(bytes.NewReader(data))
+	if err != nil {
+		return query.RunResult{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+// isQueryResult tells whether the results file data was written by a query
+// run, rather than by a load run.
+func isQueryResult(data []byte) (bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false, fmt.Errorf("not a results file written as JSON: %v", err)
+	}
+	_, ok := fields["result"]
+	return ok, nil
+}
+
+// compareQueryResults compares the results of the candidate query run to
+// those of the baseline (see query.CompareResults).
+func compareQueryResults(baseline, candidate io.Reader, threshold float64) (query.ResultComparison, error) {
+	b, err := query.ReadRunResult(baseline)
+	if err != nil {
+		return query.ResultComparison{}, err
+	}
+	c, err := query.ReadRunResult(candidate)
+	if err != nil {
+		return query.ResultComparison{}, err
+	}
+	return query.CompareResults(b, c, threshold), nil
+}
+
+// compareLoadResults compares the insert rates of the candidate load run to
+// those of the baseline, the rate of rows only if both runs inserted rows.
+func compareLoadResults(baseline, candidate io.Reader, threshold float64) (query.ResultComparison, error) {
+	var b, c load.LoadResult
+	if err := json.NewDecoder(baseline).Decode(&b); err != nil {
+		return query.ResultComparison{}, err
+	}
+	if err := json.NewDecoder(candidate).Decode(&c); err != nil {
+		return query.ResultComparison{}, err
+	}
+	comparison := query.ResultComparison{
+		Deltas: []query.MetricDelta{query.CompareMetric(labelLoad+" metrics", query.MetricThroughput, b.MetricRate, c.MetricRate, false, threshold)},
+	}
+	if b.Rows > 0 && c.Rows > 0 {
+		comparison.Deltas = append(comparison.Deltas, query.CompareMetric(labelLoad+" rows", query.MetricThroughput, b.RowRate, c.RowRate, false, threshold))
+	}
+	return comparison, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeResultsFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCompareFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsbs_compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queryBaseline := writeResultsFile(t, dir, "query_baseline.json",
+		`{"result": {"labels": [{"label": "foo", "count": 10, "mean": 10, "percentiles": [{"percentile": 99, "value": 20}]}]}, "wall_clock_seconds": 1}`)
+	queryCandidate := writeResultsFile(t, dir, "query_candidate.json",
+		`{"result": {"labels": [{"label": "foo", "count": 10, "mean": 15, "percentiles": [{"percentile": 99, "value": 20}]}]}, "wall_clock_seconds": 1}`)
+	loadBaseline := writeResultsFile(t, dir, "load_baseline.json", `{"metrics": 100, "rows": 10, "metrics_per_second": 100, "rows_per_second": 10}`)
+	loadCandidate := writeResultsFile(t, dir, "load_candidate.json", `{"metrics": 100, "rows": 10, "metrics_per_second": 80, "rows_per_second": 10}`)
+	invalid := writeResultsFile(t, dir, "invalid.csv", "statistic,value\n")
+
+	cases := []struct {
+		desc                 string
+		baseline, candidate  string
+		wantDeltas           int
+		wantRegressionMetric string
+		wantErr              bool
+	}{
+		{desc: "query runs", baseline: queryBaseline, candidate: queryCandidate, wantDeltas: 3, wantRegressionMetric: "mean"},
+		{desc: "load runs", baseline: loadBaseline, candidate: loadCandidate, wantDeltas: 2, wantRegressionMetric: "throughput"},
+		{desc: "load and query runs", baseline: loadBaseline, candidate: queryCandidate, wantErr: true},
+		{desc: "not JSON", baseline: queryBaseline, candidate: invalid, wantErr: true},
+		{desc: "missing file", baseline: queryBaseline, candidate: filepath.Join(dir, "missing.json"), wantErr: true},
+	}
+	for _, c := range cases {
+		comparison, err := compareFiles(c.baseline, c.candidate, 0.1)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.desc, err)
+			continue
+		}
+		if len(comparison.Deltas) != c.wantDeltas {
+			t.Errorf("%s: incorrect number of deltas: got %d want %d", c.desc, len(comparison.Deltas), c.wantDeltas)
+		}
+		regressions := comparison.Regressions()
+		if len(regressions) != 1 || regressions[0].Metric != c.wantRegressionMetric {
+			t.Errorf("%s: incorrect regressions: got %+v want one of %s", c.desc, regressions, c.wantRegressionMetric)
+		}
+	}
+}
+
+func TestWriteMatrix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsbs_compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeResultsFile(t, dir, "a.json", `{"result": {"labels": [{"label": "foo", "count": 10, "mean": 10}, {"label": "bar", "count": 10, "mean": 5}]}}`)
+	b := writeResultsFile(t, dir, "b.json", `{"result": {"labels": [{"label": "foo", "count": 10, "mean": 8}]}}`)
+	load := writeResultsFile(t, dir, "load.json", `{"metrics": 100, "rows": 10, "metrics_per_second": 100, "rows_per_second": 10}`)
+
+	var buf bytes.Buffer
+	if err := writeMatrix(&buf, []string{a, b}, "mean"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "bar ") || !strings.Contains(lines[2], "8.000*") {
+		t.Errorf("incorrect matrix:\n%s", buf.String())
+	}
+	if err := writeMatrix(&buf, []string{a, load}, "mean"); err == nil {
+		t.Errorf("expected an error for the results of a load run")
+	}
+	if err := writeMatrix(&buf, []string{a}, "median"); err == nil {
+		t.Errorf("expected an error for an unknown metric")
+	}
+}
+
+func TestWriteMeanComparisons(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsbs_compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseline := writeResultsFile(t, dir, "baseline.json",
+		`{"result": {"labels": [{"label": "foo", "count": 100, "mean": 10, "stddev": 1}, {"label": "bar", "count": 100, "mean": 5, "stddev": 1}]}}`)
+	candidate := writeResultsFile(t, dir, "candidate.json",
+		`{"result": {"labels": [{"label": "foo", "count": 100, "mean": 12, "stddev": 1}, {"label": "bar", "count": 100, "mean": 5.01, "stddev": 1}]}}`)
+	load := writeResultsFile(t, dir, "load.json", `{"metrics": 100, "rows": 10, "metrics_per_second": 100, "rows_per_second": 10}`)
+
+	var buf bytes.Buffer
+	if err := writeMeanComparisons(&buf, baseline, candidate, 0.05); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "bar") || !strings.HasSuffix(lines[1], "not significant") ||
+		!strings.HasPrefix(lines[2], "foo") || !strings.HasSuffix(lines[2], "regression") {
+		t.Errorf("incorrect mean comparisons:\n%s", buf.String())
+	}
+	if err := writeMeanComparisons(&buf, baseline, load, 0.05); err == nil {
+		t.Errorf("expected an error for the results of a load run")
+	}
+}
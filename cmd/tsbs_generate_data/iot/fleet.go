@@ -0,0 +1,237 @@
+package iot
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/timescale/tsbs/cmd/tsbs_generate_data/common"
+	"github.com/timescale/tsbs/cmd/tsbs_generate_data/serialize"
+)
+
+// maxLateDelay is the maximum number of later points a late point is sent after.
+const maxLateDelay = 100
+
+// truckNameTagKey is the key of the tag naming the truck an entry is from.
+var truckNameTagKey = []byte("name")
+
+// FleetConfig describes the irregularities of the data of a real truck fleet,
+// whose devices have their own clocks, send some points late and go offline
+// from time to time. The zero value describes none.
+type FleetConfig struct {
+	// TimestampJitter is the maximum shift of the timestamps of the entries,
+	// as a fraction of the interval between the entries of a truck.
+	TimestampJitter float64
+	// LateFraction is the fraction of the entries sent late, i.e., after up
+	// to maxLateDelay later entries.
+	LateFraction float64
+	// OfflineChance is the chance, per entry, for a truck to go offline.
+	OfflineChance float64
+	// OfflineDuration is the mean duration trucks stay offline for.
+	OfflineDuration time.Duration
+	// OfflineLoss is the fraction of outages whose entries are lost, rather
+	// than sent in a burst once the truck reconnects.
+	OfflineLoss float64
+}
+
+// Enabled returns whether the FleetConfig describes any irregularity.
+func (fc FleetConfig) Enabled() bool {
+	return fc.TimestampJitter > 0 || fc.LateFraction > 0 || fc.OfflineChance > 0
+}
+
+// Validate checks that the values of the FleetConfig are reasonable.
+func (fc FleetConfig) Validate() error {
+	if fc.TimestampJitter < 0 || fc.TimestampJitter >= 1 {
+		return fmt.Errorf("timestamp jitter must be in [0, 1); got %v", fc.TimestampJitter)
+	}
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{
+		{"late fraction", fc.LateFraction},
+		{"offline chance", fc.OfflineChance},
+		{"offline loss", fc.OfflineLoss},
+	} {
+		if f.value < 0 || f.value > 1 {
+			return fmt.Errorf("%s must be in [0, 1]; got %v", f.name, f.value)
+		}
+	}
+	if fc.OfflineChance > 0 && fc.OfflineDuration <= 0 {
+		return fmt.Errorf("offline duration must be positive when trucks go offline; got %v", fc.OfflineDuration)
+	}
+	return nil
+}
+
+// FleetSimulatorConfig is used to create a FleetSimulator.
+// It fulfills the common.SimulatorConfig interface.
+type FleetSimulatorConfig struct {
+	SimulatorConfig
+	FleetConfig
+}
+
+// NewSimulator produces a FleetSimulator with the given config over the
+// specified interval and points limit.
+func (sc *FleetSimulatorConfig) NewSimulator(interval time.Duration, limit uint64) common.Simulator {
+	return newFleetSimulator(sc.SimulatorConfig.NewSimulator(interval, limit), sc.FleetConfig, interval)
+}
+
+// latePoint is an entry held back to be sent late.
+type latePoint struct {
+	point *serialize.Point
+	due   uint64 // due is the number of entries pulled after which the entry is sent
+}
+
+// outage is the period a truck is offline for.
+type outage struct {
+	until   time.Time
+	lost    bool               // lost tells whether the entries of the outage are lost
+	backlog []*serialize.Point // backlog are the entries to send once the truck reconnects
+}
+
+// FleetSimulator applies the irregularities of a FleetConfig to the entries
+// of a base Simulator: it jitters their timestamps, sends some of them late,
+// and has trucks go offline, their entries being lost or sent in a burst once
+// they reconnect.
+type FleetSimulator struct {
+	base     common.Simulator
+	config   FleetConfig
+	interval time.Duration
+
+	// Mutable state.
+	ready   []*serialize.Point
+	late    []latePoint
+	offline map[string]*outage
+	// pulled is the number of entries pulled from the base Simulator.
+	pulled uint64
+}
+
+func newFleetSimulator(base common.Simulator, config FleetConfig, interval time.Duration) *FleetSimulator {
+	return &FleetSimulator{
+		base:     base,
+		config:   config,
+		interval: interval,
+		offline:  map[string]*outage{},
+	}
+}
+
+// Fields returns the fields of an entry.
+func (s *FleetSimulator) Fields() map[string][][]byte {
+	return s.base.Fields()
+}
+
+// TagKeys returns the tag keys of an entry.
+func (s *FleetSimulator) TagKeys() [][]byte {
+	return s.base.TagKeys()
+}
+
+// TagTypes returns the data types for the tags of an entry.
+func (s *FleetSimulator) TagTypes() []reflect.Type {
+	return s.base.TagTypes()
+}
+
+// Finished checks if the simulator is done.
+func (s *FleetSimulator) Finished() bool {
+	return s.base.Finished() && len(s.ready) == 0 && len(s.late) == 0 && len(s.offline) == 0
+}
+
+// Next populates the serialize.Point with the next entry to send, pulling
+// entries from the base Simulator until one is ready. Once the base Simulator
+// is finished, the entries still held back are all sent.
+func (s *FleetSimulator) Next(p *serialize.Point) bool {
+	for len(s.ready) == 0 {
+		if s.base.Finished() {
+			s.flush()
+			if len(s.ready) == 0 {
+				return false
+			}
+			break
+		}
+
+		entry := serialize.NewPoint()
+		if !s.base.Next(entry) {
+			return false
+		}
+		s.pulled++
+		s.receive(entry)
+		s.releaseLate()
+	}
+
+	p.Copy(s.ready[0])
+	s.ready[0] = nil
+	s.ready = s.ready[1:]
+	return true
+}
+
+// receive applies the irregularities to an entry pulled from the base
+// Simulator.
+func (s *FleetSimulator) receive(p *serialize.Point) {
+	ts := *p.Timestamp()
+	if s.config.TimestampJitter > 0 {
+		ts = ts.Add(time.Duration(rand.Float64() * s.config.TimestampJitter * float64(s.interval)))
+		p.SetTimestamp(&ts)
+	}
+
+	// Entries whose truck name was zeroed are never offline.
+	name, _ := p.GetTagValue(truckNameTagKey).(string)
+	if o, ok := s.offline[name]; ok {
+		if ts.Before(o.until) {
+			if !o.lost {
+				o.backlog = append(o.backlog, p)
+			}
+			return
+		}
+		// The truck reconnected: it catches up on the entries of the outage.
+		delete(s.offline, name)
+		s.ready = append(s.ready, o.backlog...)
+	} else if name != "" && s.config.OfflineChance > 0 && rand.Float64() < s.config.OfflineChance {
+		o := &outage{
+			until: ts.Add(time.Duration(rand.ExpFloat64() * float64(s.config.OfflineDuration))),
+			lost:  rand.Float64() < s.config.OfflineLoss,
+		}
+		if !o.lost {
+			o.backlog = append(o.backlog, p)
+		}
+		s.offline[name] = o
+		return
+	}
+
+	if s.config.LateFraction > 0 && rand.Float64() < s.config.LateFraction {
+		s.late = append(s.late, latePoint{point: p, due: s.pulled + 1 + uint64(rand.Intn(maxLateDelay))})
+		return
+	}
+	s.ready = append(s.ready, p)
+}
+
+// releaseLate makes the late entries that are due ready to send.
+func (s *FleetSimulator) releaseLate() {
+	kept := s.late[:0]
+	for _, l := range s.late {
+		if l.due <= s.pulled {
+			s.ready = append(s.ready, l.point)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	s.late = kept
+}
+
+// flush makes all the entries held back ready to send: the late ones, then
+// those of the trucks still offline, which reconnect, in order of truck name.
+func (s *FleetSimulator) flush() {
+	for _, l := range s.late {
+		s.ready = append(s.ready, l.point)
+	}
+	s.late = s.late[:0]
+
+	names := make([]string, 0, len(s.offline))
+	for name := range s.offline {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.ready = append(s.ready, s.offline[name].backlog...)
+		delete(s.offline, name)
+	}
+}
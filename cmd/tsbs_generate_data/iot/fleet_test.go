@@ -0,0 +1,153 @@
+package iot
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/cmd/tsbs_generate_data/serialize"
+)
+
+const fleetTestInterval = 10 * time.Second
+
+// newFleetMockBaseSimulator returns a mock base simulator of the entries of
+// trucks trucks, once every fleetTestInterval, in order.
+func newFleetMockBaseSimulator(trucks, entriesPerTruck int) *mockBaseSimulator {
+	start := time.Unix(0, 0).UTC()
+	pending := make([]*serialize.Point, 0, trucks*entriesPerTruck)
+	for i := 0; i < entriesPerTruck; i++ {
+		for j := 0; j < trucks; j++ {
+			ts := start.Add(time.Duration(i) * fleetTestInterval)
+			p := serialize.NewPoint()
+			p.SetTimestamp(&ts)
+			p.SetMeasurementName([]byte("readings"))
+			p.AppendTag(truckNameTagKey, fmt.Sprintf(truckNameFmt, j))
+			p.AppendField([]byte("entry"), i)
+			pending = append(pending, p)
+		}
+	}
+	return &mockBaseSimulator{pending: pending}
+}
+
+func runFleetSimulator(s *FleetSimulator) []*serialize.Point {
+	var got []*serialize.Point
+	for !s.Finished() {
+		p := serialize.NewPoint()
+		if s.Next(p) {
+			got = append(got, p)
+		}
+	}
+	return got
+}
+
+func TestFleetConfigValidate(t *testing.T) {
+	cases := []struct {
+		desc    string
+		config  FleetConfig
+		wantErr bool
+	}{
+		{desc: "zero value", config: FleetConfig{}},
+		{desc: "all set", config: FleetConfig{TimestampJitter: 0.5, LateFraction: 0.1, OfflineChance: 0.01, OfflineDuration: time.Hour, OfflineLoss: 0.5}},
+		{desc: "jitter of a whole interval", config: FleetConfig{TimestampJitter: 1}, wantErr: true},
+		{desc: "negative late fraction", config: FleetConfig{LateFraction: -0.1}, wantErr: true},
+		{desc: "offline chance above 1", config: FleetConfig{OfflineChance: 2, OfflineDuration: time.Hour}, wantErr: true},
+		{desc: "offline without duration", config: FleetConfig{OfflineChance: 0.1}, wantErr: true},
+	}
+	for _, c := range cases {
+		err := c.config.Validate()
+		if got := err != nil; got != c.wantErr {
+			t.Errorf("%s: got error %v, want error %v", c.desc, err, c.wantErr)
+		}
+	}
+}
+
+func TestFleetSimulatorRegular(t *testing.T) {
+	base := newFleetMockBaseSimulator(3, 10)
+	got := runFleetSimulator(newFleetSimulator(base, FleetConfig{}, fleetTestInterval))
+	if len(got) != len(base.pending) {
+		t.Fatalf("incorrect number of entries: got %d want %d", len(got), len(base.pending))
+	}
+	for i, p := range got {
+		if want := toString(base.pending[i]); toString(p) != want {
+			t.Errorf("incorrect entry %d: got %s want %s", i, toString(p), want)
+		}
+	}
+}
+
+func TestFleetSimulatorTimestampJitter(t *testing.T) {
+	rand.Seed(123)
+	base := newFleetMockBaseSimulator(3, 10)
+	got := runFleetSimulator(newFleetSimulator(base, FleetConfig{TimestampJitter: 0.5}, fleetTestInterval))
+	if len(got) != len(base.pending) {
+		t.Fatalf("incorrect number of entries: got %d want %d", len(got), len(base.pending))
+	}
+	shifted := 0
+	for i, p := range got {
+		shift := p.Timestamp().Sub(*base.pending[i].Timestamp())
+		if shift < 0 || shift >= fleetTestInterval/2 {
+			t.Errorf("entry %d shifted by %v, want in [0, %v)", i, shift, fleetTestInterval/2)
+		}
+		if shift > 0 {
+			shifted++
+		}
+	}
+	if shifted == 0 {
+		t.Errorf("no timestamp was jittered")
+	}
+}
+
+func TestFleetSimulatorLate(t *testing.T) {
+	rand.Seed(123)
+	base := newFleetMockBaseSimulator(3, 100)
+	got := runFleetSimulator(newFleetSimulator(base, FleetConfig{LateFraction: 0.2}, fleetTestInterval))
+	if len(got) != len(base.pending) {
+		t.Fatalf("incorrect number of entries: got %d want %d", len(got), len(base.pending))
+	}
+	outOfOrder := 0
+	for i := 1; i < len(got); i++ {
+		if got[i].Timestamp().Before(*got[i-1].Timestamp()) {
+			outOfOrder++
+		}
+	}
+	if outOfOrder == 0 {
+		t.Errorf("no entry was sent late")
+	}
+}
+
+func TestFleetSimulatorOffline(t *testing.T) {
+	cases := []struct {
+		desc     string
+		loss     float64
+		wantLess bool
+	}{
+		{desc: "catch up on reconnect"},
+		{desc: "lost while offline", loss: 1, wantLess: true},
+	}
+	for _, c := range cases {
+		rand.Seed(123)
+		base := newFleetMockBaseSimulator(3, 100)
+		config := FleetConfig{OfflineChance: 0.05, OfflineDuration: 10 * fleetTestInterval, OfflineLoss: c.loss}
+		got := runFleetSimulator(newFleetSimulator(base, config, fleetTestInterval))
+		if c.wantLess {
+			if len(got) >= len(base.pending) {
+				t.Errorf("%s: no entry was lost: got %d entries", c.desc, len(got))
+			}
+			continue
+		}
+		if len(got) != len(base.pending) {
+			t.Errorf("%s: incorrect number of entries: got %d want %d", c.desc, len(got), len(base.pending))
+		}
+		// A burst of entries of a truck at once shows as entries that are
+		// older than the ones of the other trucks sent before them.
+		outOfOrder := 0
+		for i := 1; i < len(got); i++ {
+			if got[i].Timestamp().Before(*got[i-1].Timestamp()) {
+				outOfOrder++
+			}
+		}
+		if outOfOrder == 0 {
+			t.Errorf("%s: no burst of entries on reconnect", c.desc)
+		}
+	}
+}
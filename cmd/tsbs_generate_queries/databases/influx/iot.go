@@ -315,6 +315,25 @@ func (i *IoT) TruckBreakdownFrequency(qi query.Query) {
 	i.fillInQuery(qi, humanLabel, humanDesc, influxql)
 }
 
+// GapFillByTruck calculates the average velocity per 10 minutes of nTrucks in
+// a time window, filling the gaps in their readings with the last known value.
+func (i *IoT) GapFillByTruck(qi query.Query, nTrucks int) {
+	interval := i.Interval.MustRandWindow(iot.GapFillDuration)
+	influxql := fmt.Sprintf(`SELECT mean("velocity") 
+		FROM "readings" 
+		WHERE %s AND time >= '%s' AND time < '%s' 
+		GROUP BY time(10m),"name" 
+		fill(previous)`,
+		i.getTruckWhereString(nTrucks),
+		interval.Start().Format(time.RFC3339),
+		interval.End().Format(time.RFC3339))
+
+	humanLabel := "Influx gap fill by specific truck"
+	humanDesc := fmt.Sprintf("%s: random %4d trucks, avg velocity per 10 minutes in last 12 hours", humanLabel, nTrucks)
+
+	i.fillInQuery(qi, humanLabel, humanDesc, influxql)
+}
+
 // tenMinutePeriods calculates the number of 10 minute periods that can fit in
 // the time duration if we subtract the minutes specified by minutesPerHour value.
 // E.g.: 4 hours - 5 minutes per hour = 3 hours and 40 minutes = 22 ten minute periods
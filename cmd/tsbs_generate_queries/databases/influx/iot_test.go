@@ -471,6 +471,40 @@ func TestTruckBreakdownFrequency(t *testing.T) {
 	}
 }
 
+func TestGapFillByTruck(t *testing.T) {
+	cases := []IoTTestCase{
+		{
+			desc:    "zero trucks",
+			input:   0,
+			fail:    true,
+			failMsg: "number of trucks cannot be < 1; got 0",
+		},
+		{
+			desc:  "one truck",
+			input: 1,
+
+			expectedHumanLabel: "Influx gap fill by specific truck",
+			expectedHumanDesc:  "Influx gap fill by specific truck: random    1 trucks, avg velocity per 10 minutes in last 12 hours",
+			expectedQuery: `SELECT mean("velocity") 
+		FROM "readings" 
+		WHERE ("name" = 'truck_3') AND time >= '1970-01-01T11:54:10Z' AND time < '1970-01-01T23:54:10Z' 
+		GROUP BY time(10m),"name" 
+		fill(previous)`,
+		},
+	}
+
+	testFunc := func(i *IoT, c IoTTestCase) query.Query {
+		q := i.GenerateEmptyQuery()
+		i.GapFillByTruck(q, c.input)
+		return q
+	}
+
+	start := time.Unix(0, 0)
+	end := start.Add(24 * time.Hour)
+
+	runIoTTestCases(t, testFunc, start, end, cases)
+}
+
 func TestTenMinutePeriods(t *testing.T) {
 	cases := []struct {
 		minutesPerHour float64
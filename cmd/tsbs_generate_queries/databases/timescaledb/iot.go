@@ -424,6 +424,38 @@ func (i *IoT) TruckBreakdownFrequency(qi query.Query) {
 	i.fillInQuery(qi, humanLabel, humanDesc, iot.DiagnosticsTableName, sql)
 }
 
+// GapFillByTruck calculates the average velocity per 10 minutes of nTrucks in
+// a time window, filling the gaps in their readings with the last known value.
+func (i *IoT) GapFillByTruck(qi query.Query, nTrucks int) {
+	name := "name"
+
+	names, err := i.GetRandomTrucks(nTrucks)
+	panicIfErr(err)
+	nameClauses := []string{}
+	for _, s := range names {
+		nameClauses = append(nameClauses, fmt.Sprintf("'%s'", s))
+	}
+
+	interval := i.Interval.MustRandWindow(iot.GapFillDuration)
+	sql := fmt.Sprintf(`SELECT time_bucket_gapfill('10 minutes', r.time) AS ten_minutes, t.%s, locf(avg(r.velocity)) AS velocity
+		FROM tags t
+		INNER JOIN readings r ON r.tags_id = t.id
+		WHERE r.time >= '%s' AND r.time < '%s'
+		AND t.%s IN (%s)
+		GROUP BY 1, 2
+		ORDER BY 2, 1`,
+		i.withAlias(name),
+		interval.Start().Format(goTimeFmt),
+		interval.End().Format(goTimeFmt),
+		i.columnSelect(name),
+		strings.Join(nameClauses, ","))
+
+	humanLabel := "TimescaleDB gap fill by specific truck"
+	humanDesc := fmt.Sprintf("%s: random %4d trucks, avg velocity per 10 minutes in last 12 hours", humanLabel, nTrucks)
+
+	i.fillInQuery(qi, humanLabel, humanDesc, iot.ReadingsTableName, sql)
+}
+
 // tenMinutePeriods calculates the number of 10 minute periods that can fit in
 // the time duration if we subtract the minutes specified by minutesPerHour value.
 // E.g.: 4 hours - 5 minutes per hour = 3 hours and 40 minutes = 22 ten minute periods
@@ -847,6 +847,59 @@ func TestTruckBreakdownFrequency(t *testing.T) {
 	}
 }
 
+func TestGapFillByTruck(t *testing.T) {
+	cases := []testCase{
+		{
+			desc:    "zero trucks",
+			input:   0,
+			fail:    true,
+			failMsg: "number of trucks cannot be < 1; got 0",
+		},
+		{
+			desc:  "one truck",
+			input: 1,
+
+			expectedHumanLabel: "TimescaleDB gap fill by specific truck",
+			expectedHumanDesc:  "TimescaleDB gap fill by specific truck: random    1 trucks, avg velocity per 10 minutes in last 12 hours",
+			expectedHypertable: iot.ReadingsTableName,
+			expectedSQLQuery: `SELECT time_bucket_gapfill('10 minutes', r.time) AS ten_minutes, t.name AS name, locf(avg(r.velocity)) AS velocity
+		FROM tags t
+		INNER JOIN readings r ON r.tags_id = t.id
+		WHERE r.time >= '1970-01-01 11:54:10.138978 +0000' AND r.time < '1970-01-01 23:54:10.138978 +0000'
+		AND t.name IN ('truck_5')
+		GROUP BY 1, 2
+		ORDER BY 2, 1`,
+		},
+		{
+			desc:    "one truck use json",
+			input:   1,
+			useJSON: true,
+
+			expectedHumanLabel: "TimescaleDB gap fill by specific truck",
+			expectedHumanDesc:  "TimescaleDB gap fill by specific truck: random    1 trucks, avg velocity per 10 minutes in last 12 hours",
+			expectedHypertable: iot.ReadingsTableName,
+			expectedSQLQuery: `SELECT time_bucket_gapfill('10 minutes', r.time) AS ten_minutes, t.tagset->>'name' AS name, locf(avg(r.velocity)) AS velocity
+		FROM tags t
+		INNER JOIN readings r ON r.tags_id = t.id
+		WHERE r.time >= '1970-01-01 04:37:12.342805 +0000' AND r.time < '1970-01-01 16:37:12.342805 +0000'
+		AND t.tagset->>'name' IN ('truck_3')
+		GROUP BY 1, 2
+		ORDER BY 2, 1`,
+		},
+	}
+
+	testFunc := func(i *IoT, c testCase) query.Query {
+		q := i.GenerateEmptyQuery()
+		i.GapFillByTruck(q, c.input)
+		return q
+	}
+
+	start := time.Unix(0, 0)
+	end := start.Add(24 * time.Hour)
+
+	runTestCases(t, testFunc, start, end, cases)
+}
+
 func TestTenMinutePeriods(t *testing.T) {
 	cases := []struct {
 		minutesPerHour float64
@@ -25,6 +25,8 @@ const (
 	LongDrivingSessionDuration = 4 * time.Hour
 	// DailyDrivingDuration is time duration of one day of driving.
 	DailyDrivingDuration = 24 * time.Hour
+	// GapFillDuration is the time duration the gap fill query fills the gaps over.
+	GapFillDuration = 12 * time.Hour
 
 	// LabelLastLoc is the label for the last location query.
 	LabelLastLoc = "last-loc"
@@ -52,6 +54,8 @@ const (
 	LabelDailyActivity = "daily-activity"
 	// LabelBreakdownFrequency is the label for the breakdown frequency query.
 	LabelBreakdownFrequency = "breakdown-frequency"
+	// LabelGapFill is the label for the gap fill query.
+	LabelGapFill = "gap-fill"
 )
 
 // Core is the common component of all generators for all systems.
@@ -164,3 +168,8 @@ type DailyTruckActivityFiller interface {
 type TruckBreakdownFrequencyFiller interface {
 	TruckBreakdownFrequency(query.Query)
 }
+
+// GapFillByTruckFiller is a type that can fill in a gap fill query for a number of trucks.
+type GapFillByTruckFiller interface {
+	GapFillByTruck(query.Query, int)
+}
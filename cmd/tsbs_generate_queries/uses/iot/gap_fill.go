@@ -0,0 +1,29 @@
+package iot
+
+import (
+	"github.com/timescale/tsbs/cmd/tsbs_generate_queries/uses/common"
+	"github.com/timescale/tsbs/cmd/tsbs_generate_queries/utils"
+	"github.com/timescale/tsbs/query"
+)
+
+// GapFillSingleTruck contains info for filling in gap fill query for a single truck.
+type GapFillSingleTruck struct {
+	core utils.QueryGenerator
+}
+
+// NewGapFillSingleTruck creates a new gap fill query filler.
+func NewGapFillSingleTruck(core utils.QueryGenerator) utils.QueryFiller {
+	return &GapFillSingleTruck{
+		core: core,
+	}
+}
+
+// Fill fills in the query.Query with query details.
+func (i *GapFillSingleTruck) Fill(q query.Query) query.Query {
+	fc, ok := i.core.(GapFillByTruckFiller)
+	if !ok {
+		common.PanicUnimplementedQuery(i.core)
+	}
+	fc.GapFillByTruck(q, 1)
+	return q
+}
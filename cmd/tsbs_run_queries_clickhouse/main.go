@@ -72,6 +72,7 @@ func init() {
 }
 
 func main() {
+	runner.SupportValidation()
 	runner.Run(&query.ClickHousePool, newProcessor)
 }
 
@@ -116,6 +117,7 @@ type queryExecutorOptions struct {
 	showExplain   bool
 	debug         bool
 	printResponse bool
+	validate      bool
 }
 
 // query.Processor interface implementation
@@ -137,6 +139,7 @@ func (p *processor) Init(workerNumber int) {
 		showExplain:   false,
 		debug:         runner.DebugLevel() > 0,
 		printResponse: runner.DoPrintResponses(),
+		validate:      runner.DoValidate(),
 	}
 }
 
@@ -165,7 +168,14 @@ func (p *processor) ProcessQuery(q query.Query, isWarm bool) ([]*query.Stat, err
 	if p.opts.debug {
 		fmt.Println(sql)
 	}
-	if p.opts.printResponse {
+	if p.opts.validate {
+		// The rows are read for validation, and so cannot be printed.
+		responseRows, err := query.SQLRows(rows.Rows)
+		if err != nil {
+			return nil, err
+		}
+		runner.RecordResponse(q, responseRows)
+	} else if p.opts.printResponse {
 		prettyPrintResponse(rows, chQuery)
 	}
 
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,6 +31,7 @@ type HTTPClient struct {
 type HTTPClientDoOptions struct {
 	Debug                int
 	PrettyPrintResponses bool
+	Validate             bool
 	chunkSize            uint64
 	database             string
 }
@@ -95,6 +99,14 @@ func (w *HTTPClient) Do(q *query.HTTP, opts *HTTPClientDoOptions) (lag float64,
 
 	lag = float64(time.Since(start).Nanoseconds()) / 1e6 // milliseconds
 
+	if opts != nil && opts.Validate {
+		rows, err := responseRows(body)
+		if err != nil {
+			return lag, err
+		}
+		runner.RecordResponse(q, rows)
+	}
+
 	if opts != nil {
 		// Print debug messages, if applicable:
 		switch opts.Debug {
@@ -134,3 +146,53 @@ func (w *HTTPClient) Do(q *query.HTTP, opts *HTTPClientDoOptions) (lag float64,
 
 	return lag, err
 }
+
+// influxResponse is the part of a response of InfluxDB the rows are made of.
+type influxResponse struct {
+	Results []struct {
+		Series []struct {
+			Columns []string               `json:"columns"`
+			Tags    map[string]interface{} `json:"tags"`
+			Values  [][]interface{}        `json:"values"`
+		} `json:"series"`
+	} `json:"results"`
+}
+
+// responseRows returns the rows of body, a response of InfluxDB, possibly in
+// chunks, as the values of the rows of its series and the values of the tags
+// of the series, as other databases return the tags grouped by as columns,
+// with the columns in the canonical order, see query.CanonicalRows.
+func responseRows(body []byte) ([][]interface{}, error) {
+	rows := [][]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	for {
+		var resp influxResponse
+		err := dec.Decode(&resp)
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode the response: %v", err)
+		}
+		for _, result := range resp.Results {
+			for _, series := range result.Series {
+				keys := make([]string, 0, len(series.Tags))
+				for k := range series.Tags {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				columns := append(append([]string(nil), series.Columns...), keys...)
+				seriesRows := make([][]interface{}, 0, len(series.Values))
+				for _, values := range series.Values {
+					row := append([]interface{}(nil), values...)
+					for _, k := range keys {
+						row = append(row, series.Tags[k])
+					}
+					seriesRows = append(seriesRows, row)
+				}
+				rows = append(rows, query.CanonicalRows(columns, seriesRows)...)
+			}
+		}
+	}
+}
@@ -60,6 +60,7 @@ func init() {
 }
 
 func main() {
+	runner.SupportValidation()
 	runner.Run(&query.HTTPPool, newProcessor)
 }
 
@@ -74,6 +75,7 @@ func (p *processor) Init(workerNumber int) {
 	p.opts = &HTTPClientDoOptions{
 		Debug:                runner.DebugLevel(),
 		PrettyPrintResponses: runner.DoPrintResponses(),
+		Validate:             runner.DoValidate(),
 		chunkSize:            chunkSize,
 		database:             runner.DatabaseName(),
 	}
@@ -78,6 +78,7 @@ func init() {
 }
 
 func main() {
+	runner.SupportValidation()
 	runner.Run(&query.MysqlPool, newProcessor)
 }
 
@@ -140,6 +141,7 @@ type queryExecutorOptions struct {
 	showExplain   bool
 	debug         bool
 	printResponse bool
+	validate      bool
 }
 
 type processor struct {
@@ -159,6 +161,7 @@ func (p *processor) Init(workerNumber int) {
 		showExplain:   showExplain,
 		debug:         runner.DebugLevel() > 0,
 		printResponse: runner.DoPrintResponses(),
+		validate:      runner.DoValidate(),
 	}
 }
 
@@ -192,6 +195,13 @@ func (p *processor) ProcessQuery(q query.Query, isWarm bool) ([]*query.Stat, err
 			text += s + "\n"
 		}
 		fmt.Printf("%s\n\n%s\n-----\n\n", qry, text)
+	} else if p.opts.validate {
+		// The rows are read for validation, and so cannot be printed.
+		responseRows, err := query.SQLRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		runner.RecordResponse(q, responseRows)
 	} else if p.opts.printResponse {
 		prettyPrintResponse(rows, tq)
 	}
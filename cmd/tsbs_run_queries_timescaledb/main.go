@@ -96,6 +96,7 @@ func init() {
 }
 
 func main() {
+	runner.SupportValidation()
 	runner.Run(&query.TimescaleDBPool, newProcessor)
 }
 
@@ -171,6 +172,7 @@ type queryExecutorOptions struct {
 	showExplain   bool
 	debug         bool
 	printResponse bool
+	validate      bool
 }
 
 type processor struct {
@@ -190,6 +192,7 @@ func (p *processor) Init(workerNumber int) {
 		showExplain:   showExplain,
 		debug:         runner.DebugLevel() > 0,
 		printResponse: runner.DoPrintResponses(),
+		validate:      runner.DoValidate(),
 	}
 }
 
@@ -223,6 +226,13 @@ func (p *processor) ProcessQuery(q query.Query, isWarm bool) ([]*query.Stat, err
 			text += s + "\n"
 		}
 		fmt.Printf("%s\n\n%s\n-----\n\n", qry, text)
+	} else if p.opts.validate {
+		// The rows are read for validation, and so cannot be printed.
+		responseRows, err := query.SQLRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		runner.RecordResponse(q, responseRows)
 	} else if p.opts.printResponse {
 		prettyPrintResponse(rows, tq)
 	}
@@ -15,6 +15,7 @@ require (
 	github.com/jackc/pgconn v1.1.0
 	github.com/jackc/pgx/v4 v4.1.1
 	github.com/jmoiron/sqlx v1.2.0
+	github.com/klauspost/compress v1.9.5
 	github.com/kshvakov/clickhouse v1.3.11
 	github.com/lib/pq v1.2.0
 	github.com/pkg/errors v0.9.1
@@ -14,6 +14,7 @@ import (
 	"github.com/timescale/tsbs/cmd/tsbs_generate_data/devops"
 	"github.com/timescale/tsbs/cmd/tsbs_generate_data/iot"
 	"github.com/timescale/tsbs/cmd/tsbs_generate_data/serialize"
+	"github.com/timescale/tsbs/internal/utils"
 )
 
 // Error messages when using a DataGenerator
@@ -25,6 +26,7 @@ const (
 	errTotalGroupsZero    = "incorrect interleaved groups configuration: total groups = 0"
 	errInvalidGroupsFmt   = "incorrect interleaved groups configuration: id %d >= total groups %d"
 	errCannotParseTimeFmt = "cannot parse time from string '%s': %v"
+	errBadCompressionFmt  = "invalid compression specified: '%s'"
 )
 
 const defaultLogInterval = 10 * time.Second
@@ -40,6 +42,25 @@ type DataGeneratorConfig struct {
 	LogInterval          time.Duration `mapstructure:"log-interval"`
 	InterleavedGroupID   uint          `mapstructure:"interleaved-generation-group-id"`
 	InterleavedNumGroups uint          `mapstructure:"interleaved-generation-groups"`
+	Compression          string        `mapstructure:"compression"`
+
+	// The irregularities of the data of the IoT use case (see iot.FleetConfig).
+	IoTTimestampJitter float64       `mapstructure:"iot-timestamp-jitter"`
+	IoTLateFraction    float64       `mapstructure:"iot-late-fraction"`
+	IoTOfflineChance   float64       `mapstructure:"iot-offline-chance"`
+	IoTOfflineDuration time.Duration `mapstructure:"iot-offline-duration"`
+	IoTOfflineLoss     float64       `mapstructure:"iot-offline-loss"`
+}
+
+// fleetConfig returns the irregularities of the data of the IoT use case.
+func (c *DataGeneratorConfig) fleetConfig() iot.FleetConfig {
+	return iot.FleetConfig{
+		TimestampJitter: c.IoTTimestampJitter,
+		LateFraction:    c.IoTLateFraction,
+		OfflineChance:   c.IoTOfflineChance,
+		OfflineDuration: c.IoTOfflineDuration,
+		OfflineLoss:     c.IoTOfflineLoss,
+	}
 }
 
 // Validate checks that the values of the DataGeneratorConfig are reasonable.
@@ -57,8 +78,19 @@ func (c *DataGeneratorConfig) Validate() error {
 		return fmt.Errorf(errLogIntervalZero)
 	}
 
+	if c.Compression == "" {
+		c.Compression = utils.CompressionNone
+	}
+	if !isIn(c.Compression, utils.Compressions) {
+		return fmt.Errorf(errBadCompressionFmt, c.Compression)
+	}
+
 	err = validateGroups(c.InterleavedGroupID, c.InterleavedNumGroups)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return c.fleetConfig().Validate()
 }
 
 func (c *DataGeneratorConfig) AddToFlagSet(fs *pflag.FlagSet) {
@@ -71,6 +103,14 @@ func (c *DataGeneratorConfig) AddToFlagSet(fs *pflag.FlagSet) {
 		"Group (0-indexed) to perform round-robin serialization within. Use this to scale up data generation to multiple processes.")
 	fs.Uint("interleaved-generation-groups", 1,
 		"The number of round-robin serialization groups. Use this to scale up data generation to multiple processes.")
+	fs.String("compression", utils.CompressionNone,
+		fmt.Sprintf("Compression of the output, the loaders decompressing it on the fly. Valid values: %v", utils.Compressions))
+
+	fs.Float64("iot-timestamp-jitter", 0, "Maximum shift of the timestamps of the trucks, as a fraction of the log interval ('iot' use case)")
+	fs.Float64("iot-late-fraction", 0, "Fraction of the points sent late, i.e., out of order ('iot' use case)")
+	fs.Float64("iot-offline-chance", 0, "Chance, per point, for a truck to go offline, leaving a gap ('iot' use case)")
+	fs.Duration("iot-offline-duration", time.Hour, "Mean duration trucks stay offline for ('iot' use case)")
+	fs.Float64("iot-offline-loss", 0, "Fraction of the outages whose points are lost, rather than sent in a burst on reconnect ('iot' use case)")
 
 }
 
@@ -90,6 +130,10 @@ type DataGenerator struct {
 	// bufOut represents the buffered writer that should actually be passed to
 	// any operations that write out data.
 	bufOut *bufio.Writer
+	// compressor, if compressing, compresses what is written to bufOut before
+	// writing it to compressedOut.
+	compressor    io.WriteCloser
+	compressedOut *bufio.Writer
 }
 
 func (g *DataGenerator) init(config GeneratorConfig) error {
@@ -124,6 +168,14 @@ func (g *DataGenerator) init(config GeneratorConfig) error {
 	if err != nil {
 		return err
 	}
+	if g.config.Compression != utils.CompressionNone {
+		g.compressedOut = g.bufOut
+		g.compressor, err = utils.NewCompressingWriter(g.compressedOut, g.config.Compression)
+		if err != nil {
+			return err
+		}
+		g.bufOut = bufio.NewWriterSize(g.compressor, defaultWriteSize)
+	}
 
 	return nil
 }
@@ -147,7 +199,23 @@ func (g *DataGenerator) Generate(config GeneratorConfig) error {
 		return err
 	}
 
-	return g.runSimulator(sim, serializer, g.config)
+	err = g.runSimulator(sim, serializer, g.config)
+	if err != nil {
+		return err
+	}
+
+	return g.closeCompressor()
+}
+
+// closeCompressor writes the end of the compressed output, if compressing.
+func (g *DataGenerator) closeCompressor() error {
+	if g.compressor == nil {
+		return nil
+	}
+	if err := g.compressor.Close(); err != nil {
+		return fmt.Errorf("cannot compress the output: %v", err)
+	}
+	return g.compressedOut.Flush()
 }
 
 func (g *DataGenerator) runSimulator(sim common.Simulator, serializer serialize.PointSerializer, dgc *DataGeneratorConfig) error {
@@ -190,7 +258,7 @@ func (g *DataGenerator) getSimulatorConfig(dgc *DataGeneratorConfig) (common.Sim
 			HostConstructor: devops.NewHost,
 		}
 	case useCaseIoT:
-		ret = &iot.SimulatorConfig{
+		sc := iot.SimulatorConfig{
 			Start: g.tsStart,
 			End:   g.tsEnd,
 
@@ -198,6 +266,10 @@ func (g *DataGenerator) getSimulatorConfig(dgc *DataGeneratorConfig) (common.Sim
 			GeneratorScale:       dgc.Scale,
 			GeneratorConstructor: iot.NewTruck,
 		}
+		ret = &sc
+		if fc := dgc.fleetConfig(); fc.Enabled() {
+			ret = &iot.FleetSimulatorConfig{SimulatorConfig: sc, FleetConfig: fc}
+		}
 	case useCaseCPUOnly:
 		ret = &devops.CPUOnlySimulatorConfig{
 			Start: g.tsStart,
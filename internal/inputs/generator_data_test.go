@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
@@ -15,6 +16,7 @@ import (
 	"github.com/timescale/tsbs/cmd/tsbs_generate_data/devops"
 	"github.com/timescale/tsbs/cmd/tsbs_generate_data/iot"
 	"github.com/timescale/tsbs/cmd/tsbs_generate_data/serialize"
+	"github.com/timescale/tsbs/internal/utils"
 )
 
 func TestDataGeneratorConfigValidate(t *testing.T) {
@@ -93,6 +95,32 @@ func TestDataGeneratorConfigValidate(t *testing.T) {
 			t.Errorf("incorrect error for group id > num groups: got\n%s\nwant\n%s", got, want)
 		}
 	}
+	c.InterleavedGroupID = 0
+
+	// Test IoT irregularities validation
+	c.IoTLateFraction = 1.5
+	err = c.Validate()
+	if err == nil {
+		t.Errorf("unexpected lack of error for late fraction > 1")
+	}
+	c.IoTLateFraction = 0
+
+	// Test compression validation
+	c.Compression = ""
+	err = c.Validate()
+	if err != nil {
+		t.Errorf("unexpected error for no compression: %v", err)
+	}
+	if c.Compression != utils.CompressionNone {
+		t.Errorf("Compression not set correctly for empty: got %s want %s", c.Compression, utils.CompressionNone)
+	}
+
+	c.Compression = "lz4"
+	err = c.Validate()
+	if err == nil {
+		t.Errorf("unexpected lack of error for bad compression")
+	}
+	c.Compression = utils.CompressionNone
 }
 
 func TestDataGeneratorInit(t *testing.T) {
@@ -213,6 +241,23 @@ func TestDataGeneratorGenerate(t *testing.T) {
 		t.Errorf("incorrect data written:\ngot\n%s\nwant\n%s", got, correctData)
 	}
 
+	// Test that compressed data decompresses to the same data
+	for _, compression := range []string{utils.CompressionGzip, utils.CompressionZstd} {
+		c.Compression = compression
+		buf.Reset()
+		dg = &DataGenerator{Out: &buf}
+		err = dg.Generate(c)
+		if err != nil {
+			t.Errorf("unexpected error when generating with %s: got %v", compression, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(utils.NewDecompressingReader(&buf))
+		if err != nil {
+			t.Errorf("unexpected error when decompressing %s: got %v", compression, err)
+		} else if string(got) != correctData {
+			t.Errorf("incorrect data written with %s:\ngot\n%s\nwant\n%s", compression, got, correctData)
+		}
+	}
 }
 
 var keyIteration = []byte("iteration")
@@ -402,6 +447,11 @@ func TestGetSimulatorConfig(t *testing.T) {
 	checkType(useCaseCPUOnly, &devops.CPUOnlySimulatorConfig{})
 	checkType(useCaseCPUSingle, &devops.CPUOnlySimulatorConfig{})
 
+	dgc.IoTOfflineChance = 0.01
+	dgc.IoTOfflineDuration = time.Hour
+	checkType(useCaseIoT, &iot.FleetSimulatorConfig{})
+	dgc.IoTOfflineChance = 0
+
 	dgc.Use = "bogus use case"
 	_, err := g.getSimulatorConfig(dgc)
 	if err == nil {
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// batchLatencyPrefix starts the lines a loader prints the latency of its
+// batches on, for a query runner inserting data while querying to tell them
+// apart from the rest of the output of the loader.
+const batchLatencyPrefix = "batch-latency,"
+
+// FormatBatchLatency returns the line reporting that inserting a batch of
+// metricCnt metrics and rowCnt rows took took, as parsed by ParseBatchLatency.
+func FormatBatchLatency(took time.Duration, metricCnt, rowCnt uint64) string {
+	return fmt.Sprintf("%s%f,%d,%d", batchLatencyPrefix, float64(took.Nanoseconds())/1e6, metricCnt, rowCnt)
+}
+
+// ParseBatchLatency returns the latency reported by line, if it is a line
+// formatted by FormatBatchLatency.
+func ParseBatchLatency(line string) (time.Duration, bool) {
+	if !strings.HasPrefix(line, batchLatencyPrefix) {
+		return 0, false
+	}
+	fields := strings.Split(line[len(batchLatencyPrefix):], ",")
+	ms, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	return time.Duration(ms * 1e6), true
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatParseBatchLatency(t *testing.T) {
+	line := FormatBatchLatency(2500*time.Microsecond, 100, 10)
+	if want := "batch-latency,2.500000,100,10"; line != want {
+		t.Errorf("incorrect line: got %q want %q", line, want)
+	}
+	took, ok := ParseBatchLatency(line)
+	if !ok || took != 2500*time.Microsecond {
+		t.Errorf("incorrect parse of %q: got %v %v want 2.5ms true", line, took, ok)
+	}
+
+	for _, line := range []string{"", "loaded 100 metrics in 1.000sec", "batch-latency,", "batch-latency,abc,1,1", "batch-latency,-1,1,1"} {
+		if _, ok := ParseBatchLatency(line); ok {
+			t.Errorf("%q parsed as a batch latency", line)
+		}
+	}
+}
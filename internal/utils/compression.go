@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compressions data files can be written with.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Compressions are the compressions data files can be written with.
+var Compressions = []string{CompressionNone, CompressionGzip, CompressionZstd}
+
+// The magic numbers compressed data starts with.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// nopWriteCloser is a WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewCompressingWriter returns a WriteCloser compressing the data written to
+// it with compression before writing it to w. Close must be called to write
+// the end of the compressed data, it does not close w.
+func NewCompressingWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone, "":
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", compression)
+	}
+}
+
+// NewDecompressingReader returns a ReadCloser of the data read from r,
+// decompressed on the fly if it was compressed with gzip or zstd, as told by
+// the magic number it starts with, as is otherwise. Nothing is read from r
+// until the first Read. Close releases the resources of the decompression, it
+// does not close r.
+func NewDecompressingReader(r io.Reader) io.ReadCloser {
+	return &decompressingReader{r: r}
+}
+
+// decompressingReader tells the compression of the data of r on the first
+// Read, then reads it through the matching decompressor.
+type decompressingReader struct {
+	r          io.Reader
+	d          io.ReadCloser
+	compressed bool // compressed tells whether the data read is compressed
+	err        error
+}
+
+func (dr *decompressingReader) Read(p []byte) (int, error) {
+	if dr.d == nil && dr.err == nil {
+		dr.d, dr.compressed, dr.err = newDecompressor(dr.r)
+	}
+	if dr.err != nil {
+		return 0, dr.err
+	}
+	return dr.d.Read(p)
+}
+
+func (dr *decompressingReader) Close() error {
+	if dr.d == nil {
+		return nil
+	}
+	return dr.d.Close()
+}
+
+// IsCompressed tells whether the data read so far by r, returned by
+// NewDecompressingReader, was compressed, i.e., whether the offsets of the
+// data read from it differ from those of the data it reads. It is false for
+// any other Reader.
+func IsCompressed(r io.Reader) bool {
+	dr, ok := r.(*decompressingReader)
+	return ok && dr.compressed
+}
+
+// newDecompressor returns the decompressor of the data of r, as told by the
+// magic number it starts with, and whether the data is compressed.
+func newDecompressor(r io.Reader) (io.ReadCloser, bool, error) {
+	br := bufio.NewReader(r)
+	// Data shorter than a magic number is not compressed, Peek returning
+	// what there is along with the error.
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		d, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, true, err
+		}
+		return d, true, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, true, err
+		}
+		return d.IOReadCloser(), true, nil
+	default:
+		return ioutil.NopCloser(br), false, nil
+	}
+}
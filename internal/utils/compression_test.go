@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := strings.Repeat("readings,name=truck_0 velocity=1 0\n", 1000)
+	for _, compression := range Compressions {
+		var buf bytes.Buffer
+		w, err := NewCompressingWriter(&buf, compression)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", compression, err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("%s: unexpected error on write: %v", compression, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: unexpected error on close: %v", compression, err)
+		}
+		if compression != CompressionNone && buf.Len() >= len(data) {
+			t.Errorf("%s: data not compressed: got %d bytes for %d", compression, buf.Len(), len(data))
+		}
+
+		r := NewDecompressingReader(&buf)
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: unexpected error on read: %v", compression, err)
+		}
+		r.Close()
+		if got, want := IsCompressed(r), compression != CompressionNone; got != want {
+			t.Errorf("%s: incorrect compressed: got %t want %t", compression, got, want)
+		}
+		if string(got) != data {
+			t.Errorf("%s: incorrect data read back: got %d bytes want %d", compression, len(got), len(data))
+		}
+	}
+}
+
+func TestNewCompressingWriterUnknown(t *testing.T) {
+	if _, err := NewCompressingWriter(&bytes.Buffer{}, "lz4"); err == nil {
+		t.Errorf("unexpected lack of error for unknown compression")
+	}
+}
+
+func TestNewDecompressingReaderShort(t *testing.T) {
+	for _, data := range []string{"", "a", "\x1f"} {
+		r := NewDecompressingReader(strings.NewReader(data))
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error on read of %q: %v", data, err)
+		}
+		if string(got) != data {
+			t.Errorf("incorrect data read back: got %q want %q", got, data)
+		}
+	}
+}
+
+func TestNewDecompressingReaderCorrupt(t *testing.T) {
+	r := NewDecompressingReader(strings.NewReader("\x1f\x8b not gzip"))
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("unexpected lack of error for corrupt gzip data")
+	}
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// RedactedFlagValue replaces the values of the flags that look like secrets
+// (see FlagValues).
+const RedactedFlagValue = "<redacted>"
+
+// sensitiveFlagNames are the parts of the names of the flags whose values are
+// redacted, e.g., "pass" or "anonymize-key".
+var sensitiveFlagNames = []string{"pass", "key", "secret", "token"}
+
+// FlagValues returns the value of each flag of fs, including the defaults, by
+// name, to record the configuration of a run along with its results. The
+// values of flags whose name suggests a secret (e.g., a password) are
+// replaced by RedactedFlagValue.
+func FlagValues(fs *pflag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *pflag.Flag) {
+		value := f.Value.String()
+		for _, s := range sensitiveFlagNames {
+			if strings.Contains(f.Name, s) && len(value) > 0 {
+				value = RedactedFlagValue
+				break
+			}
+		}
+		values[f.Name] = value
+	})
+	return values
+}
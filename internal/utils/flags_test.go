@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestFlagValues(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.Uint("workers", 1, "")
+	fs.String("db-name", "benchmark", "")
+	fs.String("pass", "", "")
+	fs.String("anonymize-key", "", "")
+	if err := fs.Parse([]string{"--workers=8", "--anonymize-key=s3cr3t"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	values := FlagValues(fs)
+	want := map[string]string{
+		"workers":       "8",
+		"db-name":       "benchmark",
+		"pass":          "",
+		"anonymize-key": RedactedFlagValue,
+	}
+	if len(values) != len(want) {
+		t.Errorf("incorrect number of flags: got %d want %d", len(values), len(want))
+	}
+	for name, value := range want {
+		if got := values[name]; got != value {
+			t.Errorf("incorrect value of %s: got %q want %q", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrometheusMetricsPath is the path live metrics are served at.
+const PrometheusMetricsPath = "/metrics"
+
+// The types of Prometheus metrics.
+const (
+	PrometheusCounter = "counter"
+	PrometheusGauge   = "gauge"
+	PrometheusSummary = "summary"
+)
+
+// PrometheusMetric is a metric and its samples, to be exposed in the
+// Prometheus text format, e.g., for live metrics of a running benchmark.
+type PrometheusMetric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []PrometheusSample
+}
+
+// PrometheusSample is a value of a metric. Suffix, if set, is appended to the
+// name of the metric, e.g., "_count" for a summary.
+type PrometheusSample struct {
+	Suffix string
+	Labels map[string]string
+	Value  float64
+}
+
+// labelValueEscaper escapes label values as the Prometheus text format
+// requires.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheusMetrics writes metrics in the Prometheus text exposition
+// format, each preceded by its HELP and TYPE comment lines, e.g.,
+//
+//	# HELP tsbs_queries_total Number of queries run.
+//	# TYPE tsbs_queries_total counter
+//	tsbs_queries_total 1234
+//
+// Labels are written in order of name.
+func WritePrometheusMetrics(w io.Writer, metrics []PrometheusMetric) error {
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type); err != nil {
+			return err
+		}
+		for _, s := range m.Samples {
+			labels := ""
+			if len(s.Labels) > 0 {
+				names := make([]string, 0, len(s.Labels))
+				for name := range s.Labels {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				pairs := make([]string, len(names))
+				for i, name := range names {
+					pairs[i] = name + `="` + labelValueEscaper.Replace(s.Labels[name]) + `"`
+				}
+				labels = "{" + strings.Join(pairs, ",") + "}"
+			}
+			if _, err := fmt.Fprintf(w, "%s%s%s %s\n", m.Name, s.Suffix, labels, strconv.FormatFloat(s.Value, 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PrometheusHandler returns a handler of requests for metrics, writing them
+// with write as they are at the time of the request.
+func PrometheusHandler(write func(w io.Writer, now time.Time) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := write(w, time.Now()); err != nil {
+			log.Printf("cannot write metrics: %v", err)
+		}
+	})
+}
+
+// ServePrometheusMetrics serves the metrics written by write at
+// PrometheusMetricsPath on address, e.g., for the whole run of a benchmark. It
+// only returns if the server fails.
+func ServePrometheusMetrics(address string, write func(w io.Writer, now time.Time) error) error {
+	mux := http.NewServeMux()
+	mux.Handle(PrometheusMetricsPath, PrometheusHandler(write))
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	metrics := []PrometheusMetric{
+		{
+			Name:    "tsbs_queries_total",
+			Help:    "Number of queries run.",
+			Type:    PrometheusCounter,
+			Samples: []PrometheusSample{{Value: 1234}},
+		},
+		{
+			Name: "tsbs_query_latency_seconds",
+			Help: "Latency of the queries.",
+			Type: PrometheusSummary,
+			Samples: []PrometheusSample{
+				{Labels: map[string]string{"quantile": "0.99", "label": `high "cpu"\all`}, Value: 0.0125},
+				{Suffix: "_count", Labels: map[string]string{"label": "lastpoint"}, Value: 7},
+			},
+		},
+	}
+	var b bytes.Buffer
+	if err := WritePrometheusMetrics(&b, metrics); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `# HELP tsbs_queries_total Number of queries run.
+# TYPE tsbs_queries_total counter
+tsbs_queries_total 1234
+# HELP tsbs_query_latency_seconds Latency of the queries.
+# TYPE tsbs_query_latency_seconds summary
+tsbs_query_latency_seconds{label="high \"cpu\"\\all",quantile="0.99"} 0.0125
+tsbs_query_latency_seconds_count{label="lastpoint"} 7
+`
+	if got := b.String(); got != want {
+		t.Errorf("incorrect metrics: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	handler := PrometheusHandler(func(w io.Writer, now time.Time) error {
+		return WritePrometheusMetrics(w, []PrometheusMetric{
+			{Name: "tsbs_workers", Help: "Number of workers.", Type: PrometheusGauge, Samples: []PrometheusSample{{Value: 8}}},
+		})
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", PrometheusMetricsPath, nil))
+	if got, want := rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"; got != want {
+		t.Errorf("incorrect content type: got %q want %q", got, want)
+	}
+	want := "# HELP tsbs_workers Number of workers.\n# TYPE tsbs_workers gauge\ntsbs_workers 8\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("incorrect metrics: got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,6 @@
+package utils
+
+// SustainedRateFraction is the fraction of an offered rate (e.g., of a rate
+// limit) that the rate achieved over a period must reach for the offered rate
+// to count as sustained, so that the jitter of pacing is not reported.
+const SustainedRateFraction = 0.95
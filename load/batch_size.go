@@ -0,0 +1,139 @@
+package load
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The parameters of the adaptive batch size.
+const (
+	// adaptiveEpochBatches is the number of batches of a size whose insert
+	// rate is measured before adjusting the size.
+	adaptiveEpochBatches = 10
+	// adaptiveDecrease is the factor the size is multiplied by when the insert
+	// rate drops.
+	adaptiveDecrease = 0.5
+	// adaptiveMaxGrowth is the largest size, as a multiple of the seed size.
+	adaptiveMaxGrowth = 100
+	// adaptiveHistory is the number of the last sizes the chosen size and
+	// its stability are computed over.
+	adaptiveHistory = 50
+)
+
+// batchSizer tells the number of items to fill the next batch with.
+type batchSizer interface {
+	size() uint
+}
+
+// fixedBatchSize is a batchSizer always telling the same size.
+type fixedBatchSize uint
+
+func (s fixedBatchSize) size() uint {
+	return uint(s)
+}
+
+// adaptiveBatchSize is a batchSizer converging on the size maximizing the
+// insert rate, AIMD-style: it measures the insert rate of the batches of the
+// current size over epochs of adaptiveEpochBatches batches, increasing the
+// size by a quarter of the seed size while the rate goes up, and halving it
+// when the rate goes down, so the size oscillates around the best one. The
+// size is always increased after a decrease, whose lower rate says nothing of
+// the best size.
+type adaptiveBatchSize struct {
+	mu       sync.Mutex
+	seed     uint
+	step     uint
+	max      uint
+	current  uint64        // current is the size of the batches to fill, accessed atomically, as the scanner reads it for every item
+	batches  int           // batches is the number of batches of the current size observed in the epoch
+	rows     uint64        // rows is the number of rows of the batches observed in the epoch
+	took     time.Duration // took is the total insert latency of the batches observed in the epoch
+	prevRate float64       // prevRate is the insert rate of the previous epoch, in rows per second
+	backoff  bool          // backoff tells whether the size was decreased after the previous epoch
+	sizes    []uint        // sizes are the last adaptiveHistory sizes, of the past epochs
+}
+
+// newAdaptiveBatchSize returns an adaptiveBatchSize starting from seed.
+func newAdaptiveBatchSize(seed uint) *adaptiveBatchSize {
+	step := seed / 4
+	if step < 1 {
+		step = 1
+	}
+	return &adaptiveBatchSize{
+		seed:    seed,
+		step:    step,
+		max:     seed * adaptiveMaxGrowth,
+		current: uint64(seed),
+	}
+}
+
+func (s *adaptiveBatchSize) size() uint {
+	return uint(atomic.LoadUint64(&s.current))
+}
+
+// observe accounts for a batch of items items, rows rows (or metrics, for the
+// databases that do not count rows), inserted in took, adjusting the size at
+// the end of an epoch. Batches of another size than the current one, e.g.,
+// filled before the last adjustment, are ignored. It is safe for concurrent
+// use by the workers.
+func (s *adaptiveBatchSize) observe(items int, rows uint64, took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := uint(atomic.LoadUint64(&s.current))
+	if uint(items) != current {
+		return
+	}
+	s.batches++
+	s.rows += rows
+	s.took += took
+	if s.batches < adaptiveEpochBatches {
+		return
+	}
+
+	rate := float64(s.rows) / s.took.Seconds()
+	s.sizes = append(s.sizes, current)
+	if len(s.sizes) > adaptiveHistory {
+		s.sizes = s.sizes[1:]
+	}
+	if s.backoff || rate >= s.prevRate {
+		current += s.step
+		if current > s.max {
+			current = s.max
+		}
+		s.backoff = false
+	} else {
+		current = uint(float64(current) * adaptiveDecrease)
+		if current < 1 {
+			current = 1
+		}
+		s.backoff = true
+	}
+	atomic.StoreUint64(&s.current, uint64(current))
+	s.prevRate = rate
+	s.batches, s.rows, s.took = 0, 0, 0
+}
+
+// chosen returns the size chosen, the mean of the last sizes, with its
+// stability, the standard deviation of the last sizes relative to the mean,
+// and the number of the last sizes. Before the first adjustment, the size
+// chosen is the current one.
+func (s *adaptiveBatchSize) chosen() (size uint, stability float64, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sizes) == 0 {
+		return s.size(), 0, 0
+	}
+	sum := 0.0
+	for _, size := range s.sizes {
+		sum += float64(size)
+	}
+	mean := sum / float64(len(s.sizes))
+	variance := 0.0
+	for _, size := range s.sizes {
+		variance += (float64(size) - mean) * (float64(size) - mean)
+	}
+	variance /= float64(len(s.sizes))
+	return uint(math.Round(mean)), math.Sqrt(variance) / mean, len(s.sizes)
+}
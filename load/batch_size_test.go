@@ -0,0 +1,87 @@
+package load
+
+import (
+	"testing"
+	"time"
+)
+
+// insertLatency is the latency of inserting a batch of size rows into a
+// database with a per-batch overhead, whose cost per row grows with the size
+// of the batch, so that the insert rate is maximized at a size of 1000.
+func insertLatency(size uint) time.Duration {
+	s := float64(size)
+	return time.Duration(1e6 + 1e3*s + s*s)
+}
+
+func TestAdaptiveBatchSizeConverges(t *testing.T) {
+	const best = 1000
+	s := newAdaptiveBatchSize(100)
+	for i := 0; i < 1000*adaptiveEpochBatches; i++ {
+		size := s.size()
+		s.observe(int(size), uint64(size), insertLatency(size))
+	}
+	size, stability, n := s.chosen()
+	if size < best/3 || size > 2*best {
+		t.Errorf("chosen size %d too far from the best size %d", size, best)
+	}
+	if n != adaptiveHistory {
+		t.Errorf("incorrect number of sizes: got %d want %d", n, adaptiveHistory)
+	}
+	if stability <= 0 || stability >= 1 {
+		t.Errorf("incorrect stability: got %f", stability)
+	}
+}
+
+func TestAdaptiveBatchSizeBounds(t *testing.T) {
+	s := newAdaptiveBatchSize(1)
+	// the insert rate keeps going up, the size stops at its maximum
+	for i := 0; i < 1000*adaptiveEpochBatches; i++ {
+		size := s.size()
+		s.observe(int(size), uint64(size), time.Millisecond)
+	}
+	if got := s.size(); got != adaptiveMaxGrowth {
+		t.Errorf("incorrect size: got %d want %d", got, adaptiveMaxGrowth)
+	}
+}
+
+func TestAdaptiveBatchSizeObserve(t *testing.T) {
+	s := newAdaptiveBatchSize(100)
+	if size, stability, n := s.chosen(); size != 100 || stability != 0 || n != 0 {
+		t.Errorf("incorrect chosen size before any adjustment: got %d, %f, %d", size, stability, n)
+	}
+
+	// batches of another size are ignored
+	for i := 0; i < adaptiveEpochBatches; i++ {
+		s.observe(50, 50, time.Millisecond)
+	}
+	if got := s.size(); got != 100 {
+		t.Errorf("size adjusted on batches of another size: got %d", got)
+	}
+
+	// the first epoch raises the size by a quarter of the seed
+	for i := 0; i < adaptiveEpochBatches; i++ {
+		s.observe(100, 100, time.Millisecond)
+	}
+	if got := s.size(); got != 125 {
+		t.Errorf("incorrect size after first epoch: got %d want %d", got, 125)
+	}
+
+	// a lower rate halves it
+	for i := 0; i < adaptiveEpochBatches; i++ {
+		s.observe(125, 50, time.Millisecond)
+	}
+	if got := s.size(); got != 62 {
+		t.Errorf("incorrect size after lower rate: got %d want %d", got, 62)
+	}
+	if size, _, n := s.chosen(); size != 113 || n != 2 {
+		t.Errorf("incorrect chosen size: got %d over %d sizes, want %d over %d", size, n, 113, 2)
+	}
+
+	// the size is increased after a decrease, even if the rate dropped
+	for i := 0; i < adaptiveEpochBatches; i++ {
+		s.observe(62, 10, time.Millisecond)
+	}
+	if got := s.size(); got != 87 {
+		t.Errorf("incorrect size after decrease: got %d want %d", got, 87)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"math/rand"
@@ -13,7 +14,9 @@ import (
 	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/timescale/tsbs/internal/utils"
 	"github.com/timescale/tsbs/load/insertstrategy"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -66,6 +69,13 @@ type BenchmarkRunnerConfig struct {
 	ReportingPeriod time.Duration `mapstructure:"reporting-period"`
 	FileName        string        `mapstructure:"file"`
 	Seed            int64         `mapstructure:"seed"`
+	Duration        time.Duration `mapstructure:"duration"`
+	MetricsAddress  string        `mapstructure:"metrics-address"`
+	RateLimit       float64       `mapstructure:"rate-limit"`
+	AdaptiveBatch   bool          `mapstructure:"adaptive-batch-size"`
+	ResultsFile     string        `mapstructure:"results-file"`
+	ResultsFormat   string        `mapstructure:"results-format"`
+	PrintLatencies  bool          `mapstructure:"print-batch-latencies"`
 }
 
 // AddToFlagSet adds command line flags needed by the BenchmarkRunnerConfig to the flag set.
@@ -80,6 +90,13 @@ func (c BenchmarkRunnerConfig) AddToFlagSet(fs *pflag.FlagSet) {
 	fs.Duration("reporting-period", 10*time.Second, "Period to report write stats")
 	fs.String("file", "", "File name to read data from")
 	fs.Int64("seed", 0, "PRNG seed (default: 0, which uses the current timestamp)")
+	fs.Duration("duration", 0, "Keep loading for this long, starting over from the first item of the file once all are loaded (requires --file, 0 to load them once)")
+	fs.String("metrics-address", "", "Serve live metrics (insert rates, busy workers) in the Prometheus text format at /metrics on this address, e.g., :9090 (empty to disable)")
+	fs.Float64("rate-limit", 0, "Offer items at this rate per second across all workers, and report the achieved rate and the periods it was not sustained (0 for no limit)")
+	fs.Bool("adaptive-batch-size", false, "Adapt the batch size to the insert latency of the batches, starting from --batch-size, to converge on the size maximizing the insert rate")
+	fs.String("results-file", "", "Write the number of items loaded, the rates, the wall clock time and the flags to this file at the end of the run.")
+	fs.String("results-format", resultsFormatJSON, "Format of the results file: json or csv")
+	fs.Bool("print-batch-latencies", false, "Print the insert latency of each batch, e.g., for a query runner started with --ingest-command to report it")
 }
 
 // BenchmarkRunner is responsible for initializing and storing common
@@ -87,10 +104,21 @@ func (c BenchmarkRunnerConfig) AddToFlagSet(fs *pflag.FlagSet) {
 type BenchmarkRunner struct {
 	BenchmarkRunnerConfig
 	br             *bufio.Reader
+	file           *os.File        // file is the file data is read from, nil for stdin
+	decompressor   io.ReadCloser   // decompressor decompresses the data read, if compressed
+	decompressed   *countingReader // decompressed counts the bytes of data read out of the decompressor
+	dataStart      int64           // dataStart is the offset of the first item in the data, after the header the DBCreator read
 	metricCnt      uint64
 	rowCnt         uint64
+	itemCnt        uint64 // itemCnt is the number of items processed in batches
 	initialRand    *rand.Rand
 	sleepRegulator insertstrategy.SleepRegulator
+	started        time.Time // started is when loading started
+	busyWorkers    int64     // busyWorkers is the number of workers inserting a batch, accessed atomically
+
+	batchObserver func(took time.Duration, metricCnt, rowCnt uint64) // batchObserver, if set, is called after each batch is processed
+	pacer         *rate.Limiter                                      // pacer, if set, is the token bucket shared by the workers to insert items at the rate limit
+	adaptive      *adaptiveBatchSize                                 // adaptive, if set, adapts the batch size to the insert latency of the batches
 }
 
 var loader = &BenchmarkRunner{}
@@ -113,6 +141,29 @@ func GetBenchmarkRunnerWithBatchSize(c BenchmarkRunnerConfig, batchSize uint) *B
 
 	loader.initialRand = rand.New(rand.NewSource(loader.Seed))
 
+	if c.Duration > 0 && len(c.FileName) == 0 {
+		fatal("--duration requires the data to be read from a --file, to load it again")
+	}
+	if len(c.ResultsFile) > 0 && c.ResultsFormat != resultsFormatJSON && c.ResultsFormat != resultsFormatCSV {
+		fatal("unknown results format %q", c.ResultsFormat)
+	}
+
+	if c.RateLimit > 0 {
+		burst := int(loader.BatchSize)
+		if burst < 1 {
+			burst = 1
+		}
+		loader.pacer = rate.NewLimiter(rate.Limit(c.RateLimit), burst)
+	}
+	if c.AdaptiveBatch && loader.BatchSize > 0 {
+		loader.adaptive = newAdaptiveBatchSize(loader.BatchSize)
+	}
+	if c.PrintLatencies {
+		loader.SetBatchObserver(func(took time.Duration, metricCnt, rowCnt uint64) {
+			printFn("%s\n", utils.FormatBatchLatency(took, metricCnt, rowCnt))
+		})
+	}
+
 	var insertIntervals string
 	flag.StringVar(&insertIntervals, "insert-intervals", "", "Time to wait between each insert, default '' => all workers insert ASAP. '1,2' = worker 1 waits 1s between inserts, worker 2 and others wait 2s")
 	var err error
@@ -133,6 +184,15 @@ func (l *BenchmarkRunner) DatabaseName() string {
 	return l.DBName
 }
 
+// SetBatchObserver makes the workers call observe with how long each batch took
+// to process and the numbers of metrics and rows in it, e.g., to record the
+// latencies of inserts while queries run (see --print-batch-latencies and
+// query.BenchmarkRunner.RunMixed).
+// observe must be safe for concurrent use.
+func (l *BenchmarkRunner) SetBatchObserver(observe func(took time.Duration, metricCnt, rowCnt uint64)) {
+	l.batchObserver = observe
+}
+
 // RunBenchmark takes in a Benchmark b, a bufio.Reader br, and holders for number of metrics and rows
 // and uses those to run the load benchmark
 func (l *BenchmarkRunner) RunBenchmark(b Benchmark, workQueues uint) {
@@ -141,9 +201,15 @@ func (l *BenchmarkRunner) RunBenchmark(b Benchmark, workQueues uint) {
 	// Create required DB
 	cleanupFn := l.useDBCreator(b.GetDBCreator())
 	defer cleanupFn()
+	l.markDataStart()
 
 	channels := l.createChannels(workQueues)
 
+	l.started = time.Now()
+	if len(l.MetricsAddress) > 0 {
+		go func() { log.Fatal(utils.ServePrometheusMetrics(l.MetricsAddress, l.writeMetrics)) }()
+	}
+
 	// Launch all worker processes in background
 	var wg sync.WaitGroup
 	numChannels := len(channels)
@@ -173,9 +239,13 @@ func (l *BenchmarkRunner) RunBenchmark(b Benchmark, workQueues uint) {
 	stop_chan <- 0
 
 	l.summary(end.Sub(start))
+	if len(l.ResultsFile) > 0 {
+		l.writeResultsFile(end.Sub(start))
+	}
 }
 
-// GetBufferedReader returns the buffered Reader that should be used by the loader
+// GetBufferedReader returns the buffered Reader that should be used by the loader,
+// the data being decompressed on the fly if it was compressed (see decompress).
 func (l *BenchmarkRunner) GetBufferedReader() *bufio.Reader {
 	if l.br == nil {
 		if len(l.FileName) > 0 {
@@ -185,15 +255,68 @@ func (l *BenchmarkRunner) GetBufferedReader() *bufio.Reader {
 				fatal("cannot open file for read %s: %v", l.FileName, err)
 				return nil
 			}
-			l.br = bufio.NewReaderSize(file, defaultReadSize)
+			l.file = file
+			l.br = bufio.NewReaderSize(l.decompress(file), defaultReadSize)
 		} else {
 			// Read from STDIN
-			l.br = bufio.NewReaderSize(os.Stdin, defaultReadSize)
+			l.br = bufio.NewReaderSize(l.decompress(os.Stdin), defaultReadSize)
 		}
 	}
 	return l.br
 }
 
+// decompress returns the data read from r, decompressed on the fly by the
+// reading goroutine if it was compressed with gzip or zstd, as is otherwise.
+func (l *BenchmarkRunner) decompress(r io.Reader) io.Reader {
+	if l.decompressor != nil {
+		l.decompressor.Close()
+	}
+	l.decompressor = utils.NewDecompressingReader(r)
+	l.decompressed = &countingReader{r: l.decompressor}
+	return l.decompressed
+}
+
+// markDataStart records the offset of the first item in the data, that of
+// the data read so far, e.g., by the DBCreator reading its header, for the
+// data to be read again from it once rewound.
+func (l *BenchmarkRunner) markDataStart() {
+	l.dataStart = l.decompressed.n - int64(l.br.Buffered())
+}
+
+// rewind makes the data be read again from its first item, after the header
+// the DBCreator read before the first pass: uncompressed data from the offset
+// of the first item, and compressed data, in which offsets differ from those
+// of the file, from its start, the header being read again and discarded.
+func (l *BenchmarkRunner) rewind() error {
+	compressed := utils.IsCompressed(l.decompressor)
+	offset := l.dataStart
+	if compressed {
+		offset = 0
+	}
+	if _, err := l.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	l.br.Reset(l.decompress(l.file))
+	if compressed {
+		if _, err := l.br.Discard(int(l.dataStart)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingReader is a Reader counting the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // useDBCreator handles a DBCreator by running it according to flags set by the
 // user. The function returns a function that the caller should defer or run
 // when the benchmark is finished
@@ -275,8 +398,60 @@ func (l *BenchmarkRunner) scan(b Benchmark, channels []*duplexChannel, stop_chan
 		go l.report(l.ReportingPeriod, stop_chan)
 	}
 
+	sizer := l.batchSizer()
+
 	// Scan incoming data
-	return scanWithIndexer(channels, l.BatchSize, l.Limit, l.br, b.GetPointDecoder(l.br), b.GetBatchFactory(), b.GetPointIndexer(uint(len(channels))))
+	if l.Duration <= 0 {
+		return scanWithBatchSizer(channels, sizer, l.Limit, l.br, b.GetPointDecoder(l.br), b.GetBatchFactory(), b.GetPointIndexer(uint(len(channels))))
+	}
+
+	// Scan the data again and again until the duration of the run is up
+	deadline := time.Now().Add(l.Duration)
+	itemsRead := uint64(0)
+	for time.Now().Before(deadline) && (l.Limit == 0 || itemsRead < l.Limit) {
+		limit := uint64(0)
+		if l.Limit > 0 {
+			limit = l.Limit - itemsRead
+		}
+		decoder := &deadlineDecoder{PointDecoder: b.GetPointDecoder(l.br), deadline: deadline}
+		read := scanWithBatchSizer(channels, sizer, limit, l.br, decoder, b.GetBatchFactory(), b.GetPointIndexer(uint(len(channels))))
+		if read == 0 {
+			break
+		}
+		itemsRead += read
+		if err := l.rewind(); err != nil {
+			fatal("cannot rewind %s: %v", l.FileName, err)
+			break
+		}
+	}
+	return itemsRead
+}
+
+// batchSizer returns the batchSizer telling the size of the batches to fill:
+// the adaptive one if the batch size is adaptive, --batch-size otherwise.
+func (l *BenchmarkRunner) batchSizer() batchSizer {
+	if l.adaptive != nil {
+		return l.adaptive
+	}
+	if l.BatchSize < 1 {
+		panic("--batch-size cannot be less than 1")
+	}
+	return fixedBatchSize(l.BatchSize)
+}
+
+// deadlineDecoder is a PointDecoder that stops decoding once its deadline has
+// passed, as if the data had run out.
+type deadlineDecoder struct {
+	PointDecoder
+	deadline time.Time
+}
+
+// Decode creates a Point from a data stream, unless the deadline has passed.
+func (d *deadlineDecoder) Decode(br *bufio.Reader) *Point {
+	if !time.Now().Before(d.deadline) {
+		return nil
+	}
+	return d.PointDecoder.Decode(br)
 }
 
 // work is the processing function for each worker in the loader
@@ -289,10 +464,26 @@ func (l *BenchmarkRunner) work(b Benchmark, wg *sync.WaitGroup, c *duplexChannel
 	// Process batches coming from duplexChannel.toWorker queue
 	// and send ACKs into duplexChannel.toScanner queue
 	for b := range c.toWorker {
+		l.pace(b.Len())
 		startedWorkAt := time.Now()
+		atomic.AddInt64(&l.busyWorkers, 1)
+		items := b.Len()
 		metricCnt, rowCnt := proc.ProcessBatch(b, l.DoLoad)
+		atomic.AddInt64(&l.busyWorkers, -1)
+		took := time.Since(startedWorkAt)
+		if l.batchObserver != nil {
+			l.batchObserver(took, metricCnt, rowCnt)
+		}
+		if l.adaptive != nil {
+			rows := rowCnt
+			if rows == 0 {
+				rows = metricCnt
+			}
+			l.adaptive.observe(items, rows, took)
+		}
 		atomic.AddUint64(&l.metricCnt, metricCnt)
 		atomic.AddUint64(&l.rowCnt, rowCnt)
+		atomic.AddUint64(&l.itemCnt, uint64(items))
 		c.sendToScanner()
 		l.timeToSleep(workerNum, startedWorkAt)
 	}
@@ -306,6 +497,25 @@ func (l *BenchmarkRunner) work(b Benchmark, wg *sync.WaitGroup, c *duplexChannel
 	wg.Done()
 }
 
+// pace waits until items can be inserted without exceeding the rate limit, if
+// any. The tokens of a batch larger than the bucket, e.g., of an adaptive
+// batch size grown past --batch-size, are reserved a bucket at a time, so
+// the batch still waits for all of them.
+func (l *BenchmarkRunner) pace(items int) {
+	if l.pacer == nil {
+		return
+	}
+	burst := l.pacer.Burst()
+	for items > 0 {
+		n := items
+		if n > burst {
+			n = burst
+		}
+		time.Sleep(l.pacer.ReserveN(time.Now(), n).Delay())
+		items -= n
+	}
+}
+
 func (l *BenchmarkRunner) timeToSleep(workerNum int, startedWorkAt time.Time) {
 	if l.sleepRegulator != nil {
 		l.sleepRegulator.Sleep(workerNum, startedWorkAt)
@@ -321,6 +531,14 @@ func (l *BenchmarkRunner) summary(took time.Duration) {
 		rowRate := float64(l.rowCnt) / float64(took.Seconds())
 		printFn("loaded %d rows in %0.3fsec with %d workers (mean rate %0.2f rows/sec)\n", l.rowCnt, took.Seconds(), l.Workers, rowRate)
 	}
+	if l.RateLimit > 0 {
+		itemRate := float64(l.itemCnt) / float64(took.Seconds())
+		printFn("offered rate %0.2f items/sec, achieved rate %0.2f items/sec\n", l.RateLimit, itemRate)
+	}
+	if l.adaptive != nil {
+		size, stability, n := l.adaptive.chosen()
+		printFn("adaptive batch size %d items (seed %d), varying by %0.2f%% over the last %d adjustments\n", size, l.adaptive.seed, 100*stability, n)
+	}
 }
 
 // report handles periodic reporting of loading stats
@@ -329,6 +547,7 @@ func (l *BenchmarkRunner) report(period time.Duration, stop_chan <-chan int) {
 	prevTime := start
 	prevColCount := uint64(0)
 	prevRowCount := uint64(0)
+	prevItemCount := uint64(0)
 
 	printFn("time,per. metric/s,metric total,overall metric/s,per. row/s,row total,overall row/s\n")
 	ticker := time.NewTicker(period)
@@ -350,6 +569,15 @@ func (l *BenchmarkRunner) report(period time.Duration, stop_chan <-chan int) {
 					printFn("%d,%0.2f,%E,%0.2f,-,-,-\n", now.Unix(), colrate, float64(cCount), overallColRate)
 				}
 
+				if l.RateLimit > 0 {
+					iCount := atomic.LoadUint64(&l.itemCnt)
+					itemRate := float64(iCount-prevItemCount) / float64(took.Seconds())
+					if itemRate < utils.SustainedRateFraction*l.RateLimit {
+						log.Printf("warning: the offered rate of %0.2f items/sec was not sustained over the period ending at %d: %0.2f items/sec\n", l.RateLimit, now.Unix(), itemRate)
+					}
+					prevItemCount = iCount
+				}
+
 				prevColCount = cCount
 				prevRowCount = rCount
 				prevTime = now
@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+	"golang.org/x/time/rate"
 )
 
 type testProcessor struct {
@@ -158,6 +163,164 @@ func TestGetBufferedReader(t *testing.T) {
 	fatal = oldFatal
 }
 
+func TestGetBufferedReaderCompressed(t *testing.T) {
+	data := "cpu,hostname=host_0 usage_user=1 0\n"
+	for _, compression := range []string{utils.CompressionNone, utils.CompressionGzip, utils.CompressionZstd} {
+		f, err := ioutil.TempFile("", "tsbs-load-data")
+		if err != nil {
+			t.Fatalf("cannot create data file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		w, err := utils.NewCompressingWriter(f, compression)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", compression, err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("%s: cannot write data file: %v", compression, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: cannot write data file: %v", compression, err)
+		}
+		f.Close()
+
+		r := &BenchmarkRunner{}
+		r.FileName = f.Name()
+		got, err := ioutil.ReadAll(r.GetBufferedReader())
+		if err != nil {
+			t.Errorf("%s: unexpected error on read: %v", compression, err)
+		} else if string(got) != data {
+			t.Errorf("%s: incorrect data read: got %q want %q", compression, got, data)
+		}
+
+		// The data is decompressed again once rewound, e.g., for --duration
+		if err := r.rewind(); err != nil {
+			t.Fatalf("%s: cannot rewind: %v", compression, err)
+		}
+		got, err = ioutil.ReadAll(r.br)
+		if err != nil {
+			t.Errorf("%s: unexpected error on read after rewind: %v", compression, err)
+		} else if string(got) != data {
+			t.Errorf("%s: incorrect data read after rewind: got %q want %q", compression, got, data)
+		}
+	}
+}
+
+// headerCreator is a DBCreator reading the header of the data, up to its
+// first empty line, like those of the databases whose data has one.
+type headerCreator struct {
+	testCreator
+	r *BenchmarkRunner
+}
+
+func (c *headerCreator) Init() {
+	for {
+		line, err := c.r.br.ReadString('\n')
+		if err != nil || line == "\n" {
+			return
+		}
+	}
+}
+
+// lineDecoder decodes a Point of each line, failing the test on the lines of
+// the header.
+type lineDecoder struct {
+	t *testing.T
+}
+
+func (d *lineDecoder) Decode(br *bufio.Reader) *Point {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if !strings.HasPrefix(line, "cpu ") {
+		d.t.Errorf("line of the header decoded as an item: %q", line)
+		return nil
+	}
+	return NewPoint(line)
+}
+
+type lineBatch struct {
+	lines []string
+}
+
+func (b *lineBatch) Len() int        { return len(b.lines) }
+func (b *lineBatch) Append(p *Point) { b.lines = append(b.lines, p.Data.(string)) }
+
+type lineFactory struct{}
+
+func (f *lineFactory) New() Batch { return &lineBatch{} }
+
+// headerBenchmark is a Benchmark of data of a header then of one item per
+// line.
+type headerBenchmark struct {
+	testBenchmark
+	t       *testing.T
+	creator *headerCreator
+}
+
+func (b *headerBenchmark) GetPointDecoder(_ *bufio.Reader) PointDecoder { return &lineDecoder{t: b.t} }
+func (b *headerBenchmark) GetBatchFactory() BatchFactory                { return &lineFactory{} }
+func (b *headerBenchmark) GetDBCreator() DBCreator                      { return b.creator }
+
+func TestScanDurationWithHeader(t *testing.T) {
+	data := "tags,hostname string\ncpu,usage_user\n\ncpu 1\ncpu 2\ncpu 3\n"
+	for _, compression := range utils.Compressions {
+		f, err := ioutil.TempFile("", "tsbs-load-data")
+		if err != nil {
+			t.Fatalf("cannot create data file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		w, err := utils.NewCompressingWriter(f, compression)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", compression, err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("%s: cannot write data file: %v", compression, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: cannot write data file: %v", compression, err)
+		}
+		f.Close()
+
+		r := &BenchmarkRunner{}
+		r.FileName = f.Name()
+		r.DoLoad = true
+		r.Workers = 1
+		r.BatchSize = 2
+		r.Duration = time.Minute
+		r.Limit = 10
+		r.br = r.GetBufferedReader()
+		b := &headerBenchmark{t: t, creator: &headerCreator{r: r}}
+		r.useDBCreator(b.GetDBCreator())
+		r.markDataStart()
+
+		// a worker collecting the items of the batches
+		channels := r.createChannels(WorkerPerQueue)
+		var items []string
+		done := make(chan struct{})
+		go func() {
+			for batch := range channels[0].toWorker {
+				items = append(items, batch.(*lineBatch).lines...)
+				channels[0].sendToScanner()
+			}
+			close(done)
+		}()
+		// the items are read again and again, without the header, up to the limit
+		read := r.scan(b, channels, nil)
+		channels[0].close()
+		<-done
+		if read != 10 || len(items) != 10 {
+			t.Fatalf("%s: incorrect number of items: got %d read, %d in batches, want 10", compression, read, len(items))
+		}
+		for i, item := range items {
+			if want := fmt.Sprintf("cpu %d", i%3+1); item != want {
+				t.Errorf("%s: incorrect item %d: got %q want %q", compression, i, item, want)
+			}
+		}
+	}
+}
+
 func TestUseDBCreator(t *testing.T) {
 	cases := []struct {
 		desc         string
@@ -521,7 +684,9 @@ func TestReport(t *testing.T) {
 	}
 	br := &BenchmarkRunner{}
 	duration := 200 * time.Millisecond
-	go br.report(duration)
+	stop := make(chan int)
+	defer close(stop)
+	go br.report(duration, stop)
 
 	time.Sleep(25 * time.Millisecond)
 	if got := atomic.LoadInt64(&counter); got != 1 {
@@ -557,3 +722,32 @@ func TestReport(t *testing.T) {
 		t.Errorf("TestReport: row report ends in -")
 	}
 }
+
+func TestPace(t *testing.T) {
+	br := &BenchmarkRunner{}
+	br.pace(1000) // no rate limit: does not wait
+
+	br.pacer = rate.NewLimiter(100, 10)
+	start := time.Now()
+	br.pace(10) // the bucket starts full
+	br.pace(20) // larger than the bucket: waits for two full buckets
+	if took := time.Since(start); took < 180*time.Millisecond || took > time.Second {
+		t.Errorf("incorrect pacing: took %v, want about 200ms", took)
+	}
+}
+
+func TestPaceAdaptiveBatchSize(t *testing.T) {
+	// --rate-limit with --adaptive-batch-size: the bucket is as large as the
+	// seed size, which the batches grow past
+	br := &BenchmarkRunner{}
+	br.pacer = rate.NewLimiter(10000, 10)
+	br.adaptive = newAdaptiveBatchSize(10)
+	grown := int(br.adaptive.max)
+	start := time.Now()
+	br.pace(10) // the bucket starts full
+	br.pace(grown)
+	// the grown batch waits for all its tokens, rather than those of a bucket
+	if took, want := time.Since(start), time.Duration(grown)*time.Second/10000; took < want*8/10 || took > 10*want {
+		t.Errorf("incorrect pacing of a grown batch of %d items: took %v, want about %v", grown, took, want)
+	}
+}
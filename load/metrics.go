@@ -0,0 +1,36 @@
+package load
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// writeMetrics writes the live metrics of the load at now in the Prometheus
+// text format: the numbers of metrics and rows inserted and their mean rates,
+// and the number of workers inserting a batch.
+func (l *BenchmarkRunner) writeMetrics(w io.Writer, now time.Time) error {
+	metricCnt := atomic.LoadUint64(&l.metricCnt)
+	rowCnt := atomic.LoadUint64(&l.rowCnt)
+	metricRate, rowRate := 0.0, 0.0
+	if elapsed := now.Sub(l.started).Seconds(); elapsed > 0 {
+		metricRate = float64(metricCnt) / elapsed
+		rowRate = float64(rowCnt) / elapsed
+	}
+	gauge := func(name, help string, value float64) utils.PrometheusMetric {
+		return utils.PrometheusMetric{Name: name, Help: help, Type: utils.PrometheusGauge, Samples: []utils.PrometheusSample{{Value: value}}}
+	}
+	counter := func(name, help string, value float64) utils.PrometheusMetric {
+		return utils.PrometheusMetric{Name: name, Help: help, Type: utils.PrometheusCounter, Samples: []utils.PrometheusSample{{Value: value}}}
+	}
+	return utils.WritePrometheusMetrics(w, []utils.PrometheusMetric{
+		counter("tsbs_metrics_inserted_total", "Number of metrics inserted.", float64(metricCnt)),
+		gauge("tsbs_metrics_inserted_per_second", "Mean rate of metrics inserted since the start of the load.", metricRate),
+		counter("tsbs_rows_inserted_total", "Number of rows inserted.", float64(rowCnt)),
+		gauge("tsbs_rows_inserted_per_second", "Mean rate of rows inserted since the start of the load.", rowRate),
+		gauge("tsbs_workers", "Number of workers inserting batches.", float64(l.Workers)),
+		gauge("tsbs_workers_busy", "Number of workers inserting a batch.", float64(atomic.LoadInt64(&l.busyWorkers))),
+	})
+}
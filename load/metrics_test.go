@@ -0,0 +1,34 @@
+package load
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	br := &BenchmarkRunner{}
+	br.Workers = 4
+	br.started = time.Now()
+	br.metricCnt = 100
+	br.rowCnt = 10
+	br.busyWorkers = 3
+
+	var b bytes.Buffer
+	if err := br.writeMetrics(&b, br.started.Add(2*time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE tsbs_metrics_inserted_total counter\ntsbs_metrics_inserted_total 100\n",
+		"tsbs_metrics_inserted_per_second 50\n",
+		"tsbs_rows_inserted_total 10\n",
+		"tsbs_rows_inserted_per_second 5\n",
+		"tsbs_workers 4\n",
+		"tsbs_workers_busy 3\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %q in metrics:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package load
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// The formats the results file can be written in.
+const (
+	resultsFormatJSON = "json"
+	resultsFormatCSV  = "csv"
+)
+
+// ErrUnknownResultsFormat is returned when writing the results file in a
+// format other than resultsFormatJSON and resultsFormatCSV.
+var ErrUnknownResultsFormat = errors.New("load: unknown results format")
+
+// LoadResult is the outcome of a load benchmark run as written to the results
+// file: what was loaded, how fast, and how the run was made.
+type LoadResult struct {
+	Metrics          uint64            `json:"metrics"`
+	Rows             uint64            `json:"rows"`
+	WallClockSeconds float64           `json:"wall_clock_seconds"`
+	MetricRate       float64           `json:"metrics_per_second"`
+	RowRate          float64           `json:"rows_per_second"`
+	Workers          uint              `json:"workers"`
+	BatchSize        uint              `json:"batch_size"`
+	OfferedItemRate  float64           `json:"offered_items_per_second,omitempty"`
+	ItemRate         float64           `json:"items_per_second,omitempty"`
+	AdaptiveBatch    bool              `json:"adaptive_batch_size,omitempty"`
+	BatchStability   float64           `json:"batch_size_stability,omitempty"`
+	Flags            map[string]string `json:"flags,omitempty"`
+}
+
+// loadResult returns the LoadResult of the run that took took, whose flags
+// were set to flags.
+func (l *BenchmarkRunner) loadResult(took time.Duration, flags map[string]string) LoadResult {
+	r := LoadResult{
+		Metrics:          l.metricCnt,
+		Rows:             l.rowCnt,
+		WallClockSeconds: took.Seconds(),
+		MetricRate:       float64(l.metricCnt) / took.Seconds(),
+		RowRate:          float64(l.rowCnt) / took.Seconds(),
+		Workers:          l.Workers,
+		BatchSize:        l.BatchSize,
+		Flags:            flags,
+	}
+	if l.RateLimit > 0 {
+		r.OfferedItemRate = l.RateLimit
+		r.ItemRate = float64(l.itemCnt) / took.Seconds()
+	}
+	if l.adaptive != nil {
+		// the batch size is the one chosen, see adaptiveBatchSize.chosen
+		r.AdaptiveBatch = true
+		r.BatchSize, r.BatchStability, _ = l.adaptive.chosen()
+	}
+	return r
+}
+
+// writeLoadResult writes r in format: as indented JSON, or as CSV with one
+// (statistic, value) row per statistic, preceded by the flags as
+// "# flag name: value" comment lines.
+func writeLoadResult(w io.Writer, format string, r LoadResult) error {
+	switch format {
+	case resultsFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case resultsFormatCSV:
+		names := make([]string, 0, len(r.Flags))
+		for name := range r.Flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "# flag %s: %s\n", name, r.Flags[name]); err != nil {
+				return err
+			}
+		}
+		formatFloat := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+		cw := csv.NewWriter(w)
+		cw.WriteAll([][]string{
+			{"statistic", "value"},
+			{"metrics", strconv.FormatUint(r.Metrics, 10)},
+			{"rows", strconv.FormatUint(r.Rows, 10)},
+			{"wall_clock_seconds", formatFloat(r.WallClockSeconds)},
+			{"metrics_per_second", formatFloat(r.MetricRate)},
+			{"rows_per_second", formatFloat(r.RowRate)},
+			{"workers", strconv.FormatUint(uint64(r.Workers), 10)},
+			{"batch_size", strconv.FormatUint(uint64(r.BatchSize), 10)},
+		})
+		if r.OfferedItemRate > 0 {
+			cw.WriteAll([][]string{
+				{"offered_items_per_second", formatFloat(r.OfferedItemRate)},
+				{"items_per_second", formatFloat(r.ItemRate)},
+			})
+		}
+		if r.AdaptiveBatch {
+			cw.WriteAll([][]string{
+				{"adaptive_batch_size", strconv.FormatBool(r.AdaptiveBatch)},
+				{"batch_size_stability", formatFloat(r.BatchStability)},
+			})
+		}
+		return cw.Error()
+	}
+	return ErrUnknownResultsFormat
+}
+
+// writeResultsFile writes the LoadResult of the run that took took to the
+// results file, with the values of the command line flags.
+func (l *BenchmarkRunner) writeResultsFile(took time.Duration) {
+	printFn("Saving the results to %s\n", l.ResultsFile)
+	f, err := os.Create(l.ResultsFile)
+	if err != nil {
+		fatal("cannot create results file %s: %v", l.ResultsFile, err)
+		return
+	}
+	if err := writeLoadResult(f, l.ResultsFormat, l.loadResult(took, utils.FlagValues(pflag.CommandLine))); err != nil {
+		f.Close()
+		fatal("cannot write results file %s: %v", l.ResultsFile, err)
+		return
+	}
+	// a failed flush of the results is only reported by Close
+	if err := f.Close(); err != nil {
+		fatal("cannot write results file %s: %v", l.ResultsFile, err)
+	}
+}
@@ -0,0 +1,110 @@
+package load
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteLoadResult(t *testing.T) {
+	br := &BenchmarkRunner{}
+	br.Workers = 4
+	br.BatchSize = 1000
+	br.metricCnt = 100
+	br.rowCnt = 10
+	r := br.loadResult(2*time.Second, map[string]string{"db-name": "benchmark"})
+	if r.MetricRate != 50 || r.RowRate != 5 {
+		t.Errorf("incorrect rates: got %f metrics/sec, %f rows/sec", r.MetricRate, r.RowRate)
+	}
+
+	var b bytes.Buffer
+	if err := writeLoadResult(&b, resultsFormatJSON, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var decoded LoadResult
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatalf("results file is not valid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, r) {
+		t.Errorf("result did not survive JSON:\ngot  %+v\nwant %+v", decoded, r)
+	}
+
+	b.Reset()
+	if err := writeLoadResult(&b, resultsFormatCSV, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.HasPrefix(b.Bytes(), []byte("# flag db-name: benchmark\n")) {
+		t.Errorf("missing flags in CSV:\n%s", b.String())
+	}
+	cr := csv.NewReader(&b)
+	cr.Comment = '#'
+	rows, err := cr.ReadAll()
+	if err != nil {
+		t.Fatalf("results file is not valid CSV: %v", err)
+	}
+	values := map[string]string{}
+	for _, row := range rows[1:] {
+		values[row[0]] = row[1]
+	}
+	if values["rows"] != "10" || values["wall_clock_seconds"] != "2" || values["workers"] != "4" {
+		t.Errorf("incorrect CSV values: got %v", values)
+	}
+	if err := writeLoadResult(&b, "yaml", r); err != ErrUnknownResultsFormat {
+		t.Errorf("incorrect error: got %v want %v", err, ErrUnknownResultsFormat)
+	}
+}
+
+func TestWriteLoadResultRateLimit(t *testing.T) {
+	br := &BenchmarkRunner{}
+	br.RateLimit = 100
+	br.itemCnt = 180
+	r := br.loadResult(2*time.Second, nil)
+	if r.OfferedItemRate != 100 || r.ItemRate != 90 {
+		t.Errorf("incorrect rates: got offered %f items/sec, achieved %f items/sec", r.OfferedItemRate, r.ItemRate)
+	}
+
+	var b bytes.Buffer
+	if err := writeLoadResult(&b, resultsFormatCSV, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("results file is not valid CSV: %v", err)
+	}
+	values := map[string]string{}
+	for _, row := range rows[1:] {
+		values[row[0]] = row[1]
+	}
+	if values["offered_items_per_second"] != "100" || values["items_per_second"] != "90" {
+		t.Errorf("incorrect CSV values: got %v", values)
+	}
+}
+
+func TestWriteLoadResultAdaptiveBatch(t *testing.T) {
+	br := &BenchmarkRunner{}
+	br.BatchSize = 100
+	br.adaptive = newAdaptiveBatchSize(100)
+	r := br.loadResult(time.Second, nil)
+	if !r.AdaptiveBatch || r.BatchSize != 100 {
+		t.Errorf("incorrect batch size: got %d, adaptive %v", r.BatchSize, r.AdaptiveBatch)
+	}
+
+	var b bytes.Buffer
+	if err := writeLoadResult(&b, resultsFormatCSV, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("results file is not valid CSV: %v", err)
+	}
+	values := map[string]string{}
+	for _, row := range rows[1:] {
+		values[row[0]] = row[1]
+	}
+	if values["adaptive_batch_size"] != "true" || values["batch_size_stability"] != "0" {
+		t.Errorf("incorrect CSV values: got %v", values)
+	}
+}
@@ -88,12 +88,18 @@ type PointDecoder interface {
 // which are then dispatched to workers (duplexChannel chosen by PointIndexer). Scan does flow control to make sure workers are not left idle for too long
 // and also that the scanning process  does not starve them of CPU.
 func scanWithIndexer(channels []*duplexChannel, batchSize uint, limit uint64, br *bufio.Reader, decoder PointDecoder, factory BatchFactory, indexer PointIndexer) uint64 {
-	var itemsRead uint64
-	numChannels := len(channels)
-
 	if batchSize < 1 {
 		panic("--batch-size cannot be less than 1")
 	}
+	return scanWithBatchSizer(channels, fixedBatchSize(batchSize), limit, br, decoder, factory, indexer)
+}
+
+// scanWithBatchSizer is scanWithIndexer with batches filled up to the number of
+// items sizer tells at the time, e.g., to adapt the batch size as the data is
+// loaded.
+func scanWithBatchSizer(channels []*duplexChannel, sizer batchSizer, limit uint64, br *bufio.Reader, decoder PointDecoder, factory BatchFactory, indexer PointIndexer) uint64 {
+	var itemsRead uint64
+	numChannels := len(channels)
 
 	// Batches details
 	// 1. fillingBatches contains batches that are being filled with items from scanner.
@@ -167,7 +173,7 @@ func scanWithIndexer(channels []*duplexChannel, batchSize uint, limit uint64, br
 		idx := indexer.GetIndex(item)
 		fillingBatches[idx].Append(item)
 
-		if fillingBatches[idx].Len() >= int(batchSize) {
+		if fillingBatches[idx].Len() >= int(sizer.size()) {
 			// Batch is full (contains at least batchSize items) - ready to be sent to worker,
 			// or moved to outstanding, in case no workers available atm.
 			unsentBatches[idx] = sendOrQueueBatch(channels[idx], &ocnt, fillingBatches[idx], unsentBatches[idx])
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"testing"
+	"time"
 )
 
 type testBatch struct {
@@ -263,3 +264,15 @@ func TestScanWithIndexer(t *testing.T) {
 		}
 	}
 }
+
+func TestDeadlineDecoder(t *testing.T) {
+	br := bufio.NewReader(bytes.NewReader([]byte{1, 2}))
+	d := &deadlineDecoder{PointDecoder: &testDecoder{}, deadline: time.Now().Add(time.Hour)}
+	if p := d.Decode(br); p == nil || p.Data.(byte) != 1 {
+		t.Errorf("incorrect point before the deadline: got %v", p)
+	}
+	d.deadline = time.Now()
+	if p := d.Decode(br); p != nil {
+		t.Errorf("point decoded past the deadline: got %v", p)
+	}
+}
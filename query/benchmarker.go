@@ -3,13 +3,17 @@ package query
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/timescale/tsbs/internal/utils"
 	"golang.org/x/time/rate"
 )
 
@@ -23,18 +27,62 @@ const (
 
 // BenchmarkRunnerConfig is the configuration of the benchmark runner.
 type BenchmarkRunnerConfig struct {
-	DBName           string `mapstructure:"db-name"`
-	Limit            uint64 `mapstructure:"max-queries"`
-	LimitRPS         uint64 `mapstructure:"max-rps"`
-	MemProfile       string `mapstructure:"memprofile"`
-	HDRLatenciesFile string `mapstructure:"hdr-latencies"`
-	Workers          uint   `mapstructure:"workers"`
-	PrintResponses   bool   `mapstructure:"print-responses"`
-	Debug            int    `mapstructure:"debug"`
-	FileName         string `mapstructure:"file"`
-	BurnIn           uint64 `mapstructure:"burn-in"`
-	PrintInterval    uint64 `mapstructure:"print-interval"`
-	PrewarmQueries   bool   `mapstructure:"prewarm-queries"`
+	DBName             string        `mapstructure:"db-name"`
+	Limit              uint64        `mapstructure:"max-queries"`
+	LimitRPS           uint64        `mapstructure:"max-rps"`
+	MemProfile         string        `mapstructure:"memprofile"`
+	HDRLatenciesFile   string        `mapstructure:"hdr-latencies"`
+	Workers            uint          `mapstructure:"workers"`
+	PrintResponses     bool          `mapstructure:"print-responses"`
+	Debug              int           `mapstructure:"debug"`
+	FileName           string        `mapstructure:"file"`
+	BurnIn             uint64        `mapstructure:"burn-in"`
+	PrintInterval      uint64        `mapstructure:"print-interval"`
+	PrewarmQueries     bool          `mapstructure:"prewarm-queries"`
+	MinSampleCount     uint64        `mapstructure:"min-sample-count"`
+	MaxDuration        time.Duration `mapstructure:"max-duration"`
+	ExpectedInterval   time.Duration `mapstructure:"expected-interval"`
+	PreciseLatencies   bool          `mapstructure:"precise-latencies"`
+	RunMetadata        []string      `mapstructure:"run-metadata"`
+	LogSpaceStats      bool          `mapstructure:"log-space-stats"`
+	CheckpointFile     string        `mapstructure:"checkpoint-file"`
+	CheckpointInterval time.Duration `mapstructure:"checkpoint-interval"`
+	ResumeCheckpoint   bool          `mapstructure:"resume-checkpoint"`
+	ThroughputCSVFile  string        `mapstructure:"throughput-csv"`
+	StallFraction      float64       `mapstructure:"stall-fraction"`
+	MaxDisplayedGroups int           `mapstructure:"max-displayed-groups"`
+	DisplayOrder       string        `mapstructure:"display-order"`
+	AnonymizeKey       string        `mapstructure:"anonymize-key"`
+	LabelMappingFile   string        `mapstructure:"label-mapping-file"`
+	ResultsProtoFile   string        `mapstructure:"results-proto"`
+	ResultsParquetFile string        `mapstructure:"results-parquet"`
+	ApdexTarget        time.Duration `mapstructure:"apdex-target"`
+	OmissionInterval   time.Duration `mapstructure:"omission-cost-interval"`
+	AbsoluteDeviations bool          `mapstructure:"absolute-deviations"`
+	RecentWindowSize   int           `mapstructure:"effective-sample-window"`
+	OutlierThreshold   float64       `mapstructure:"outlier-threshold"`
+	LatencyKnee        bool          `mapstructure:"latency-knee"`
+	GoBenchFile        string        `mapstructure:"go-bench-file"`
+	Duration           time.Duration `mapstructure:"duration"`
+	IntervalPeriod     time.Duration `mapstructure:"interval-stats-period"`
+	MetricsAddress     string        `mapstructure:"metrics-address"`
+	RateLimit          float64       `mapstructure:"rate-limit"`
+	Coordinator        []string      `mapstructure:"coordinator"`
+	Worker             string        `mapstructure:"worker"`
+	LatencyLogFile     string        `mapstructure:"latency-log"`
+	ResultsFile        string        `mapstructure:"results-file"`
+	ResultsFormat      string        `mapstructure:"results-format"`
+	ValidateFile       string        `mapstructure:"validate"`
+	ValidateAgainst    string        `mapstructure:"validate-against"`
+	ValidateTolerance  float64       `mapstructure:"validate-tolerance"`
+	WorkerStats        bool          `mapstructure:"worker-stats"`
+	HistogramBuckets   int           `mapstructure:"histogram-buckets"`
+	LabelDecimals      int           `mapstructure:"label-decimals"`
+	ReportFile         string        `mapstructure:"report-file"`
+	TailSamples        int           `mapstructure:"tail-samples"`
+	TailThreshold      time.Duration `mapstructure:"tail-threshold"`
+	TailPercentile     float64       `mapstructure:"tail-percentile"`
+	IngestCommand      string        `mapstructure:"ingest-command"`
 }
 
 // AddToFlagSet adds command line flags needed by the BenchmarkRunnerConfig to the flag set.
@@ -43,14 +91,58 @@ func (c BenchmarkRunnerConfig) AddToFlagSet(fs *pflag.FlagSet) {
 	fs.Uint64("burn-in", 0, "Number of queries to ignore before collecting statistics.")
 	fs.Uint64("max-queries", 0, "Limit the number of queries to send, 0 = no limit")
 	fs.Uint64("max-rps", 0, "Limit the rate of queries per second, 0 = no limit")
+	fs.Duration("max-duration", 0, "Stop sending queries after this much time and report the stats collected so far, 0 = no limit")
 	fs.Uint64("print-interval", 100, "Print timing stats to stderr after this many queries (0 to disable)")
 	fs.String("memprofile", "", "Write a memory profile to this file.")
 	fs.String("hdr-latencies", "", "Write the High Dynamic Range (HDR) Histogram of Response Latencies to this file.")
+	fs.Float64("stall-fraction", 0, "Report the seconds whose throughput dropped below this fraction of the running median as stalls (0 to disable)")
+	fs.String("throughput-csv", "", "Write the number of queries and their mean latency per second of the run to this file, as CSV.")
 	fs.Uint("workers", 1, "Number of concurrent requests to make.")
 	fs.Bool("prewarm-queries", false, "Run each query twice in a row so the warm query is guaranteed to be a cache hit")
 	fs.Bool("print-responses", false, "Pretty print response bodies for correctness checking (default false).")
 	fs.Int("debug", 0, "Whether to print debug messages.")
 	fs.String("file", "", "File name to read queries from")
+	fs.Uint64("min-sample-count", 0, "Warn about query types with fewer than this many samples in the final stats (0 to disable)")
+	fs.String("checkpoint-file", "", "File to periodically save the stats collected so far to, so a restarted run can resume from them")
+	fs.Duration("checkpoint-interval", 0, "How often to save the stats collected so far to the checkpoint file (0 to disable)")
+	fs.Bool("resume-checkpoint", false, "Start from the stats saved in the checkpoint file, e.g., after a crash, skipping the queries already run (with the same --anonymize-key, if the saved labels are anonymized)")
+	fs.Bool("log-space-stats", false, "Also report the geometric mean and stddev factor of the latencies, which suit log-normal latencies better")
+	fs.StringSlice("run-metadata", nil, "Metadata describing the run, written at the top of the stats output, as key=value pairs (e.g., commit=abc123,scale=100)")
+	fs.Bool("precise-latencies", false, "Record latencies with nanosecond rather than microsecond precision, e.g., for in-memory databases")
+	fs.Int("max-displayed-groups", 0, "Only display the top this many query types in the final stats, and a summary of the others (0 to display all)")
+	fs.String("display-order", defaultDisplayOrder, "Metric the top query types are chosen by when not all are displayed: count, total, mean, max or p99")
+	fs.String("anonymize-key", "", "Replace the query types by their hash keyed with this key in all the stats outputs, progress and checkpoints included, e.g., to publish results (empty to disable)")
+	fs.String("label-mapping-file", "", "Write the hashes of the anonymized query types and the query types to this file, as CSV.")
+	fs.String("results-proto", "", "Write the result, with the histogram of each query type, to this file as a protobuf message (see query/result.proto).")
+	fs.String("results-parquet", "", "Write the stats of each query type to this file as a Parquet table, one row per query type, e.g., for an analytics pipeline.")
+	fs.Duration("apdex-target", 0, "Report the Apdex score of each query type for this target latency: satisfied up to it, tolerating up to 4 times it (0 to disable)")
+	fs.Duration("omission-cost-interval", 0, "Report how much coordinated omission understates the p99 of each query type, were queries expected to start at this interval per worker (0 to disable, exclusive with --expected-interval)")
+	fs.Bool("absolute-deviations", false, "Also report the mean and median absolute deviations of the latencies, which weigh outliers less than the stddev")
+	fs.Int("effective-sample-window", 0, "Report the effective sample size, accounting for autocorrelation, and the confidence interval of the mean of the last this many queries (0 to disable)")
+	fs.Float64("outlier-threshold", 0, "Warn about query types whose max latency is more than this many standard deviations above their mean (0 to disable)")
+	fs.Bool("latency-knee", false, "Report the throughput at the knee of the mean latency against the throughput of each second of the run, beyond which latency climbs sharply")
+	fs.String("go-bench-file", "", "Write the mean latency of each query type to this file in the output format of Go benchmarks, e.g., to compare runs with benchstat.")
+	fs.String("results-file", "", "Write the stats of each query type, the wall clock time, the number of workers and the flags to this file at the end of the run.")
+	fs.String("results-format", resultsFormatJSON, "Format of the results file: json or csv")
+	fs.Duration("duration", 0, "Run the queries for this long, starting over from the first query of the file once all have run (requires --file, 0 to run them once)")
+	fs.Duration("interval-stats-period", 0, "Print the stats of the queries of each period of this length to stderr, e.g., 10s to watch a long run for degradation (0 to disable)")
+	fs.String("metrics-address", "", "Serve live metrics (query rate, busy workers, latency quantiles) in the Prometheus text format at /metrics on this address, e.g., :9090 (empty to disable)")
+	fs.Float64("rate-limit", 0, "Offer queries at this rate per second across all workers, and report the achieved rate and the seconds it was not sustained (0 for no limit, exclusive with --max-rps)")
+	fs.String("latency-log", "", "Write every latency, with the time it was measured at, its query type and kind (complete, warm, partial or ingest), to this file as CSV, e.g., to plot latency over time (appended to when resuming from a checkpoint)")
+	fs.StringSlice("coordinator", nil, "Coordinate a distributed run: have the workers at these addresses (e.g., host1:8089,host2:8089) each run a shard of the queries, and report their merged stats")
+	fs.String("worker", "", "Run as a worker of a distributed run: wait on this address (e.g., :8089) for the coordinator to assign a shard of the queries, and send it the stats")
+	fs.String("validate", "", "Write the normalized response of each query to this golden file, e.g., to validate another database or version against (responses are kept in memory)")
+	fs.String("validate-against", "", "Compare the normalized response of each query to that in this golden file, and report the mismatched queries by query type")
+	fs.Float64("validate-tolerance", defaultValidateTolerance, "Relative difference up to which numbers of responses are deemed equal when validating against a golden file")
+	fs.Bool("worker-stats", false, "Also report the throughput and latency of each worker, their throughput skew and the slowest query type/worker combinations, e.g., to spot a stalling worker")
+	fs.Int("label-decimals", -1, "Aggregate the query types whose labels differ only in numbers with a fractional part rounded to this number of decimals, e.g., \"scale=1.01\" and \"scale=1.02\" as \"scale=1.0\" with 1 (-1 to disable)")
+	fs.Int("histogram-buckets", 0, "Also report an ASCII histogram of each query type over this number of buckets, whose edges adapt to its first latencies so each holds about as many queries (0 to disable)")
+	fs.String("report-file", "", "Also write the final stats to this file, e.g., to keep them apart from the rest of the output")
+	fs.Int("tail-samples", 0, "Report the query type and time of this many of the slowest queries, e.g., to look them up in the logs of the database (0 to disable)")
+	fs.Duration("tail-threshold", 0, "Only report the slowest queries above this latency, see --tail-samples")
+	fs.Float64("tail-percentile", 0, "Only report the slowest queries above this percentile (e.g., 99) of the queries so far, rather than above --tail-threshold, see --tail-samples")
+	fs.String("ingest-command", "", "Run this loader command line (e.g., \"tsbs_load_timescaledb --file=data.txt --workers=2\") during the run, and report the latency of its inserts apart from that of the queries: the ratio of writers to readers is that of its --workers to --workers")
+	fs.Duration("expected-interval", 0, "Interval at which each worker is expected to start queries (e.g., workers/max-rps), to correct latencies for coordinated omission (0 to disable, at least 1µs, or 1ns with --precise-latencies)")
 }
 
 // BenchmarkRunner contains the common components for running a query benchmarking
@@ -58,9 +150,22 @@ func (c BenchmarkRunnerConfig) AddToFlagSet(fs *pflag.FlagSet) {
 type BenchmarkRunner struct {
 	BenchmarkRunnerConfig
 	br      *bufio.Reader
+	file    *os.File // file is the file queries are read from, nil for stdin
 	sp      statProcessor
 	scanner *scanner
 	ch      chan Query
+
+	started     time.Time // started is when the run started
+	queriesRun  uint64    // queriesRun is the number of queries run so far, accessed atomically
+	busyWorkers int64     // busyWorkers is the number of workers running a query, accessed atomically
+
+	ingest func(record IngestRecorder) // ingest, if set, inserts data during the run, see RunMixed
+
+	reportFile *os.File // reportFile, if set, is also written the final stats to
+
+	validator           *validator          // validator, if set, keeps the responses of the queries, see RecordResponse
+	golden              map[uint64]Response // golden are the responses of the golden file validated against, by ID
+	validationSupported bool                // validationSupported tells whether the processors record the responses, see SupportValidation
 }
 
 // NewBenchmarkRunner creates a new instance of BenchmarkRunner which is
@@ -69,17 +174,215 @@ func NewBenchmarkRunner(config BenchmarkRunnerConfig) *BenchmarkRunner {
 	runner := &BenchmarkRunner{BenchmarkRunnerConfig: config}
 	runner.scanner = newScanner(&runner.Limit)
 	spArgs := &statProcessorArgs{
-		limit:          &runner.Limit,
-		printInterval:  runner.PrintInterval,
-		prewarmQueries: runner.PrewarmQueries,
-		burnIn:         runner.BurnIn,
-		hdrLatenciesFile: runner.HDRLatenciesFile,
+		limit:              &runner.Limit,
+		printInterval:      runner.PrintInterval,
+		prewarmQueries:     runner.PrewarmQueries,
+		burnIn:             runner.BurnIn,
+		hdrLatenciesFile:   runner.HDRLatenciesFile,
+		minSampleCount:     runner.MinSampleCount,
+		maxDuration:        runner.MaxDuration,
+		expectedInterval:   runner.ExpectedInterval,
+		preciseLatencies:   runner.PreciseLatencies,
+		runMetadata:        parseRunMetadata(runner.RunMetadata),
+		logSpaceStats:      runner.LogSpaceStats,
+		checkpointFile:     runner.CheckpointFile,
+		checkpointInterval: runner.CheckpointInterval,
+		resumeCheckpoint:   runner.ResumeCheckpoint,
+		throughputCSVFile:  runner.ThroughputCSVFile,
+		stallFraction:      runner.StallFraction,
+		maxDisplayedGroups: runner.MaxDisplayedGroups,
+		labelMappingFile:   runner.LabelMappingFile,
+		resultsProtoFile:   runner.ResultsProtoFile,
+		resultsParquetFile: runner.ResultsParquetFile,
+		apdexTarget:        runner.ApdexTarget,
+		omissionInterval:   runner.OmissionInterval,
+		absoluteDeviations: runner.AbsoluteDeviations,
+		recentWindowSize:   runner.RecentWindowSize,
+		outlierThreshold:   runner.OutlierThreshold,
+		latencyKnee:        runner.LatencyKnee,
+		goBenchFile:        runner.GoBenchFile,
+		intervalPeriod:     runner.IntervalPeriod,
+		liveMetrics:        len(runner.MetricsAddress) > 0,
+		targetRate:         runner.RateLimit,
+		latencyLogFile:     runner.LatencyLogFile,
+		workerStats:        runner.WorkerStats,
+		histogramBuckets:   runner.HistogramBuckets,
+	}
+	if len(runner.AnonymizeKey) > 0 {
+		spArgs.anonymizer = newLabelAnonymizer([]byte(runner.AnonymizeKey))
+	}
+	if runner.MaxDisplayedGroups > 0 {
+		metric, ok := groupMetrics[runner.DisplayOrder]
+		if !ok {
+			log.Fatalf("unknown display order %q", runner.DisplayOrder)
+		}
+		spArgs.displayMetric = metric
+	}
+	if runner.TailSamples > 0 {
+		if runner.TailPercentile > 0 {
+			spArgs.tailSampler = newPercentileTailSampler(realClock{}, runner.TailPercentile, runner.TailSamples)
+		} else {
+			spArgs.tailSampler = newThresholdTailSampler(realClock{}, float64(runner.TailThreshold)/float64(time.Millisecond), runner.TailSamples)
+		}
+	}
+	if runner.ExpectedInterval > 0 && runner.ExpectedInterval < histogramResolution(runner.PreciseLatencies) {
+		log.Fatalf("--expected-interval of %v is below the resolution of the latencies, %v", runner.ExpectedInterval, histogramResolution(runner.PreciseLatencies))
+	}
+	if runner.OmissionInterval > 0 {
+		if runner.ExpectedInterval > 0 {
+			log.Fatal("--omission-cost-interval is for latencies not corrected for coordinated omission, unlike with --expected-interval")
+		}
+		if runner.OmissionInterval < histogramResolution(runner.PreciseLatencies) {
+			log.Fatalf("--omission-cost-interval of %v is below the resolution of the latencies, %v", runner.OmissionInterval, histogramResolution(runner.PreciseLatencies))
+		}
+	}
+	if runner.Duration > 0 {
+		if len(runner.FileName) == 0 {
+			log.Fatal("--duration requires the queries to be read from a --file, to run them again")
+		}
+		if runner.MaxDuration <= 0 || runner.Duration < runner.MaxDuration {
+			spArgs.maxDuration = runner.Duration
+		}
+	}
+	if len(runner.ResultsFile) > 0 && runner.ResultsFormat != resultsFormatJSON && runner.ResultsFormat != resultsFormatCSV {
+		log.Fatalf("unknown results format %q", runner.ResultsFormat)
+	}
+	if len(runner.Coordinator) > 0 && len(runner.Worker) > 0 {
+		log.Fatal("--coordinator and --worker are exclusive, a process either coordinates a distributed run or is one of its workers")
+	}
+	if runner.RateLimit > 0 && runner.LimitRPS > 0 {
+		log.Fatal("--rate-limit and --max-rps both limit the rate of queries, set only one")
+	}
+	if runner.LabelDecimals >= 0 {
+		spArgs.canonicalizeLabel = RoundLabelNumbers(runner.LabelDecimals)
+	}
+	if runner.HistogramBuckets < 0 {
+		log.Fatalf("--histogram-buckets of %d is negative", runner.HistogramBuckets)
+	}
+	if len(runner.ThroughputCSVFile) > 0 || runner.StallFraction > 0 || runner.LatencyKnee || runner.RateLimit > 0 {
+		spArgs.windowWidth = time.Second
+	}
+
+	if len(runner.ReportFile) > 0 {
+		f, err := os.Create(runner.ReportFile)
+		if err != nil {
+			log.Fatalf("cannot create the report file: %v", err)
+		}
+		runner.reportFile = f
+		spArgs.reportSinks = []io.Writer{os.Stdout, f}
+	}
+	if len(runner.ValidateFile) > 0 || len(runner.ValidateAgainst) > 0 {
+		runner.validator = newValidator()
+	}
+	if len(runner.ValidateAgainst) > 0 {
+		golden, err := readGoldenFile(runner.ValidateAgainst)
+		if err != nil {
+			log.Fatalf("cannot read the golden file: %v", err)
+		}
+		runner.golden = golden
+	}
+	if len(runner.IngestCommand) > 0 {
+		runner.ingest = commandIngest(runner.IngestCommand, os.Stderr)
 	}
 
 	runner.sp = newStatProcessor(spArgs)
 	return runner
 }
 
+// parseRunMetadata parses key=value pairs into a map. A pair without "=" is a
+// key with an empty value.
+func parseRunMetadata(pairs []string) map[string]string {
+	metadata := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		metadata[kv[0]] = kv[1]
+	}
+	return metadata
+}
+
+// SetStatForwarder makes the runner hand the value of each query over to
+// forward instead of aggregating stats and reporting them at the end of the
+// run, for when they are analyzed by an external aggregator.
+func (b *BenchmarkRunner) SetStatForwarder(forward StatForwarder) {
+	b.sp = newPassthroughStatProcessor(b.sp.getArgs(), forward)
+}
+
+// CurrentMean returns the mean latency of the queries of label so far, in
+// milliseconds, while the benchmark is running. It is 0 when stats are not
+// aggregated (see SetStatForwarder).
+func (b *BenchmarkRunner) CurrentMean(label string) float64 {
+	if sp, ok := b.sp.(*defaultStatProcessor); ok {
+		return sp.CurrentMean(label)
+	}
+	return 0
+}
+
+// WriteThroughputCSV writes the number of queries and their mean latency per
+// second of the run as CSV, like --throughput-csv, e.g., to plot them. It is
+// meant to be called once Run returned, and returns ErrNoWindows unless the
+// run kept them (with --throughput-csv, --stall-fraction, --latency-knee or
+// --rate-limit) and stats were aggregated (see SetStatForwarder).
+func (b *BenchmarkRunner) WriteThroughputCSV(w io.Writer) error {
+	sp, ok := b.sp.(*defaultStatProcessor)
+	if !ok || sp.windows == nil {
+		return ErrNoWindows
+	}
+	return sp.windows.WriteThroughputCSV(w)
+}
+
+// Report writes the stats of the queries of each label so far with r, e.g., in
+// another format than the final stats. It writes no labels when stats are not
+// aggregated (see SetStatForwarder).
+func (b *BenchmarkRunner) Report(r *Reporter) error {
+	statGroups := map[string]*statGroup{}
+	if sp, ok := b.sp.(*defaultStatProcessor); ok {
+		exported := sp.exported()
+		exported.mappingMu.RLock()
+		statGroups = exported.queryStatGroups()
+		exported.mappingMu.RUnlock()
+	}
+	return r.report(statGroups)
+}
+
+// Pause sets aside the stats of the queries that complete from now on, until
+// Resume is called, so that an intentional disruption (e.g., a compaction
+// triggered during the run) does not skew them; they are reported separately.
+// Queries keep being run meanwhile. It has no effect when stats are not
+// aggregated (see SetStatForwarder).
+func (b *BenchmarkRunner) Pause() {
+	if sp, ok := b.sp.(*defaultStatProcessor); ok {
+		sp.Pause()
+	}
+}
+
+// Resume aggregates the stats of the queries that complete again, after Pause.
+func (b *BenchmarkRunner) Resume() {
+	if sp, ok := b.sp.(*defaultStatProcessor); ok {
+		sp.Resume()
+	}
+}
+
+// SetLabelCanonicalizer makes the runner aggregate the stats of each query
+// under the label canonicalize maps its label to, e.g., to collapse labels
+// embedding near-identical numeric parameters into one (see
+// RoundLabelNumbers). It replaces the canonicalizer set by --label-decimals.
+func (b *BenchmarkRunner) SetLabelCanonicalizer(canonicalize func(label string) string) {
+	b.sp.getArgs().canonicalizeLabel = canonicalize
+}
+
+// Result returns the result of the benchmark, once it has run. It is empty
+// when stats are not aggregated (see SetStatForwarder). Its labels are
+// anonymized if an anonymization key is set.
+func (b *BenchmarkRunner) Result() BenchmarkResult {
+	if sp, ok := b.sp.(*defaultStatProcessor); ok {
+		return sp.exported().result()
+	}
+	return BenchmarkResult{}
+}
+
 // SetLimit changes the number of queries to run, with 0 being all of them
 func (b *BenchmarkRunner) SetLimit(limit uint64) {
 	b.Limit = limit
@@ -90,6 +393,30 @@ func (b *BenchmarkRunner) DoPrintResponses() bool {
 	return b.PrintResponses
 }
 
+// SupportValidation tells that the processors of the runner pass the
+// responses of the queries to RecordResponse when DoValidate, so --validate
+// and --validate-against can be used. It is to be called before Run, which
+// fails with them otherwise, rather than reporting no mismatch for the lack
+// of any response.
+func (b *BenchmarkRunner) SupportValidation() {
+	b.validationSupported = true
+}
+
+// DoValidate indicates whether the responses of the queries should be passed
+// to RecordResponse, to validate them.
+func (b *BenchmarkRunner) DoValidate() bool {
+	return b.validator != nil
+}
+
+// RecordResponse keeps the response of q, made of rows, see NewResponse, to
+// write it to the golden file or compare it to that of the golden file at the
+// end of the run. It is safe for concurrent use by the processors.
+func (b *BenchmarkRunner) RecordResponse(q Query, rows [][]interface{}) {
+	if b.validator != nil {
+		b.validator.record(NewResponse(q, rows))
+	}
+}
+
 // DebugLevel returns the level of debug messages for this benchmark
 func (b *BenchmarkRunner) DebugLevel() int {
 	return b.Debug
@@ -121,6 +448,7 @@ func (b *BenchmarkRunner) GetBufferedReader() *bufio.Reader {
 			if err != nil {
 				panic(fmt.Sprintf("cannot open file for read %s: %v", b.FileName, err))
 			}
+			b.file = file
 			b.br = bufio.NewReaderSize(file, defaultReadSize)
 		} else {
 			// Read from STDIN
@@ -130,6 +458,30 @@ func (b *BenchmarkRunner) GetBufferedReader() *bufio.Reader {
 	return b.br
 }
 
+// rewind makes the queries be read from the start of the file again.
+func (b *BenchmarkRunner) rewind() {
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		log.Fatalf("cannot rewind %s: %v", b.FileName, err)
+	}
+	b.br.Reset(b.file)
+}
+
+// IngestRecorder records that inserting a batch of data took took, under
+// label. It is safe for concurrent use.
+type IngestRecorder func(label string, took time.Duration)
+
+// RunMixed runs the benchmark like Run while ingest inserts data into the same
+// target, to measure how inserts and queries interfere: ingest is typically a
+// load.BenchmarkRunner run whose batch observer calls record (--ingest-command
+// runs a loader command for it). The latencies
+// recorded are reported apart from those of the queries. The ratio of writers
+// to readers is that of the workers of the loader to Workers. The run lasts
+// until both the queries and ingest are done.
+func (b *BenchmarkRunner) RunMixed(queryPool *sync.Pool, processorCreateFn ProcessorCreate, ingest func(record IngestRecorder)) {
+	b.ingest = ingest
+	b.Run(queryPool, processorCreateFn)
+}
+
 // Run does the bulk of the benchmark execution.
 // It launches a gorountine to track stats, creates workers to process queries,
 // read in the input, execute the queries, and then does cleanup.
@@ -142,12 +494,37 @@ func (b *BenchmarkRunner) Run(queryPool *sync.Pool, processorCreateFn ProcessorC
 	if spArgs.burnIn > b.Limit {
 		panic("burn-in is larger than limit")
 	}
+	if b.validator != nil && !b.validationSupported {
+		log.Fatal("--validate and --validate-against are not supported by the query runner of this database, which does not record the responses")
+	}
+	if len(b.Coordinator) > 0 {
+		b.coordinate()
+		b.closeReportFile()
+		return
+	}
 	b.ch = make(chan Query, b.Workers)
 
+	// Wait for the shard of the queries to run, as a worker of a distributed run:
+	var worker *distributedWorker
+	if len(b.Worker) > 0 {
+		worker = newDistributedWorker(b.Workers)
+		go worker.serve(b.Worker)
+		log.Printf("waiting for the coordinator to assign a shard of the queries on %s", b.Worker)
+		a := <-worker.assignments
+		b.scanner.setShard(a.Shard, a.Shards)
+	}
+
 	// Launch the stats processor:
+	b.started = time.Now()
 	go b.sp.process(b.Workers)
+	if len(b.MetricsAddress) > 0 {
+		go func() { log.Fatal(utils.ServePrometheusMetrics(b.MetricsAddress, b.writeMetrics)) }()
+	}
 
 	rateLimiter := getRateLimiter(b.LimitRPS,b.Workers)
+	if b.RateLimit > 0 {
+		rateLimiter = getPacer(b.RateLimit, b.Workers)
+	}
 
 	// Launch query processors
 	var wg sync.WaitGroup
@@ -156,15 +533,43 @@ func (b *BenchmarkRunner) Run(queryPool *sync.Pool, processorCreateFn ProcessorC
 		go b.processorHandler(&wg, rateLimiter, queryPool, processorCreateFn(), i)
 	}
 
+	// Launch the inserts of a mixed run:
+	var ingestWg sync.WaitGroup
+	if b.ingest != nil {
+		ingestWg.Add(1)
+		go func() {
+			defer ingestWg.Done()
+			b.ingest(b.recordIngest)
+		}()
+	}
+
 	// Read in jobs, closing the job channel when done:
 	// Wall clock start time
 	wallStart := time.Now()
-	b.scanner.setReader(b.GetBufferedReader()).scan(queryPool, b.ch)
+	b.scanner.setReader(b.GetBufferedReader()).setStop(b.sp.budgetExhausted())
+	if b.ResumeCheckpoint {
+		// the queries processed before the restart are not run again
+		processed, err := checkpointProcessed(b.CheckpointFile)
+		if err != nil {
+			log.Fatalf("cannot resume from checkpoint %s: %v", b.CheckpointFile, err)
+		}
+		b.scanner.setSkip(processed)
+	}
+	for {
+		read := b.scanner.n
+		if !b.scanner.scan(queryPool, b.ch) || b.Duration <= 0 || b.scanner.n == read {
+			break
+		}
+		// run the queries again until the duration of the run is up
+		b.rewind()
+	}
 	close(b.ch)
 
 	// Block for workers to finish sending requests, closing the stats channel when done:
 	wg.Wait()
+	ingestWg.Wait()
 	b.sp.CloseAndWait()
+	b.closeReportFile()
 
 	// Wall clock end time
 	wallEnd := time.Now()
@@ -174,6 +579,15 @@ func (b *BenchmarkRunner) Run(queryPool *sync.Pool, processorCreateFn ProcessorC
 		log.Fatal(err)
 	}
 
+	if len(b.ResultsFile) > 0 {
+		b.writeResultsFile(wallTook)
+	}
+	mismatched := b.validate()
+	if worker != nil {
+		worker.results <- b.shardStats()
+		<-worker.sent
+	}
+
 	// (Optional) create a memory profile:
 	if len(b.MemProfile) > 0 {
 		f, err := os.Create(b.MemProfile)
@@ -183,6 +597,83 @@ func (b *BenchmarkRunner) Run(queryPool *sync.Pool, processorCreateFn ProcessorC
 		pprof.WriteHeapProfile(f)
 		f.Close()
 	}
+	if mismatched > 0 {
+		log.Fatalf("validation failed: %d queries mismatched the golden file", mismatched)
+	}
+}
+
+// validate writes the responses of the queries of the run to the golden file
+// and reports how they compare to those of the golden file validated against,
+// if set, returning the number of mismatched queries.
+func (b *BenchmarkRunner) validate() int {
+	if b.validator == nil {
+		return 0
+	}
+	responses := b.validator.all()
+	if len(b.ValidateFile) > 0 {
+		_, _ = fmt.Printf("Saving the responses to %s\n", b.ValidateFile)
+		f, err := os.Create(b.ValidateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = WriteResponses(f, responses); err != nil {
+			log.Fatal(err)
+		}
+		if err = f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(b.ValidateAgainst) == 0 {
+		return 0
+	}
+	v := validate(responses, b.golden, b.ValidateTolerance)
+	if err := v.write(os.Stdout, b.ValidateAgainst, b.sp.getArgs().anonymizer); err != nil {
+		log.Fatal(err)
+	}
+	return v.mismatched()
+}
+
+// closeReportFile closes the report file, if any, once the final stats are
+// written to it.
+func (b *BenchmarkRunner) closeReportFile() {
+	if b.reportFile == nil {
+		return
+	}
+	if err := b.reportFile.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeResultsFile writes the stats of the run that took wallTook to the
+// results file, with the values of the command line flags.
+func (b *BenchmarkRunner) writeResultsFile(wallTook time.Duration) {
+	sp, ok := b.sp.(*defaultStatProcessor)
+	if !ok {
+		// stats were forwarded rather than aggregated, there are none to write
+		sp = newStatProcessor(b.sp.getArgs()).(*defaultStatProcessor)
+		sp.initStatMappings()
+	}
+	_, _ = fmt.Printf("Saving the results to %s\n", b.ResultsFile)
+	f, err := os.Create(b.ResultsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = sp.exported().writeResults(f, b.ResultsFormat, b.Workers, wallTook, utils.FlagValues(pflag.CommandLine))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// recordIngest sends the latency of inserting a batch of data, under label, to
+// the stat processor.
+func (b *BenchmarkRunner) recordIngest(label string, took time.Duration) {
+	stat := GetStat().Init([]byte(label), float64(took.Nanoseconds())/1e6)
+	stat.isIngest = true
+	b.sp.send([]*Stat{stat})
 }
 
 func (b *BenchmarkRunner) processorHandler(wg *sync.WaitGroup, rateLimiter *rate.Limiter, queryPool *sync.Pool, processor Processor, workerNum int) {
@@ -191,10 +682,11 @@ func (b *BenchmarkRunner) processorHandler(wg *sync.WaitGroup, rateLimiter *rate
 		r := rateLimiter.Reserve()
 		time.Sleep(r.Delay())
 
-		stats, err := processor.ProcessQuery(query, false)
+		stats, err := b.processQuery(processor, query, false)
 		if err != nil {
 			panic(err)
 		}
+		setWorker(stats, workerNum)
 		b.sp.send(stats)
 
 		// If PrewarmQueries is set, we run the query as 'cold' first (see above),
@@ -203,10 +695,11 @@ func (b *BenchmarkRunner) processorHandler(wg *sync.WaitGroup, rateLimiter *rate
 		spArgs := b.sp.getArgs()
 		if spArgs.prewarmQueries {
 			// Warm run
-			stats, err = processor.ProcessQuery(query, true)
+			stats, err = b.processQuery(processor, query, true)
 			if err != nil {
 				panic(err)
 			}
+			setWorker(stats, workerNum)
 			b.sp.sendWarm(stats)
 		}
 		queryPool.Put(query)
@@ -214,6 +707,22 @@ func (b *BenchmarkRunner) processorHandler(wg *sync.WaitGroup, rateLimiter *rate
 	wg.Done()
 }
 
+// processQuery runs query with processor, keeping track of the workers running
+// a query and of the number of queries run.
+func (b *BenchmarkRunner) processQuery(processor Processor, query Query, isWarm bool) ([]*Stat, error) {
+	atomic.AddInt64(&b.busyWorkers, 1)
+	defer atomic.AddInt64(&b.busyWorkers, -1)
+	defer atomic.AddUint64(&b.queriesRun, 1)
+	return processor.ProcessQuery(query, isWarm)
+}
+
+// setWorker records that stats are of a query run by the worker numbered worker.
+func setWorker(stats []*Stat, worker int) {
+	for _, s := range stats {
+		s.worker = worker
+	}
+}
+
 func getRateLimiter(limitRPS uint64, workers uint) *rate.Limiter {
 	var requestRate = rate.Inf
 	var requestBurst = 0
@@ -223,3 +732,9 @@ func getRateLimiter(limitRPS uint64, workers uint) *rate.Limiter {
 	}
 	return rate.NewLimiter(requestRate, requestBurst)
 }
+
+// getPacer returns a token bucket shared by the workers that offers queries at
+// ratePerSec, allowing at most one query per worker to start at once.
+func getPacer(ratePerSec float64, workers uint) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(ratePerSec), int(workers))
+}
@@ -2,13 +2,16 @@ package query
 
 import (
 	"golang.org/x/time/rate"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type testProcessor struct {
@@ -295,6 +298,83 @@ func TestBenchmarkRunnerRunNoQueries(t *testing.T) {
 	}
 }
 
+func TestBenchmarkRunnerReportFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reportFile := filepath.Join(dir, "report.txt")
+
+	b := NewBenchmarkRunner(BenchmarkRunnerConfig{Workers: 1, ReportFile: reportFile})
+	sinks := b.sp.getArgs().reportSinks
+	if len(sinks) != 2 || sinks[0] != os.Stdout {
+		t.Fatalf("incorrect report sinks: got %v, want stdout and the report file", sinks)
+	}
+	writeToSinks(sinks[1:], func(w io.Writer) error {
+		_, err := io.WriteString(w, "Run complete\n")
+		return err
+	})
+	b.closeReportFile()
+
+	report, err := ioutil.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(report) != "Run complete\n" {
+		t.Errorf("incorrect report file: got %q", report)
+	}
+}
+
+func TestBenchmarkRunnerRunMixed(t *testing.T) {
+	fakeQueriesFile, err := ioutil.TempFile("", "fake_queries*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fakeQueriesFile.Name())
+
+	var ingestStats []*Stat
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	sp := mockStatProcessor{
+		args: &statProcessorArgs{},
+		onSend: func(stats []*Stat) {
+			lock.Lock()
+			ingestStats = append(ingestStats, stats...)
+			lock.Unlock()
+		},
+		wg: wg,
+	}
+	limit := uint64(0)
+	b := &BenchmarkRunner{
+		BenchmarkRunnerConfig: BenchmarkRunnerConfig{
+			Workers:  1,
+			FileName: fakeQueriesFile.Name(),
+		},
+		sp:      &sp,
+		scanner: newScanner(&limit),
+	}
+
+	wg.Add(1)
+	b.RunMixed(&TimescaleDBPool, func() Processor { return &mockProcessor{} }, func(record IngestRecorder) {
+		record("insert", 2*time.Millisecond)
+		record("insert", 4*time.Millisecond)
+	})
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(ingestStats) != 2 {
+		t.Fatalf("got %d stats sent, want the 2 recorded while ingesting", len(ingestStats))
+	}
+	for i, want := range []float64{2.0, 4.0} {
+		s := ingestStats[i]
+		if !s.isIngest || string(s.label) != "insert" || s.value != want {
+			t.Errorf("stat %d: got label %s value %f ingest %v, want insert %f true", i, s.label, s.value, s.isIngest, want)
+		}
+	}
+}
+
 type mockStatProcessor struct {
 	args      *statProcessorArgs
 	onSend    func([]*Stat)
@@ -325,6 +405,9 @@ func (m *mockStatProcessor) CloseAndWait() {
 	m.closed = true
 	m.wg.Done()
 }
+func (m *mockStatProcessor) budgetExhausted() <-chan struct{} {
+	return nil
+}
 
 type mockProcessor struct {
 	processRes []*Stat
@@ -0,0 +1,16 @@
+package query
+
+import "time"
+
+// Clock is the source of time used when collecting stats, so that time-based
+// behavior can be controlled, e.g., in tests.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+}
+
+// realClock is a Clock that tells the system time.
+type realClock struct{}
+
+// Now returns the current system time
+func (realClock) Now() time.Time { return time.Now() }
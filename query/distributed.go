@@ -0,0 +1,191 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// runPath is the path of the HTTP endpoint the workers of a distributed run
+// are assigned their shard of the queries at, answering with their stats.
+const runPath = "/run"
+
+// workersHeader is the HTTP header a worker of a distributed run tells the
+// number of its concurrent clients in.
+const workersHeader = "X-Tsbs-Workers"
+
+// shardAssignment is the part of the queries the coordinator of a distributed
+// run asks a worker to run: those whose index in the input modulo Shards is
+// Shard.
+type shardAssignment struct {
+	Shard  uint64 `json:"shard"`
+	Shards uint64 `json:"shards"`
+}
+
+// distributedWorker waits for the coordinator of a distributed run to assign
+// it a shard, then answers it with the stats of the shard once run.
+type distributedWorker struct {
+	assignments chan shardAssignment       // assignments receives the one shard to run
+	results     chan map[string]*statGroup // results receives the stats of the shard once run
+	workers     uint                       // workers is the number of concurrent clients running the shard
+	sent        chan struct{}              // sent is closed once the stats are sent to the coordinator
+	sentOnce    sync.Once
+}
+
+// newDistributedWorker returns a distributedWorker running its shard with
+// workers concurrent clients.
+func newDistributedWorker(workers uint) *distributedWorker {
+	return &distributedWorker{
+		assignments: make(chan shardAssignment, 1),
+		results:     make(chan map[string]*statGroup, 1),
+		workers:     workers,
+		sent:        make(chan struct{}),
+	}
+}
+
+// serve serves the run endpoint on address until the process exits.
+func (dw *distributedWorker) serve(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(runPath, dw.handleRun)
+	log.Fatal(http.ListenAndServe(address, mux))
+}
+
+// handleRun accepts the first valid shard assignment, and answers it with the
+// stats of the shard in binary form (see writeStatGroupMapBinary) once run.
+func (dw *distributedWorker) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "the shard to run must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var a shardAssignment
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil || a.Shards == 0 || a.Shard >= a.Shards {
+		http.Error(w, "invalid shard assignment", http.StatusBadRequest)
+		return
+	}
+	select {
+	case dw.assignments <- a:
+	default:
+		http.Error(w, "a shard is already assigned", http.StatusConflict)
+		return
+	}
+
+	statGroups := <-dw.results
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(workersHeader, strconv.FormatUint(uint64(dw.workers), 10))
+	if err := writeStatGroupMapBinary(w, statGroups); err != nil {
+		log.Printf("cannot send the stats to the coordinator: %v", err)
+	}
+	dw.sentOnce.Do(func() { close(dw.sent) })
+}
+
+// runShards assigns each worker of a distributed run at addresses its shard of
+// the queries, and merges the stats they answer with, label by label, once
+// they have all run. It also returns the total number of concurrent clients
+// of the workers.
+func runShards(client *http.Client, addresses []string) (map[string]*statGroup, uint, error) {
+	type shardResult struct {
+		statGroups map[string]*statGroup
+		workers    uint
+		err        error
+	}
+	results := make([]shardResult, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			r := &results[i]
+			r.statGroups, r.workers, r.err = runShard(client, address, shardAssignment{Shard: uint64(i), Shards: uint64(len(addresses))})
+		}(i, address)
+	}
+	wg.Wait()
+
+	merged := map[string]*statGroup{}
+	workers := uint(0)
+	for i, r := range results {
+		if r.err != nil {
+			return nil, 0, fmt.Errorf("worker %s: %v", addresses[i], r.err)
+		}
+		mergeStatGroupMaps(merged, r.statGroups, "the stats of worker "+addresses[i])
+		workers += r.workers
+	}
+	return merged, workers, nil
+}
+
+// runShard has the worker at address run the shard a, and returns its stats
+// and number of concurrent clients.
+func runShard(client *http.Client, address string, a shardAssignment) (map[string]*statGroup, uint, error) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Post("http://"+address+runPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	workers, err := strconv.ParseUint(resp.Header.Get(workersHeader), 10, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid number of workers: %v", err)
+	}
+	statGroups, err := readStatGroupMapBinary(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return statGroups, uint(workers), nil
+}
+
+// shardStats returns the stats of the complete results of the shard run by the
+// worker of a distributed run, as labelled in the outputs.
+func (b *BenchmarkRunner) shardStats() map[string]*statGroup {
+	sp, ok := b.sp.(*defaultStatProcessor)
+	if !ok {
+		// stats were forwarded rather than aggregated, there are none to send
+		return map[string]*statGroup{}
+	}
+	return sp.exported().statMapping
+}
+
+// coordinate has the workers of a distributed run each run a shard of the
+// queries, then reports their merged stats as the final stats of the run, and
+// saves them to the results file if asked to.
+func (b *BenchmarkRunner) coordinate() {
+	wallStart := time.Now()
+	statGroups, workers, err := runShards(http.DefaultClient, b.Coordinator)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wallTook := time.Since(wallStart)
+
+	sp := newStatProcessor(b.sp.getArgs()).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for k, sg := range statGroups {
+		sp.statMapping[k] = sg
+	}
+	b.sp = sp
+	queries := uint64(sp.statMapping[labelAllQueries].count)
+	sinks := sp.args.reportSinks
+	if len(sinks) == 0 {
+		sinks = []io.Writer{os.Stdout}
+	}
+	writeToSinks(sinks, func(w io.Writer) error {
+		return sp.writeReport(w, queries, workers, float64(queries)/wallTook.Seconds())
+	})
+	_, err = fmt.Printf("wall clock time: %fsec\n", float64(wallTook.Nanoseconds())/1e9)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(b.ResultsFile) > 0 {
+		b.writeResultsFile(wallTook)
+	}
+}
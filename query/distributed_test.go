@@ -0,0 +1,84 @@
+package query
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunShards(t *testing.T) {
+	var addresses []string
+	for i, workers := range []uint{2, 3} {
+		dw := newDistributedWorker(workers)
+		server := httptest.NewServer(http.HandlerFunc(dw.handleRun))
+		defer server.Close()
+		addresses = append(addresses, strings.TrimPrefix(server.URL, "http://"))
+
+		go func(i int, dw *distributedWorker) {
+			a := <-dw.assignments
+			if a.Shard != uint64(i) || a.Shards != 2 {
+				t.Errorf("worker %d: incorrect shard: got %d of %d", i, a.Shard, a.Shards)
+			}
+			sg := newStatGroup(0)
+			for j := 0; j <= i; j++ {
+				sg.push(float64(10 * (j + 1)))
+			}
+			dw.results <- map[string]*statGroup{"foo": sg}
+		}(i, dw)
+	}
+
+	statGroups, workers, err := runShards(http.DefaultClient, addresses)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if workers != 5 {
+		t.Errorf("incorrect number of workers: got %d want %d", workers, 5)
+	}
+	sg := statGroups["foo"]
+	if sg == nil || sg.count != 3 || sg.sum != 40 || sg.Max() < 19.9 || sg.Max() > 20.1 {
+		t.Errorf("incorrect merged stats: %v", statGroups)
+	}
+}
+
+func TestDistributedWorkerHandleRun(t *testing.T) {
+	dw := newDistributedWorker(1)
+	server := httptest.NewServer(http.HandlerFunc(dw.handleRun))
+	defer server.Close()
+
+	cases := []struct {
+		desc   string
+		method string
+		body   string
+		want   int
+	}{
+		{desc: "not posted", method: http.MethodGet, want: http.StatusMethodNotAllowed},
+		{desc: "not JSON", method: http.MethodPost, body: "shard 1", want: http.StatusBadRequest},
+		{desc: "shard out of range", method: http.MethodPost, body: `{"shard": 2, "shards": 2}`, want: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, server.URL+runPath, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: incorrect status: got %d want %d", c.desc, resp.StatusCode, c.want)
+		}
+	}
+
+	// a shard is only assigned once
+	dw.assignments <- shardAssignment{Shard: 0, Shards: 1}
+	resp, err := http.Post(server.URL+runPath, "application/json", strings.NewReader(`{"shard": 0, "shards": 1}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("incorrect status of a second assignment: got %d want %d", resp.StatusCode, http.StatusConflict)
+	}
+}
@@ -0,0 +1,56 @@
+package query
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// ingestLabel is the label the inserts of --ingest-command are reported under.
+const ingestLabel = "insert"
+
+// commandIngest returns an ingest function for RunMixed running the loader
+// command line command, with --print-batch-latencies so it prints the latency
+// of each of its batches for them to be recorded. The rest of the output of
+// the loader, on stdout or stderr, is written to out.
+func commandIngest(command string, out io.Writer) func(record IngestRecorder) {
+	return func(record IngestRecorder) {
+		cmd := exec.Command("sh", "-c", command+" --print-batch-latencies")
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Fatalf("cannot run the ingest command: %v", err)
+		}
+		// its stderr goes to the same pipe, for out to be written by one goroutine
+		cmd.Stderr = cmd.Stdout
+		if err := cmd.Start(); err != nil {
+			log.Fatalf("cannot run the ingest command: %v", err)
+		}
+		if err := recordIngestOutput(stdout, out, record); err != nil {
+			log.Printf("cannot read the output of the ingest command: %v", err)
+		}
+		if err := cmd.Wait(); err != nil {
+			log.Printf("ingest command failed: %v", err)
+		}
+	}
+}
+
+// recordIngestOutput records the batch latencies printed by a loader to r,
+// and copies its other lines to out.
+func recordIngestOutput(r io.Reader, out io.Writer, record IngestRecorder) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if took, ok := utils.ParseBatchLatency(line); ok {
+			record(ingestLabel, took)
+			continue
+		}
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,50 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordIngestOutput(t *testing.T) {
+	var took []time.Duration
+	record := func(label string, d time.Duration) {
+		if label != ingestLabel {
+			t.Errorf("incorrect label: got %s want %s", label, ingestLabel)
+		}
+		took = append(took, d)
+	}
+	in := "time,per. metric/s\nbatch-latency,2.000000,10,1\nbatch-latency,4.500000,10,1\nloaded 20 metrics\n"
+	var out bytes.Buffer
+	if err := recordIngestOutput(strings.NewReader(in), &out, record); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(took) != 2 || took[0] != 2*time.Millisecond || took[1] != 4500*time.Microsecond {
+		t.Errorf("incorrect latencies recorded: got %v want [2ms 4.5ms]", took)
+	}
+	if got, want := out.String(), "time,per. metric/s\nloaded 20 metrics\n"; got != want {
+		t.Errorf("incorrect output copied: got %q want %q", got, want)
+	}
+}
+
+func TestCommandIngest(t *testing.T) {
+	var took []time.Duration
+	lock := &sync.Mutex{}
+	record := func(label string, d time.Duration) {
+		lock.Lock()
+		took = append(took, d)
+		lock.Unlock()
+	}
+	// the --print-batch-latencies appended to the loader command line goes to
+	// the echo, which prints it
+	var out bytes.Buffer
+	commandIngest("echo batch-latency,3.000000,5,5; echo loaded", &out)(record)
+	if len(took) != 1 || took[0] != 3*time.Millisecond {
+		t.Errorf("incorrect latencies recorded: got %v want [3ms]", took)
+	}
+	if got, want := out.String(), "loaded --print-batch-latencies\n"; got != want {
+		t.Errorf("incorrect output copied: got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package query
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// writeMetrics writes the live metrics of the run at now in the Prometheus
+// text format: the number of queries run and their mean rate, the number of
+// workers running a query, and the latency quantiles of each label over the
+// latest complete window of liveStatsWindow, in seconds. Labels are replaced
+// by their hashes if asked to anonymize them.
+func (b *BenchmarkRunner) writeMetrics(w io.Writer, now time.Time) error {
+	queries := atomic.LoadUint64(&b.queriesRun)
+	rate := 0.0
+	if elapsed := now.Sub(b.started).Seconds(); elapsed > 0 {
+		rate = float64(queries) / elapsed
+	}
+	metrics := []utils.PrometheusMetric{
+		{
+			Name:    "tsbs_queries_total",
+			Help:    "Number of queries run, counting the warm runs of prewarmed queries.",
+			Type:    utils.PrometheusCounter,
+			Samples: []utils.PrometheusSample{{Value: float64(queries)}},
+		},
+		{
+			Name:    "tsbs_queries_per_second",
+			Help:    "Mean rate of queries since the start of the run.",
+			Type:    utils.PrometheusGauge,
+			Samples: []utils.PrometheusSample{{Value: rate}},
+		},
+		{
+			Name:    "tsbs_workers",
+			Help:    "Number of workers running queries.",
+			Type:    utils.PrometheusGauge,
+			Samples: []utils.PrometheusSample{{Value: float64(b.Workers)}},
+		},
+		{
+			Name:    "tsbs_workers_busy",
+			Help:    "Number of workers running a query.",
+			Type:    utils.PrometheusGauge,
+			Samples: []utils.PrometheusSample{{Value: float64(atomic.LoadInt64(&b.busyWorkers))}},
+		},
+	}
+	if sp, ok := b.sp.(*defaultStatProcessor); ok {
+		sp.mappingMu.RLock()
+		live := sp.live
+		sp.mappingMu.RUnlock()
+		if live != nil {
+			metrics = append(metrics, latencyMetric(live.latest(), sp.args.anonymizer))
+		}
+	}
+	return utils.WritePrometheusMetrics(w, metrics)
+}
+
+// latencyMetric returns the summary of the latencies of statGroups, in
+// seconds, by label, ordered by label.
+func latencyMetric(statGroups map[string]*statGroup, anonymizer *labelAnonymizer) utils.PrometheusMetric {
+	m := utils.PrometheusMetric{
+		Name: "tsbs_query_latency_seconds",
+		Help: "Latency of the complete queries over the latest " + liveStatsWindow.String() + " window.",
+		Type: utils.PrometheusSummary,
+	}
+	keys, _ := labelsAndMaxLength(statGroups)
+	sort.Strings(keys)
+	for _, k := range keys {
+		sg := statGroups[k]
+		label := k
+		if anonymizer != nil {
+			label = anonymizer.anonymize(k)
+		}
+		for _, p := range reportedPercentiles {
+			m.Samples = append(m.Samples, utils.PrometheusSample{
+				Labels: map[string]string{"label": label, "quantile": strconv.FormatFloat(p/100, 'f', -1, 64)},
+				Value:  sg.Percentile(p) / 1e3,
+			})
+		}
+		m.Samples = append(m.Samples,
+			utils.PrometheusSample{Suffix: "_sum", Labels: map[string]string{"label": label}, Value: sg.sum / 1e3},
+			utils.PrometheusSample{Suffix: "_count", Labels: map[string]string{"label": label}, Value: float64(sg.count)},
+		)
+	}
+	return m
+}
@@ -0,0 +1,47 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkRunnerWriteMetrics(t *testing.T) {
+	anonymizer := newLabelAnonymizer([]byte("key"))
+	limit := uint64(0)
+	sp := &defaultStatProcessor{args: &statProcessorArgs{limit: &limit, anonymizer: anonymizer}}
+	clock := newFakeClock()
+	sp.live = newLiveStats(clock, time.Second)
+	for _, v := range []float64{10, 20, 30} {
+		if err := sp.live.push("secret label", v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	clock.advance(time.Second)
+
+	b := &BenchmarkRunner{sp: sp, started: time.Now(), queriesRun: 30, busyWorkers: 2}
+	b.Workers = 3
+	var buf bytes.Buffer
+	if err := b.writeMetrics(&buf, b.started.Add(10*time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := buf.String()
+	label := anonymizer.anonymize("secret label")
+	for _, want := range []string{
+		"# TYPE tsbs_queries_total counter\ntsbs_queries_total 30\n",
+		"tsbs_queries_per_second 3\n",
+		"tsbs_workers 3\n",
+		"tsbs_workers_busy 2\n",
+		"# TYPE tsbs_query_latency_seconds summary\n",
+		`tsbs_query_latency_seconds_count{label="` + label + `"} 3` + "\n",
+		`tsbs_query_latency_seconds{label="` + label + `",quantile="0.5"} 0.02`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in metrics:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "secret label") {
+		t.Errorf("metrics leak the label:\n%s", got)
+	}
+}
@@ -0,0 +1,53 @@
+// Package otelmeter adapts an OpenTelemetry meter to the query.Meter of the
+// histogram forwarder, so the latencies of the queries of a benchmark flow
+// into an OpenTelemetry metrics pipeline (e.g., OTLP):
+//
+//	forward, err := query.NewHistogramForwarder(ctx, otelmeter.NewMeter(provider.Meter("tsbs")))
+//	...
+//	runner.SetStatForwarder(forward)
+//
+// It is a module of its own, so the benchmark programs do not depend on
+// OpenTelemetry.
+package otelmeter
+
+import (
+	"context"
+
+	"github.com/timescale/tsbs/query"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// meter is a query.Meter creating OpenTelemetry histograms.
+type meter struct {
+	m metric.Meter
+}
+
+// NewMeter returns a query.Meter creating its histogram instruments with m.
+func NewMeter(m metric.Meter) query.Meter {
+	return meter{m: m}
+}
+
+// Float64Histogram creates an OpenTelemetry histogram of name, in unit.
+func (m meter) Float64Histogram(name, unit, description string) (query.Float64Histogram, error) {
+	h, err := m.m.Float64Histogram(name, metric.WithUnit(unit), metric.WithDescription(description))
+	if err != nil {
+		return nil, err
+	}
+	return histogram{h: h}, nil
+}
+
+// histogram is a query.Float64Histogram recording into an OpenTelemetry
+// histogram.
+type histogram struct {
+	h metric.Float64Histogram
+}
+
+// Record records value with attributes as string attributes.
+func (h histogram) Record(ctx context.Context, value float64, attributes map[string]string) {
+	kvs := make([]attribute.KeyValue, 0, len(attributes))
+	for k, v := range attributes {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	h.h.Record(ctx, value, metric.WithAttributes(kvs...))
+}
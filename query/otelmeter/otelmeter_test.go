@@ -0,0 +1,66 @@
+package otelmeter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/timescale/tsbs/query"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestHistogramForwarder(t *testing.T) {
+	ctx := context.Background()
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	forward, err := query.NewHistogramForwarder(ctx, NewMeter(provider.Meter("tsbs")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	forward([]byte("foo"), 2.5, false, false)
+	forward([]byte("foo"), 3.5, false, false)
+	forward([]byte("bar"), 7.0, true, true)
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rm.ScopeMetrics) != 1 || len(rm.ScopeMetrics[0].Metrics) != 1 {
+		t.Fatalf("incorrect metrics collected: got %+v want one histogram", rm.ScopeMetrics)
+	}
+	m := rm.ScopeMetrics[0].Metrics[0]
+	if m.Name != "tsbs.query.latency" || m.Unit != "ms" {
+		t.Errorf("incorrect instrument: got %s in %s", m.Name, m.Unit)
+	}
+	data, ok := m.Data.(metricdata.Histogram[float64])
+	if !ok {
+		t.Fatalf("incorrect data: got %T want a histogram of float64", m.Data)
+	}
+	if len(data.DataPoints) != 2 {
+		t.Fatalf("incorrect number of data points: got %d want %d", len(data.DataPoints), 2)
+	}
+
+	want := map[string]struct {
+		count         uint64
+		sum           float64
+		warm, partial string
+	}{
+		"foo": {2, 6.0, "false", "false"},
+		"bar": {1, 7.0, "true", "true"},
+	}
+	for _, dp := range data.DataPoints {
+		label, _ := dp.Attributes.Value(attribute.Key("label"))
+		w, ok := want[label.AsString()]
+		if !ok {
+			t.Errorf("unexpected label %q", label.AsString())
+			continue
+		}
+		warm, _ := dp.Attributes.Value(attribute.Key("warm"))
+		partial, _ := dp.Attributes.Value(attribute.Key("partial"))
+		if dp.Count != w.count || dp.Sum != w.sum || warm.AsString() != w.warm || partial.AsString() != w.partial {
+			t.Errorf("%s: incorrect data point: got count %d sum %f warm %s partial %s, want %d %f %s %s",
+				label.AsString(), dp.Count, dp.Sum, warm.AsString(), partial.AsString(), w.count, w.sum, w.warm, w.partial)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package query
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ErrInvalidProto is returned when decoding bytes that are not a valid
+// protobuf encoding of the expected message.
+var ErrInvalidProto = errors.New("stats: invalid protobuf encoding")
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoEncoder appends fields in the protobuf wire format to buf. Fields with
+// the default (zero) value are left out, as in proto3.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.buf = append(e.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.varint(uint64(field<<3 | wireType))
+}
+
+func (e *protoEncoder) int64Field(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.varint(uint64(v))
+}
+
+func (e *protoEncoder) doubleField(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *protoEncoder) bytesField(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *protoEncoder) stringField(field int, s string) {
+	e.bytesField(field, []byte(s))
+}
+
+// messageField appends an embedded message, written by encode. It is written
+// even if empty, e.g., for the elements of repeated fields.
+func (e *protoEncoder) messageField(field int, encode func(e *protoEncoder)) {
+	var m protoEncoder
+	encode(&m)
+	e.tag(field, wireBytes)
+	e.varint(uint64(len(m.buf)))
+	e.buf = append(e.buf, m.buf...)
+}
+
+// protoDecoder reads fields in the protobuf wire format from buf.
+type protoDecoder struct {
+	buf []byte
+}
+
+// decodeProto calls decodeField for each field of the message encoded in b,
+// which must consume its value.
+func decodeProto(b []byte, decodeField func(d *protoDecoder, field, wireType int) error) error {
+	d := &protoDecoder{buf: b}
+	for len(d.buf) > 0 {
+		tag, err := d.varint()
+		if err != nil {
+			return err
+		}
+		field, wireType := int(tag>>3), int(tag&7)
+		if field == 0 {
+			return ErrInvalidProto
+		}
+		if err := decodeField(d, field, wireType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *protoDecoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, ErrInvalidProto
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+// expect checks that a field has the wire type of the value it is decoded into.
+func (d *protoDecoder) expect(wireType, want int) error {
+	if wireType != want {
+		return ErrInvalidProto
+	}
+	return nil
+}
+
+func (d *protoDecoder) int64(wireType int, v *int64) error {
+	if err := d.expect(wireType, wireVarint); err != nil {
+		return err
+	}
+	u, err := d.varint()
+	*v = int64(u)
+	return err
+}
+
+func (d *protoDecoder) double(wireType int, v *float64) error {
+	if err := d.expect(wireType, wireFixed64); err != nil {
+		return err
+	}
+	if len(d.buf) < 8 {
+		return ErrInvalidProto
+	}
+	*v = math.Float64frombits(binary.LittleEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	return nil
+}
+
+func (d *protoDecoder) bytes(wireType int) ([]byte, error) {
+	if err := d.expect(wireType, wireBytes); err != nil {
+		return nil, err
+	}
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)) {
+		return nil, ErrInvalidProto
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *protoDecoder) string(wireType int, s *string) error {
+	b, err := d.bytes(wireType)
+	*s = string(b)
+	return err
+}
+
+// repeatedInt64 appends the values of a repeated integer field to vs, be it
+// packed or not.
+func (d *protoDecoder) repeatedInt64(wireType int, vs *[]int64) error {
+	if wireType == wireVarint {
+		var v int64
+		if err := d.int64(wireType, &v); err != nil {
+			return err
+		}
+		*vs = append(*vs, v)
+		return nil
+	}
+	b, err := d.bytes(wireType)
+	if err != nil {
+		return err
+	}
+	packed := &protoDecoder{buf: b}
+	for len(packed.buf) > 0 {
+		v, err := packed.varint()
+		if err != nil {
+			return err
+		}
+		*vs = append(*vs, int64(v))
+	}
+	return nil
+}
+
+// skip skips the value of a field that is not decoded.
+func (d *protoDecoder) skip(wireType int) error {
+	switch wireType {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireFixed64, wireFixed32:
+		n := 8
+		if wireType == wireFixed32 {
+			n = 4
+		}
+		if len(d.buf) < n {
+			return ErrInvalidProto
+		}
+		d.buf = d.buf[n:]
+		return nil
+	case wireBytes:
+		_, err := d.bytes(wireType)
+		return err
+	}
+	return ErrInvalidProto
+}
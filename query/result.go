@@ -0,0 +1,172 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrUnknownResultsFormat is returned when writing the results file in a
+// format other than resultsFormatJSON and resultsFormatCSV.
+var ErrUnknownResultsFormat = errors.New("stats: unknown results format")
+
+// The formats the results file can be written in.
+const (
+	resultsFormatJSON = "json"
+	resultsFormatCSV  = "csv"
+)
+
+// BenchmarkResult is the outcome of a query benchmark run, for programmatic
+// consumers: the metadata of the run, the stats of the complete and partial
+// results of each query label, and those of all the queries together.
+// Durations are in milliseconds.
+type BenchmarkResult struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Labels   []LabelResult     `json:"labels"`
+	Partial  []LabelResult     `json:"partial,omitempty"`
+	Totals   LabelResult       `json:"totals"`
+}
+
+// LabelResult holds the stats of the queries of one label.
+type LabelResult struct {
+	Label       string            `json:"label"`
+	Count       int64             `json:"count"`
+	Min         float64           `json:"min"`
+	Max         float64           `json:"max"`
+	Mean        float64           `json:"mean"`
+	StdDev      float64           `json:"stddev"`
+	Sum         float64           `json:"sum"`
+	SkewCount   int64             `json:"clock_skew_count"`
+	Percentiles []PercentilePoint `json:"percentiles"`         // Percentiles are nil (null) when Count is 0, since they are undefined
+	Histogram   []byte            `json:"histogram,omitempty"` // Histogram, if set, is the histogram of the values, as a Histogram protobuf message (see result.proto)
+}
+
+// newLabelResult returns the LabelResult of the StatGroup of label.
+func newLabelResult(label string, sg *statGroup) LabelResult {
+	lr := LabelResult{
+		Label:     label,
+		Count:     sg.count,
+		Min:       sg.Min(),
+		Max:       sg.Max(),
+		Mean:      sg.Mean(),
+		StdDev:    sg.StdDev(),
+		Sum:       sg.sum,
+		SkewCount: sg.skewCount,
+	}
+	if sg.count > 0 {
+		lr.Percentiles = sg.ExportPercentileCurve(reportedPercentiles...)
+	}
+	return lr
+}
+
+// labelResults returns the LabelResults of the StatGroups, ordered by label.
+func labelResults(statGroups map[string]*statGroup) []LabelResult {
+	keys, _ := labelsAndMaxLength(statGroups)
+	sort.Strings(keys)
+	results := make([]LabelResult, 0, len(keys))
+	for _, k := range keys {
+		results = append(results, newLabelResult(k, statGroups[k]))
+	}
+	return results
+}
+
+// MarshalJSON encodes the result with its labels in order, so that equal
+// results always have the same encoding.
+func (r BenchmarkResult) MarshalJSON() ([]byte, error) {
+	// result has the fields of BenchmarkResult, but not this method
+	type result BenchmarkResult
+	sorted := result(r)
+	sorted.Labels = sortedLabelResults(r.Labels)
+	if len(r.Partial) > 0 {
+		sorted.Partial = sortedLabelResults(r.Partial)
+	}
+	return json.Marshal(sorted)
+}
+
+// sortedLabelResults returns a copy of results ordered by label, never nil.
+func sortedLabelResults(results []LabelResult) []LabelResult {
+	sorted := make([]LabelResult, len(results))
+	copy(sorted, results)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Label < sorted[j].Label })
+	return sorted
+}
+
+// result returns the BenchmarkResult of the stats aggregated so far.
+func (sp *defaultStatProcessor) result() BenchmarkResult {
+	sp.mappingMu.RLock()
+	defer sp.mappingMu.RUnlock()
+	r := BenchmarkResult{
+		Metadata: sp.args.runMetadata,
+		Labels:   labelResults(sp.queryStatGroups()),
+		Partial:  labelResults(sp.partialStatMapping),
+	}
+	if all, ok := sp.statMapping[labelAllQueries]; ok {
+		r.Totals = newLabelResult(labelAllQueries, all)
+	}
+	return r
+}
+
+// RunResult is the outcome of a query benchmark run as written to the results
+// file: its BenchmarkResult, along with the stats of the cold and warm runs of
+// queries if they were prewarmed, and how the run was made.
+type RunResult struct {
+	Result           BenchmarkResult   `json:"result"`
+	Cold             *LabelResult      `json:"cold,omitempty"`
+	Warm             *LabelResult      `json:"warm,omitempty"`
+	Workers          uint              `json:"workers"`
+	WallClockSeconds float64           `json:"wall_clock_seconds"`
+	Flags            map[string]string `json:"flags,omitempty"`
+}
+
+// runResult returns the RunResult of the stats aggregated so far, for a run
+// with workers that took wallClock, and whose flags were set to flags.
+func (sp *defaultStatProcessor) runResult(workers uint, wallClock time.Duration, flags map[string]string) RunResult {
+	r := RunResult{
+		Result:           sp.result(),
+		Workers:          workers,
+		WallClockSeconds: wallClock.Seconds(),
+		Flags:            flags,
+	}
+	sp.mappingMu.RLock()
+	defer sp.mappingMu.RUnlock()
+	if cold, ok := sp.statMapping[labelColdQueries]; ok {
+		lr := newLabelResult(labelColdQueries, cold)
+		r.Cold = &lr
+	}
+	if warm, ok := sp.statMapping[labelWarmQueries]; ok {
+		lr := newLabelResult(labelWarmQueries, warm)
+		r.Warm = &lr
+	}
+	return r
+}
+
+// writeResults writes the stats aggregated so far, for a run with workers that
+// took wallClock and whose flags were set to flags, in format: the RunResult
+// as JSON, or the stats of every label (including all, cold and warm queries)
+// in the long CSV format of WriteLongFormat, how the run was made being
+// written as metadata comment lines, e.g., "# workers: 8" and "# flag
+// db-name: benchmark".
+func (sp *defaultStatProcessor) writeResults(w io.Writer, format string, workers uint, wallClock time.Duration, flags map[string]string) error {
+	switch format {
+	case resultsFormatJSON:
+		return writeJSON(w, sp.runResult(workers, wallClock, flags))
+	case resultsFormatCSV:
+		metadata := map[string]string{
+			"workers":            strconv.FormatUint(uint64(workers), 10),
+			"wall_clock_seconds": strconv.FormatFloat(wallClock.Seconds(), 'f', -1, 64),
+		}
+		for k, v := range sp.args.runMetadata {
+			metadata[k] = v
+		}
+		for k, v := range flags {
+			metadata["flag "+k] = v
+		}
+		sp.mappingMu.RLock()
+		defer sp.mappingMu.RUnlock()
+		return writeLongFormat(w, metadata, labelResults(sp.statMapping))
+	}
+	return ErrUnknownResultsFormat
+}
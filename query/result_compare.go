@@ -0,0 +1,175 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// The metrics of each label CompareResults compares.
+const (
+	MetricMean       = "mean"       // MetricMean is the mean latency, in milliseconds
+	MetricP99        = "p99"        // MetricP99 is the 99th percentile of the latencies, in milliseconds
+	MetricThroughput = "throughput" // MetricThroughput is the number of queries per second of wall clock time
+)
+
+// MetricDelta is the change of a metric of a label from a baseline run to a
+// candidate run.
+type MetricDelta struct {
+	Label      string
+	Metric     string
+	Baseline   float64
+	Candidate  float64
+	Change     float64 // Change is the change relative to the baseline, e.g., 0.1 for 10% higher, infinite if the baseline is 0
+	Regression bool    // Regression tells whether the metric got worse by more than the threshold
+}
+
+// CompareMetric returns the MetricDelta of metric of label from baseline to
+// candidate. It is a regression if the metric got worse, i.e., higher if
+// higherIsWorse and lower otherwise, by more than threshold relative to the
+// baseline (e.g., 0.1 for 10%).
+func CompareMetric(label, metric string, baseline, candidate float64, higherIsWorse bool, threshold float64) MetricDelta {
+	d := MetricDelta{Label: label, Metric: metric, Baseline: baseline, Candidate: candidate}
+	switch {
+	case baseline != 0:
+		d.Change = (candidate - baseline) / math.Abs(baseline)
+	case candidate != 0:
+		d.Change = math.Copysign(math.Inf(1), candidate)
+	}
+	worsening := d.Change
+	if !higherIsWorse {
+		worsening = -worsening
+	}
+	d.Regression = worsening > threshold
+	return d
+}
+
+// ResultComparison is the comparison of a candidate run to a baseline run,
+// label by label.
+type ResultComparison struct {
+	Deltas        []MetricDelta // Deltas are those of the metrics of the labels of both runs, ordered by label
+	OnlyBaseline  []string      // OnlyBaseline are the labels only the baseline run has, ordered
+	OnlyCandidate []string      // OnlyCandidate are the labels only the candidate run has, ordered
+}
+
+// Regressions returns the deltas that are regressions.
+func (c ResultComparison) Regressions() []MetricDelta {
+	var regressions []MetricDelta
+	for _, d := range c.Deltas {
+		if d.Regression {
+			regressions = append(regressions, d)
+		}
+	}
+	return regressions
+}
+
+// CompareResults compares the metrics of each label of the candidate run to
+// those of the baseline run, as written to the results file, the totals being
+// compared under labelAllQueries. A metric that got worse by more than
+// threshold relative to the baseline (e.g., 0.1 for 10%) is a regression. The
+// throughput of a label is its number of queries over the wall clock time of
+// the run, so it is not compared if either run has no wall clock time.
+func CompareResults(baseline, candidate RunResult, threshold float64) ResultComparison {
+	baselineLabels, candidateLabels := runLabelResults(baseline), runLabelResults(candidate)
+	var c ResultComparison
+	var keys []string
+	for k := range baselineLabels {
+		if _, ok := candidateLabels[k]; ok {
+			keys = append(keys, k)
+		} else {
+			c.OnlyBaseline = append(c.OnlyBaseline, k)
+		}
+	}
+	for k := range candidateLabels {
+		if _, ok := baselineLabels[k]; !ok {
+			c.OnlyCandidate = append(c.OnlyCandidate, k)
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(c.OnlyBaseline)
+	sort.Strings(c.OnlyCandidate)
+
+	for _, k := range keys {
+		b, cand := baselineLabels[k], candidateLabels[k]
+		c.Deltas = append(c.Deltas, CompareMetric(k, MetricMean, b.Mean, cand.Mean, true, threshold))
+		if bp99, ok := percentileValue(b.Percentiles, 99); ok {
+			if cp99, ok := percentileValue(cand.Percentiles, 99); ok {
+				c.Deltas = append(c.Deltas, CompareMetric(k, MetricP99, bp99, cp99, true, threshold))
+			}
+		}
+		if baseline.WallClockSeconds > 0 && candidate.WallClockSeconds > 0 {
+			c.Deltas = append(c.Deltas, CompareMetric(k, MetricThroughput,
+				float64(b.Count)/baseline.WallClockSeconds, float64(cand.Count)/candidate.WallClockSeconds, false, threshold))
+		}
+	}
+	return c
+}
+
+// runLabelResults returns the LabelResults of the complete results of r, and
+// its totals if any, by label.
+func runLabelResults(r RunResult) map[string]LabelResult {
+	results := make(map[string]LabelResult, len(r.Result.Labels)+1)
+	for _, lr := range r.Result.Labels {
+		results[lr.Label] = lr
+	}
+	if r.Result.Totals.Count > 0 {
+		results[labelAllQueries] = r.Result.Totals
+	}
+	return results
+}
+
+// percentileValue returns the value of percentile p among points, if there.
+func percentileValue(points []PercentilePoint, p float64) (float64, bool) {
+	for _, point := range points {
+		if point.Percentile == p {
+			return point.Value, true
+		}
+	}
+	return 0, false
+}
+
+// WriteComparison writes the deltas of c, one line per metric of each label,
+// regressions being marked, then the labels only one of the runs has.
+func WriteComparison(w io.Writer, c ResultComparison) error {
+	maxLabelLength := 0
+	for _, d := range c.Deltas {
+		if len(d.Label) > maxLabelLength {
+			maxLabelLength = len(d.Label)
+		}
+	}
+	for _, d := range c.Deltas {
+		unit := "ms"
+		if d.Metric == MetricThroughput {
+			unit = "/sec"
+		}
+		verdict := ""
+		if d.Regression {
+			verdict = ", regression"
+		}
+		_, err := fmt.Fprintf(w, "%-*s: %-10s baseline: %10.2f%s, candidate: %10.2f%s, change: %+8.2f%%%s\n",
+			maxLabelLength, d.Label, d.Metric, d.Baseline, unit, d.Candidate, unit, 100*d.Change, verdict)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	for _, k := range c.OnlyBaseline {
+		if _, err := fmt.Fprintf(w, "%s: only in the baseline\n", k); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	for _, k := range c.OnlyCandidate {
+		if _, err := fmt.Fprintf(w, "%s: only in the candidate\n", k); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// ReadRunResult reads a RunResult written to a results file as JSON.
+func ReadRunResult(r io.Reader) (RunResult, error) {
+	var result RunResult
+	err := json.NewDecoder(r).Decode(&result)
+	return result, err
+}
@@ -0,0 +1,101 @@
+package query
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCompareMetric(t *testing.T) {
+	cases := []struct {
+		desc          string
+		baseline      float64
+		candidate     float64
+		higherIsWorse bool
+		want          float64
+		regression    bool
+	}{
+		{desc: "slower within the threshold", baseline: 10, candidate: 10.5, higherIsWorse: true, want: 0.05},
+		{desc: "slower", baseline: 10, candidate: 12, higherIsWorse: true, want: 0.2, regression: true},
+		{desc: "faster", baseline: 10, candidate: 5, higherIsWorse: true, want: -0.5},
+		{desc: "lower throughput", baseline: 100, candidate: 80, want: -0.2, regression: true},
+		{desc: "higher throughput", baseline: 100, candidate: 150, want: 0.5},
+		{desc: "from 0", baseline: 0, candidate: 1, higherIsWorse: true, want: math.Inf(1), regression: true},
+		{desc: "both 0", baseline: 0, candidate: 0, higherIsWorse: true, want: 0},
+	}
+	for _, c := range cases {
+		d := CompareMetric("foo", MetricMean, c.baseline, c.candidate, c.higherIsWorse, 0.1)
+		if math.Abs(d.Change-c.want) > 1e-9 && !(math.IsInf(c.want, 1) && math.IsInf(d.Change, 1)) {
+			t.Errorf("%s: incorrect change: got %f want %f", c.desc, d.Change, c.want)
+		}
+		if d.Regression != c.regression {
+			t.Errorf("%s: incorrect regression: got %v want %v", c.desc, d.Regression, c.regression)
+		}
+	}
+}
+
+func TestCompareResults(t *testing.T) {
+	labelResult := func(label string, count int64, mean, p99 float64) LabelResult {
+		return LabelResult{Label: label, Count: count, Mean: mean, Percentiles: []PercentilePoint{{50, mean}, {99, p99}}}
+	}
+	baseline := RunResult{
+		Result: BenchmarkResult{
+			Labels: []LabelResult{labelResult("foo", 100, 10, 20), labelResult("old", 10, 1, 1)},
+			Totals: labelResult(labelAllQueries, 110, 9, 20),
+		},
+		WallClockSeconds: 10,
+	}
+	candidate := RunResult{
+		Result: BenchmarkResult{
+			Labels: []LabelResult{labelResult("foo", 100, 10.5, 30), labelResult("new", 10, 1, 1)},
+			Totals: labelResult(labelAllQueries, 110, 9, 20),
+		},
+		WallClockSeconds: 10,
+	}
+
+	c := CompareResults(baseline, candidate, 0.1)
+	if len(c.Deltas) != 6 {
+		t.Fatalf("incorrect number of deltas: got %d want %d: %+v", len(c.Deltas), 6, c.Deltas)
+	}
+	regressions := c.Regressions()
+	if len(regressions) != 1 || regressions[0].Label != "foo" || regressions[0].Metric != MetricP99 {
+		t.Errorf("incorrect regressions: got %+v want the p99 of foo", regressions)
+	}
+	if len(c.OnlyBaseline) != 1 || c.OnlyBaseline[0] != "old" || len(c.OnlyCandidate) != 1 || c.OnlyCandidate[0] != "new" {
+		t.Errorf("incorrect unmatched labels: got %v and %v", c.OnlyBaseline, c.OnlyCandidate)
+	}
+
+	var b bytes.Buffer
+	if err := WriteComparison(&b, c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"foo        : p99        baseline:      20.00ms, candidate:      30.00ms, change:   +50.00%, regression\n",
+		"all queries: throughput baseline:      11.00/sec, candidate:      11.00/sec, change:    +0.00%\n",
+		"old: only in the baseline\n",
+		"new: only in the candidate\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %q in the comparison:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestReadRunResult(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	var b bytes.Buffer
+	if err := sp.writeResults(&b, resultsFormatJSON, 2, 0, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := ReadRunResult(&b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Workers != 2 || len(r.Result.Labels) != 1 || r.Result.Labels[0].Label != "foo" || r.Result.Totals.Count != 1 {
+		t.Errorf("incorrect result read back: %+v", r)
+	}
+}
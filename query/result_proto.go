@@ -0,0 +1,327 @@
+package query
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/filipecosta90/hdrhistogram"
+)
+
+// ErrNoHistogram is returned when asking for the histogram of a LabelResult
+// that was not exported with one.
+var ErrNoHistogram = errors.New("stats: result has no histogram")
+
+// Field numbers of the messages of result.proto, which must be kept in sync
+// with it (as checked by the tests).
+const (
+	benchmarkResultMetadataField = 1
+	benchmarkResultLabelsField   = 2
+	benchmarkResultPartialField  = 3
+	benchmarkResultTotalsField   = 4
+
+	metadataEntryKeyField   = 1
+	metadataEntryValueField = 2
+
+	labelResultLabelField       = 1
+	labelResultCountField       = 2
+	labelResultMinField         = 3
+	labelResultMaxField         = 4
+	labelResultMeanField        = 5
+	labelResultStdDevField      = 6
+	labelResultSumField         = 7
+	labelResultSkewCountField   = 8
+	labelResultPercentilesField = 9
+	labelResultHistogramField   = 10
+
+	percentilePointPercentileField = 1
+	percentilePointValueField      = 2
+
+	histogramLowestField      = 1
+	histogramHighestField     = 2
+	histogramSigFigsField     = 3
+	histogramScaleFactorField = 4
+	histogramIndexesField     = 5
+	histogramCountsField      = 6
+)
+
+// MarshalProto encodes the result as a BenchmarkResult protobuf message (see
+// result.proto), which is more compact than JSON and can be decoded in any
+// language, e.g., to ship results to a benchmark coordinator.
+func (r BenchmarkResult) MarshalProto() ([]byte, error) {
+	var e protoEncoder
+	for _, k := range sortedKeys(r.Metadata) {
+		v := r.Metadata[k]
+		e.messageField(benchmarkResultMetadataField, func(entry *protoEncoder) {
+			entry.stringField(metadataEntryKeyField, k)
+			entry.stringField(metadataEntryValueField, v)
+		})
+	}
+	for _, lr := range sortedLabelResults(r.Labels) {
+		e.messageField(benchmarkResultLabelsField, lr.marshalProto)
+	}
+	for _, lr := range sortedLabelResults(r.Partial) {
+		e.messageField(benchmarkResultPartialField, lr.marshalProto)
+	}
+	e.messageField(benchmarkResultTotalsField, r.Totals.marshalProto)
+	return e.buf, nil
+}
+
+// UnmarshalProto decodes a BenchmarkResult protobuf message into r. Unknown
+// fields are skipped.
+func (r *BenchmarkResult) UnmarshalProto(b []byte) error {
+	*r = BenchmarkResult{}
+	return decodeProto(b, func(d *protoDecoder, field, wireType int) error {
+		switch field {
+		case benchmarkResultMetadataField:
+			entry, err := d.bytes(wireType)
+			if err != nil {
+				return err
+			}
+			var k, v string
+			err = decodeProto(entry, func(d *protoDecoder, field, wireType int) error {
+				switch field {
+				case metadataEntryKeyField:
+					return d.string(wireType, &k)
+				case metadataEntryValueField:
+					return d.string(wireType, &v)
+				}
+				return d.skip(wireType)
+			})
+			if err != nil {
+				return err
+			}
+			if r.Metadata == nil {
+				r.Metadata = map[string]string{}
+			}
+			r.Metadata[k] = v
+			return nil
+		case benchmarkResultLabelsField, benchmarkResultPartialField:
+			b, err := d.bytes(wireType)
+			if err != nil {
+				return err
+			}
+			var lr LabelResult
+			if err := lr.unmarshalProto(b); err != nil {
+				return err
+			}
+			if field == benchmarkResultLabelsField {
+				r.Labels = append(r.Labels, lr)
+			} else {
+				r.Partial = append(r.Partial, lr)
+			}
+			return nil
+		case benchmarkResultTotalsField:
+			b, err := d.bytes(wireType)
+			if err != nil {
+				return err
+			}
+			return r.Totals.unmarshalProto(b)
+		}
+		return d.skip(wireType)
+	})
+}
+
+// marshalProto encodes the fields of the LabelResult protobuf message.
+func (lr LabelResult) marshalProto(e *protoEncoder) {
+	e.stringField(labelResultLabelField, lr.Label)
+	e.int64Field(labelResultCountField, lr.Count)
+	e.doubleField(labelResultMinField, lr.Min)
+	e.doubleField(labelResultMaxField, lr.Max)
+	e.doubleField(labelResultMeanField, lr.Mean)
+	e.doubleField(labelResultStdDevField, lr.StdDev)
+	e.doubleField(labelResultSumField, lr.Sum)
+	e.int64Field(labelResultSkewCountField, lr.SkewCount)
+	for _, p := range lr.Percentiles {
+		p := p
+		e.messageField(labelResultPercentilesField, func(e *protoEncoder) {
+			e.doubleField(percentilePointPercentileField, p.Percentile)
+			e.doubleField(percentilePointValueField, p.Value)
+		})
+	}
+	e.bytesField(labelResultHistogramField, lr.Histogram)
+}
+
+// unmarshalProto decodes a LabelResult protobuf message into lr.
+func (lr *LabelResult) unmarshalProto(b []byte) error {
+	return decodeProto(b, func(d *protoDecoder, field, wireType int) error {
+		switch field {
+		case labelResultLabelField:
+			return d.string(wireType, &lr.Label)
+		case labelResultCountField:
+			return d.int64(wireType, &lr.Count)
+		case labelResultMinField:
+			return d.double(wireType, &lr.Min)
+		case labelResultMaxField:
+			return d.double(wireType, &lr.Max)
+		case labelResultMeanField:
+			return d.double(wireType, &lr.Mean)
+		case labelResultStdDevField:
+			return d.double(wireType, &lr.StdDev)
+		case labelResultSumField:
+			return d.double(wireType, &lr.Sum)
+		case labelResultSkewCountField:
+			return d.int64(wireType, &lr.SkewCount)
+		case labelResultPercentilesField:
+			b, err := d.bytes(wireType)
+			if err != nil {
+				return err
+			}
+			var p PercentilePoint
+			err = decodeProto(b, func(d *protoDecoder, field, wireType int) error {
+				switch field {
+				case percentilePointPercentileField:
+					return d.double(wireType, &p.Percentile)
+				case percentilePointValueField:
+					return d.double(wireType, &p.Value)
+				}
+				return d.skip(wireType)
+			})
+			if err != nil {
+				return err
+			}
+			lr.Percentiles = append(lr.Percentiles, p)
+			return nil
+		case labelResultHistogramField:
+			b, err := d.bytes(wireType)
+			if err != nil {
+				return err
+			}
+			lr.Histogram = append([]byte(nil), b...)
+			return nil
+		}
+		return d.skip(wireType)
+	})
+}
+
+// HistogramPercentile returns percentile p (0..100) of the values of the
+// label in milliseconds, computed from its histogram, e.g., for percentiles
+// not in Percentiles. It returns ErrNoHistogram if the result was exported
+// without histograms, and ErrInvalidProto if the histogram is corrupt.
+func (lr LabelResult) HistogramPercentile(p float64) (float64, error) {
+	if len(lr.Histogram) == 0 {
+		return 0, ErrNoHistogram
+	}
+	sg, err := decodeHistogram(lr.Histogram)
+	if err != nil {
+		return 0, err
+	}
+	return sg.Percentile(p), nil
+}
+
+// OmissionCost returns percentile p (0..100) of the values of the label, as
+// recorded and as if they had been corrected for coordinated omission with the
+// expected interval, computed from its histogram (see statGroup.OmissionCost),
+// e.g., to tell from the results of a past run whether correcting matters. It
+// returns ErrNoHistogram if the result was exported without histograms, and
+// ErrInvalidProto if the histogram is corrupt.
+func (lr LabelResult) OmissionCost(p float64, interval time.Duration) (CoordinatedOmissionCost, error) {
+	if len(lr.Histogram) == 0 {
+		return CoordinatedOmissionCost{}, ErrNoHistogram
+	}
+	sg, err := decodeHistogram(lr.Histogram)
+	if err != nil {
+		return CoordinatedOmissionCost{}, err
+	}
+	return sg.OmissionCost(p, float64(interval)/float64(time.Millisecond)), nil
+}
+
+// encodeHistogram encodes the histogram of sg as a Histogram protobuf message
+// (see result.proto), listing only its non-empty buckets.
+func encodeHistogram(sg *statGroup) []byte {
+	sg.mu.Lock()
+	snapshot := sg.latencyHDRHistogram.Export()
+	sg.mu.Unlock()
+
+	var e protoEncoder
+	e.int64Field(histogramLowestField, snapshot.LowestTrackableValue)
+	e.int64Field(histogramHighestField, snapshot.HighestTrackableValue)
+	e.int64Field(histogramSigFigsField, snapshot.SignificantFigures)
+	e.doubleField(histogramScaleFactorField, sg.scaleFactor)
+	var indexes, counts protoEncoder
+	for i, c := range snapshot.Counts {
+		if c != 0 {
+			indexes.varint(uint64(i))
+			counts.varint(uint64(c))
+		}
+	}
+	// repeated scalars are packed
+	e.bytesField(histogramIndexesField, indexes.buf)
+	e.bytesField(histogramCountsField, counts.buf)
+	return e.buf
+}
+
+// decodeHistogram decodes a Histogram protobuf message into a StatGroup
+// holding the histogram, but not the sum and counts kept alongside it. The
+// histogram parameters are checked against the bounds of the StatGroups of
+// this package first, so a corrupt message cannot make for a huge histogram.
+func decodeHistogram(b []byte) (*statGroup, error) {
+	var snapshot hdrhistogram.Snapshot
+	var scaleFactor float64
+	var indexes, counts []int64
+	err := decodeProto(b, func(d *protoDecoder, field, wireType int) error {
+		switch field {
+		case histogramLowestField:
+			return d.int64(wireType, &snapshot.LowestTrackableValue)
+		case histogramHighestField:
+			return d.int64(wireType, &snapshot.HighestTrackableValue)
+		case histogramSigFigsField:
+			return d.int64(wireType, &snapshot.SignificantFigures)
+		case histogramScaleFactorField:
+			return d.double(wireType, &scaleFactor)
+		case histogramIndexesField:
+			return d.repeatedInt64(wireType, &indexes)
+		case histogramCountsField:
+			return d.repeatedInt64(wireType, &counts)
+		}
+		return d.skip(wireType)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scaleFactor <= 0 || len(indexes) != len(counts) ||
+		!validHistogramParameters(snapshot.LowestTrackableValue, snapshot.HighestTrackableValue, snapshot.SignificantFigures) {
+		return nil, ErrInvalidProto
+	}
+
+	h := hdrhistogram.New(snapshot.LowestTrackableValue, snapshot.HighestTrackableValue, int(snapshot.SignificantFigures))
+	snapshot.Counts = make([]int64, h.CountsLen())
+	for i, index := range indexes {
+		if index < 0 || index >= int64(len(snapshot.Counts)) || counts[i] < 0 {
+			return nil, ErrInvalidProto
+		}
+		snapshot.Counts[index] = counts[i]
+	}
+	return &statGroup{latencyHDRHistogram: hdrhistogram.Import(&snapshot), scaleFactor: scaleFactor}, nil
+}
+
+// resultWithHistograms returns the BenchmarkResult of the stats aggregated so
+// far, like result, with the histogram of each label.
+func (sp *defaultStatProcessor) resultWithHistograms() BenchmarkResult {
+	r := sp.result()
+	sp.mappingMu.RLock()
+	defer sp.mappingMu.RUnlock()
+	attach := func(results []LabelResult, statGroups map[string]*statGroup) {
+		for i := range results {
+			if sg, ok := statGroups[results[i].Label]; ok {
+				results[i].Histogram = encodeHistogram(sg)
+			}
+		}
+	}
+	attach(r.Labels, sp.statMapping)
+	attach(r.Partial, sp.partialStatMapping)
+	if all, ok := sp.statMapping[labelAllQueries]; ok {
+		r.Totals.Histogram = encodeHistogram(all)
+	}
+	return r
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,172 @@
+package query
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestBenchmarkResultProtoRoundTrip(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, runMetadata: map[string]string{"commit": "abc123", "scale": "100"}}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for i, val := range []float64{1.0, 2.0, 3.0, 40.0, 500.0} {
+		sp.aggregate(GetStat().Init([]byte("foo"), val))
+		sp.aggregate(GetStat().Init([]byte("bar"), float64(i)))
+	}
+	sp.aggregate(GetPartialStat().Init([]byte("foo"), 7.0))
+	sp.statMapping["foo"].skewCount = 2
+	want := sp.resultWithHistograms()
+
+	b, err := want.MarshalProto()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got BenchmarkResult
+	if err := got.UnmarshalProto(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want.Labels = sortedLabelResults(want.Labels)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result changed by the round trip:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	p99, err := got.Labels[1].HistogramPercentile(99)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p99 != sp.statMapping["foo"].Percentile(99) {
+		t.Errorf("incorrect percentile from the histogram: got %f want %f", p99, sp.statMapping["foo"].Percentile(99))
+	}
+	if _, err := sp.result().Totals.HistogramPercentile(99); err != ErrNoHistogram {
+		t.Errorf("incorrect error without histogram: got %v want %v", err, ErrNoHistogram)
+	}
+}
+
+func TestLabelResultProtoWireFormat(t *testing.T) {
+	// label "a" is field 1, a string of length 1; count 150 is field 2, the
+	// varint 0x96 0x01; mean 1.0 is field 5, a little-endian double
+	lr := LabelResult{Label: "a", Count: 150, Mean: 1.0}
+	var e protoEncoder
+	lr.marshalProto(&e)
+	want := []byte{0x0a, 0x01, 'a', 0x10, 0x96, 0x01, 0x29, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}
+	if !bytes.Equal(e.buf, want) {
+		t.Errorf("incorrect encoding: got % x want % x", e.buf, want)
+	}
+
+	// unknown fields of all wire types are skipped
+	withUnknown := append([]byte{0x58, 0x01, 0x61, 1, 2, 3, 4, 5, 6, 7, 8, 0x6a, 0x02, 'x', 'y', 0x75, 1, 2, 3, 4}, want...)
+	var got LabelResult
+	if err := got.unmarshalProto(withUnknown); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, lr) {
+		t.Errorf("incorrect decoding: got %+v want %+v", got, lr)
+	}
+
+	for _, corrupt := range [][]byte{{0x0a, 0x05, 'a'}, {0x10}, {0x29, 0, 0}, {0x0b}, {0x00}} {
+		if err := got.unmarshalProto(corrupt); err != ErrInvalidProto {
+			t.Errorf("incorrect error for % x: got %v want %v", corrupt, err, ErrInvalidProto)
+		}
+	}
+}
+
+// protoField matches the fields of the messages of a .proto file, e.g.,
+// "  repeated LabelResult labels = 2;".
+var protoField = regexp.MustCompile(`^\s*(?:repeated\s+)?(?:map<[^>]+>|\w+)\s+(\w+)\s*=\s*(\d+);`)
+
+// protoMessage matches the start of a message of a .proto file.
+var protoMessage = regexp.MustCompile(`^message\s+(\w+)\s*{`)
+
+func TestResultProtoSchema(t *testing.T) {
+	want := map[string]map[string]int{
+		"BenchmarkResult": {
+			"metadata": benchmarkResultMetadataField,
+			"labels":   benchmarkResultLabelsField,
+			"partial":  benchmarkResultPartialField,
+			"totals":   benchmarkResultTotalsField,
+		},
+		"LabelResult": {
+			"label":            labelResultLabelField,
+			"count":            labelResultCountField,
+			"min":              labelResultMinField,
+			"max":              labelResultMaxField,
+			"mean":             labelResultMeanField,
+			"stddev":           labelResultStdDevField,
+			"sum":              labelResultSumField,
+			"clock_skew_count": labelResultSkewCountField,
+			"percentiles":      labelResultPercentilesField,
+			"histogram":        labelResultHistogramField,
+		},
+		"PercentilePoint": {
+			"percentile": percentilePointPercentileField,
+			"value":      percentilePointValueField,
+		},
+		"Histogram": {
+			"lowest_trackable_value":  histogramLowestField,
+			"highest_trackable_value": histogramHighestField,
+			"significant_figures":     histogramSigFigsField,
+			"scale_factor":            histogramScaleFactorField,
+			"indexes":                 histogramIndexesField,
+			"counts":                  histogramCountsField,
+		},
+	}
+	// the entries of a map field have the key as field 1 and the value as field 2
+	if metadataEntryKeyField != 1 || metadataEntryValueField != 2 {
+		t.Errorf("incorrect map entry fields: got %d and %d want 1 and 2", metadataEntryKeyField, metadataEntryValueField)
+	}
+
+	schema, err := ioutil.ReadFile("result.proto")
+	if err != nil {
+		t.Fatalf("cannot read schema: %v", err)
+	}
+	got := map[string]map[string]int{}
+	message := ""
+	for _, line := range bytes.Split(schema, []byte("\n")) {
+		if m := protoMessage.FindSubmatch(line); m != nil {
+			message = string(m[1])
+			got[message] = map[string]int{}
+		} else if m := protoField.FindSubmatch(line); m != nil && message != "" {
+			number, _ := strconv.Atoi(string(m[2]))
+			got[message][string(m[1])] = number
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("codec out of sync with result.proto:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestDecodeHistogramInvalid(t *testing.T) {
+	sg := newStatGroup(0)
+	sg.push(3.0)
+	valid := encodeHistogram(sg)
+	if _, err := decodeHistogram(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	histogram := func(lowest, highest, sigfigs int64) []byte {
+		var e protoEncoder
+		e.int64Field(histogramLowestField, lowest)
+		e.int64Field(histogramHighestField, highest)
+		e.int64Field(histogramSigFigsField, sigfigs)
+		e.doubleField(histogramScaleFactorField, hdrScaleFactor)
+		return e.buf
+	}
+	cases := map[string][]byte{
+		"huge range":          histogram(1, 1<<62, 4),
+		"too many figures":    histogram(1, 3600000000, 5),
+		"no figures":          histogram(1, 3600000000, 0),
+		"no lowest value":     histogram(0, 3600000000, 4),
+		"bucket out of range": append(histogram(1, 3600000000, 4), 0x2a, 0x03, 0xff, 0xff, 0x7f, 0x32, 0x01, 0x01),
+		"unpaired counts":     append(histogram(1, 3600000000, 4), 0x2a, 0x01, 0x01),
+		"truncated":           valid[:len(valid)-1],
+	}
+	for name, b := range cases {
+		if _, err := decodeHistogram(b); err != ErrInvalidProto {
+			t.Errorf("%s: incorrect error: got %v want %v", name, err, ErrInvalidProto)
+		}
+	}
+}
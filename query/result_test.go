@@ -0,0 +1,133 @@
+package query
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkResultJSONRoundTrip(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, runMetadata: map[string]string{"commit": "abc123"}}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for _, val := range []float64{1.0, 2.0, -1.0} {
+		sp.aggregate(GetStat().Init([]byte("foo"), val))
+	}
+	sp.aggregate(GetStat().Init([]byte("bar"), 10.0))
+	sp.aggregate(GetPartialStat().Init([]byte("foo"), 100.0))
+
+	result := sp.result()
+	if got := len(result.Labels); got != 2 {
+		t.Fatalf("incorrect number of labels: got %d want %d", got, 2)
+	}
+	if result.Labels[0].Label != "bar" || result.Labels[1].Label != "foo" {
+		t.Errorf("incorrect label order: got %s, %s", result.Labels[0].Label, result.Labels[1].Label)
+	}
+	if foo := result.Labels[1]; foo.Count != 3 || foo.Sum != 3.0 || foo.SkewCount != 1 {
+		t.Errorf("incorrect stats for foo: got %+v", foo)
+	}
+	if result.Totals.Label != labelAllQueries || result.Totals.Count != 4 {
+		t.Errorf("incorrect totals: got %+v", result.Totals)
+	}
+	if len(result.Partial) != 1 || result.Partial[0].Count != 1 {
+		t.Errorf("incorrect partial results: got %+v", result.Partial)
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var decoded BenchmarkResult
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, result) {
+		t.Errorf("result did not survive JSON:\ngot  %+v\nwant %+v", decoded, result)
+	}
+
+	// the encoding does not depend on the order labels were added in
+	reversed := result
+	reversed.Labels = []LabelResult{result.Labels[1], result.Labels[0]}
+	again, err := json.Marshal(reversed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(again) != string(encoded) {
+		t.Errorf("encoding not stable:\n%s\nvs\n%s", again, encoded)
+	}
+
+	empty, err := json.Marshal(BenchmarkResult{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(empty, &fields)
+	if string(fields["labels"]) != "[]" {
+		t.Errorf("labels of an empty result not an empty list: %s", empty)
+	}
+}
+
+func TestStatProcessorWriteResults(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, prewarmQueries: true}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for _, val := range []float64{1.0, 2.0} {
+		sp.aggregate(GetStat().Init([]byte("foo"), val))
+		warm := GetStat().Init([]byte("foo"), val/2)
+		warm.isWarm = true
+		sp.aggregate(warm)
+	}
+	flags := map[string]string{"workers": "8"}
+
+	var buf bytes.Buffer
+	if err := sp.writeResults(&buf, resultsFormatJSON, 8, 90*time.Second, flags); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var decoded RunResult
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("results file is not valid JSON: %v", err)
+	}
+	if decoded.Workers != 8 || decoded.WallClockSeconds != 90 || decoded.Flags["workers"] != "8" {
+		t.Errorf("incorrect run: got %+v", decoded)
+	}
+	if decoded.Cold == nil || decoded.Cold.Count != 2 || decoded.Warm == nil || decoded.Warm.Count != 2 {
+		t.Errorf("incorrect cold and warm stats: got %+v, %+v", decoded.Cold, decoded.Warm)
+	}
+	if len(decoded.Result.Labels) != 1 || decoded.Result.Labels[0].Count != 4 {
+		t.Errorf("incorrect label stats: got %+v", decoded.Result.Labels)
+	}
+
+	buf.Reset()
+	if err := sp.writeResults(&buf, resultsFormatCSV, 8, 90*time.Second, flags); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"# flag workers: 8\n", "# wall_clock_seconds: 90\n", "# workers: 8\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in CSV:\n%s", want, out)
+		}
+	}
+	r := csv.NewReader(&buf)
+	r.Comment = '#'
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("results file is not valid CSV: %v", err)
+	}
+	labels := map[string]bool{}
+	for _, row := range rows {
+		labels[row[0]] = true
+	}
+	for _, label := range []string{"foo", labelAllQueries, labelColdQueries, labelWarmQueries} {
+		if !labels[label] {
+			t.Errorf("missing %s in CSV", label)
+		}
+	}
+
+	if err := sp.writeResults(&buf, "yaml", 8, 0, nil); err != ErrUnknownResultsFormat {
+		t.Errorf("incorrect error: got %v want %v", err, ErrUnknownResultsFormat)
+	}
+}
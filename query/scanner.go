@@ -12,6 +12,13 @@ import (
 type scanner struct {
 	r     io.Reader
 	limit *uint64
+	stop  <-chan struct{}
+	n     uint64 // n is the number of Queries read so far, over all the scans
+
+	shard   uint64 // shard is which of the shards of the input is read, see setShard
+	shards  uint64 // shards is the number of shards the input is split into, all of it is read if 0
+	decoded uint64 // decoded is the number of Queries decoded so far, over all the scans, read or not
+	skip    uint64 // skip is the number of Queries read but not sent, e.g., run before a restart, see setSkip
 }
 
 // newScanner returns a new scanner for a given Reader and its limit
@@ -25,33 +32,78 @@ func (s *scanner) setReader(r io.Reader) *scanner {
 	return s
 }
 
-// scan reads encoded Queries and places them into a channel
-func (s *scanner) scan(pool *sync.Pool, c chan Query) {
+// setStop sets a channel that, once closed, makes the scanner stop reading
+// more Queries
+func (s *scanner) setStop(stop <-chan struct{}) *scanner {
+	s.stop = stop
+	return s
+}
+
+// setSkip makes the scanner read the first n Queries without sending them,
+// e.g., those a restarted run ran before, so they count towards the limit
+// and keep their IDs but are not run again.
+func (s *scanner) setSkip(n uint64) *scanner {
+	s.skip = n
+	return s
+}
+
+// setShard makes the scanner only read the Queries of shard out of shards,
+// those whose index in the input modulo shards is shard, e.g., for each worker
+// of a distributed run to run a disjoint part of the input.
+func (s *scanner) setShard(shard, shards uint64) *scanner {
+	s.shard = shard
+	s.shards = shards
+	return s
+}
+
+// scan reads encoded Queries and places them into a channel. It returns true
+// if it stopped at the end of the input, rather than at the limit or when
+// asked to, so more Queries can be read from the start of the input again;
+// the limit and the IDs of the Queries carry over to the next scans.
+func (s *scanner) scan(pool *sync.Pool, c chan Query) bool {
 	decoder := gob.NewDecoder(s.r)
 
-	n := uint64(0)
 	for {
-		if *s.limit > 0 && n >= *s.limit {
+		if *s.limit > 0 && s.n >= *s.limit {
 			// request queries limit reached, time to quit
-			break
+			return false
+		}
+		select {
+		case <-s.stop:
+			// asked to stop, e.g., the time budget is used up
+			return false
+		default:
 		}
 
 		q := pool.Get().(Query)
 		err := decoder.Decode(q)
 		if err == io.EOF {
 			// EOF, all done
-			break
+			return true
 		}
 		if err != nil {
 			// Can't read, time to quit
 			log.Fatal(err)
 		}
+		s.decoded++
+		if s.shards > 0 && (s.decoded-1)%s.shards != s.shard {
+			// the query is in another shard
+			pool.Put(q)
+			continue
+		}
+
+		if s.n < s.skip {
+			// the query was run before a restart
+			pool.Put(q)
+			s.n++
+			continue
+		}
 
 		// We have a query, send it to the runner
-		q.SetID(n)
+		q.SetID(s.n)
 		c <- q
 
 		// Queries counter
-		n++
+		s.n++
 	}
 }
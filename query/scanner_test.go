@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"reflect"
 	"sync"
 	"testing"
 )
@@ -150,3 +151,106 @@ func TestScanTimescaleDB(t *testing.T) {
 		return nil
 	})
 }
+
+func TestScannerStop(t *testing.T) {
+	var b bytes.Buffer
+	err := encodeQueries(&b, 5, func(i uint64) Query {
+		return &testQuery{HumanLabel: []byte("testlabel")}
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	limit := uint64(0)
+	stop := make(chan struct{})
+	queryChan := make(chan Query, 5)
+	s := newScanner(&limit).setReader(&b).setStop(stop)
+	close(stop)
+	s.scan(&testQueryPool, queryChan)
+	close(queryChan)
+	if got := len(queryChan); got != 0 {
+		t.Errorf("scanner did not stop: got %d queries want %d", got, 0)
+	}
+}
+
+func TestScannerScanAgain(t *testing.T) {
+	var b bytes.Buffer
+	err := encodeQueries(&b, 3, func(i uint64) Query {
+		return &testQuery{HumanLabel: []byte("testlabel")}
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	limit := uint64(5)
+	queryChan := make(chan Query, 5)
+	s := newScanner(&limit)
+	if atEnd := s.setReader(bytes.NewReader(b.Bytes())).scan(&testQueryPool, queryChan); !atEnd {
+		t.Errorf("scanner did not stop at the end of the input")
+	}
+	// the limit is over the scans, and the IDs carry on
+	if atEnd := s.setReader(bytes.NewReader(b.Bytes())).scan(&testQueryPool, queryChan); atEnd {
+		t.Errorf("scanner stopped at the end of the input rather than at the limit")
+	}
+	close(queryChan)
+	id := uint64(0)
+	for q := range queryChan {
+		if q.GetID() != id {
+			t.Errorf("incorrect ID: got %d want %d", q.GetID(), id)
+		}
+		id++
+	}
+	if id != limit {
+		t.Errorf("incorrect number of queries: got %d want %d", id, limit)
+	}
+}
+
+func TestScannerShard(t *testing.T) {
+	var b bytes.Buffer
+	err := encodeQueries(&b, 7, func(i uint64) Query {
+		return &testQuery{HumanLabel: []byte(fmt.Sprintf("query %d", i))}
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	limit := uint64(0)
+	queryChan := make(chan Query, 7)
+	newScanner(&limit).setShard(1, 3).setReader(bytes.NewReader(b.Bytes())).scan(&testQueryPool, queryChan)
+	close(queryChan)
+	var got []string
+	for q := range queryChan {
+		got = append(got, string(q.HumanLabelName()))
+	}
+	if want := []string{"query 1", "query 4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect queries of the shard: got %v want %v", got, want)
+	}
+}
+
+func TestScannerSkip(t *testing.T) {
+	var b bytes.Buffer
+	err := encodeQueries(&b, 5, func(i uint64) Query {
+		return &testQuery{HumanLabel: []byte(fmt.Sprintf("query %d", i))}
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	limit := uint64(4)
+	queryChan := make(chan Query, 5)
+	newScanner(&limit).setSkip(2).setReader(bytes.NewReader(b.Bytes())).scan(&testQueryPool, queryChan)
+	close(queryChan)
+	var got []string
+	var ids []uint64
+	for q := range queryChan {
+		got = append(got, string(q.HumanLabelName()))
+		ids = append(ids, q.GetID())
+	}
+	// the skipped queries count towards the limit
+	if want := []string{"query 2", "query 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect queries after the skipped ones: got %v want %v", got, want)
+	}
+	if want := []uint64{2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("incorrect IDs: got %v want %v", ids, want)
+	}
+}
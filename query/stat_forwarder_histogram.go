@@ -0,0 +1,48 @@
+package query
+
+import (
+	"context"
+	"strconv"
+)
+
+// Names of the histogram instrument values are recorded into by a histogram
+// forwarder, and of the attributes recorded along with each value.
+const (
+	latencyHistogramName = "tsbs.query.latency"
+	labelAttribute       = "label"
+	warmAttribute        = "warm"
+	partialAttribute     = "partial"
+)
+
+// Float64Histogram is a histogram instrument of a metrics API, such as an
+// OpenTelemetry metric.Float64Histogram, that values are recorded into along
+// with attributes.
+type Float64Histogram interface {
+	Record(ctx context.Context, value float64, attributes map[string]string)
+}
+
+// Meter creates histogram instruments, such as an OpenTelemetry metric.Meter.
+// It keeps this package independent of the metrics API: the otelmeter
+// package adapts an OpenTelemetry meter to it.
+type Meter interface {
+	Float64Histogram(name, unit, description string) (Float64Histogram, error)
+}
+
+// NewHistogramForwarder returns a StatForwarder recording the latency of each
+// query, in milliseconds, into a histogram instrument created with meter,
+// with the label of the query and whether it is warm and partial as
+// attributes. It is meant to be set with BenchmarkRunner.SetStatForwarder, so
+// latencies flow into an existing metrics pipeline (e.g., OTLP).
+func NewHistogramForwarder(ctx context.Context, meter Meter) (StatForwarder, error) {
+	h, err := meter.Float64Histogram(latencyHistogramName, "ms", "Latency of the queries of the benchmark")
+	if err != nil {
+		return nil, err
+	}
+	return func(label []byte, value float64, isWarm, isPartial bool) {
+		h.Record(ctx, value, map[string]string{
+			labelAttribute:   string(label),
+			warmAttribute:    strconv.FormatBool(isWarm),
+			partialAttribute: strconv.FormatBool(isPartial),
+		})
+	}, nil
+}
@@ -0,0 +1,73 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// dataPoint is a value recorded into a memoryHistogram.
+type dataPoint struct {
+	value      float64
+	attributes map[string]string
+}
+
+// memoryHistogram is a Float64Histogram keeping the values recorded into it.
+type memoryHistogram struct {
+	name, unit string
+	points     []dataPoint
+}
+
+func (h *memoryHistogram) Record(_ context.Context, value float64, attributes map[string]string) {
+	h.points = append(h.points, dataPoint{value, attributes})
+}
+
+// memoryMeter is a Meter of memoryHistograms.
+type memoryMeter struct {
+	histograms []*memoryHistogram
+	err        error
+}
+
+func (m *memoryMeter) Float64Histogram(name, unit, _ string) (Float64Histogram, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	h := &memoryHistogram{name: name, unit: unit}
+	m.histograms = append(m.histograms, h)
+	return h, nil
+}
+
+func TestHistogramForwarder(t *testing.T) {
+	meter := &memoryMeter{}
+	forward, err := NewHistogramForwarder(context.Background(), meter)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	limit := uint64(0)
+	sp := newPassthroughStatProcessor(&statProcessorArgs{limit: &limit}, forward).(*passthroughStatProcessor)
+	sp.c = make(chan *Stat, 2)
+	sp.send([]*Stat{GetStat().Init([]byte("foo"), 2.5), GetPartialStat().Init([]byte("bar"), 7.0)})
+	close(sp.c)
+	sp.forwardAll()
+
+	if len(meter.histograms) != 1 {
+		t.Fatalf("incorrect number of instruments: got %d want %d", len(meter.histograms), 1)
+	}
+	h := meter.histograms[0]
+	if h.name != latencyHistogramName || h.unit != "ms" {
+		t.Errorf("incorrect instrument: got %s in %s", h.name, h.unit)
+	}
+	want := []dataPoint{
+		{2.5, map[string]string{"label": "foo", "warm": "false", "partial": "false"}},
+		{7.0, map[string]string{"label": "bar", "warm": "false", "partial": "true"}},
+	}
+	if !reflect.DeepEqual(h.points, want) {
+		t.Errorf("incorrect data points: got %+v want %+v", h.points, want)
+	}
+
+	meter.err = errors.New("no meter")
+	if _, err := NewHistogramForwarder(context.Background(), meter); err != meter.err {
+		t.Errorf("incorrect error: got %v want %v", err, meter.err)
+	}
+}
@@ -0,0 +1,127 @@
+package query
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	// labelToken matches the runs of letters, digits, underscores and dots of
+	// a label, the only ones that may be numbers.
+	labelToken = regexp.MustCompile(`[\w.]+`)
+	// decimalNumber matches the tokens that are numbers with a fractional
+	// part, possibly followed by a unit, e.g., "1.5ms".
+	decimalNumber = regexp.MustCompile(`^(\d+\.\d+)([A-Za-z_]*)$`)
+)
+
+// RoundLabelNumbers returns a label canonicalizer, e.g., for
+// SetLabelCanonicalizer, rounding the numbers with a fractional part in labels
+// to the given number of decimals, e.g., with 1 decimal "scale=1.02" and
+// "scale=1.01" both become "scale=1.0". Only the numbers standing on their
+// own, or followed by a unit, are rounded, not those that are part of a word
+// or of a version such as "v1.2.3" or "1.2.3".
+func RoundLabelNumbers(decimals int) func(label string) string {
+	scale := math.Pow(10, float64(decimals))
+	return func(label string) string {
+		return labelToken.ReplaceAllStringFunc(label, func(token string) string {
+			m := decimalNumber.FindStringSubmatch(token)
+			if m == nil {
+				return token
+			}
+			v, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				return token
+			}
+			return strconv.FormatFloat(math.Round(v*scale)/scale, 'f', decimals, 64) + m[2]
+		})
+	}
+}
+
+// labelAnonymizer replaces labels by stable hashes in exported outputs, so
+// results can be shared without revealing the queries. The hashes are keyed,
+// so that they cannot be reversed by hashing guessed labels without the key.
+// The labels of the aggregate groups (e.g., "all queries") are kept as is. It
+// is safe for concurrent use, e.g., by live metrics.
+type labelAnonymizer struct {
+	key    []byte
+	mu     sync.Mutex
+	labels map[string]string // labels maps the hashes given out so far to their label
+	kept   map[string]bool   // kept holds the hashes of labels read back from outputs, e.g., checkpoints, which are already anonymized
+}
+
+// newLabelAnonymizer returns a labelAnonymizer hashing labels with key.
+func newLabelAnonymizer(key []byte) *labelAnonymizer {
+	return &labelAnonymizer{key: key, labels: map[string]string{}, kept: map[string]bool{}}
+}
+
+// keep makes anonymize return hash as is, it being the hash of a label read
+// back from an output of a previous run, e.g., a checkpoint, whose label is
+// not known.
+func (a *labelAnonymizer) keep(hash string) {
+	a.mu.Lock()
+	a.kept[hash] = true
+	a.mu.Unlock()
+}
+
+// anonymize returns the hash of label, e.g., "label-3f2a9c0d1b7e4a66", which
+// is the same for the same label and key.
+func (a *labelAnonymizer) anonymize(label string) string {
+	switch label {
+	case labelAllQueries, labelColdQueries, labelWarmQueries:
+		return label
+	}
+	a.mu.Lock()
+	kept := a.kept[label]
+	a.mu.Unlock()
+	if kept {
+		return label
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(label))
+	hash := "label-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	a.mu.Lock()
+	a.labels[hash] = label
+	a.mu.Unlock()
+	return hash
+}
+
+// anonymizeStatGroups returns statGroups keyed by the hashes of their labels.
+func (a *labelAnonymizer) anonymizeStatGroups(statGroups map[string]*statGroup) map[string]*statGroup {
+	anonymized := make(map[string]*statGroup, len(statGroups))
+	for k, sg := range statGroups {
+		anonymized[a.anonymize(k)] = sg
+	}
+	return anonymized
+}
+
+// writeMapping writes the hashes given out so far and their label as CSV, in
+// order of hash, for the results to be re-identified internally.
+func (a *labelAnonymizer) writeMapping(w io.Writer) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	hashes := make([]string, 0, len(a.labels))
+	for hash := range a.labels {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"hash", "label"}); err != nil {
+		return wrapWriteError(err)
+	}
+	for _, hash := range hashes {
+		if err := cw.Write([]string{hash, a.labels[hash]}); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	cw.Flush()
+	return wrapWriteError(cw.Error())
+}
@@ -0,0 +1,117 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRoundLabelNumbers(t *testing.T) {
+	round := RoundLabelNumbers(1)
+	cases := []struct {
+		label string
+		want  string
+	}{
+		{"scale=1.01", "scale=1.0"},
+		{"scale=1.02", "scale=1.0"},
+		{"scale=1.06", "scale=1.1"},
+		{"lastpoint, 8 hosts, ratio 0.349", "lastpoint, 8 hosts, ratio 0.3"},
+		{"no numbers", "no numbers"},
+		{"version v1.2.3", "version v1.2.3"},
+		{"version 1.2.3", "version 1.2.3"},
+		{"x1.25 y_2.25", "x1.25 y_2.25"},
+		{"ratios 0.25,0.35 (1.04)", "ratios 0.3,0.4 (1.0)"},
+		{"-1.04ms", "-1.0ms"},
+	}
+	for _, c := range cases {
+		if got := round(c.label); got != c.want {
+			t.Errorf("incorrect canonical label of %q: got %q want %q", c.label, got, c.want)
+		}
+	}
+}
+
+func TestStatProcessorCanonicalizeLabel(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, canonicalizeLabel: RoundLabelNumbers(1)}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("scale=1.01"), 1.0))
+	sp.aggregate(GetStat().Init([]byte("scale=1.02"), 3.0))
+	sp.aggregate(GetPartialStat().Init([]byte("scale=1.04"), 5.0))
+
+	sg, ok := sp.statMapping["scale=1.0"]
+	if !ok {
+		t.Fatalf("labels not binned together: %v", sp.statMapping)
+	}
+	if sg.count != 2 || sg.sum != 4.0 {
+		t.Errorf("incorrect binned group: got count %d sum %f want count %d sum %f", sg.count, sg.sum, 2, 4.0)
+	}
+	for _, label := range []string{"scale=1.01", "scale=1.02"} {
+		if _, ok := sp.statMapping[label]; ok {
+			t.Errorf("original label %s still has its own group", label)
+		}
+	}
+	if got := sp.partialStatMapping["scale=1.0"]; got == nil || got.count != 1 {
+		t.Errorf("partial result not binned: %v", sp.partialStatMapping)
+	}
+}
+
+func TestLabelAnonymizer(t *testing.T) {
+	a := newLabelAnonymizer([]byte("secret"))
+	foo, bar := a.anonymize("foo"), a.anonymize("bar")
+	if got := a.anonymize("foo"); got != foo {
+		t.Errorf("same label hashed differently: got %q and %q", foo, got)
+	}
+	if got := newLabelAnonymizer([]byte("secret")).anonymize("foo"); got != foo {
+		t.Errorf("same label hashed differently with the same key: got %q and %q", foo, got)
+	}
+	if foo == bar {
+		t.Errorf("different labels hashed the same: %q", foo)
+	}
+	if got := newLabelAnonymizer([]byte("other")).anonymize("foo"); got == foo {
+		t.Errorf("same hash with a different key: %q", got)
+	}
+	if strings.Contains(foo, "foo") || !strings.HasPrefix(foo, "label-") {
+		t.Errorf("incorrect hash: %q", foo)
+	}
+	if got := a.anonymize(labelAllQueries); got != labelAllQueries {
+		t.Errorf("aggregate label anonymized: got %q want %q", got, labelAllQueries)
+	}
+
+	var buf bytes.Buffer
+	if err := a.writeMapping(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"hash,label\n", foo + ",foo\n", bar + ",bar\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("mapping missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestStatProcessorAnonymizeLabels(t *testing.T) {
+	limit := uint64(0)
+	a := newLabelAnonymizer([]byte("secret"))
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, anonymizer: a}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	sp.aggregate(GetStat().Init([]byte("foo"), 3.0))
+
+	exported := sp.exported()
+	sg, ok := exported.statMapping[a.anonymize("foo")]
+	if !ok || sg.count != 2 {
+		t.Fatalf("grouping not preserved: %v", exported.statMapping)
+	}
+	var buf bytes.Buffer
+	if err := exported.writeReport(&buf, 2, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(buf.String(), "foo") {
+		t.Errorf("label leaked into the report:\n%s", buf.String())
+	}
+	if got := exported.result().Labels; len(got) != 1 || got[0].Label != a.anonymize("foo") {
+		t.Errorf("label not anonymized in the result: %+v", got)
+	}
+	if _, ok := sp.statMapping["foo"]; !ok {
+		t.Errorf("stats aggregated so far changed: %v", sp.statMapping)
+	}
+}
@@ -2,12 +2,16 @@ package query
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
 )
 
 // statProcessor is used to collect, analyze, and print query execution statistics.
@@ -17,30 +21,95 @@ type statProcessor interface {
 	sendWarm(stats []*Stat)
 	process(workers uint)
 	CloseAndWait()
+	// budgetExhausted returns a channel that is closed once the run has used up its time budget
+	budgetExhausted() <-chan struct{}
 }
 
 type statProcessorArgs struct {
-	prewarmQueries bool    // PrewarmQueries tells the StatProcessor whether we're running each query twice to prewarm the cache
-	limit          *uint64 // limit is the number of statistics to analyze before stopping
-	burnIn         uint64  // burnIn is the number of statistics to ignore before analyzing
-	printInterval  uint64  // printInterval is how often print intermediate stats (number of queries)
-	hdrLatenciesFile string // hdrLatenciesFile is the filename to Write the High Dynamic Range (HDR) Histogram of Response Latencies to
-
+	prewarmQueries     bool                      // PrewarmQueries tells the StatProcessor whether we're running each query twice to prewarm the cache
+	limit              *uint64                   // limit is the number of statistics to analyze before stopping
+	burnIn             uint64                    // burnIn is the number of statistics to ignore before analyzing
+	printInterval      uint64                    // printInterval is how often print intermediate stats (number of queries)
+	hdrLatenciesFile   string                    // hdrLatenciesFile is the filename to Write the High Dynamic Range (HDR) Histogram of Response Latencies to
+	minSampleCount     uint64                    // minSampleCount is the number of samples below which a label's stats are reported as unreliable
+	throughputCSVFile  string                    // throughputCSVFile is the filename to write the throughput per window of time to, as CSV
+	stallFraction      float64                   // stallFraction, if positive, is the fraction of the running median throughput below which windows are reported as stalls
+	windowWidth        time.Duration             // windowWidth, if positive, is the width of the windows of time stats are also split into
+	maxDuration        time.Duration             // maxDuration, if positive, is the time budget of the run, after which it is stopped
+	reportSinks        []io.Writer               // reportSinks are all written the final report to, stdout if empty
+	preciseLatencies   bool                      // preciseLatencies tells the StatProcessor to record latencies in nanoseconds rather than microseconds
+	tailSampler        *tailSampler              // tailSampler, if set, retains the details of the slow complete results
+	logSpaceStats      bool                      // logSpaceStats tells the StatProcessor to also report log-space (geometric) stats per label
+	checkpointFile     string                    // checkpointFile is the file the aggregated stats are periodically saved to, to resume from
+	checkpointInterval time.Duration             // checkpointInterval, if positive, is how often the aggregated stats are saved to checkpointFile
+	resumeCheckpoint   bool                      // resumeCheckpoint tells the StatProcessor to start from the stats saved in checkpointFile
+	canonicalizeLabel  func(label string) string // canonicalizeLabel, if set, maps labels to the label they are aggregated under, e.g., to bin their numeric parts
+	runMetadata        map[string]string         // runMetadata describes the run (e.g., commit, database version) at the top of the outputs
+	expectedInterval   time.Duration             // expectedInterval, if positive, is the interval at which queries are expected to start, to correct for coordinated omission
+	maxDisplayedGroups int                       // maxDisplayedGroups, if positive, is the number of labels above which only the top ones are displayed in the final report
+	displayMetric      groupMetric               // displayMetric is the metric labels are ranked by when not all of them are displayed, the total time if nil
+	anonymizer         *labelAnonymizer          // anonymizer, if set, replaces the labels by their hashes in all the outputs
+	labelMappingFile   string                    // labelMappingFile is the filename to write the hashes of the anonymized labels and the labels to, as CSV
+	resultsProtoFile   string                    // resultsProtoFile is the filename to write the result, with histograms, to as a protobuf message
+	resultsParquetFile string                    // resultsParquetFile is the filename to write the stats of each label to as a Parquet table
+	apdexTarget        time.Duration             // apdexTarget, if positive, is the target latency the Apdex score of each label is reported for
+	omissionInterval   time.Duration             // omissionInterval, if positive, is the expected interval the cost of coordinated omission of each label is reported for
+	absoluteDeviations bool                      // absoluteDeviations tells the StatProcessor to also report the mean and median absolute deviations per label
+	recentWindowSize   int                       // recentWindowSize, if positive, is the number of last complete results kept in order, to report their effective sample size
+	liveMetrics        bool                      // liveMetrics tells the StatProcessor to keep the stats of the latest window of time, to expose them while running
+	intervalPeriod     time.Duration             // intervalPeriod, if positive, is how often the stats of the complete results since the previous period are printed
+	goBenchFile        string                    // goBenchFile is the filename to write the stats per label to in the output format of Go benchmarks, e.g., for benchstat
+	latencyKnee        bool                      // latencyKnee tells the StatProcessor to report the throughput beyond which latency climbs sharply, over the windows
+	outlierThreshold   float64                   // outlierThreshold, if positive, is the number of stddevs above its mean a label's max is reported as an outlier beyond
+	latencyLogFile     string                    // latencyLogFile is the filename to write every latency aggregated to, with its time and label, as CSV
+	targetRate         float64                   // targetRate, if positive, is the rate of queries per second offered, reported against the achieved rate over the windows
+	workerStats        bool                      // workerStats tells the StatProcessor to also report the stats of complete results by worker, and by label and worker
+	histogramBuckets   int                       // histogramBuckets, if positive, is the number of adaptive buckets of the ASCII histogram of each label reported
 }
 
+// budgetCheckInterval is how often the time budget of a run is checked.
+const budgetCheckInterval = 10 * time.Millisecond
+
 // statProcessor is used to collect, analyze, and print query execution statistics.
 type defaultStatProcessor struct {
-	args *statProcessorArgs
-	wg   sync.WaitGroup
-	c    chan *Stat // c is the channel for Stats to be sent for processing
-	opsCount 	uint64
+	args     *statProcessorArgs
+	wg       sync.WaitGroup
+	c        chan *Stat // c is the channel for Stats to be sent for processing
+	opsCount uint64
+	clock    Clock // clock is the source of time for all time-based stats
+
+	mappingMu          sync.RWMutex                // mappingMu guards changes to the maps of StatGroups, so they can be read during the run
+	statMapping        map[string]*statGroup       // statMapping holds the StatGroups of complete results, by label
+	partialStatMapping map[string]*statGroup       // partialStatMapping holds the StatGroups of partial results, by label
+	logStatMapping     map[string]*logStatGroup    // logStatMapping holds the log-space stats of complete results, by label, if enabled
+	queueStatMapping   map[string]*statGroup       // queueStatMapping holds the StatGroups of the queuing delays of complete results, by label
+	serviceStatMapping map[string]*statGroup       // serviceStatMapping holds the StatGroups of the service times of complete results, by label
+	windows            *windowedStats              // windows holds the stats of complete results per window of time, if enabled
+	recent             *ringStatGroup              // recent holds the last complete results in order, if enabled
+	live               *liveStats                  // live holds the stats of complete results of the latest window of time, if enabled
+	latencies          *latencyLog                 // latencies is where every latency aggregated is logged, if enabled
+	workers            *workerStats                // workers holds the stats of complete results by worker, and by label and worker, if enabled
+	buckets            map[string]*adaptiveBuckets // buckets holds the adaptive buckets of complete results, by label, the ASCII histograms are drawn with, if enabled
+
+	ingestStatMapping   map[string]*statGroup // ingestStatMapping holds the StatGroups of the latencies of inserting data during a mixed run, by label
+	intervalStatMapping map[string]*statGroup // intervalStatMapping holds the StatGroups of the complete results since the last interval stats, by label, if enabled
+
+	paused              int32                 // paused is 1 while stat collection is paused, accessed atomically
+	excludedStatMapping map[string]*statGroup // excludedStatMapping holds the StatGroups of the results received while paused, by label
+
+	budgetDone    chan struct{} // budgetDone is closed once the time budget is used up
+	budgetReached int32         // budgetReached is 1 once the time budget is used up, accessed atomically
+	took          time.Duration // took is how long the run took, set at its end
+	processed     uint64        // processed is the number of queries counted towards the limit and the burn-in so far, saved in checkpoints
+
+	anonymizedResume bool // anonymizedResume is set once an anonymized checkpoint is loaded, whose StatGroups are keyed by the hashes of their labels
 }
 
 func newStatProcessor(args *statProcessorArgs) statProcessor {
 	if args == nil {
 		panic("Stat Processor needs args")
 	}
-	return &defaultStatProcessor{args: args}
+	return &defaultStatProcessor{args: args, clock: realClock{}, budgetDone: make(chan struct{})}
 }
 
 func (sp *defaultStatProcessor) getArgs() *statProcessorArgs {
@@ -73,22 +142,44 @@ func (sp *defaultStatProcessor) sendWarm(stats []*Stat) {
 func (sp *defaultStatProcessor) process(workers uint) {
 	sp.c = make(chan *Stat, workers)
 	sp.wg.Add(1)
-	const allQueriesLabel = labelAllQueries
-	statMapping := map[string]*statGroup{
-		allQueriesLabel: newStatGroup(*sp.args.limit),
+	sp.initStatMappings()
+	if sp.args.resumeCheckpoint {
+		if err := sp.LoadCheckpoint(sp.args.checkpointFile); err != nil {
+			log.Fatalf("cannot resume from checkpoint %s: %v", sp.args.checkpointFile, err)
+		}
 	}
-	// Only needed when differentiating between cold & warm
-	if sp.args.prewarmQueries {
-		statMapping[labelColdQueries] = newStatGroup(*sp.args.limit)
-		statMapping[labelWarmQueries] = newStatGroup(*sp.args.limit)
+	if len(sp.args.latencyLogFile) > 0 {
+		// resuming a run carries on with its latency log
+		latencies, err := openLatencyLog(sp.args.latencyLogFile, sp.args.resumeCheckpoint, sp.args.anonymizer)
+		if err != nil {
+			log.Fatalf("cannot open latency log %s: %v", sp.args.latencyLogFile, err)
+		}
+		sp.latencies = latencies
 	}
+	statMapping := sp.statMapping
 
-	i := uint64(0)
-	start := time.Now()
+	i := sp.processed
+	start := sp.clock.Now()
 	prevTime := start
 	prevRequestCount := uint64(0)
+	lastCheckpoint := start
+	lastInterval := start
+	// the budget is watched on its own, as it is used up even when no stat
+	// arrives, e.g., while all workers are stuck or during the burn-in
+	stopWatching := make(chan struct{})
+	watched := make(chan struct{})
+	go sp.watchBudget(start, stopWatching, watched)
 
 	for stat := range sp.c {
+		if stat.isIngest {
+			// inserts are neither queries to count nor subject to the burn-in
+			if err := sp.aggregate(stat); err != nil {
+				log.Printf("skipping stat for %s: %v", sp.exportedLabel(string(stat.label)), err)
+			}
+			sp.logLatency(stat)
+			statPool.Put(stat)
+			continue
+		}
 		atomic.AddUint64(&sp.opsCount, 1)
 		if i < sp.args.burnIn {
 			i++
@@ -100,24 +191,12 @@ func (sp *defaultStatProcessor) process(workers uint) {
 				log.Fatal(err)
 			}
 		}
-		if _, ok := statMapping[string(stat.label)]; !ok {
-			statMapping[string(stat.label)] = newStatGroup(*sp.args.limit)
+		if err := sp.aggregate(stat); err != nil {
+			log.Printf("skipping stat for %s: %v", sp.exportedLabel(string(stat.label)), err)
 		}
-
-		statMapping[string(stat.label)].push(stat.value)
+		sp.logLatency(stat)
 
 		if !stat.isPartial {
-			statMapping[allQueriesLabel].push(stat.value)
-
-			// Only needed when differentiating between cold & warm
-			if sp.args.prewarmQueries {
-				if stat.isWarm {
-					statMapping[labelWarmQueries].push(stat.value)
-				} else {
-					statMapping[labelColdQueries].push(stat.value)
-				}
-			}
-
 			// If we're prewarming queries (i.e., running them twice in a row),
 			// only increment the counter for the first (cold) query. Otherwise,
 			// increment for every query.
@@ -127,10 +206,13 @@ func (sp *defaultStatProcessor) process(workers uint) {
 		}
 
 		statPool.Put(stat)
+		sp.processed = i
+		sp.checkpointIfDue(&lastCheckpoint)
+		sp.writeIntervalStatsIfDue(os.Stderr, start, &lastInterval)
 
 		// print stats to stderr (if printInterval is greater than zero):
 		if sp.args.printInterval > 0 && i > 0 && i%sp.args.printInterval == 0 && (i < *sp.args.limit || *sp.args.limit == 0) {
-			now := time.Now()
+			now := sp.clock.Now()
 			sinceStart := now.Sub(start)
 			took := now.Sub(prevTime)
 			intervalQueryRate := float64(sp.opsCount-prevRequestCount) / float64(took.Seconds())
@@ -144,7 +226,7 @@ func (sp *defaultStatProcessor) process(workers uint) {
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = writeStatGroupMap(os.Stderr, statMapping)
+			err = writeStatGroupMap(os.Stderr, sp.exported().statMapping)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -156,32 +238,712 @@ func (sp *defaultStatProcessor) process(workers uint) {
 			prevTime = now
 		}
 	}
-	sinceStart := time.Now().Sub(start)
+	close(stopWatching)
+	<-watched
+	if sp.latencies != nil {
+		if err := sp.latencies.Close(); err != nil {
+			log.Fatalf("cannot write latency log %s: %v", sp.args.latencyLogFile, err)
+		}
+	}
+	sinceStart := sp.clock.Now().Sub(start)
+	sp.took = sinceStart
 	overallQueryRate := float64(sp.opsCount) / float64(sinceStart.Seconds())
-	// the final stats output goes to stdout:
-	_, err := fmt.Printf("Run complete after %d queries with %d workers (Overall query rate %0.2f queries/sec):\n", i-sp.args.burnIn, workers,overallQueryRate)
-	if err != nil {
-		log.Fatal(err)
+	// the final stats output goes to stdout, unless told otherwise:
+	sinks := sp.args.reportSinks
+	if len(sinks) == 0 {
+		sinks = []io.Writer{os.Stdout}
 	}
-	err = writeStatGroupMap(os.Stdout, statMapping)
-	if err != nil {
-		log.Fatal(err)
+	report := sp.exported()
+	writeToSinks(sinks, func(w io.Writer) error {
+		return report.writeReport(w, i-sp.args.burnIn, workers, overallQueryRate)
+	})
+
+	if len(sp.args.labelMappingFile) > 0 && sp.args.anonymizer != nil {
+		_, _ = fmt.Printf("Saving the mapping of anonymized labels to %s\n", sp.args.labelMappingFile)
+		f, err := os.Create(sp.args.labelMappingFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = sp.args.anonymizer.writeMapping(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(sp.args.resultsProtoFile) > 0 {
+		_, _ = fmt.Printf("Saving the result as protobuf to %s\n", sp.args.resultsProtoFile)
+		b, err := report.resultWithHistograms().MarshalProto()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = ioutil.WriteFile(sp.args.resultsProtoFile, b, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(sp.args.resultsParquetFile) > 0 {
+		_, _ = fmt.Printf("Saving the stats as Parquet to %s\n", sp.args.resultsParquetFile)
+		f, err := os.Create(sp.args.resultsParquetFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writeParquet(f, report.statMapping)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(sp.args.goBenchFile) > 0 {
+		_, _ = fmt.Printf("Saving the stats in the Go benchmark format to %s\n", sp.args.goBenchFile)
+		f, err := os.Create(sp.args.goBenchFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r := &Reporter{Format: ReportGoBench, Sinks: []io.Writer{f}, Metadata: sp.args.runMetadata}
+		err = r.report(report.queryStatGroups())
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if len(sp.args.hdrLatenciesFile) > 0  {
 		_, _ = fmt.Printf("Saving High Dynamic Range (HDR) Histogram of Response Latencies to %s\n", sp.args.hdrLatenciesFile)
 
-		d1 := []byte(statMapping[allQueriesLabel].latencyHDRHistogram.PercentilesPrint(10, 1000.0))
-		err = ioutil.WriteFile(sp.args.hdrLatenciesFile, d1, 0644)
+		all := statMapping[labelAllQueries]
+		d1 := []byte(all.latencyHDRHistogram.PercentilesPrint(10, all.scaleFactor))
+		err := ioutil.WriteFile(sp.args.hdrLatenciesFile, d1, 0644)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 	}
 
+	if len(sp.args.throughputCSVFile) > 0 && sp.windows != nil {
+		_, _ = fmt.Printf("Saving throughput per window of time to %s\n", sp.args.throughputCSVFile)
+		f, err := os.Create(sp.args.throughputCSVFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = sp.windows.WriteThroughputCSV(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	sp.wg.Done()
 }
 
+// writeReport writes the final report of the run to w.
+func (sp *defaultStatProcessor) writeReport(w io.Writer, queries uint64, workers uint, overallQueryRate float64) error {
+	if err := writeMetadata(w, "", sp.args.runMetadata); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Run complete after %d queries with %d workers (Overall query rate %0.2f queries/sec):\n", queries, workers, overallQueryRate)
+	if err != nil {
+		return wrapWriteError(err)
+	}
+	if atomic.LoadInt32(&sp.budgetReached) == 1 {
+		_, err = fmt.Fprintf(w, "Run stopped early: time budget of %v used up\n", sp.args.maxDuration)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	err = sp.writeCompleteStats(w)
+	if err != nil {
+		return err
+	}
+	if len(sp.partialStatMapping) > 0 {
+		_, err = fmt.Fprintln(w, "Partial results:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeStatGroupMap(w, sp.partialStatMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sp.excludedStatMapping) > 0 {
+		_, err = fmt.Fprintln(w, "Excluded while paused:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeStatGroupMap(w, sp.excludedStatMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sp.ingestStatMapping) > 0 {
+		_, err = fmt.Fprintln(w, "Ingest latency:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeStatGroupMap(w, sp.ingestStatMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sp.queueStatMapping) > 0 {
+		_, err = fmt.Fprintln(w, "Queuing delay:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeStatGroupMap(w, sp.queueStatMapping)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, "Service time:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeStatGroupMap(w, sp.serviceStatMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if sp.workers != nil && len(sp.workers.workers) > 0 {
+		err = sp.workers.write(w, sp.took, sp.statMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sp.buckets) > 0 {
+		_, err = fmt.Fprintln(w, "Latency histograms:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = sp.writeHistograms(w)
+		if err != nil {
+			return err
+		}
+	}
+	if sp.args.tailSampler != nil {
+		err = sp.args.tailSampler.write(w, sp.args.anonymizer)
+		if err != nil {
+			return err
+		}
+	}
+	if sp.args.apdexTarget > 0 {
+		_, err = fmt.Fprintf(w, "Apdex (target %v):\n", sp.args.apdexTarget)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeApdex(w, sp.statMapping, float64(sp.args.apdexTarget)/float64(time.Millisecond))
+		if err != nil {
+			return err
+		}
+	}
+	if sp.args.omissionInterval > 0 {
+		_, err = fmt.Fprintf(w, "Cost of coordinated omission (expected interval %v):\n", sp.args.omissionInterval)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeOmissionCosts(w, sp.statMapping, float64(sp.args.omissionInterval)/float64(time.Millisecond))
+		if err != nil {
+			return err
+		}
+	}
+	if sp.args.absoluteDeviations {
+		_, err = fmt.Fprintln(w, "Absolute deviations:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeAbsoluteDeviations(w, sp.statMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if sp.logStatMapping != nil {
+		_, err = fmt.Fprintln(w, "Log-space stats:")
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		err = writeLogStatGroupMap(w, sp.logStatMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if sp.windows != nil && sp.args.stallFraction > 0 {
+		if stalls := sp.windows.stalls(sp.args.stallFraction); len(stalls) > 0 {
+			_, err = fmt.Fprintf(w, "Throughput stalls (below %0.0f%% of the running median):\n", 100*sp.args.stallFraction)
+			if err != nil {
+				return wrapWriteError(err)
+			}
+			err = sp.windows.writeStalls(w, stalls)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if sp.windows != nil && sp.args.targetRate > 0 {
+		_, err = fmt.Fprintf(w, "Offered rate: %0.2f queries/sec, achieved rate: %0.2f queries/sec\n", sp.args.targetRate, overallQueryRate)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		for _, s := range sp.windows.belowRate(sp.args.targetRate, utils.SustainedRateFraction) {
+			_, err = fmt.Fprintf(w, "warning: the offered rate was not sustained at %v for %v, min throughput: %0.2f queries/sec\n", s.start.Sub(sp.windows.start), s.duration, s.minThroughput)
+			if err != nil {
+				return wrapWriteError(err)
+			}
+		}
+	}
+	if sp.windows != nil && sp.args.latencyKnee {
+		if knee, ok := sp.windows.latencyKnee(); ok {
+			_, err = fmt.Fprintf(w, "Latency knee: %0.2f queries/sec at a mean latency of %0.2fms, latency climbs sharply beyond\n", knee.throughput, knee.latency)
+		} else {
+			_, err = fmt.Fprintln(w, "Latency knee: not enough distinct throughputs to tell")
+		}
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	if sp.recent != nil && sp.recent.Count() > 0 {
+		_, err = fmt.Fprintf(w, "Last %d queries: effective sample size: %0.0f (lag-1 autocorrelation %0.2f), mean: %0.2fms ±%0.2fms (95%% confidence)\n",
+			sp.recent.Count(), sp.recent.EffectiveSampleSize(), sp.recent.lag1Autocorrelation(), sp.recent.Mean(), sp.recent.MeanConfidenceInterval(0.95))
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	if sp.args.minSampleCount > 0 {
+		for _, warning := range lowSampleCountWarnings(sp.statMapping, int64(sp.args.minSampleCount)) {
+			_, err = fmt.Fprintln(w, warning)
+			if err != nil {
+				return wrapWriteError(err)
+			}
+		}
+	}
+	if sp.args.outlierThreshold > 0 {
+		for _, warning := range outlierWarnings(sp.queryStatGroups(), sp.args.outlierThreshold) {
+			_, err = fmt.Fprintln(w, warning)
+			if err != nil {
+				return wrapWriteError(err)
+			}
+		}
+	}
+	for _, warning := range bimodalWarnings(sp.queryStatGroups()) {
+		_, err = fmt.Fprintln(w, warning)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// exportedLabel returns label as it is to be exported, i.e., replaced by its
+// hash if asked to anonymize labels.
+func (sp *defaultStatProcessor) exportedLabel(label string) string {
+	if sp.args.anonymizer == nil {
+		return label
+	}
+	return sp.args.anonymizer.anonymize(label)
+}
+
+// exported returns the stats as they are to be exported, i.e., with their
+// labels replaced by their hashes if asked to anonymize them.
+func (sp *defaultStatProcessor) exported() *defaultStatProcessor {
+	a := sp.args.anonymizer
+	if a == nil {
+		return sp
+	}
+	sp.mappingMu.RLock()
+	defer sp.mappingMu.RUnlock()
+	exported := &defaultStatProcessor{
+		args:               sp.args,
+		clock:              sp.clock,
+		opsCount:           atomic.LoadUint64(&sp.opsCount),
+		statMapping:        a.anonymizeStatGroups(sp.statMapping),
+		partialStatMapping: a.anonymizeStatGroups(sp.partialStatMapping),
+		queueStatMapping:   a.anonymizeStatGroups(sp.queueStatMapping),
+		serviceStatMapping: a.anonymizeStatGroups(sp.serviceStatMapping),
+		windows:            sp.windows,
+		budgetReached:      atomic.LoadInt32(&sp.budgetReached),
+		took:               sp.took,
+	}
+	if sp.workers != nil {
+		exported.workers = sp.workers.anonymized(a)
+	}
+	if sp.buckets != nil {
+		exported.buckets = make(map[string]*adaptiveBuckets, len(sp.buckets))
+		for k, b := range sp.buckets {
+			exported.buckets[a.anonymize(k)] = b
+		}
+	}
+	exported.excludedStatMapping = a.anonymizeStatGroups(sp.excludedStatMapping)
+	exported.ingestStatMapping = a.anonymizeStatGroups(sp.ingestStatMapping)
+	if sp.logStatMapping != nil {
+		exported.logStatMapping = make(map[string]*logStatGroup, len(sp.logStatMapping))
+		for k, lsg := range sp.logStatMapping {
+			exported.logStatMapping[a.anonymize(k)] = lsg
+		}
+	}
+	return exported
+}
+
+// writeCompleteStats writes the StatGroups of complete results. If there are
+// too many labels to display, the aggregate groups such as "all queries" are
+// written first, then only the top labels and a summary of the others.
+func (sp *defaultStatProcessor) writeCompleteStats(w io.Writer) error {
+	queryStatGroups := sp.queryStatGroups()
+	if sp.args.maxDisplayedGroups == 0 || len(queryStatGroups) <= sp.args.maxDisplayedGroups {
+		return writeStatGroupMap(w, sp.statMapping)
+	}
+	aggregates := map[string]*statGroup{}
+	for k, sg := range sp.statMapping {
+		if _, ok := queryStatGroups[k]; !ok {
+			aggregates[k] = sg
+		}
+	}
+	if err := writeStatGroupMap(w, aggregates); err != nil {
+		return err
+	}
+	metric := sp.args.displayMetric
+	if metric == nil {
+		metric = groupMetrics[defaultDisplayOrder]
+	}
+	return writeTruncatedStatGroupMap(w, queryStatGroups, sp.args.maxDisplayedGroups, metric)
+}
+
+// queryStatGroups returns the StatGroups of complete results of each query
+// label, i.e., without the aggregate groups such as "all queries".
+func (sp *defaultStatProcessor) queryStatGroups() map[string]*statGroup {
+	statGroups := make(map[string]*statGroup, len(sp.statMapping))
+	for k, sg := range sp.statMapping {
+		switch k {
+		case labelAllQueries, labelColdQueries, labelWarmQueries:
+			continue
+		}
+		statGroups[k] = sg
+	}
+	return statGroups
+}
+
+// writeToSinks calls write for each of the sinks. A sink failing is logged and
+// does not stop the others from being written to; the errors of all the sinks
+// that failed are returned, in order.
+func writeToSinks(sinks []io.Writer, write func(w io.Writer) error) []error {
+	var errs []error
+	for i, sink := range sinks {
+		if err := write(sink); err != nil {
+			log.Printf("cannot write report to sink %d: %v", i, err)
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// writeIntervalStatsIfDue writes the stats of the complete results since the
+// last interval stats (at last) to w, and starts collecting them afresh, if
+// they are due, i.e., once a period of intervalPeriod has passed, e.g., to
+// observe the steady state of a long run or its performance degrading over
+// time.
+func (sp *defaultStatProcessor) writeIntervalStatsIfDue(w io.Writer, start time.Time, last *time.Time) {
+	if sp.intervalStatMapping == nil {
+		return
+	}
+	now := sp.clock.Now()
+	if now.Sub(*last) < sp.args.intervalPeriod {
+		return
+	}
+	sp.mappingMu.RLock()
+	snapshots := make(map[string]*statGroup, len(sp.intervalStatMapping))
+	for k, sg := range sp.intervalStatMapping {
+		snapshots[k] = sg.SnapshotAndReset()
+	}
+	sp.mappingMu.RUnlock()
+	if a := sp.args.anonymizer; a != nil {
+		snapshots = a.anonymizeStatGroups(snapshots)
+	}
+	_, err := fmt.Fprintf(w, "Interval from %v to %v:\n", last.Sub(start).Round(time.Second), now.Sub(start).Round(time.Second))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeStatGroupMap(w, snapshots)
+	if err != nil {
+		log.Fatal(err)
+	}
+	*last = now
+}
+
+// checkBudget signals, by closing budgetDone, that the run should stop once
+// the time since start has reached the time budget (if any).
+func (sp *defaultStatProcessor) checkBudget(start time.Time) {
+	if atomic.LoadInt32(&sp.budgetReached) == 1 || sp.args.maxDuration <= 0 {
+		return
+	}
+	if sp.clock.Now().Sub(start) >= sp.args.maxDuration {
+		atomic.StoreInt32(&sp.budgetReached, 1)
+		close(sp.budgetDone)
+	}
+}
+
+// watchBudget calls checkBudget every budgetCheckInterval until the budget is
+// used up or stop is closed, then closes done.
+func (sp *defaultStatProcessor) watchBudget(start time.Time, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if sp.args.maxDuration <= 0 {
+		return
+	}
+	ticker := time.NewTicker(budgetCheckInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&sp.budgetReached) == 0 {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sp.checkBudget(start)
+		}
+	}
+}
+
+func (sp *defaultStatProcessor) budgetExhausted() <-chan struct{} {
+	return sp.budgetDone
+}
+
+// initStatMappings creates the StatGroups that exist regardless of which
+// queries are run.
+func (sp *defaultStatProcessor) initStatMappings() {
+	sp.mappingMu.Lock()
+	defer sp.mappingMu.Unlock()
+	sp.statMapping = map[string]*statGroup{
+		labelAllQueries: sp.newStatGroup(),
+	}
+	// Only needed when differentiating between cold & warm
+	if sp.args.prewarmQueries {
+		sp.statMapping[labelColdQueries] = sp.newStatGroup()
+		sp.statMapping[labelWarmQueries] = sp.newStatGroup()
+	}
+	sp.partialStatMapping = map[string]*statGroup{}
+	sp.queueStatMapping = map[string]*statGroup{}
+	sp.ingestStatMapping = map[string]*statGroup{}
+	sp.serviceStatMapping = map[string]*statGroup{}
+	sp.excludedStatMapping = map[string]*statGroup{}
+	if sp.args.logSpaceStats {
+		sp.logStatMapping = map[string]*logStatGroup{}
+	}
+	if sp.args.windowWidth > 0 {
+		sp.windows = newWindowedStats(sp.clock, sp.args.windowWidth)
+	}
+	if sp.args.recentWindowSize > 0 {
+		sp.recent = newRingStatGroup(sp.args.recentWindowSize)
+	}
+	if sp.args.intervalPeriod > 0 {
+		sp.intervalStatMapping = map[string]*statGroup{}
+	}
+	if sp.args.liveMetrics {
+		sp.live = newLiveStats(sp.clock, liveStatsWindow)
+	}
+	if sp.args.workerStats {
+		sp.workers = newWorkerStats()
+	}
+	if sp.args.histogramBuckets > 0 {
+		sp.buckets = map[string]*adaptiveBuckets{}
+	}
+}
+
+// writeHistograms writes the ASCII histogram of the complete results of each
+// label, sorted, over its adaptive buckets (see writeASCIIHistogram).
+func (sp *defaultStatProcessor) writeHistograms(w io.Writer) error {
+	labels := make([]string, 0, len(sp.buckets))
+	for k := range sp.buckets {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		sg, ok := sp.statMapping[k]
+		if !ok || sg.count == 0 {
+			continue
+		}
+		if err := writeASCIIHistogram(w, k, sg, asciiHistogramWidth, sp.buckets[k].bucketEdges()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pause makes the StatProcessor set aside the results received from now on,
+// until Resume is called, e.g., during an intentional disruption such as a
+// compaction: they are aggregated per label on their own, and do not affect
+// any other stats. It is safe to call while the stats are being processed.
+func (sp *defaultStatProcessor) Pause() {
+	atomic.StoreInt32(&sp.paused, 1)
+}
+
+// Resume makes the StatProcessor aggregate the results received again, after Pause.
+func (sp *defaultStatProcessor) Resume() {
+	atomic.StoreInt32(&sp.paused, 0)
+}
+
+// aggregate pushes the value of a Stat to the StatGroups it is part of.
+// Partial results (e.g., queries that timed out) are aggregated on their own,
+// per label, so they do not distort the latencies of complete results.
+// Labels are canonicalized first, if asked to, so near-identical labels are
+// aggregated together. A value that cannot be recorded is not pushed to any group.
+func (sp *defaultStatProcessor) aggregate(stat *Stat) error {
+	label := stat.label
+	if sp.args.canonicalizeLabel != nil {
+		label = []byte(sp.args.canonicalizeLabel(string(label)))
+	}
+	if atomic.LoadInt32(&sp.paused) == 1 {
+		return sp.labelStatGroup(sp.excludedStatMapping, label).push(stat.value)
+	}
+	if stat.isPartial {
+		return sp.labelStatGroup(sp.partialStatMapping, label).push(stat.value)
+	}
+	if stat.isIngest {
+		return sp.labelStatGroup(sp.ingestStatMapping, label).push(stat.value)
+	}
+
+	if err := sp.push(sp.labelStatGroup(sp.statMapping, label), stat.value); err != nil {
+		return err
+	}
+	sp.push(sp.statMapping[labelAllQueries], stat.value)
+	if sp.live != nil {
+		if err := sp.live.push(string(label), stat.value); err != nil {
+			log.Printf("cannot push the stat for %s to the live metrics: %v", sp.exportedLabel(string(label)), err)
+		}
+	}
+	if sp.workers != nil && stat.worker >= 0 {
+		combination, all := sp.workers.groups(string(label), stat.worker)
+		sp.push(combination, stat.value)
+		sp.push(all, stat.value)
+	}
+	if sp.buckets != nil {
+		for _, k := range []string{string(label), labelAllQueries} {
+			b, ok := sp.buckets[k]
+			if !ok {
+				b = newAdaptiveBuckets(sp.args.histogramBuckets, adaptiveSampleSize)
+				sp.buckets[k] = b
+			}
+			b.push(stat.value)
+		}
+	}
+	if sp.intervalStatMapping != nil {
+		sp.push(sp.labelStatGroup(sp.intervalStatMapping, label), stat.value)
+		sp.push(sp.labelStatGroup(sp.intervalStatMapping, []byte(labelAllQueries)), stat.value)
+	}
+	if stat.hasComponents {
+		// the components are what they were measured to be, so they are not corrected
+		if err := sp.labelStatGroup(sp.queueStatMapping, label).push(stat.queueDelay); err != nil {
+			return err
+		}
+		if err := sp.labelStatGroup(sp.serviceStatMapping, label).push(stat.serviceTime); err != nil {
+			return err
+		}
+	}
+	if sp.logStatMapping != nil {
+		lsg, ok := sp.logStatMapping[string(label)]
+		if !ok {
+			lsg = &logStatGroup{}
+			if hash, ok := sp.resumedKey(string(label)); ok && sp.logStatMapping[hash] != nil {
+				lsg = sp.logStatMapping[hash]
+				delete(sp.logStatMapping, hash)
+			}
+			sp.logStatMapping[string(label)] = lsg
+		}
+		// values that are not positive are counted by the group
+		_ = lsg.push(stat.value)
+	}
+	if sp.args.tailSampler != nil {
+		// tail samples keep the full detail of the original label
+		sp.args.tailSampler.push(stat.label, stat.value)
+	}
+	if sp.windows != nil {
+		sp.windows.push(stat.value)
+	}
+	if sp.recent != nil {
+		sp.recent.push(stat.value)
+	}
+
+	// Only needed when differentiating between cold & warm
+	if sp.args.prewarmQueries {
+		if stat.isWarm {
+			sp.push(sp.statMapping[labelWarmQueries], stat.value)
+		} else {
+			sp.push(sp.statMapping[labelColdQueries], stat.value)
+		}
+	}
+	return nil
+}
+
+// logLatency writes the latency of stat to the latency log, if enabled.
+func (sp *defaultStatProcessor) logLatency(stat *Stat) {
+	if sp.latencies == nil {
+		return
+	}
+	if err := sp.latencies.write(sp.clock.Now(), stat); err != nil {
+		log.Fatalf("cannot write latency log %s: %v", sp.args.latencyLogFile, err)
+	}
+}
+
+// push pushes the value of a complete result to sg, corrected for coordinated
+// omission if queries are expected to start at a fixed interval. The windows
+// are not corrected, as they also measure the actual throughput.
+func (sp *defaultStatProcessor) push(sg *statGroup, value float64) error {
+	return sg.pushCorrected(value, float64(sp.args.expectedInterval)/float64(time.Millisecond))
+}
+
+// labelStatGroup returns the StatGroup for label in statMapping, creating it if needed.
+func (sp *defaultStatProcessor) labelStatGroup(statMapping map[string]*statGroup, label []byte) *statGroup {
+	sg, ok := statMapping[string(label)]
+	if !ok {
+		sp.mappingMu.Lock()
+		defer sp.mappingMu.Unlock()
+		if hash, ok := sp.resumedKey(string(label)); ok {
+			if sg, ok := statMapping[hash]; ok {
+				delete(statMapping, hash)
+				statMapping[string(label)] = sg
+				return sg
+			}
+		}
+		sg = sp.newStatGroup()
+		statMapping[string(label)] = sg
+	}
+	return sg
+}
+
+// CurrentMean returns the mean of the complete results of label so far, in
+// milliseconds, 0 if there are none. It is safe to call while the stats are
+// being processed, e.g., for a controller throttling the load when latency
+// climbs past a target.
+func (sp *defaultStatProcessor) CurrentMean(label string) float64 {
+	sp.mappingMu.RLock()
+	sg, ok := sp.statMapping[label]
+	sp.mappingMu.RUnlock()
+	if !ok {
+		return 0
+	}
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	if sg.count == 0 {
+		return 0
+	}
+	return sg.sum / float64(sg.count)
+}
+
+// newStatGroup returns a new StatGroup, precise if nanosecond precision was asked for.
+func (sp *defaultStatProcessor) newStatGroup() *statGroup {
+	if sp.args.preciseLatencies {
+		return newPreciseStatGroup()
+	}
+	return newStatGroup(*sp.args.limit)
+}
+
 // CloseAndWait closes the stats channel and blocks until the StatProcessor has finished all the stats on its channel.
 func (sp *defaultStatProcessor) CloseAndWait() {
 	close(sp.c)
@@ -0,0 +1,207 @@
+package query
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// statsCheckpointVersion is the version of the format of checkpoints, to be
+// bumped whenever the format changes incompatibly.
+const statsCheckpointVersion = 1
+
+// statsCheckpoint is the binary (gob) form of the stats aggregated by a
+// defaultStatProcessor, from which a restarted run can resume.
+type statsCheckpoint struct {
+	Version    int
+	Processed  uint64 // Processed is the number of queries counted towards the limit and the burn-in
+	Anonymized bool   // Anonymized tells that the labels are replaced by their hashes, by the anonymizer of the run
+	Complete   map[string]statGroupRecord
+	Partial    map[string]statGroupRecord
+	LogSpace   map[string]logStatGroupRecord
+	Queue      map[string]statGroupRecord
+	Service    map[string]statGroupRecord
+	Ingest     map[string]statGroupRecord
+	Excluded   map[string]statGroupRecord
+}
+
+// logStatGroupRecord is the binary form of a logStatGroup.
+type logStatGroupRecord struct {
+	Count       int64
+	Mean        float64
+	M2          float64
+	NonPositive int64
+}
+
+// statGroupRecords returns the binary forms of the StatGroups, by label, or
+// by the hash of their label by a, if not nil.
+func statGroupRecords(statGroups map[string]*statGroup, a *labelAnonymizer) map[string]statGroupRecord {
+	records := make(map[string]statGroupRecord, len(statGroups))
+	for k, sg := range statGroups {
+		if a != nil {
+			k = a.anonymize(k)
+		}
+		records[k] = newStatGroupRecord(sg)
+	}
+	return records
+}
+
+// SaveCheckpoint writes all the stats aggregated so far (that is, all the
+// StatGroups, but not the windows of time) and the number of queries processed
+// to the file at path, replacing it atomically, so a restarted run can resume
+// from it with LoadCheckpoint. The labels are replaced by their hashes if
+// asked to anonymize them, like in the other outputs. It must be called from
+// the goroutine processing the stats.
+func (sp *defaultStatProcessor) SaveCheckpoint(path string) error {
+	a := sp.args.anonymizer
+	c := statsCheckpoint{
+		Version:    statsCheckpointVersion,
+		Processed:  sp.processed,
+		Anonymized: a != nil,
+		Complete:   statGroupRecords(sp.statMapping, a),
+		Partial:    statGroupRecords(sp.partialStatMapping, a),
+		LogSpace:   map[string]logStatGroupRecord{},
+		Queue:      statGroupRecords(sp.queueStatMapping, a),
+		Service:    statGroupRecords(sp.serviceStatMapping, a),
+		Ingest:     statGroupRecords(sp.ingestStatMapping, a),
+		Excluded:   statGroupRecords(sp.excludedStatMapping, a),
+	}
+	for k, lsg := range sp.logStatMapping {
+		if a != nil {
+			k = a.anonymize(k)
+		}
+		c.LogSpace[k] = logStatGroupRecord{Count: lsg.count, Mean: lsg.mean, M2: lsg.m2, NonPositive: lsg.nonPositive}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(&c); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return wrapWriteError(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return wrapWriteError(err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readCheckpoint reads the checkpoint saved at path by SaveCheckpoint.
+func readCheckpoint(path string) (*statsCheckpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c statsCheckpoint
+	if err := gob.NewDecoder(f).Decode(&c); err != nil {
+		return nil, err
+	}
+	if c.Version != statsCheckpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d (want %d)", c.Version, statsCheckpointVersion)
+	}
+	return &c, nil
+}
+
+// checkpointProcessed returns the number of queries processed by the run the
+// checkpoint at path was saved by, e.g., for a restarted run to skip them.
+func checkpointProcessed(path string) (uint64, error) {
+	c, err := readCheckpoint(path)
+	if err != nil {
+		return 0, err
+	}
+	return c.Processed, nil
+}
+
+// LoadCheckpoint replaces the StatGroups aggregated so far, and the number of
+// queries processed, with those saved in the checkpoint at path by
+// SaveCheckpoint, so further values keep adding up to the same totals, and
+// the limit and the burn-in go on from where the run was. The StatGroups of an
+// anonymized checkpoint are keyed by the hashes of their labels until a result
+// of their label is aggregated (see resumedKey), which requires the same
+// anonymization key. It must be called after the stat mappings are
+// initialized, from the goroutine processing the stats.
+func (sp *defaultStatProcessor) LoadCheckpoint(path string) error {
+	c, err := readCheckpoint(path)
+	if err != nil {
+		return err
+	}
+	a := sp.args.anonymizer
+	if c.Anonymized && a == nil {
+		return fmt.Errorf("the labels of the checkpoint are anonymized, resuming from it requires their anonymization key")
+	}
+	restored := []struct {
+		records    map[string]statGroupRecord
+		statGroups map[string]*statGroup
+	}{
+		{c.Complete, sp.statMapping},
+		{c.Partial, sp.partialStatMapping},
+		{c.Queue, sp.queueStatMapping},
+		{c.Service, sp.serviceStatMapping},
+		{c.Ingest, sp.ingestStatMapping},
+		{c.Excluded, sp.excludedStatMapping},
+	}
+	loaded := make([]map[string]*statGroup, len(restored))
+	for i, r := range restored {
+		if loaded[i], err = statGroupsFromRecords(r.records); err != nil {
+			return err
+		}
+	}
+
+	sp.mappingMu.Lock()
+	defer sp.mappingMu.Unlock()
+	for i, r := range restored {
+		for k, sg := range loaded[i] {
+			r.statGroups[k] = sg
+			if c.Anonymized {
+				a.keep(k)
+			}
+		}
+	}
+	sp.processed = c.Processed
+	sp.anonymizedResume = c.Anonymized
+	if sp.logStatMapping != nil {
+		for k, rec := range c.LogSpace {
+			if c.Anonymized {
+				a.keep(k)
+			}
+			sp.logStatMapping[k] = &logStatGroup{count: rec.Count, mean: rec.Mean, m2: rec.M2, nonPositive: rec.NonPositive}
+		}
+	}
+	return nil
+}
+
+// resumedKey returns the hash of label under which its StatGroups were
+// restored from an anonymized checkpoint, for them to be keyed by label again
+// once a result of label is aggregated, and whether one was loaded.
+func (sp *defaultStatProcessor) resumedKey(label string) (string, bool) {
+	if !sp.anonymizedResume {
+		return "", false
+	}
+	hash := sp.args.anonymizer.anonymize(label)
+	return hash, hash != label
+}
+
+// checkpointIfDue saves a checkpoint if checkpoints are enabled and the
+// checkpoint interval has passed since last. Failing to save one is logged
+// and does not stop the run.
+func (sp *defaultStatProcessor) checkpointIfDue(last *time.Time) {
+	if sp.args.checkpointFile == "" || sp.args.checkpointInterval <= 0 {
+		return
+	}
+	now := sp.clock.Now()
+	if now.Sub(*last) < sp.args.checkpointInterval {
+		return
+	}
+	if err := sp.SaveCheckpoint(sp.args.checkpointFile); err != nil {
+		log.Printf("cannot save checkpoint to %s: %v", sp.args.checkpointFile, err)
+	}
+	*last = now
+}
@@ -0,0 +1,182 @@
+package query
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatProcessorCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.checkpoint")
+
+	limit := uint64(0)
+	args := &statProcessorArgs{limit: &limit, logSpaceStats: true}
+	before := newStatProcessor(args).(*defaultStatProcessor)
+	before.initStatMappings()
+	before.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	before.aggregate(GetStat().Init([]byte("foo"), -1.0))
+	before.aggregate(GetStat().Init([]byte("bar"), 10.0))
+	before.aggregate(GetPartialStat().Init([]byte("foo"), 100.0))
+	before.aggregate(GetStat().InitWithQueueDelay([]byte("foo"), 1.0, 3.0))
+	ingest := GetStat().Init([]byte("insert"), 2.0)
+	ingest.isIngest = true
+	before.aggregate(ingest)
+	before.processed = 42
+	if err := before.SaveCheckpoint(path); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// a restarted run
+	after := newStatProcessor(args).(*defaultStatProcessor)
+	after.initStatMappings()
+	if err := after.LoadCheckpoint(path); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	for label, sg := range before.statMapping {
+		if got, want := after.statMapping[label].DebugState(), sg.DebugState(); got != want {
+			t.Errorf("%s: state not restored: got %+v want %+v", label, got, want)
+		}
+	}
+	after.aggregate(GetStat().Init([]byte("foo"), 3.0))
+	after.aggregate(GetStat().Init([]byte("baz"), 5.0))
+
+	want := map[string]struct {
+		count     int64
+		sum       float64
+		skewCount int64
+	}{
+		"foo":           {4, 8.0, 1},
+		"bar":           {1, 10.0, 0},
+		"baz":           {1, 5.0, 0},
+		labelAllQueries: {6, 23.0, 1},
+	}
+	for label, w := range want {
+		sg := after.statMapping[label]
+		if sg.count != w.count || sg.sum != w.sum || sg.skewCount != w.skewCount || sg.latencyHDRHistogram.TotalCount() != w.count {
+			t.Errorf("%s: totals not continuous: got count %d sum %f skew %d want count %d sum %f skew %d",
+				label, sg.count, sg.sum, sg.skewCount, w.count, w.sum, w.skewCount)
+		}
+	}
+	if got := after.partialStatMapping["foo"].count; got != 1 {
+		t.Errorf("incorrect partial count: got %d want %d", got, 1)
+	}
+	if lsg := after.logStatMapping["foo"]; lsg.count != 3 || lsg.nonPositive != 1 {
+		t.Errorf("incorrect log-space stats: got %+v", lsg)
+	}
+	if after.queueStatMapping["foo"] == nil || after.queueStatMapping["foo"].sum != 1.0 || after.serviceStatMapping["foo"].sum != 3.0 {
+		t.Errorf("queue and service stats not restored: got %v, %v", after.queueStatMapping, after.serviceStatMapping)
+	}
+	if sg := after.ingestStatMapping["insert"]; sg == nil || sg.count != 1 {
+		t.Errorf("ingest stats not restored: got %v", after.ingestStatMapping)
+	}
+	// the limit and the burn-in go on from where the run was
+	if after.processed != 42 {
+		t.Errorf("incorrect number of queries processed: got %d want 42", after.processed)
+	}
+	if got, err := checkpointProcessed(path); err != nil || got != 42 {
+		t.Errorf("incorrect number of queries processed of the checkpoint: got %d, %v want 42", got, err)
+	}
+
+	if err := after.LoadCheckpoint(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected error loading a missing checkpoint")
+	}
+}
+
+func TestStatProcessorCheckpointAnonymized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.checkpoint")
+
+	limit := uint64(0)
+	before := newStatProcessor(&statProcessorArgs{limit: &limit, logSpaceStats: true, anonymizer: newLabelAnonymizer([]byte("secret"))}).(*defaultStatProcessor)
+	before.initStatMappings()
+	before.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	before.aggregate(GetStat().Init([]byte("bar"), 10.0))
+	if err := before.SaveCheckpoint(path); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read checkpoint: %v", err)
+	}
+	if bytes.Contains(file, []byte("foo")) || bytes.Contains(file, []byte("bar")) {
+		t.Errorf("label leaked into the checkpoint")
+	}
+
+	// resuming requires the anonymization key
+	if err := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor).LoadCheckpoint(path); err == nil {
+		t.Errorf("expected error loading an anonymized checkpoint without its key")
+	}
+
+	// a restarted run, with a fresh anonymizer of the same key
+	a := newLabelAnonymizer([]byte("secret"))
+	after := newStatProcessor(&statProcessorArgs{limit: &limit, logSpaceStats: true, anonymizer: a}).(*defaultStatProcessor)
+	after.initStatMappings()
+	if err := after.LoadCheckpoint(path); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	after.aggregate(GetStat().Init([]byte("foo"), 3.0))
+
+	// the stats of foo are keyed by its label again, adding up to the same totals
+	if sg := after.statMapping["foo"]; sg == nil || sg.count != 2 || sg.sum != 4.0 {
+		t.Errorf("stats of foo not continuous: got %v", after.statMapping)
+	}
+	if lsg := after.logStatMapping["foo"]; lsg == nil || lsg.count != 2 {
+		t.Errorf("log-space stats of foo not continuous: got %v", after.logStatMapping)
+	}
+	if _, ok := after.statMapping[a.anonymize("foo")]; ok {
+		t.Errorf("stats of foo still keyed by its hash")
+	}
+	// those of bar, which did not reappear, are exported under its hash as is
+	exported := after.exported()
+	for _, label := range []string{"foo", "bar"} {
+		hash := a.anonymize(label)
+		if _, ok := exported.statMapping[hash]; !ok {
+			t.Errorf("stats of %s not exported under its hash %s: got %v", label, hash, exported.statMapping)
+		}
+	}
+	if got := len(exported.statMapping); got != 3 {
+		t.Errorf("incorrect number of exported labels: got %d want 3", got)
+	}
+}
+
+func TestStatProcessorCheckpointIfDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.checkpoint")
+
+	limit := uint64(0)
+	clock := newFakeClock()
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, checkpointFile: path, checkpointInterval: time.Minute}).(*defaultStatProcessor)
+	sp.clock = clock
+	sp.initStatMappings()
+	last := clock.Now()
+
+	clock.advance(59 * time.Second)
+	sp.checkpointIfDue(&last)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint saved before its interval")
+	}
+	clock.advance(time.Second)
+	sp.checkpointIfDue(&last)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("checkpoint not saved at its interval: %v", err)
+	}
+	if !last.Equal(clock.Now()) {
+		t.Errorf("time of the last checkpoint not updated")
+	}
+}
@@ -0,0 +1,105 @@
+package query
+
+import (
+	"sync"
+	"time"
+)
+
+// StatForwarder receives the value of each query of a run as is, e.g., to
+// forward it to an external metrics backend. label is only valid during the call.
+type StatForwarder func(label []byte, value float64, isWarm, isPartial bool)
+
+// passthroughStatProcessor is a statProcessor that does not aggregate any
+// stats: it just hands each Stat past the burn-in over to a StatForwarder,
+// which keeps the overhead of collecting stats to a minimum when they are
+// analyzed elsewhere. It reports nothing at the end of the run.
+type passthroughStatProcessor struct {
+	args       *statProcessorArgs
+	wg         sync.WaitGroup
+	c          chan *Stat // c is the channel for Stats to be sent for processing
+	forward    StatForwarder
+	budgetDone chan struct{} // budgetDone, if the run has a time budget, is closed once it is used up
+}
+
+func newPassthroughStatProcessor(args *statProcessorArgs, forward StatForwarder) statProcessor {
+	if args == nil {
+		panic("Stat Processor needs args")
+	}
+	if forward == nil {
+		panic("passthrough Stat Processor needs a forwarder")
+	}
+	sp := &passthroughStatProcessor{args: args, forward: forward}
+	if args.maxDuration > 0 {
+		sp.budgetDone = make(chan struct{})
+	}
+	return sp
+}
+
+func (sp *passthroughStatProcessor) getArgs() *statProcessorArgs {
+	return sp.args
+}
+
+func (sp *passthroughStatProcessor) send(stats []*Stat) {
+	for _, s := range stats {
+		sp.c <- s
+	}
+}
+
+func (sp *passthroughStatProcessor) sendWarm(stats []*Stat) {
+	for _, s := range stats {
+		s.isWarm = true
+		sp.c <- s
+	}
+}
+
+// process forwards the Stats sent, from a single goroutine so the forwarder
+// does not need to be safe for concurrent use.
+func (sp *passthroughStatProcessor) process(workers uint) {
+	sp.c = make(chan *Stat, workers)
+	sp.wg.Add(1)
+	if timer := sp.startBudget(); timer != nil {
+		defer timer.Stop()
+	}
+	sp.forwardAll()
+	sp.wg.Done()
+}
+
+// forwardAll forwards the Stats sent past the burn-in, until the channel is closed.
+func (sp *passthroughStatProcessor) forwardAll() {
+	i := uint64(0)
+	for stat := range sp.c {
+		if stat.isIngest {
+			// forwarders only know of queries, so inserts are not forwarded
+		} else if i < sp.args.burnIn {
+			i++
+		} else {
+			sp.forwardStat(stat)
+		}
+		statPool.Put(stat)
+	}
+}
+
+// forwardStat hands a Stat over to the forwarder.
+func (sp *passthroughStatProcessor) forwardStat(stat *Stat) {
+	sp.forward(stat.label, stat.value, stat.isWarm, stat.isPartial)
+}
+
+func (sp *passthroughStatProcessor) CloseAndWait() {
+	close(sp.c)
+	sp.wg.Wait()
+}
+
+// startBudget starts the timer closing budgetDone once the time budget is
+// used up, whether or not stats arrive, e.g., if the database stalls. It
+// returns nil if the run has no time budget.
+func (sp *passthroughStatProcessor) startBudget() *time.Timer {
+	if sp.budgetDone == nil {
+		return nil
+	}
+	return time.AfterFunc(sp.args.maxDuration, func() { close(sp.budgetDone) })
+}
+
+// budgetExhausted returns nil if the run has no time budget.
+func (sp *passthroughStatProcessor) budgetExhausted() <-chan struct{} {
+	return sp.budgetDone
+}
@@ -0,0 +1,81 @@
+package query
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPassthroughStatProcessor(t *testing.T) {
+	limit := uint64(0)
+	type forwarded struct {
+		label             string
+		value             float64
+		isWarm, isPartial bool
+	}
+	var got []forwarded
+	sp := newPassthroughStatProcessor(&statProcessorArgs{limit: &limit, burnIn: 1}, func(label []byte, value float64, isWarm, isPartial bool) {
+		got = append(got, forwarded{string(label), value, isWarm, isPartial})
+	}).(*passthroughStatProcessor)
+	sp.c = make(chan *Stat, 4)
+	sp.send([]*Stat{GetStat().Init([]byte("burn-in"), 1.0)})
+	sp.send([]*Stat{GetStat().Init([]byte("foo"), 2.0), GetPartialStat().Init([]byte("foo"), 3.0)})
+	sp.sendWarm([]*Stat{GetStat().Init([]byte("bar"), 4.0)})
+	close(sp.c)
+	sp.forwardAll()
+
+	want := []forwarded{
+		{"foo", 2.0, false, false},
+		{"foo", 3.0, false, true},
+		{"bar", 4.0, true, false},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("incorrect number of stats forwarded: got %d want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("stat %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+	if sp.budgetExhausted() != nil {
+		t.Errorf("passthrough has a time budget")
+	}
+}
+
+func TestPassthroughStatProcessorTimeBudget(t *testing.T) {
+	limit := uint64(0)
+	sp := newPassthroughStatProcessor(&statProcessorArgs{limit: &limit, maxDuration: 10 * time.Millisecond}, func([]byte, float64, bool, bool) {}).(*passthroughStatProcessor)
+	// no stat arrives, as when the database stalls
+	timer := sp.startBudget()
+	defer timer.Stop()
+	select {
+	case <-sp.budgetExhausted():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("time budget not used up")
+	}
+}
+
+var benchmarkLabels = [][]byte{[]byte("lastpoint"), []byte("groupby"), []byte("high-cpu")}
+
+func BenchmarkStatProcessorAggregate(b *testing.B) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	stat := &Stat{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sp.aggregate(stat.Init(benchmarkLabels[i%len(benchmarkLabels)], float64(i%1000)))
+	}
+}
+
+func BenchmarkPassthroughStatProcessorForward(b *testing.B) {
+	limit := uint64(0)
+	sum := 0.0
+	sp := newPassthroughStatProcessor(&statProcessorArgs{limit: &limit}, func(label []byte, value float64, isWarm, isPartial bool) {
+		sum += value
+	}).(*passthroughStatProcessor)
+	stat := &Stat{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sp.forwardStat(stat.Init(benchmarkLabels[i%len(benchmarkLabels)], float64(i%1000)))
+	}
+}
@@ -1,6 +1,13 @@
 package query
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
 	"testing"
 	"time"
 )
@@ -77,3 +84,450 @@ func TestStatProcessorSendWarm(t *testing.T) {
 		t.Errorf("empty stat array changed channel length: got %d want %d", got, wantLen)
 	}
 }
+
+func TestStatProcessorAggregatePartial(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	label := []byte("foo")
+	for _, val := range []float64{1.0, 2.0, 3.0} {
+		sp.aggregate(GetStat().Init(label, val))
+	}
+	for _, val := range []float64{100.0, 200.0} {
+		sp.aggregate(GetPartialStat().Init(label, val))
+	}
+
+	complete := sp.statMapping["foo"]
+	if complete.count != 3 || complete.Max() != 3.0 {
+		t.Errorf("incorrect complete group: got count %d max %f want count %d max %f", complete.count, complete.Max(), 3, 3.0)
+	}
+	partial := sp.partialStatMapping["foo"]
+	if partial == nil {
+		t.Fatalf("no partial group created for label")
+	}
+	if partial.count != 2 || partial.Min() != 100.0 || partial.sum != 300.0 {
+		t.Errorf("incorrect partial group: got count %d min %f sum %f want count %d min %f sum %f", partial.count, partial.Min(), partial.sum, 2, 100.0, 300.0)
+	}
+	if got := sp.statMapping[labelAllQueries].count; got != 3 {
+		t.Errorf("partial results counted in %s: got count %d want %d", labelAllQueries, got, 3)
+	}
+}
+
+func TestStatProcessorTimeBudget(t *testing.T) {
+	limit := uint64(0)
+	clock := newFakeClock()
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, maxDuration: 10 * time.Second}).(*defaultStatProcessor)
+	sp.clock = clock
+	start := clock.Now()
+
+	isDone := func() bool {
+		select {
+		case <-sp.budgetExhausted():
+			return true
+		default:
+			return false
+		}
+	}
+
+	clock.advance(9 * time.Second)
+	sp.checkBudget(start)
+	if isDone() {
+		t.Fatalf("run stopped before its time budget")
+	}
+	clock.advance(time.Second)
+	sp.checkBudget(start)
+	if !isDone() {
+		t.Fatalf("run not stopped at its time budget")
+	}
+	// must not close the channel twice
+	clock.advance(time.Second)
+	sp.checkBudget(start)
+}
+
+func TestStatProcessorTimeBudgetWithoutStats(t *testing.T) {
+	limit := uint64(0)
+	// no stat gets past the burn-in, or even arrives
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, burnIn: 100, maxDuration: 20 * time.Millisecond, reportSinks: []io.Writer{ioutil.Discard}}).(*defaultStatProcessor)
+	go sp.process(1)
+	select {
+	case <-sp.budgetExhausted():
+	case <-time.After(5 * time.Second):
+		t.Errorf("run not stopped at its time budget without stats")
+	}
+	sp.CloseAndWait()
+}
+
+func TestStatProcessorNoTimeBudget(t *testing.T) {
+	limit := uint64(0)
+	clock := newFakeClock()
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.clock = clock
+	start := clock.Now()
+	clock.advance(1000 * time.Hour)
+	sp.checkBudget(start)
+	select {
+	case <-sp.budgetExhausted():
+		t.Errorf("run stopped without a time budget")
+	default:
+	}
+}
+
+// failingWriter is an io.Writer that always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestStatProcessorReportToSinks(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	sp.aggregate(GetStat().Init([]byte("foo"), 3.0))
+
+	var first, second bytes.Buffer
+	errs := writeToSinks([]io.Writer{&first, failingWriter{}, &second}, func(w io.Writer) error {
+		return sp.writeReport(w, 2, 1, 100)
+	})
+	if len(errs) != 1 || !errors.Is(errs[0], ErrWriteFailed) {
+		t.Errorf("incorrect errors: got %v want one matching %v", errs, ErrWriteFailed)
+	}
+	if first.Len() == 0 {
+		t.Fatalf("nothing written to the first sink")
+	}
+	if got, want := second.String(), first.String(); got != want {
+		t.Errorf("sinks got different reports:\n%s\nvs\n%s", got, want)
+	}
+	for _, want := range []string{"Run complete after 2 queries with 1 workers", "foo", labelAllQueries} {
+		if !strings.Contains(first.String(), want) {
+			t.Errorf("report is missing %q:\n%s", want, first.String())
+		}
+	}
+}
+
+func TestStatProcessorCoordinatedOmissionCorrection(t *testing.T) {
+	limit := uint64(0)
+	naive := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	corrected := newStatProcessor(&statProcessorArgs{limit: &limit, expectedInterval: 10 * time.Millisecond}).(*defaultStatProcessor)
+
+	// queries every 10ms take 1ms, but one stalls for 1s, delaying the ~99
+	// queries that should have started meanwhile
+	for _, sp := range []*defaultStatProcessor{naive, corrected} {
+		sp.initStatMappings()
+		for i := 0; i < 99; i++ {
+			sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+		}
+		sp.aggregate(GetStat().Init([]byte("foo"), 1000.0))
+	}
+
+	naiveGroup, correctedGroup := naive.statMapping["foo"], corrected.statMapping["foo"]
+	if got := naiveGroup.count; got != 100 {
+		t.Errorf("incorrect naive count: got %d want %d", got, 100)
+	}
+	// 990ms, 980ms, ... down to 10ms are synthesized for the stall
+	if got := correctedGroup.count; got != 199 {
+		t.Errorf("incorrect corrected count: got %d want %d", got, 199)
+	}
+	if got := corrected.statMapping[labelAllQueries].count; got != 199 {
+		t.Errorf("incorrect corrected count of all queries: got %d want %d", got, 199)
+	}
+	naiveP99, correctedP99 := naiveGroup.Percentile(99), correctedGroup.Percentile(99)
+	if naiveP99 > 1.01 {
+		t.Errorf("incorrect naive p99: got %f want %f", naiveP99, 1.0)
+	}
+	if correctedP99 < 900 {
+		t.Errorf("corrected p99 not higher than naive p99: got %f (naive %f)", correctedP99, naiveP99)
+	}
+}
+
+func TestStatProcessorPreciseLatencies(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, preciseLatencies: true}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 0.0005))
+	for _, label := range []string{"foo", labelAllQueries} {
+		if got := sp.statMapping[label].Min(); got != 0.0005 {
+			t.Errorf("%s: 500ns not preserved: got %vms want %vms", label, got, 0.0005)
+		}
+	}
+}
+
+func TestStatProcessorTailSampler(t *testing.T) {
+	limit := uint64(0)
+	ts := newThresholdTailSampler(newFakeClock(), 10.0, 10)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, tailSampler: ts}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	sp.aggregate(GetStat().Init([]byte("foo"), 50.0))
+	sp.aggregate(GetPartialStat().Init([]byte("foo"), 60.0))
+
+	retained := ts.retained()
+	if len(retained) != 1 || retained[0].value != 50.0 {
+		t.Errorf("incorrect samples retained: got %+v want only the complete 50ms", retained)
+	}
+}
+
+func TestStatProcessorReportMetadata(t *testing.T) {
+	limit := uint64(0)
+	metadata := parseRunMetadata([]string{"scale=100", "commit=abc=123", "dirty"})
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, runMetadata: metadata}).(*defaultStatProcessor)
+	sp.initStatMappings()
+
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 0, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "commit: abc=123\ndirty: \nscale: 100\nRun complete"
+	if got := buf.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("metadata not at the top of the report: got\n%s\nwant prefix\n%s", got, want)
+	}
+}
+
+func TestStatProcessorCurrentMean(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	if got := sp.CurrentMean("foo"); got != 0 {
+		t.Errorf("incorrect mean before processing: got %f want %f", got, 0.0)
+	}
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	sp.aggregate(GetStat().Init([]byte("foo"), 3.0))
+	if got := sp.CurrentMean("foo"); got != 2.0 {
+		t.Errorf("incorrect mean: got %f want %f", got, 2.0)
+	}
+	sp.aggregate(GetStat().Init([]byte("foo"), 8.0))
+	if got := sp.CurrentMean("foo"); got != 4.0 {
+		t.Errorf("mean does not reflect the latest push: got %f want %f", got, 4.0)
+	}
+	if got := sp.CurrentMean("bar"); got != 0 {
+		t.Errorf("incorrect mean of an unknown label: got %f want %f", got, 0.0)
+	}
+
+	// read while new labels and values are being aggregated
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			sp.aggregate(GetStat().Init([]byte(fmt.Sprintf("label-%d", i%50)), 4.0))
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if got := sp.CurrentMean(fmt.Sprintf("label-%d", i%50)); got != 0 && got != 4.0 {
+			t.Fatalf("incorrect concurrent mean: got %f want %f", got, 4.0)
+		}
+	}
+	<-done
+}
+
+func TestStatProcessorLogSpaceStats(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, logSpaceStats: true}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for _, val := range []float64{1.0, 100.0, 0} {
+		sp.aggregate(GetStat().Init([]byte("foo"), val))
+	}
+	lsg := sp.logStatMapping["foo"]
+	if lsg == nil || math.Abs(lsg.GeometricMean()-10) > 1e-9 || lsg.nonPositive != 1 {
+		t.Fatalf("incorrect log-space stats: %+v", lsg)
+	}
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 3, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Log-space stats:\nfoo: geo mean:    10.00ms") {
+		t.Errorf("log-space stats missing from the report:\n%s", buf.String())
+	}
+}
+
+func TestStatProcessorQueueDelay(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().InitWithQueueDelay([]byte("foo"), 3.0, 1.0))
+	sp.aggregate(GetStat().InitWithQueueDelay([]byte("foo"), 5.0, 3.0))
+	sp.aggregate(GetStat().Init([]byte("bar"), 2.0))
+
+	if got := sp.statMapping["foo"].Mean(); got != 6.0 {
+		t.Errorf("incorrect mean latency relative to issue time: got %v want %v", got, 6.0)
+	}
+	if got := sp.queueStatMapping["foo"].Mean(); got != 4.0 {
+		t.Errorf("incorrect mean queuing delay: got %v want %v", got, 4.0)
+	}
+	if got := sp.serviceStatMapping["foo"].Mean(); got != 2.0 {
+		t.Errorf("incorrect mean service time: got %v want %v", got, 2.0)
+	}
+	if _, ok := sp.queueStatMapping["bar"]; ok {
+		t.Errorf("queuing delay recorded for a stat without one")
+	}
+
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 3, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"Queuing delay:\nfoo:", "Service time:\nfoo:"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("report missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestStatProcessorEffectiveSampleSize(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, recentWindowSize: 3}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for _, val := range []float64{100.0, 1.0, 2.0, 3.0} {
+		sp.aggregate(GetStat().Init([]byte("foo"), val))
+	}
+	if got := sp.recent.Mean(); got != 2.0 {
+		t.Errorf("incorrect mean of the last queries: got %f want %f", got, 2.0)
+	}
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 4, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Last 3 queries: effective sample size: ") {
+		t.Errorf("effective sample size missing from the report:\n%s", buf.String())
+	}
+}
+
+func TestStatProcessorPauseResume(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	sp.Pause()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1000.0))
+	sp.aggregate(GetPartialStat().Init([]byte("foo"), 2000.0))
+	sp.Resume()
+	sp.aggregate(GetStat().Init([]byte("foo"), 3.0))
+
+	for _, label := range []string{"foo", labelAllQueries} {
+		if sg := sp.statMapping[label]; sg.count != 2 || sg.Max() != 3.0 {
+			t.Errorf("%s: paused stats aggregated: got count %d max %f", label, sg.count, sg.Max())
+		}
+	}
+	if len(sp.partialStatMapping) != 0 {
+		t.Errorf("paused partial stat aggregated: %v", sp.partialStatMapping)
+	}
+	if sg := sp.excludedStatMapping["foo"]; sg == nil || sg.count != 2 {
+		t.Errorf("paused stats not set aside: %v", sp.excludedStatMapping)
+	}
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 4, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Excluded while paused:\nfoo:") {
+		t.Errorf("excluded stats missing from the report:\n%s", buf.String())
+	}
+}
+
+func TestStatProcessorIngestStats(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	ingest := GetStat().Init([]byte("insert"), 5.0)
+	ingest.isIngest = true
+	sp.aggregate(ingest)
+
+	if sg := sp.statMapping[labelAllQueries]; sg.count != 1 {
+		t.Errorf("ingest stat aggregated with the queries: got count %d", sg.count)
+	}
+	if _, ok := sp.statMapping["insert"]; ok {
+		t.Errorf("ingest stat aggregated with the queries: %v", sp.statMapping)
+	}
+	if sg := sp.ingestStatMapping["insert"]; sg == nil || sg.count != 1 {
+		t.Errorf("ingest stat not aggregated: %v", sp.ingestStatMapping)
+	}
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 1, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Ingest latency:\ninsert:") {
+		t.Errorf("ingest stats missing from the report:\n%s", buf.String())
+	}
+}
+
+func TestStatProcessorTargetRate(t *testing.T) {
+	limit := uint64(0)
+	clock := newFakeClock()
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, windowWidth: time.Second, targetRate: 2}).(*defaultStatProcessor)
+	sp.clock = clock
+	sp.initStatMappings()
+	for _, count := range []int{2, 1, 2} {
+		for i := 0; i < count; i++ {
+			sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+		}
+		clock.advance(time.Second)
+	}
+
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 5, 1, 1.67); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"Offered rate: 2.00 queries/sec, achieved rate: 1.67 queries/sec\n",
+		"warning: the offered rate was not sustained at 1s for 1s, min throughput: 1.00 queries/sec\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in the report:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestStatProcessorIntervalStats(t *testing.T) {
+	limit := uint64(0)
+	clock := newFakeClock()
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, intervalPeriod: 10 * time.Second}).(*defaultStatProcessor)
+	sp.clock = clock
+	sp.initStatMappings()
+	start := clock.Now()
+	last := start
+
+	var buf bytes.Buffer
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	clock.advance(9 * time.Second)
+	sp.writeIntervalStatsIfDue(&buf, start, &last)
+	if buf.Len() != 0 {
+		t.Fatalf("interval stats written before the end of the period:\n%s", buf.String())
+	}
+	sp.aggregate(GetStat().Init([]byte("foo"), 3.0))
+	clock.advance(time.Second)
+	sp.writeIntervalStatsIfDue(&buf, start, &last)
+	if got := buf.String(); !strings.HasPrefix(got, "Interval from 0s to 10s:\n") || !strings.Contains(got, "mean:     2.00ms") || !strings.Contains(got, "count: 2") {
+		t.Errorf("incorrect interval stats:\n%s", got)
+	}
+
+	// the next interval starts afresh, unlike the totals
+	buf.Reset()
+	sp.aggregate(GetStat().Init([]byte("foo"), 10.0))
+	clock.advance(10 * time.Second)
+	sp.writeIntervalStatsIfDue(&buf, start, &last)
+	if got := buf.String(); !strings.HasPrefix(got, "Interval from 10s to 20s:\n") || !strings.Contains(got, "mean:    10.00ms") || !strings.Contains(got, "count: 1") {
+		t.Errorf("incorrect interval stats:\n%s", got)
+	}
+	if got := sp.statMapping["foo"].count; got != 3 {
+		t.Errorf("interval stats reset the totals: got count %d want %d", got, 3)
+	}
+}
+
+func TestStatProcessorIntervalStatsAnonymized(t *testing.T) {
+	limit := uint64(0)
+	clock := newFakeClock()
+	a := newLabelAnonymizer([]byte("secret"))
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, intervalPeriod: 10 * time.Second, anonymizer: a}).(*defaultStatProcessor)
+	sp.clock = clock
+	sp.initStatMappings()
+	start := clock.Now()
+	last := start
+
+	var buf bytes.Buffer
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	clock.advance(10 * time.Second)
+	sp.writeIntervalStatsIfDue(&buf, start, &last)
+	if got := buf.String(); !strings.Contains(got, a.anonymize("foo")) || strings.Contains(got, "foo") {
+		t.Errorf("label not anonymized in the interval stats:\n%s", got)
+	}
+	if got := sp.exportedLabel("foo"); got != a.anonymize("foo") {
+		t.Errorf("incorrect exported label: got %q want %q", got, a.anonymize("foo"))
+	}
+}
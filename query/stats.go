@@ -1,17 +1,60 @@
 package query
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"sort"
 	"sync"
+	"time"
 	"github.com/filipecosta90/hdrhistogram"
 )
 
 var (
 	hdrScaleFactor = 1e3
+	// preciseHDRScaleFactor is the scale factor of precise StatGroups, which
+	// record their values in nanoseconds.
+	preciseHDRScaleFactor = 1e6
 )
 
+var (
+	// ErrNotFinite is returned when a NaN or infinite value is pushed to a StatGroup.
+	ErrNotFinite = errors.New("stats: value is not finite")
+	// ErrWriteFailed is matched (see errors.Is) by the errors returned when
+	// stats cannot be written out.
+	ErrWriteFailed = errors.New("stats: write failed")
+	// ErrIncompatibleStatGroups is returned when merging StatGroups that
+	// track their values with different histogram parameters.
+	ErrIncompatibleStatGroups = errors.New("stats: stat groups have different histogram parameters")
+)
+
+// writeError wraps an error returned by an io.Writer so it matches
+// ErrWriteFailed, while keeping the message of the original error.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+
+// Unwrap returns the original error.
+func (e *writeError) Unwrap() error { return e.err }
+
+// Is reports whether target is ErrWriteFailed.
+func (e *writeError) Is(target error) bool { return target == ErrWriteFailed }
+
+// wrapWriteError wraps a non-nil err to match ErrWriteFailed.
+func wrapWriteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*writeError); ok {
+		return err
+	}
+	return &writeError{err: err}
+}
+
 // Stat represents one statistical measurement, typically used to store the
 // latency of a query (or part of query).
 type Stat struct {
@@ -19,6 +62,13 @@ type Stat struct {
 	value     float64
 	isWarm    bool
 	isPartial bool
+	isIngest  bool // isIngest tells whether value is the latency of inserting data rather than of a query
+
+	hasComponents bool    // hasComponents tells whether value is split into queueDelay and serviceTime
+	queueDelay    float64 // queueDelay is the time from issuing the query to starting it
+	serviceTime   float64 // serviceTime is the time from starting the query to finishing it
+
+	worker int // worker is the number of the worker that ran the query, -1 if unknown (e.g., for inserts)
 }
 
 var statPool = &sync.Pool{
@@ -48,6 +98,20 @@ func (s *Stat) Init(label []byte, value float64) *Stat {
 	s.label = append(s.label, label...)
 	s.value = value
 	s.isWarm = false
+	s.hasComponents = false
+	return s
+}
+
+// InitWithQueueDelay initializes a Stat measured relative to the time the
+// query was issued, i.e., whose value is the sum of the time it waited to be
+// started (queueDelay) and the time it took (serviceTime). Both components
+// are also aggregated on their own, so client side and server side delays
+// can be told apart.
+func (s *Stat) InitWithQueueDelay(label []byte, queueDelay, serviceTime float64) *Stat {
+	s.Init(label, queueDelay+serviceTime)
+	s.hasComponents = true
+	s.queueDelay = queueDelay
+	s.serviceTime = serviceTime
 	return s
 }
 
@@ -56,14 +120,22 @@ func (s *Stat) reset() *Stat {
 	s.value = 0.0
 	s.isWarm = false
 	s.isPartial = false
+	s.isIngest = false
+	s.hasComponents = false
+	s.queueDelay = 0.0
+	s.serviceTime = 0.0
+	s.worker = -1
 	return s
 }
 
 // statGroup collects simple streaming statistics.
 type statGroup struct {
+	mu                  sync.Mutex // mu guards the fields below so a group can be snapshotted while it is being pushed to
 	latencyHDRHistogram *hdrhistogram.Histogram
+	scaleFactor         float64 // scaleFactor is what values (in milliseconds) are multiplied by to be recorded in the histogram
 	sum    float64
 	count int64
+	skewCount int64 // skewCount is the number of negative values pushed (and recorded as 0 instead)
 }
 
 // newStatGroup returns a new StatGroup with an initial size
@@ -79,56 +151,546 @@ func newStatGroup(size uint64) *statGroup {
 	return &statGroup{
 		count:  0,
 		latencyHDRHistogram: lH,
+		scaleFactor:         hdrScaleFactor,
+	}
+}
+
+// newCompactStatGroup returns a new StatGroup whose histogram only keeps 2
+// significant digits, which takes ~100 times less memory than that of
+// newStatGroup. It suits cases where many groups are kept, e.g., one per
+// window of time.
+func newCompactStatGroup() *statGroup {
+	return &statGroup{
+		latencyHDRHistogram: hdrhistogram.New(1, 3600000000, 2),
+		scaleFactor:         hdrScaleFactor,
+	}
+}
+
+// newPreciseStatGroup returns a new StatGroup that records its values in
+// nanoseconds rather than microseconds, so sub-microsecond latencies (e.g.,
+// of in-memory databases) are not rounded away. Values are still pushed and
+// reported in milliseconds. Its histogram takes ~1.5 times the memory of
+// that of newStatGroup.
+func newPreciseStatGroup() *statGroup {
+	// 1 ns to 3600 secs, with 4 significant digits
+	return &statGroup{
+		latencyHDRHistogram: hdrhistogram.New(1, 3600000000000, 4),
+		scaleFactor:         preciseHDRScaleFactor,
 	}
 }
 
-// push updates a StatGroup with a new value.
-func (s *statGroup) push(n float64) {
-	s.latencyHDRHistogram.RecordValue(int64(n * hdrScaleFactor))
+// push updates a StatGroup with a new value. Values that are not finite
+// (ErrNotFinite) or outside of the histogram range are not recorded.
+// Durations can come out slightly negative when the clock is not monotonic:
+// such values are counted as clock skew and recorded as 0.
+func (s *statGroup) push(n float64) error {
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return ErrNotFinite
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 0 {
+		s.skewCount++
+		n = 0
+	}
+	// microseconds are truncated, as they always were, so the stats of the
+	// default scale do not change; nanoseconds are rounded, which recovers the
+	// exact integer number of nanoseconds of durations converted to float
+	// milliseconds, e.g., 500ns as 0.0005ms
+	scaled := n * s.scaleFactor
+	if s.scaleFactor == preciseHDRScaleFactor {
+		scaled = math.Round(scaled)
+	}
+	if err := s.latencyHDRHistogram.RecordValue(int64(scaled)); err != nil {
+		return err
+	}
 	s.sum += n
 	s.count++
+	return nil
+}
+
+// histogramResolution returns the smallest latency the histograms of
+// StatGroups tell apart from 0, that of precise ones if precise.
+func histogramResolution(precise bool) time.Duration {
+	scaleFactor := hdrScaleFactor
+	if precise {
+		scaleFactor = preciseHDRScaleFactor
+	}
+	return time.Duration(float64(time.Millisecond) / scaleFactor)
+}
+
+// pushCorrected updates a StatGroup with a new value like push, correcting for
+// coordinated omission: when a value exceeds the interval at which operations
+// are expected to start, the operations that would have started (and been
+// delayed) meanwhile are also recorded, with decreasing values n-interval,
+// n-2*interval, ... as long as they are at least interval. This is the
+// correction of HdrHistogram's RecordCorrectedValue. The interval is in
+// milliseconds, like n; a non-positive interval disables the correction.
+func (s *statGroup) pushCorrected(n, interval float64) error {
+	if err := s.push(n); err != nil || interval <= 0 {
+		return err
+	}
+	for missing := n - interval; missing >= interval; missing -= interval {
+		if err := s.push(missing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CoordinatedOmissionCost compares a percentile of values recorded without
+// correcting for coordinated omission with the same percentile once corrected.
+type CoordinatedOmissionCost struct {
+	Uncorrected float64 // Uncorrected is the percentile as recorded, in milliseconds
+	Corrected   float64 // Corrected is the percentile once corrected, in milliseconds
+}
+
+// Ratio returns how many times larger the corrected percentile is than the
+// uncorrected one, i.e., 1 when coordinated omission does not matter.
+func (c CoordinatedOmissionCost) Ratio() float64 {
+	if c.Uncorrected == 0 {
+		return 1
+	}
+	return c.Corrected / c.Uncorrected
 }
 
-// string makes a simple description of a statGroup.
+// OmissionCost returns percentile p (0..100) of the values of the StatGroup,
+// as recorded and as if they had been corrected for coordinated omission with
+// the expected interval (see pushCorrected), in milliseconds. It is meant for
+// values recorded without correction, to tell whether correcting matters; the
+// StatGroup is left unchanged.
+func (s *statGroup) OmissionCost(p, interval float64) CoordinatedOmissionCost {
+	s.mu.Lock()
+	bars := s.nonEmptyBars()
+	s.mu.Unlock()
+
+	corrected := newStatGroupLike(s)
+	step := int64(math.Round(interval * s.scaleFactor))
+	for _, bar := range bars {
+		// values are recorded in the bucket of the bar, the correction being
+		// computed from its lowest value; recording cannot fail, the values
+		// being in the range of the histogram
+		_ = corrected.latencyHDRHistogram.RecordValues(bar.From, bar.Count)
+		if step <= 0 {
+			continue
+		}
+		for missing := bar.From - step; missing >= step; missing -= step {
+			_ = corrected.latencyHDRHistogram.RecordValues(missing, bar.Count)
+		}
+	}
+	return CoordinatedOmissionCost{Uncorrected: s.Percentile(p), Corrected: corrected.Percentile(p)}
+}
+
+// writeOmissionCosts writes the p99 of each StatGroup with values, as recorded
+// and as corrected for coordinated omission with the expected interval (in
+// milliseconds, see OmissionCost), ordered by label.
+func writeOmissionCosts(w io.Writer, statGroups map[string]*statGroup, interval float64) error {
+	keys, maxKeyLength := labelsAndMaxLength(statGroups)
+	sort.Strings(keys)
+	for _, k := range keys {
+		sg := statGroups[k]
+		if sg.count == 0 {
+			continue
+		}
+		cost := sg.OmissionCost(99, interval)
+		_, err := fmt.Fprintf(w, "%-*s: p99: %0.2fms, corrected: %0.2fms (%0.2fx)\n", maxKeyLength, k, cost.Uncorrected, cost.Corrected, cost.Ratio())
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// SnapshotAndReset atomically returns the statistics collected so far and
+// resets the StatGroup, so collection can continue from scratch without any
+// value being counted twice or lost. It is safe to call concurrently with push.
+// The returned snapshots can be combined again later with Merge.
+func (s *statGroup) SnapshotAndReset() *statGroup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := &statGroup{
+		latencyHDRHistogram: s.latencyHDRHistogram,
+		scaleFactor:         s.scaleFactor,
+		sum:                 s.sum,
+		count:               s.count,
+		skewCount:           s.skewCount,
+	}
+	s.latencyHDRHistogram = newHistogramLike(s.latencyHDRHistogram)
+	s.sum = 0
+	s.count = 0
+	s.skewCount = 0
+	return snapshot
+}
+
+// Merge adds all the values collected by other into the StatGroup. Both groups
+// must track their latencies with the same histogram parameters and unit.
+func (s *statGroup) Merge(other *statGroup) error {
+	other.mu.Lock()
+	h := hdrhistogram.Import(other.latencyHDRHistogram.Export())
+	sum, count, skewCount := other.sum, other.count, other.skewCount
+	other.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scaleFactor != other.scaleFactor || !sameHistogramParameters(s.latencyHDRHistogram, h) {
+		return ErrIncompatibleStatGroups
+	}
+	s.latencyHDRHistogram.Merge(h)
+	s.sum += sum
+	s.count += count
+	s.skewCount += skewCount
+	return nil
+}
+
+// MergeRebucketed adds all the values collected by other into the StatGroup
+// like Merge, but also when other tracks its values with different histogram
+// parameters or unit: its values are then re-recorded into the histogram of
+// the StatGroup, each as the middle of its bucket, at the cost of some
+// accuracy, and a warning is logged. It returns the bound of the relative
+// error of the re-recorded values, that of both histograms (e.g., 0.2% from 3
+// into 3 significant digits), or 0 when the groups are compatible. Values
+// outside of the range of the StatGroup are clamped to it.
+func (s *statGroup) MergeRebucketed(other *statGroup) (float64, error) {
+	err := s.Merge(other)
+	if err != ErrIncompatibleStatGroups {
+		return 0, err
+	}
+
+	other.mu.Lock()
+	bars := other.nonEmptyBars()
+	otherScaleFactor, otherSigFigs := other.scaleFactor, other.latencyHDRHistogram.SignificantFigures()
+	sum, count, skewCount := other.sum, other.count, other.skewCount
+	other.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.latencyHDRHistogram
+	clamped := int64(0)
+	for _, bar := range bars {
+		v := int64(math.Round(barMiddle(bar) / otherScaleFactor * s.scaleFactor))
+		if v < h.LowestTrackableValue() || v > h.HighestTrackableValue() {
+			v = int64(math.Max(float64(h.LowestTrackableValue()), math.Min(float64(v), float64(h.HighestTrackableValue()))))
+			clamped += bar.Count
+		}
+		// cannot fail, the value being in the range of the histogram
+		_ = h.RecordValues(v, bar.Count)
+	}
+	s.sum += sum
+	s.count += count
+	s.skewCount += skewCount
+
+	relativeError := math.Pow(10, -float64(otherSigFigs)) + math.Pow(10, -float64(h.SignificantFigures()))
+	log.Printf("warning: merging stats with different histogram parameters: values re-bucketed with a relative error of up to %0.2f%%, %d clamped to the range",
+		100*relativeError, clamped)
+	return relativeError, nil
+}
+
+// nonEmptyBars returns the buckets of the histogram of the StatGroup that hold
+// at least one value, in increasing order of value. Bucket bounds are in the
+// histogram's unit (see scaleFactor).
+func (s *statGroup) nonEmptyBars() []hdrhistogram.Bar {
+	bars := []hdrhistogram.Bar{}
+	for _, bar := range s.latencyHDRHistogram.Distribution() {
+		if bar.Count > 0 {
+			bars = append(bars, bar)
+		}
+	}
+	return bars
+}
+
+// newStatGroupLike returns an empty StatGroup with the same histogram
+// parameters and unit as sg, i.e., that sg can be merged into.
+func newStatGroupLike(sg *statGroup) *statGroup {
+	return &statGroup{
+		latencyHDRHistogram: newHistogramLike(sg.latencyHDRHistogram),
+		scaleFactor:         sg.scaleFactor,
+	}
+}
+
+// newHistogramLike returns an empty histogram with the same parameters as h.
+func newHistogramLike(h *hdrhistogram.Histogram) *hdrhistogram.Histogram {
+	return hdrhistogram.New(h.LowestTrackableValue(), h.HighestTrackableValue(), int(h.SignificantFigures()))
+}
+
+// Bounds of the histograms of StatGroups: values from 1 up to 3600 secs in
+// nanoseconds (see newPreciseStatGroup), with at most 4 significant digits.
+const (
+	maxHistogramValue              = 3600000000000
+	maxHistogramSignificantFigures = 4
+)
+
+// validHistogramParameters reports whether a histogram with the given
+// parameters is within the bounds of the histograms of StatGroups, e.g., to
+// check parameters read from a file before allocating the histogram.
+func validHistogramParameters(lowest, highest, sigfigs int64) bool {
+	return lowest >= 1 && highest >= 2*lowest && highest <= maxHistogramValue &&
+		sigfigs >= 1 && sigfigs <= maxHistogramSignificantFigures
+}
+
+// sameHistogramParameters reports whether a and b bucket their values identically.
+func sameHistogramParameters(a, b *hdrhistogram.Histogram) bool {
+	return a.LowestTrackableValue() == b.LowestTrackableValue() &&
+		a.HighestTrackableValue() == b.HighestTrackableValue() &&
+		a.SignificantFigures() == b.SignificantFigures()
+}
+
+// string makes a simple description of a statGroup, with the tail
+// percentiles (see reportedPercentiles) after the count, its median being the
+// p50.
 func (s *statGroup) string() string {
-	return fmt.Sprintf("min: %8.2fms, med: %8.2fms, mean: %8.2fms, max: %7.2fms, stddev: %8.2fms, sum: %5.1fsec, count: %d",
-		s.Min(),
-		s.Median(),
-		s.Mean(),
-		s.Max(),
-		s.StdDev(),
+	return s.stringWithPrecision(2)
+}
+
+// stringWithPrecision makes a simple description of a statGroup like string,
+// with precision digits after the decimal point of the values in milliseconds.
+func (s *statGroup) stringWithPrecision(precision int) string {
+	desc := fmt.Sprintf("min: %*.*fms, med: %*.*fms, mean: %*.*fms, max: %*.*fms, stddev: %*.*fms, sum: %5.1fsec, count: %d",
+		precision+6, precision, s.Min(),
+		precision+6, precision, s.Median(),
+		precision+6, precision, s.Mean(),
+		precision+5, precision, s.Max(),
+		precision+6, precision, s.StdDev(),
 		s.sum/hdrScaleFactor,
 		s.count)
+	for _, p := range reportedPercentiles {
+		if p != 50 {
+			desc += fmt.Sprintf(", %s: %*.*fms", percentileName(p), precision+6, precision, s.Percentile(p))
+		}
+	}
+	if s.skewCount > 0 {
+		desc += fmt.Sprintf(", clock skew: %d", s.skewCount)
+	}
+	return desc
 }
 
 func (s *statGroup) write(w io.Writer) error {
 	_, err := fmt.Fprintln(w, s.string())
-	return err
+	return wrapWriteError(err)
 }
 
 // Median returns the Median value of the StatGroup in milliseconds
 func (s *statGroup) Median() float64 {
-	return float64(s.latencyHDRHistogram.ValueAtQuantile(50.0))/ hdrScaleFactor
+	return float64(s.latencyHDRHistogram.ValueAtQuantile(50.0))/ s.scaleFactor
+}
+
+// Percentile returns the value at percentile p (0..100) of the StatGroup in milliseconds
+func (s *statGroup) Percentile(p float64) float64 {
+	if p <= 0 {
+		return s.Min()
+	}
+	return float64(s.latencyHDRHistogram.ValueAtQuantile(p)) / s.scaleFactor
+}
+
+// Apdex returns the Apdex score of the values of the StatGroup for the
+// target latency (in milliseconds): (satisfied + tolerating/2) / total, where
+// values up to target are satisfied and values up to 4 times target are
+// tolerating, between 0 (all frustrated) and 1 (all satisfied). Values are
+// classified at the resolution of the histogram, by the lowest value of their
+// bucket. It is 0 for an empty StatGroup.
+func (s *statGroup) Apdex(target float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := s.latencyHDRHistogram.TotalCount()
+	if total == 0 {
+		return 0
+	}
+	satisfiedMax, toleratingMax := int64(target*s.scaleFactor), int64(4*target*s.scaleFactor)
+	satisfied, tolerating := int64(0), int64(0)
+	for _, bar := range s.nonEmptyBars() {
+		switch {
+		case bar.From <= satisfiedMax:
+			satisfied += bar.Count
+		case bar.From <= toleratingMax:
+			tolerating += bar.Count
+		}
+	}
+	return (float64(satisfied) + float64(tolerating)/2) / float64(total)
+}
+
+// writeApdex writes the Apdex score of each StatGroup with values for the
+// target latency (in milliseconds), ordered by label.
+func writeApdex(w io.Writer, statGroups map[string]*statGroup, target float64) error {
+	keys, maxKeyLength := labelsAndMaxLength(statGroups)
+	sort.Strings(keys)
+	for _, k := range keys {
+		sg := statGroups[k]
+		if sg.count == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%-*s: apdex: %0.3f\n", maxKeyLength, k, sg.Apdex(target)); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// PercentilePoint is a point of a percentile distribution curve: the value,
+// in milliseconds, below which Percentile percent of the values fall.
+type PercentilePoint struct {
+	Percentile float64 `json:"percentile"`
+	Value      float64 `json:"value"`
+}
+
+// defaultCurvePercentiles are spread along a log-scaled percentile axis, as
+// used by the classic percentile distribution plot.
+var defaultCurvePercentiles = []float64{0, 50, 90, 99, 99.9, 99.99}
+
+// ExportPercentileCurve returns (percentile, value) pairs of the StatGroup,
+// ready to be plotted, for the given percentiles or, if none are given, for
+// p0, p50, p90, p99, p99.9 and p99.99.
+func (s *statGroup) ExportPercentileCurve(percentiles ...float64) []PercentilePoint {
+	if len(percentiles) == 0 {
+		percentiles = defaultCurvePercentiles
+	}
+	curve := make([]PercentilePoint, 0, len(percentiles))
+	for _, p := range percentiles {
+		curve = append(curve, PercentilePoint{Percentile: p, Value: s.Percentile(p)})
+	}
+	return curve
 }
 
 // Mean returns the Mean value of the StatGroup in milliseconds
 func (s *statGroup) Mean() float64 {
-	return float64(s.latencyHDRHistogram.Mean())/ hdrScaleFactor
+	return float64(s.latencyHDRHistogram.Mean())/ s.scaleFactor
 }
 
 // Max returns the Max value of the StatGroup in milliseconds
 func (s *statGroup) Max() float64 {
-	return float64(s.latencyHDRHistogram.Max())/ hdrScaleFactor
+	return float64(s.latencyHDRHistogram.Max())/ s.scaleFactor
 }
 
 // Min returns the Min value of the StatGroup in milliseconds
 func (s *statGroup) Min() float64 {
-	return float64(s.latencyHDRHistogram.Min())/ hdrScaleFactor
+	return float64(s.latencyHDRHistogram.Min())/ s.scaleFactor
 }
 
 // StdDev returns the StdDev value of the StatGroup in milliseconds
 func (s *statGroup) StdDev() float64 {
-	return float64(s.latencyHDRHistogram.StdDev())/ hdrScaleFactor
+	return float64(s.latencyHDRHistogram.StdDev())/ s.scaleFactor
+}
+
+// MeanAbsoluteDeviation returns the mean absolute deviation of the values of
+// the StatGroup around their mean, in milliseconds, which weighs outliers
+// less than the stddev. Like the stddev, it is computed from the histogram,
+// each value counting as the middle of its bucket. It is 0 for an empty StatGroup.
+func (s *statGroup) MeanAbsoluteDeviation() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := s.latencyHDRHistogram.TotalCount()
+	if total == 0 {
+		return 0
+	}
+	mean := s.latencyHDRHistogram.Mean()
+	sum := 0.0
+	for _, bar := range s.nonEmptyBars() {
+		sum += math.Abs(barMiddle(bar)-mean) * float64(bar.Count)
+	}
+	return sum / float64(total) / s.scaleFactor
+}
+
+// MedianAbsoluteDeviation returns the median of the absolute deviations of
+// the values of the StatGroup from their median, in milliseconds, which is
+// not affected by outliers at all. It is computed from the histogram like
+// MeanAbsoluteDeviation; for an even number of values, it is the lower of
+// the two middle deviations. It is 0 for an empty StatGroup.
+func (s *statGroup) MedianAbsoluteDeviation() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := s.latencyHDRHistogram.TotalCount()
+	if total == 0 {
+		return 0
+	}
+	median := float64(s.latencyHDRHistogram.ValueAtQuantile(50.0))
+	bars := s.nonEmptyBars()
+	deviations := make([]float64, len(bars))
+	for i, bar := range bars {
+		deviations[i] = math.Abs(barMiddle(bar) - median)
+	}
+	sort.Sort(byDeviation{bars, deviations})
+	cumulative := int64(0)
+	for i, bar := range bars {
+		cumulative += bar.Count
+		if 2*cumulative >= total {
+			return deviations[i] / s.scaleFactor
+		}
+	}
+	return deviations[len(deviations)-1] / s.scaleFactor
+}
+
+// barMiddle returns the middle value of a histogram bar.
+func barMiddle(bar hdrhistogram.Bar) float64 {
+	return float64(bar.From+bar.To) / 2
+}
+
+// byDeviation sorts histogram bars by the deviations of their values.
+type byDeviation struct {
+	bars       []hdrhistogram.Bar
+	deviations []float64
+}
+
+func (b byDeviation) Len() int           { return len(b.bars) }
+func (b byDeviation) Less(i, j int) bool { return b.deviations[i] < b.deviations[j] }
+func (b byDeviation) Swap(i, j int) {
+	b.bars[i], b.bars[j] = b.bars[j], b.bars[i]
+	b.deviations[i], b.deviations[j] = b.deviations[j], b.deviations[i]
+}
+
+// writeAbsoluteDeviations writes the mean and median absolute deviations of
+// each StatGroup with values, ordered by label.
+func writeAbsoluteDeviations(w io.Writer, statGroups map[string]*statGroup) error {
+	keys, maxKeyLength := labelsAndMaxLength(statGroups)
+	sort.Strings(keys)
+	for _, k := range keys {
+		sg := statGroups[k]
+		if sg.count == 0 {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "%-*s: mean abs dev: %8.2fms, median abs dev: %8.2fms\n",
+			maxKeyLength, k, sg.MeanAbsoluteDeviation(), sg.MedianAbsoluteDeviation())
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// StatGroupDebugState is the raw internal state of a StatGroup, for debugging.
+// A StatGroup keeps no moment accumulators (e.g., Welford's m and s): its
+// mean and stddev are computed from its histogram, next to which it only
+// keeps the exact running sum and count of the values pushed.
+type StatGroupDebugState struct {
+	Sum       float64 // Sum is the exact running sum of the values pushed
+	Count     int64   // Count is the number of values pushed
+	SkewCount int64   // SkewCount is the number of negative values recorded as 0
+
+	HistogramTotalCount         int64   // HistogramTotalCount is the number of values recorded in the histogram
+	HistogramMean               float64 // HistogramMean is the mean as computed from the histogram, in the histogram unit
+	HistogramStdDev             float64 // HistogramStdDev is the stddev as computed from the histogram, in the histogram unit
+	HistogramScaleFactor        float64 // HistogramScaleFactor is what values are multiplied by to be recorded in the histogram
+	HistogramLowestTrackable    int64
+	HistogramHighestTrackable   int64
+	HistogramSignificantFigures int64
+}
+
+// DebugState returns the raw internal state of the StatGroup. It is meant for
+// diagnosing numerical discrepancies (e.g., comparing the exact mean Sum/Count
+// with the HistogramMean) and not for reporting.
+func (s *statGroup) DebugState() StatGroupDebugState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.latencyHDRHistogram
+	return StatGroupDebugState{
+		Sum:                         s.sum,
+		Count:                       s.count,
+		SkewCount:                   s.skewCount,
+		HistogramTotalCount:         h.TotalCount(),
+		HistogramMean:               h.Mean(),
+		HistogramStdDev:             h.StdDev(),
+		HistogramScaleFactor:        s.scaleFactor,
+		HistogramLowestTrackable:    h.LowestTrackableValue(),
+		HistogramHighestTrackable:   h.HighestTrackableValue(),
+		HistogramSignificantFigures: h.SignificantFigures(),
+	}
 }
 
 // writeStatGroupMap writes a map of StatGroups in an ordered fashion by
@@ -152,7 +714,7 @@ func writeStatGroupMap(w io.Writer, statGroups map[string]*statGroup) error {
 
 		_, err := fmt.Fprintf(w, "%s:\n", paddedKey)
 		if err != nil {
-			return err
+			return wrapWriteError(err)
 		}
 
 		err = v.write(w)
@@ -162,3 +724,116 @@ func writeStatGroupMap(w io.Writer, statGroups map[string]*statGroup) error {
 	}
 	return nil
 }
+
+// lowSampleCountWarnings returns a warning, ordered by label, for each StatGroup
+// that collected fewer than minCount values, since statistics over so few
+// samples are not meaningful.
+func lowSampleCountWarnings(statGroups map[string]*statGroup, minCount int64) []string {
+	keys := make([]string, 0, len(statGroups))
+	for k := range statGroups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	warnings := []string{}
+	for _, k := range keys {
+		if count := statGroups[k].count; count < minCount {
+			warnings = append(warnings, fmt.Sprintf("warning: %s has only %d samples (minimum %d), its statistics are unreliable", k, count, minCount))
+		}
+	}
+	return warnings
+}
+
+// outlierWarnings returns a warning, ordered by label, for each StatGroup whose
+// max is more than sigmas standard deviations above its mean, as a hint that
+// something unusual happened to one of its queries.
+func outlierWarnings(statGroups map[string]*statGroup, sigmas float64) []string {
+	keys := make([]string, 0, len(statGroups))
+	for k := range statGroups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	warnings := []string{}
+	for _, k := range keys {
+		sg := statGroups[k]
+		mean, stdDev, max := sg.Mean(), sg.StdDev(), sg.Max()
+		if stdDev > 0 && max > mean+sigmas*stdDev {
+			warnings = append(warnings, fmt.Sprintf("warning: %s has an outlier, its max %0.2fms is %0.1f standard deviations above its mean %0.2fms", k, max, (max-mean)/stdDev, mean))
+		}
+	}
+	return warnings
+}
+
+// aggregateMatching returns a new StatGroup combining all the StatGroups whose
+// label matches, e.g., to get the total of all the write queries.
+func aggregateMatching(statGroups map[string]*statGroup, match func(label string) bool) (*statGroup, error) {
+	var aggregate *statGroup
+	for k, sg := range statGroups {
+		if !match(k) {
+			continue
+		}
+		if aggregate == nil {
+			aggregate = newStatGroupLike(sg)
+		}
+		if err := aggregate.Merge(sg); err != nil {
+			return nil, err
+		}
+	}
+	if aggregate == nil {
+		aggregate = newStatGroup(0)
+	}
+	return aggregate, nil
+}
+
+// AggregateMatching returns the combined stats of the labels of r that match,
+// e.g., the total of all the write queries, without an "all queries" label of
+// their own: the returned LabelResult is unnamed. The labels are combined from
+// their histograms, so r must have been exported with them (e.g., read with
+// UnmarshalProto from a --results-proto file): it returns ErrNoHistogram if a
+// matching label has none, and ErrInvalidProto if a histogram is corrupt.
+func AggregateMatching(r BenchmarkResult, match func(label string) bool) (LabelResult, error) {
+	statGroups := map[string]*statGroup{}
+	for _, lr := range r.Labels {
+		if !match(lr.Label) {
+			continue
+		}
+		if len(lr.Histogram) == 0 {
+			return LabelResult{}, ErrNoHistogram
+		}
+		sg, err := decodeHistogram(lr.Histogram)
+		if err != nil {
+			return LabelResult{}, err
+		}
+		// the sum and counts are kept alongside the histogram
+		sg.sum, sg.count, sg.skewCount = lr.Sum, lr.Count, lr.SkewCount
+		statGroups[lr.Label] = sg
+	}
+	aggregate, err := aggregateMatching(statGroups, func(string) bool { return true })
+	if err != nil {
+		return LabelResult{}, err
+	}
+	result := newLabelResult("", aggregate)
+	result.Histogram = encodeHistogram(aggregate)
+	return result, nil
+}
+
+// RequiredSampleSize estimates how many samples are needed to measure the mean
+// within ±relativeMargin (e.g., 0.05 for ±5%) of its value, with the given
+// two-sided confidence (e.g., 0.95), based on the stddev and mean of a pilot
+// run: n = (z * stddev / (relativeMargin * mean))^2, rounded up.
+// Zero variance returns 1. Returns 0 when the size cannot be estimated, i.e.,
+// for a zero mean, a non-positive margin or a confidence outside of (0, 1).
+func RequiredSampleSize(stddev, mean, relativeMargin, confidence float64) int {
+	if mean == 0 || relativeMargin <= 0 || confidence <= 0 || confidence >= 1 {
+		return 0
+	}
+	if stddev == 0 {
+		return 1
+	}
+	n := zScore(confidence) * stddev / (relativeMargin * math.Abs(mean))
+	return int(math.Max(1, math.Ceil(n*n)))
+}
+
+// zScore returns the z-score of a two-sided confidence (e.g., 1.96 for 0.95).
+func zScore(confidence float64) float64 {
+	return math.Sqrt2 * math.Erfinv(confidence)
+}
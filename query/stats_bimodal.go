@@ -0,0 +1,83 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// bimodalityThreshold is the bimodality coefficient above which a distribution
+// is considered bimodal; it is the coefficient of a uniform distribution.
+const bimodalityThreshold = 5.0 / 9.0
+
+// minBimodalityCount is the number of values below which the bimodality of a
+// StatGroup is not assessed, as its coefficient is not meaningful.
+const minBimodalityCount = 30
+
+// BimodalityCoefficient returns Sarle's bimodality coefficient of the logarithm
+// of the values of the StatGroup, (skewness^2 + 1) / (excess kurtosis + 3 *
+// (n-1)^2 / ((n-2) * (n-3))), computed from its histogram. Values above 5/9
+// (see bimodalityThreshold) suggest the distribution is bimodal, e.g., cache
+// hits vs misses. The logarithm is used as latencies tend to be right skewed,
+// which inflates the coefficient of unimodal distributions. Returns 0 for
+// fewer than 4 values or no variance.
+func (s *statGroup) BimodalityCoefficient() float64 {
+	s.mu.Lock()
+	bars := s.nonEmptyBars()
+	s.mu.Unlock()
+
+	n, mean := 0.0, 0.0
+	for _, bar := range bars {
+		n += float64(bar.Count)
+		mean += float64(bar.Count) * logBarValue(bar.From, bar.To)
+	}
+	if n < 4 {
+		return 0
+	}
+	mean /= n
+
+	var m2, m3, m4 float64
+	for _, bar := range bars {
+		d := logBarValue(bar.From, bar.To) - mean
+		c := float64(bar.Count)
+		m2 += c * d * d
+		m3 += c * d * d * d
+		m4 += c * d * d * d * d
+	}
+	m2, m3, m4 = m2/n, m3/n, m4/n
+	if m2 == 0 {
+		return 0
+	}
+	skewness := m3 / math.Pow(m2, 1.5)
+	excessKurtosis := m4/(m2*m2) - 3
+	return (skewness*skewness + 1) / (excessKurtosis + 3*(n-1)*(n-1)/((n-2)*(n-3)))
+}
+
+// logBarValue returns the logarithm of the middle of a histogram bucket,
+// shifted by 1 so that buckets of 0 are defined.
+func logBarValue(from, to int64) float64 {
+	return math.Log1p(float64(from+to) / 2)
+}
+
+// bimodalWarnings returns a warning, ordered by label, for each StatGroup with
+// enough values whose distribution appears bimodal, as its mean then lands
+// between the modes and is misleading. Aggregate groups mix query types, so
+// they are bimodal by nature and should be left out of statGroups.
+func bimodalWarnings(statGroups map[string]*statGroup) []string {
+	keys := make([]string, 0, len(statGroups))
+	for k := range statGroups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	warnings := []string{}
+	for _, k := range keys {
+		sg := statGroups[k]
+		if sg.count < minBimodalityCount {
+			continue
+		}
+		if bc := sg.BimodalityCoefficient(); bc > bimodalityThreshold {
+			warnings = append(warnings, fmt.Sprintf("warning: %s looks bimodal (bimodality coefficient %.2f), its mean may be misleading", k, bc))
+		}
+	}
+	return warnings
+}
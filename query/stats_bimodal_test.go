@@ -0,0 +1,52 @@
+package query
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestBimodalityCoefficient(t *testing.T) {
+	// cache hits at ~1ms and misses at ~50ms
+	bimodal := newStatGroup(0)
+	for i := 0; i < 500; i++ {
+		bimodal.push(1.0 + float64(i%10)*0.01)
+		bimodal.push(50.0 + float64(i%10)*0.5)
+	}
+	// normal around 10ms
+	normal := newStatGroup(0)
+	for i := 0; i < 1000; i++ {
+		normal.push(10.0 + 2.0*math.Sqrt2*math.Erfinv(2*(float64(i)+0.5)/1000-1))
+	}
+	// exponential, right skewed as latencies often are
+	exponential := newStatGroup(0)
+	for i := 0; i < 1000; i++ {
+		exponential.push(-10.0 * math.Log((float64(i)+0.5)/1000))
+	}
+
+	if bc := bimodal.BimodalityCoefficient(); bc <= bimodalityThreshold {
+		t.Errorf("bimodal distribution not detected: coefficient %f", bc)
+	}
+	for desc, sg := range map[string]*statGroup{"normal": normal, "exponential": exponential} {
+		if bc := sg.BimodalityCoefficient(); bc > bimodalityThreshold {
+			t.Errorf("%s distribution detected as bimodal: coefficient %f", desc, bc)
+		}
+	}
+
+	m := map[string]*statGroup{"hits and misses": bimodal, "normal": normal, "exponential": exponential}
+	warnings := bimodalWarnings(m)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "hits and misses") {
+		t.Errorf("incorrect warnings: got %v", warnings)
+	}
+
+	few := newStatGroup(0)
+	for _, val := range []float64{1.0, 1.0, 50.0, 50.0} {
+		few.push(val)
+	}
+	if got := bimodalWarnings(map[string]*statGroup{"few": few}); len(got) != 0 {
+		t.Errorf("warning for too few values: got %v", got)
+	}
+	if bc := newStatGroup(0).BimodalityCoefficient(); bc != 0 {
+		t.Errorf("incorrect coefficient of an empty group: got %f want %f", bc, 0.0)
+	}
+}
@@ -0,0 +1,89 @@
+package query
+
+import (
+	"io"
+	"sort"
+)
+
+const (
+	// adaptiveSampleSize is the number of first values of a label the edges of
+	// the buckets of its ASCII histogram are chosen from.
+	adaptiveSampleSize = 1000
+	// asciiHistogramWidth is the width of the longest bar of ASCII histograms.
+	asciiHistogramWidth = 40
+)
+
+// adaptiveBuckets counts values in buckets whose edges are chosen from the
+// data, so that they hold roughly equal counts: the first sampleSize values
+// are kept, then the edges are fixed at their quantiles and all the values,
+// including the sampled ones, are counted. Unlike fixed (e.g., logarithmic)
+// buckets, resolution goes where the values are.
+type adaptiveBuckets struct {
+	buckets    int       // buckets is the number of buckets aimed for
+	sampleSize int       // sampleSize is the number of values the edges are chosen from
+	sample     []float64 // sample holds the values pushed until the edges are fixed
+	edges      []float64 // edges are the bucket edges (see HistogramDiff), nil until fixed
+	counts     []int64   // counts are the number of values in each bucket
+}
+
+// newAdaptiveBuckets returns adaptiveBuckets aiming for the given number of
+// buckets, chosen from the first sampleSize values.
+func newAdaptiveBuckets(buckets, sampleSize int) *adaptiveBuckets {
+	return &adaptiveBuckets{buckets: buckets, sampleSize: sampleSize, sample: make([]float64, 0, sampleSize)}
+}
+
+// push counts value n, in milliseconds, or samples it if the edges are not
+// fixed yet.
+func (b *adaptiveBuckets) push(n float64) {
+	if b.edges == nil {
+		b.sample = append(b.sample, n)
+		if len(b.sample) >= b.sampleSize {
+			b.fix()
+		}
+		return
+	}
+	b.counts[b.bucket(n)]++
+}
+
+// fix fixes the edges at the quantiles of the sampled values, then counts
+// them. Values equal to several quantiles make for fewer, larger buckets, the
+// edges being strictly increasing.
+func (b *adaptiveBuckets) fix() {
+	sorted := make([]float64, len(b.sample))
+	copy(sorted, b.sample)
+	sort.Float64s(sorted)
+
+	b.edges = []float64{}
+	for i := 1; i < b.buckets && len(sorted) > 0; i++ {
+		edge := sorted[i*len(sorted)/b.buckets]
+		if len(b.edges) == 0 || edge > b.edges[len(b.edges)-1] {
+			b.edges = append(b.edges, edge)
+		}
+	}
+	b.counts = make([]int64, len(b.edges)+1)
+	for _, n := range b.sample {
+		b.counts[b.bucket(n)]++
+	}
+	b.sample = nil
+}
+
+// bucket returns the index of the bucket of value n.
+func (b *adaptiveBuckets) bucket(n float64) int {
+	return sort.Search(len(b.edges), func(i int) bool { return b.edges[i] > n })
+}
+
+// bucketEdges returns the bucket edges, fixing them from the values sampled
+// so far if needed. They can be used for a histogram diff.
+func (b *adaptiveBuckets) bucketEdges() []float64 {
+	if b.edges == nil {
+		b.fix()
+	}
+	return b.edges
+}
+
+// write writes the buckets as an ASCII bar chart like writeASCIIHistogram,
+// one line per bucket in increasing order of value, fixing the edges from the
+// values sampled so far if needed.
+func (b *adaptiveBuckets) write(w io.Writer, label string, maxWidth int) error {
+	return writeASCIIBars(w, label, edgeBars(b.bucketEdges(), b.counts), maxWidth)
+}
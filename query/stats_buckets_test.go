@@ -0,0 +1,100 @@
+package query
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestAdaptiveBucketsBalanced(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := newAdaptiveBuckets(10, 1000)
+	// log-normal latencies, most of them below 3ms with a long tail
+	values := make([]float64, 100000)
+	for i := range values {
+		values[i] = math.Exp(r.NormFloat64())
+		b.push(values[i])
+	}
+
+	if got := len(b.bucketEdges()); got != 9 {
+		t.Fatalf("incorrect number of edges: got %d want %d", got, 9)
+	}
+	total := int64(0)
+	for i, count := range b.counts {
+		total += count
+		// each bucket should hold about 10% of the values
+		if share := float64(count) / float64(len(values)); math.Abs(share-0.1) > 0.03 {
+			t.Errorf("bucket %d unbalanced: share %f", i, share)
+		}
+	}
+	if total != int64(len(values)) {
+		t.Errorf("values lost: got %d want %d", total, len(values))
+	}
+
+	var buf bytes.Buffer
+	if err := b.write(&buf, "foo", 20); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 11 {
+		t.Errorf("incorrect number of lines: got %d want %d\n%s", got, 11, buf.String())
+	}
+}
+
+func TestAdaptiveBucketsBeforeFixed(t *testing.T) {
+	b := newAdaptiveBuckets(4, 1000)
+	for _, v := range []float64{1, 1, 1, 1, 1, 1, 1, 3} {
+		b.push(v)
+	}
+	// the edges are fixed from the values sampled so far, all the quantiles
+	// being 1 and making for a single edge
+	edges := b.bucketEdges()
+	if len(edges) != 1 || edges[0] != 1 {
+		t.Fatalf("incorrect edges: got %v want %v", edges, []float64{1})
+	}
+	if b.counts[0] != 0 || b.counts[1] != 8 {
+		t.Errorf("incorrect counts: got %v want %v", b.counts, []int64{0, 8})
+	}
+	b.push(0.5)
+	if b.counts[0] != 1 {
+		t.Errorf("value not counted once the edges are fixed: %v", b.counts)
+	}
+}
+
+func TestStatProcessorHistogramsReport(t *testing.T) {
+	limit := uint64(0)
+	a := newLabelAnonymizer([]byte("secret"))
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, histogramBuckets: 4, anonymizer: a}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for i := 1; i <= 100; i++ {
+		sp.aggregate(GetStat().Init([]byte("foo"), float64(i)))
+	}
+
+	var buf bytes.Buffer
+	if err := sp.exported().writeReport(&buf, 100, 1, 100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	i := strings.Index(out, "Latency histograms:\n")
+	if i < 0 {
+		t.Fatalf("histograms missing from the report:\n%s", out)
+	}
+	histograms := out[i:]
+	for _, label := range []string{labelAllQueries, a.anonymize("foo")} {
+		if !strings.Contains(histograms, "\n"+label+":\n") {
+			t.Errorf("histogram of %s missing from the report:\n%s", label, histograms)
+		}
+	}
+	// the buckets hold about as many queries each, so the bars are about as
+	// long, rather than the first ones being empty as with the HDR buckets
+	for _, line := range strings.Split(histograms, "\n") {
+		if strings.Contains(line, " | ") && strings.HasSuffix(line, " 0") {
+			t.Errorf("empty bucket in the histograms:\n%s", histograms)
+			break
+		}
+	}
+	if strings.Contains(out, "foo") {
+		t.Errorf("label leaked into the report:\n%s", out)
+	}
+}
@@ -0,0 +1,458 @@
+package query
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// distributionComparison is the result of comparing the distributions of the
+// values of a label between a baseline and a candidate run.
+type distributionComparison struct {
+	label string
+	ks    float64 // ks is the Kolmogorov–Smirnov statistic, from 0 (same) to 1 (disjoint)
+	pass  bool    // pass is true if ks is at most the threshold
+}
+
+// ksStatistic returns the two-sample Kolmogorov–Smirnov statistic of a and b,
+// i.e., the largest distance between their cumulative distributions, computed
+// at the resolution of their histograms.
+func ksStatistic(a, b *statGroup) float64 {
+	aBars, bBars := a.nonEmptyBars(), b.nonEmptyBars()
+	aTotal, bTotal := float64(a.latencyHDRHistogram.TotalCount()), float64(b.latencyHDRHistogram.TotalCount())
+	if aTotal == 0 || bTotal == 0 {
+		return 0
+	}
+
+	var aCount, bCount int64
+	i, j := 0, 0
+	maxDistance := 0.0
+	for i < len(aBars) || j < len(bBars) {
+		// advance through the bucket(s) with the lowest upper bound
+		var to int64
+		switch {
+		case j >= len(bBars) || (i < len(aBars) && aBars[i].To < bBars[j].To):
+			to = aBars[i].To
+		default:
+			to = bBars[j].To
+		}
+		for i < len(aBars) && aBars[i].To <= to {
+			aCount += aBars[i].Count
+			i++
+		}
+		for j < len(bBars) && bBars[j].To <= to {
+			bCount += bBars[j].Count
+			j++
+		}
+		distance := math.Abs(float64(aCount)/aTotal - float64(bCount)/bTotal)
+		if distance > maxDistance {
+			maxDistance = distance
+		}
+	}
+	return maxDistance
+}
+
+// compareDistributions computes, for each label with values both in baseline
+// and candidate, the Kolmogorov–Smirnov statistic of the two distributions,
+// which catches changes (e.g., in the tail) that the mean does not show. A
+// label passes if its statistic is at most threshold. Results are ordered by label.
+func compareDistributions(baseline, candidate map[string]*statGroup, threshold float64) []distributionComparison {
+	keys := []string{}
+	for k, sg := range baseline {
+		if other, ok := candidate[k]; ok && sg.count > 0 && other.count > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	results := make([]distributionComparison, 0, len(keys))
+	for _, k := range keys {
+		ks := ksStatistic(baseline[k], candidate[k])
+		results = append(results, distributionComparison{label: k, ks: ks, pass: ks <= threshold})
+	}
+	return results
+}
+
+// defaultDiffEdges are the bucket edges, in milliseconds, of histogram diffs.
+var defaultDiffEdges = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// BucketDelta is the difference between a baseline and a candidate in the
+// number of values of a bucket of latency [From, To), in milliseconds.
+type BucketDelta struct {
+	From, To       float64 // To is +Inf for the last bucket
+	BaselineCount  int64
+	CandidateCount int64
+	BaselineShare  float64 // BaselineShare is the fraction of the baseline values in the bucket
+	CandidateShare float64 // CandidateShare is the fraction of the candidate values in the bucket
+}
+
+// CountDelta returns the change of the number of values in the bucket.
+func (d BucketDelta) CountDelta() int64 {
+	return d.CandidateCount - d.BaselineCount
+}
+
+// ShareDelta returns the change of the fraction of values in the bucket, e.g.,
+// 0.2 when the bucket gained 20% of the traffic.
+func (d BucketDelta) ShareDelta() float64 {
+	return d.CandidateShare - d.BaselineShare
+}
+
+// HistogramDiff returns, for each of the buckets delimited by edges (in
+// increasing order, in milliseconds, or the default edges from 1ms to 10s if
+// nil), how the number of values of a label in it changed from baseline to
+// candidate, computed from their histograms, which localizes where latency
+// moved. The buckets are [0, edges[0]), [edges[0], edges[1]), ...,
+// [edges[n-1], +Inf). It returns ErrNoHistogram if either result was exported
+// without histograms, and ErrInvalidProto if a histogram is corrupt.
+func HistogramDiff(baseline, candidate LabelResult, edges []float64) ([]BucketDelta, error) {
+	if len(baseline.Histogram) == 0 || len(candidate.Histogram) == 0 {
+		return nil, ErrNoHistogram
+	}
+	b, err := decodeHistogram(baseline.Histogram)
+	if err != nil {
+		return nil, err
+	}
+	c, err := decodeHistogram(candidate.Histogram)
+	if err != nil {
+		return nil, err
+	}
+	if edges == nil {
+		edges = defaultDiffEdges
+	}
+	return histogramDiff(b, c, edges), nil
+}
+
+// histogramDiff returns the BucketDeltas of the StatGroups baseline and
+// candidate for the buckets delimited by edges, see HistogramDiff.
+func histogramDiff(baseline, candidate *statGroup, edges []float64) []BucketDelta {
+	deltas := make([]BucketDelta, len(edges)+1)
+	for i := range deltas {
+		if i > 0 {
+			deltas[i].From = edges[i-1]
+		}
+		deltas[i].To = math.Inf(1)
+		if i < len(edges) {
+			deltas[i].To = edges[i]
+		}
+	}
+	baselineCounts, baselineTotal := bucketCounts(baseline, edges)
+	candidateCounts, candidateTotal := bucketCounts(candidate, edges)
+	for i := range deltas {
+		deltas[i].BaselineCount = baselineCounts[i]
+		deltas[i].CandidateCount = candidateCounts[i]
+		if baselineTotal > 0 {
+			deltas[i].BaselineShare = float64(baselineCounts[i]) / float64(baselineTotal)
+		}
+		if candidateTotal > 0 {
+			deltas[i].CandidateShare = float64(candidateCounts[i]) / float64(candidateTotal)
+		}
+	}
+	return deltas
+}
+
+// bucketCounts returns the number of values of sg in each of the buckets
+// delimited by edges (see HistogramDiff), and the total number of values.
+// Histogram buckets are assigned by their lower bound.
+func bucketCounts(sg *statGroup, edges []float64) ([]int64, int64) {
+	sg.mu.Lock()
+	bars := sg.nonEmptyBars()
+	sg.mu.Unlock()
+	counts := make([]int64, len(edges)+1)
+	total := int64(0)
+	for _, bar := range bars {
+		from := float64(bar.From) / sg.scaleFactor
+		i := sort.Search(len(edges), func(i int) bool { return edges[i] > from })
+		counts[i] += bar.Count
+		total += bar.Count
+	}
+	return counts, total
+}
+
+// WriteHistogramDiff writes the BucketDeltas of a histogram diff (see
+// HistogramDiff), one line per bucket holding values in either run.
+func WriteHistogramDiff(w io.Writer, deltas []BucketDelta) error {
+	for _, d := range deltas {
+		if d.BaselineCount == 0 && d.CandidateCount == 0 {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "%8.1fms - %8.1fms: baseline: %10d (%6.2f%%), candidate: %10d (%6.2f%%), delta: %+10d (%+7.2f%%)\n",
+			d.From, d.To, d.BaselineCount, 100*d.BaselineShare, d.CandidateCount, 100*d.CandidateShare, d.CountDelta(), 100*d.ShareDelta())
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// labelResultMetrics are the metrics of LabelResults a comparison matrix can
+// show, by name, as for groupMetrics; a metric is missing, e.g., a percentile
+// that was not reported, if its second value is false.
+var labelResultMetrics = map[string]func(lr LabelResult) (float64, bool){
+	"count": func(lr LabelResult) (float64, bool) { return float64(lr.Count), true },
+	"total": func(lr LabelResult) (float64, bool) { return lr.Sum, true },
+	"mean":  func(lr LabelResult) (float64, bool) { return lr.Mean, true },
+	"max":   func(lr LabelResult) (float64, bool) { return lr.Max, true },
+	"p99":   func(lr LabelResult) (float64, bool) { return percentileValue(lr.Percentiles, 99) },
+}
+
+// WriteComparisonMatrix writes the results of several named runs (e.g., one
+// per database config, as read from their results files with ReadRunResult)
+// side by side: one row per label of any of the runs, in order, one column per
+// run, in order of name, each cell the metric (count, total, mean, max or p99)
+// of the label in that run, in milliseconds. The best (i.e., lowest) value of
+// each row is marked with "*". The cells of labels missing from a run, or
+// without queries, are left blank.
+func WriteComparisonMatrix(w io.Writer, runs map[string]BenchmarkResult, metric string) error {
+	value, ok := labelResultMetrics[metric]
+	if !ok {
+		return fmt.Errorf("stats: unknown metric %q", metric)
+	}
+	cells := make(map[string]map[string]float64, len(runs))
+	for name, r := range runs {
+		cells[name] = map[string]float64{}
+		for _, lr := range r.Labels {
+			if v, ok := value(lr); ok && lr.Count > 0 {
+				cells[name][lr.Label] = v
+			}
+		}
+	}
+	return writeMatrix(w, cells)
+}
+
+// writeComparisonMatrix writes the StatGroups of several named runs side by
+// side, like WriteComparisonMatrix, each cell the metric of the label in that run.
+func writeComparisonMatrix(w io.Writer, runs map[string]map[string]*statGroup, metric groupMetric) error {
+	cells := make(map[string]map[string]float64, len(runs))
+	for name, statGroups := range runs {
+		cells[name] = map[string]float64{}
+		for k, sg := range statGroups {
+			if sg.count > 0 {
+				cells[name][k] = metric(sg)
+			}
+		}
+	}
+	return writeMatrix(w, cells)
+}
+
+// writeMatrix writes the values of the labels of several named runs, by run
+// then label, as a comparison matrix (see WriteComparisonMatrix), those of the
+// labels missing from a run being left blank.
+func writeMatrix(w io.Writer, runs map[string]map[string]float64) error {
+	names := make([]string, 0, len(runs))
+	labelSet := map[string]bool{}
+	for name, values := range runs {
+		names = append(names, name)
+		for k := range values {
+			labelSet[k] = true
+		}
+	}
+	sort.Strings(names)
+	labels := make([]string, 0, len(labelSet))
+	maxLabelLength := len("label")
+	for k := range labelSet {
+		labels = append(labels, k)
+		if len(k) > maxLabelLength {
+			maxLabelLength = len(k)
+		}
+	}
+	sort.Strings(labels)
+
+	const minColumnWidth = 12
+	widths := make([]int, len(names))
+	for i, name := range names {
+		widths[i] = len(name)
+		if widths[i] < minColumnWidth {
+			widths[i] = minColumnWidth
+		}
+	}
+
+	row := fmt.Sprintf("%-*s", maxLabelLength, "label")
+	for i, name := range names {
+		row += fmt.Sprintf(" | %*s", widths[i], name)
+	}
+	if _, err := fmt.Fprintln(w, row); err != nil {
+		return wrapWriteError(err)
+	}
+
+	for _, k := range labels {
+		values := make([]float64, len(names))
+		present := make([]bool, len(names))
+		best := math.Inf(1)
+		for i, name := range names {
+			values[i], present[i] = runs[name][k]
+			if present[i] {
+				best = math.Min(best, values[i])
+			}
+		}
+		row := fmt.Sprintf("%-*s", maxLabelLength, k)
+		for i := range names {
+			cell := ""
+			if present[i] {
+				mark := " "
+				if values[i] == best {
+					mark = "*"
+				}
+				cell = fmt.Sprintf("%.3f%s", values[i], mark)
+			}
+			row += fmt.Sprintf(" | %*s", widths[i], cell)
+		}
+		if _, err := fmt.Fprintln(w, row); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// MeanComparison is the result of Welch's t-test on the means of the values
+// of a label in a baseline and a candidate run.
+type MeanComparison struct {
+	Label                       string
+	BaselineMean, CandidateMean float64 // the means, in milliseconds
+	T                           float64 // T is the t-statistic, positive when the candidate is slower
+	DF                          float64 // DF is the Welch–Satterthwaite degrees of freedom
+	P                           float64 // P is the two-sided p-value
+	Significant                 bool    // Significant is true if P is below the significance level
+}
+
+// Verdict returns whether the difference is a regression, an improvement, or
+// is not significant (i.e., may well be noise).
+func (c MeanComparison) Verdict() string {
+	switch {
+	case !c.Significant:
+		return "not significant"
+	case c.T > 0:
+		return "regression"
+	default:
+		return "improvement"
+	}
+}
+
+// CompareMeans runs Welch's t-test, for each label with at least 2 values
+// both in baseline and candidate, on the means of the two runs, based on
+// their counts and stddevs. A difference is significant if its p-value is
+// below alpha (e.g., 0.05), which tells real changes from run-to-run noise
+// better than the percent change alone. Results are ordered by label.
+func CompareMeans(baseline, candidate RunResult, alpha float64) []MeanComparison {
+	baselineLabels, candidateLabels := runLabelResults(baseline), runLabelResults(candidate)
+	keys := []string{}
+	for k, b := range baselineLabels {
+		if c, ok := candidateLabels[k]; ok && b.Count > 1 && c.Count > 1 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	results := make([]MeanComparison, 0, len(keys))
+	for _, k := range keys {
+		b, c := baselineLabels[k], candidateLabels[k]
+		result := MeanComparison{Label: k, BaselineMean: b.Mean, CandidateMean: c.Mean}
+		result.T, result.DF = welchT(b.Mean, b.StdDev, b.Count, c.Mean, c.StdDev, c.Count)
+		result.P = studentTTwoSided(result.T, result.DF)
+		result.Significant = result.P < alpha
+		results = append(results, result)
+	}
+	return results
+}
+
+// welchT returns the t-statistic of the difference between the means of two
+// samples with unequal variances, and its Welch–Satterthwaite degrees of
+// freedom. Samples without variance make for an infinite statistic, unless
+// their means are equal.
+func welchT(mean1, stddev1 float64, n1 int64, mean2, stddev2 float64, n2 int64) (float64, float64) {
+	v1, v2 := stddev1*stddev1/float64(n1), stddev2*stddev2/float64(n2)
+	diff := mean2 - mean1
+	if v1+v2 == 0 {
+		if diff == 0 {
+			return 0, float64(n1 + n2 - 2)
+		}
+		return math.Copysign(math.Inf(1), diff), float64(n1 + n2 - 2)
+	}
+	df := (v1 + v2) * (v1 + v2) / (v1*v1/float64(n1-1) + v2*v2/float64(n2-1))
+	return diff / math.Sqrt(v1+v2), df
+}
+
+// studentTTwoSided returns the two-sided p-value of the t-statistic t of a
+// Student's t distribution with df degrees of freedom: I(df/(df+t²); df/2, 1/2).
+func studentTTwoSided(t, df float64) float64 {
+	if math.IsInf(t, 0) {
+		return 0
+	}
+	return regularizedIncompleteBeta(df/(df+t*t), df/2, 0.5)
+}
+
+// regularizedIncompleteBeta returns the regularized incomplete beta function
+// I(x; a, b), evaluated with its continued fraction (Numerical Recipes, 6.4).
+func regularizedIncompleteBeta(x, a, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lgab, _ := math.Lgamma(a + b)
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+	// the continued fraction converges quickly for x < (a+1)/(a+b+2)
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(x, a, b) / a
+	}
+	return 1 - front*betaContinuedFraction(1-x, b, a)/b
+}
+
+// betaContinuedFraction evaluates the continued fraction of the incomplete
+// beta function with the modified Lentz method.
+func betaContinuedFraction(x, a, b float64) float64 {
+	const (
+		maxIterations = 300
+		epsilon       = 1e-14
+		tiny          = 1e-300
+	)
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
+
+// WriteMeanComparisons writes the results of CompareMeans, one line per label.
+func WriteMeanComparisons(w io.Writer, comparisons []MeanComparison) error {
+	maxLabelLength := 0
+	for _, c := range comparisons {
+		if len(c.Label) > maxLabelLength {
+			maxLabelLength = len(c.Label)
+		}
+	}
+	for _, c := range comparisons {
+		_, err := fmt.Fprintf(w, "%-*s: baseline: %10.2fms, candidate: %10.2fms, t: %8.2f, p: %.4f, %s\n",
+			maxLabelLength, c.Label, c.BaselineMean, c.CandidateMean, c.T, c.P, c.Verdict())
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package query
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareDistributions(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	baseline := map[string]*statGroup{
+		"same":    newStatGroup(0),
+		"shifted": newStatGroup(0),
+		"missing": newStatGroup(0),
+	}
+	candidate := map[string]*statGroup{
+		"same":    newStatGroup(0),
+		"shifted": newStatGroup(0),
+	}
+	for i := 0; i < 5000; i++ {
+		baseline["same"].push(10 + r.NormFloat64())
+		candidate["same"].push(10 + r.NormFloat64())
+		baseline["shifted"].push(10 + r.NormFloat64())
+		candidate["shifted"].push(20 + r.NormFloat64())
+		baseline["missing"].push(1.0)
+	}
+
+	results := compareDistributions(baseline, candidate, 0.1)
+	if got := len(results); got != 2 {
+		t.Fatalf("incorrect number of results: got %d want %d", got, 2)
+	}
+	same, shifted := results[0], results[1]
+	if same.label != "same" || shifted.label != "shifted" {
+		t.Fatalf("results not ordered by label: %v", results)
+	}
+	if same.ks > 0.05 || !same.pass {
+		t.Errorf("similar distributions: got ks %f pass %v want low ks and pass", same.ks, same.pass)
+	}
+	if shifted.ks < 0.95 || shifted.pass {
+		t.Errorf("different distributions: got ks %f pass %v want high ks and fail", shifted.ks, shifted.pass)
+	}
+}
+
+func TestKSStatisticIdentical(t *testing.T) {
+	a, b := newStatGroup(0), newStatGroup(0)
+	for _, val := range []float64{1.0, 2.0, 3.0, 50.0} {
+		a.push(val)
+		b.push(val)
+	}
+	if got := ksStatistic(a, b); got != 0 {
+		t.Errorf("incorrect ks for identical distributions: got %f want %f", got, 0.0)
+	}
+	if got := ksStatistic(a, newStatGroup(0)); got != 0 {
+		t.Errorf("incorrect ks against empty group: got %f want %f", got, 0.0)
+	}
+}
+
+func TestHistogramDiff(t *testing.T) {
+	baseline, candidate := newStatGroup(0), newStatGroup(0)
+	// baseline: 80 values at 3ms, 20 at 30ms; candidate: 60 at 3ms, 40 at 30ms, 10 at 300ms
+	for value, counts := range map[float64][2]int{3.0: {80, 60}, 30.0: {20, 40}, 300.0: {0, 10}} {
+		for i := 0; i < counts[0]; i++ {
+			baseline.push(value)
+		}
+		for i := 0; i < counts[1]; i++ {
+			candidate.push(value)
+		}
+	}
+
+	edges := []float64{10, 50, 100}
+	deltas := histogramDiff(baseline, candidate, edges)
+	if len(deltas) != len(edges)+1 {
+		t.Fatalf("incorrect number of buckets: got %d want %d", len(deltas), len(edges)+1)
+	}
+	want := []struct {
+		from, to   float64
+		baseline   int64
+		candidate  int64
+		countDelta int64
+		shareDelta float64
+	}{
+		{0, 10, 80, 60, -20, 60.0/110 - 0.8},
+		{10, 50, 20, 40, 20, 40.0/110 - 0.2},
+		{50, 100, 0, 0, 0, 0},
+		{100, math.Inf(1), 0, 10, 10, 10.0 / 110},
+	}
+	for i, w := range want {
+		d := deltas[i]
+		if d.From != w.from || d.To != w.to {
+			t.Errorf("bucket %d: incorrect bounds: got [%f, %f) want [%f, %f)", i, d.From, d.To, w.from, w.to)
+		}
+		if d.BaselineCount != w.baseline || d.CandidateCount != w.candidate || d.CountDelta() != w.countDelta {
+			t.Errorf("bucket %d: incorrect counts: got %d -> %d (%+d) want %d -> %d (%+d)", i, d.BaselineCount, d.CandidateCount, d.CountDelta(), w.baseline, w.candidate, w.countDelta)
+		}
+		if math.Abs(d.ShareDelta()-w.shareDelta) > 1e-9 {
+			t.Errorf("bucket %d: incorrect share delta: got %f want %f", i, d.ShareDelta(), w.shareDelta)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteHistogramDiff(&buf, deltas); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// the empty 50-100ms bucket is left out
+	if len(lines) != 3 {
+		t.Fatalf("incorrect number of lines: got %d want %d\n%s", len(lines), 3, buf.String())
+	}
+	if !strings.Contains(lines[1], "delta:        +20 ( +16.36%)") {
+		t.Errorf("incorrect 10-50ms line: %q", lines[1])
+	}
+
+	// the same diff, of the results of the runs exported with histograms
+	exported, err := HistogramDiff(LabelResult{Histogram: encodeHistogram(baseline)}, LabelResult{Histogram: encodeHistogram(candidate)}, edges)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(exported, deltas) {
+		t.Errorf("incorrect diff of the results: got %+v want %+v", exported, deltas)
+	}
+	if defaults, err := HistogramDiff(LabelResult{Histogram: encodeHistogram(baseline)}, LabelResult{Histogram: encodeHistogram(candidate)}, nil); err != nil || len(defaults) != len(defaultDiffEdges)+1 {
+		t.Errorf("incorrect diff with the default edges: got %d buckets, %v", len(defaults), err)
+	}
+	if _, err := HistogramDiff(LabelResult{}, LabelResult{Histogram: encodeHistogram(candidate)}, edges); err != ErrNoHistogram {
+		t.Errorf("incorrect error without histogram: got %v want %v", err, ErrNoHistogram)
+	}
+}
+
+func TestWriteComparisonMatrix(t *testing.T) {
+	runs := map[string]map[string]*statGroup{}
+	for name, values := range map[string]map[string]float64{
+		"config-a": {"foo": 2.0, "bar": 5.0},
+		"config-b": {"foo": 1.0, "bar": 6.0},
+		"config-c": {"foo": 3.0, "baz": 4.0},
+	} {
+		runs[name] = map[string]*statGroup{}
+		for label, value := range values {
+			sg := newStatGroup(0)
+			sg.push(value)
+			runs[name][label] = sg
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeComparisonMatrix(&buf, runs, groupMetrics["mean"]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"label |     config-a |     config-b |     config-c",
+		"bar   |       5.000* |       6.000  |             ",
+		"baz   |              |              |       4.000*",
+		"foo   |       2.000  |       1.000* |       3.000 ",
+	}
+	if got, want := buf.String(), strings.Join(want, "\n")+"\n"; got != want {
+		t.Errorf("incorrect matrix: got\n%s\nwant\n%s", got, want)
+	}
+
+	if err := writeComparisonMatrix(&errWriter{}, runs, groupMetrics["mean"]); err == nil {
+		t.Errorf("expected error but did not get one")
+	}
+
+	// the same matrix, of the results of the runs
+	results := map[string]BenchmarkResult{}
+	for name, statGroups := range runs {
+		results[name] = BenchmarkResult{Labels: labelResults(statGroups)}
+	}
+	buf.Reset()
+	if err := WriteComparisonMatrix(&buf, results, "mean"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := buf.String(), strings.Join(want, "\n")+"\n"; got != want {
+		t.Errorf("incorrect matrix of the results: got\n%s\nwant\n%s", got, want)
+	}
+	buf.Reset()
+	if err := WriteComparisonMatrix(&buf, results, "p99"); err != nil || !strings.Contains(buf.String(), "foo   |       2.000  |       1.000* |       3.000 ") {
+		t.Errorf("incorrect p99 matrix: got %v\n%s", err, buf.String())
+	}
+	if err := WriteComparisonMatrix(&buf, results, "median"); err == nil {
+		t.Errorf("expected error for an unknown metric")
+	}
+}
+
+func TestStudentTTwoSided(t *testing.T) {
+	// reference values of the two-sided p-values of the t distribution
+	cases := []struct {
+		t, df, want float64
+	}{
+		{0, 10, 1},
+		{2.228, 10, 0.05},
+		{1.96, 1e6, 0.05},
+		{2.576, 1e6, 0.01},
+		{-12.706, 1, 0.05},
+	}
+	for _, c := range cases {
+		if got := studentTTwoSided(c.t, c.df); math.Abs(got-c.want) > 1e-3 {
+			t.Errorf("incorrect p-value of t=%v with %v degrees of freedom: got %f want %f", c.t, c.df, got, c.want)
+		}
+	}
+}
+
+func TestCompareMeans(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	baseline, candidate := map[string]*statGroup{}, map[string]*statGroup{}
+	// label -> mean of the baseline and of the candidate, both with a stddev of 1ms
+	for label, means := range map[string][2]float64{
+		"slower": {10, 12},
+		"faster": {10, 8},
+		"same":   {10, 10},
+	} {
+		baseline[label], candidate[label] = newStatGroup(0), newStatGroup(0)
+		for i := 0; i < 200; i++ {
+			baseline[label].push(means[0] + r.NormFloat64())
+			candidate[label].push(means[1] + r.NormFloat64())
+		}
+	}
+	baseline["single"], candidate["single"] = newStatGroup(0), newStatGroup(0)
+	baseline["single"].push(1.0)
+	candidate["single"].push(100.0)
+
+	results := CompareMeans(RunResult{Result: BenchmarkResult{Labels: labelResults(baseline)}},
+		RunResult{Result: BenchmarkResult{Labels: labelResults(candidate)}}, 0.01)
+	if len(results) != 3 {
+		t.Fatalf("incorrect number of results: got %d want %d", len(results), 3)
+	}
+	want := map[string]string{"faster": "improvement", "same": "not significant", "slower": "regression"}
+	for _, c := range results {
+		if got := c.Verdict(); got != want[c.Label] {
+			t.Errorf("%s: incorrect verdict: got %s want %s (t %f, p %f)", c.Label, got, want[c.Label], c.T, c.P)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMeanComparisons(&buf, results); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 3 {
+		t.Errorf("incorrect number of lines: got %d want %d", got, 3)
+	}
+}
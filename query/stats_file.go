@@ -0,0 +1,160 @@
+package query
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/filipecosta90/hdrhistogram"
+)
+
+// statGroupFileVersion is the version of the binary format of StatGroup maps,
+// to be bumped whenever the format changes incompatibly.
+const statGroupFileVersion = 1
+
+// statGroupFile is the binary (gob) form of a map of StatGroups, e.g., of the
+// results of one client of a fleet benchmark.
+type statGroupFile struct {
+	Version int
+	Groups  map[string]statGroupRecord
+}
+
+// statGroupRecord is the binary form of a StatGroup, with its full histogram.
+type statGroupRecord struct {
+	Sum         float64
+	Count       int64
+	SkewCount   int64
+	ScaleFactor float64
+	Histogram   *hdrhistogram.Snapshot
+}
+
+// writeStatGroupMapBinary writes a map of StatGroups to w in binary form, to
+// be read back, without any loss, by readStatGroupMapBinary.
+func writeStatGroupMapBinary(w io.Writer, statGroups map[string]*statGroup) error {
+	f := statGroupFile{Version: statGroupFileVersion, Groups: map[string]statGroupRecord{}}
+	for k, sg := range statGroups {
+		f.Groups[k] = newStatGroupRecord(sg)
+	}
+	return wrapWriteError(gob.NewEncoder(w).Encode(&f))
+}
+
+// readStatGroupMapBinary reads a map of StatGroups written by writeStatGroupMapBinary.
+func readStatGroupMapBinary(r io.Reader) (map[string]*statGroup, error) {
+	var f statGroupFile
+	if err := gob.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version != statGroupFileVersion {
+		return nil, fmt.Errorf("unsupported stats file version %d (want %d)", f.Version, statGroupFileVersion)
+	}
+	return statGroupsFromRecords(f.Groups)
+}
+
+// newStatGroupRecord returns the binary form of sg.
+func newStatGroupRecord(sg *statGroup) statGroupRecord {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return statGroupRecord{
+		Sum:         sg.sum,
+		Count:       sg.count,
+		SkewCount:   sg.skewCount,
+		ScaleFactor: sg.scaleFactor,
+		Histogram:   sg.latencyHDRHistogram.Export(),
+	}
+}
+
+// statGroupsFromRecords returns the StatGroups of their binary forms, by label.
+func statGroupsFromRecords(records map[string]statGroupRecord) (map[string]*statGroup, error) {
+	statGroups := make(map[string]*statGroup, len(records))
+	for k, rec := range records {
+		if rec.Histogram == nil || rec.ScaleFactor <= 0 || !validSnapshot(rec.Histogram) {
+			return nil, fmt.Errorf("invalid stats of %s", k)
+		}
+		statGroups[k] = &statGroup{
+			latencyHDRHistogram: hdrhistogram.Import(rec.Histogram),
+			scaleFactor:         rec.ScaleFactor,
+			sum:                 rec.Sum,
+			count:               rec.Count,
+			skewCount:           rec.SkewCount,
+		}
+	}
+	return statGroups, nil
+}
+
+// validSnapshot reports whether hdrhistogram.Import can import s without
+// panicking, i.e., whether its parameters are within the bounds of the
+// histograms of StatGroups (see validHistogramParameters) and it has the count,
+// not negative, of each of their buckets, as files that decode may be corrupt.
+func validSnapshot(s *hdrhistogram.Snapshot) bool {
+	if !validHistogramParameters(s.LowestTrackableValue, s.HighestTrackableValue, s.SignificantFigures) {
+		return false
+	}
+	h := hdrhistogram.New(s.LowestTrackableValue, s.HighestTrackableValue, int(s.SignificantFigures))
+	if len(s.Counts) != int(h.CountsLen()) {
+		return false
+	}
+	for _, c := range s.Counts {
+		if c < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeFromDir reads all the files of the directory at path as binary maps of
+// StatGroups (see writeStatGroupMapBinary) and merges them, label by label,
+// into a single map, e.g., to report on a benchmark run by a fleet of clients.
+// Groups tracked with different histogram parameters are re-bucketed (see
+// MergeRebucketed). Files that cannot be read, and groups that cannot be
+// merged, are skipped with a warning; subdirectories are ignored.
+func mergeFromDir(path string) (map[string]*statGroup, error) {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	merged := map[string]*statGroup{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		filename := filepath.Join(path, entry.Name())
+		statGroups, err := readStatGroupMapBinaryFile(filename)
+		if err != nil {
+			log.Printf("warning: skipping stats file %s: %v", filename, err)
+			continue
+		}
+		mergeStatGroupMaps(merged, statGroups, filename)
+	}
+	return merged, nil
+}
+
+// mergeStatGroupMaps merges the StatGroups of statGroups, label by label, into
+// merged, re-bucketing them if needed (see MergeRebucketed). Groups that cannot
+// be merged are skipped with a warning naming where they came from, source.
+func mergeStatGroupMaps(merged, statGroups map[string]*statGroup, source string) {
+	for k, sg := range statGroups {
+		if merged[k] == nil {
+			merged[k] = newStatGroupLike(sg)
+		}
+		if _, err := merged[k].MergeRebucketed(sg); err != nil {
+			log.Printf("warning: skipping stats of %s in %s: %v", k, source, err)
+		}
+	}
+}
+
+// readStatGroupMapBinaryFile reads a map of StatGroups from the file filename.
+func readStatGroupMapBinaryFile(filename string) (map[string]*statGroup, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readStatGroupMapBinary(f)
+}
@@ -0,0 +1,141 @@
+package query
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filipecosta90/hdrhistogram"
+)
+
+func TestStatGroupMapBinaryRoundTrip(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{1.0, 2.0, 3.0, -1.0} {
+		sg.push(val)
+	}
+	precise := newPreciseStatGroup()
+	precise.push(0.0005)
+
+	var buf bytes.Buffer
+	if err := writeStatGroupMapBinary(&buf, map[string]*statGroup{"foo": sg, "precise": precise}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := readStatGroupMapBinary(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("incorrect number of groups: got %d want %d", len(got), 2)
+	}
+	if want := sg.DebugState(); got["foo"].DebugState() != want {
+		t.Errorf("incorrect group: got %+v want %+v", got["foo"].DebugState(), want)
+	}
+	if got := got["precise"].Min(); got != 0.0005 {
+		t.Errorf("incorrect precise min: got %v want %v", got, 0.0005)
+	}
+}
+
+func TestReadStatGroupMapBinaryCorrupt(t *testing.T) {
+	sg := newStatGroup(0)
+	sg.push(1.0)
+	for name, corrupt := range map[string]func(s *hdrhistogram.Snapshot){
+		"sigfigs":      func(s *hdrhistogram.Snapshot) { s.SignificantFigures = 6 },
+		"no sigfigs":   func(s *hdrhistogram.Snapshot) { s.SignificantFigures = 0 },
+		"lowest":       func(s *hdrhistogram.Snapshot) { s.LowestTrackableValue = 0 },
+		"highest":      func(s *hdrhistogram.Snapshot) { s.HighestTrackableValue = maxHistogramValue + 1 },
+		"short counts": func(s *hdrhistogram.Snapshot) { s.Counts = s.Counts[:len(s.Counts)/2] },
+		"long counts":  func(s *hdrhistogram.Snapshot) { s.Counts = append(s.Counts, 1) },
+		"negative":     func(s *hdrhistogram.Snapshot) { s.Counts[0] = -1 },
+	} {
+		rec := newStatGroupRecord(sg)
+		corrupt(rec.Histogram)
+		f := statGroupFile{Version: statGroupFileVersion, Groups: map[string]statGroupRecord{"foo": rec}}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&f); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if _, err := readStatGroupMapBinary(&buf); err == nil {
+			t.Errorf("%s: expected error for a corrupt histogram", name)
+		}
+	}
+}
+
+func TestMergeFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// file -> label -> values pushed
+	files := map[string]map[string][]float64{
+		"client1": {"foo": {1.0, 2.0}, "bar": {10.0}},
+		"client2": {"foo": {3.0}},
+		"client3": {"bar": {20.0, 30.0}, "baz": {5.0}},
+	}
+	for name, labels := range files {
+		m := map[string]*statGroup{}
+		for label, vals := range labels {
+			m[label] = newStatGroup(0)
+			for _, val := range vals {
+				m[label].push(val)
+			}
+		}
+		var buf bytes.Buffer
+		if err := writeStatGroupMapBinary(&buf, m); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatalf("cannot write file: %v", err)
+		}
+	}
+	// must be skipped
+	if err := ioutil.WriteFile(filepath.Join(dir, "corrupt"), []byte("not stats"), 0644); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	rec := newStatGroupRecord(newStatGroup(0))
+	rec.Histogram.Counts = nil
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&statGroupFile{Version: statGroupFileVersion, Groups: map[string]statGroupRecord{"foo": rec}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "corrupt-histogram"), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatalf("cannot create subdir: %v", err)
+	}
+
+	merged, err := mergeFromDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]struct {
+		count int64
+		sum   float64
+	}{
+		"foo": {3, 6.0},
+		"bar": {3, 60.0},
+		"baz": {1, 5.0},
+	}
+	if len(merged) != len(want) {
+		t.Fatalf("incorrect number of groups: got %d want %d", len(merged), len(want))
+	}
+	for label, w := range want {
+		sg := merged[label]
+		if sg == nil {
+			t.Errorf("%s: missing group", label)
+			continue
+		}
+		if sg.count != w.count || sg.sum != w.sum || sg.latencyHDRHistogram.TotalCount() != w.count {
+			t.Errorf("%s: incorrect totals: got count %d sum %f want count %d sum %f", label, sg.count, sg.sum, w.count, w.sum)
+		}
+	}
+
+	if _, err := mergeFromDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected error for a missing directory")
+	}
+}
@@ -0,0 +1,107 @@
+package query
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// latencyLogBufferSize is the size of the buffer of the latency log, large so
+// that writing every latency seldom blocks the aggregation of the stats.
+const latencyLogBufferSize = 1 << 20
+
+// The kinds of the latencies of the latency log.
+const (
+	latencyKindComplete = "complete"
+	latencyKindWarm     = "warm"
+	latencyKindPartial  = "partial"
+	latencyKindIngest   = "ingest"
+)
+
+// latencyLog writes every latency aggregated, one CSV row each, with the time
+// it was aggregated at (i.e., right after it was measured), its label and its
+// kind, e.g., to plot latency over time or CDFs offline. Rows are buffered, and
+// written by the goroutine aggregating the stats rather than by the workers,
+// so logging barely perturbs the measurements.
+type latencyLog struct {
+	f          *os.File
+	w          *bufio.Writer
+	cw         *csv.Writer
+	anonymizer *labelAnonymizer // anonymizer, if set, replaces the labels by their hashes
+}
+
+// openLatencyLog opens the latency log at filename, appended to if appending
+// (e.g., when resuming a run), truncated otherwise. The header is written if
+// the file is empty.
+func openLatencyLog(filename string, appending bool, anonymizer *labelAnonymizer) (*latencyLog, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l := newLatencyLog(f, anonymizer)
+	l.f = f
+	if info.Size() == 0 {
+		if err := l.cw.Write([]string{"timestamp", "label", "latency_ms", "kind"}); err != nil {
+			f.Close()
+			return nil, wrapWriteError(err)
+		}
+	}
+	return l, nil
+}
+
+// newLatencyLog returns a latencyLog writing to w, without a header.
+func newLatencyLog(w io.Writer, anonymizer *labelAnonymizer) *latencyLog {
+	bw := bufio.NewWriterSize(w, latencyLogBufferSize)
+	return &latencyLog{w: bw, cw: csv.NewWriter(bw), anonymizer: anonymizer}
+}
+
+// write writes the row of stat, aggregated at t.
+func (l *latencyLog) write(t time.Time, stat *Stat) error {
+	label := string(stat.label)
+	if l.anonymizer != nil {
+		label = l.anonymizer.anonymize(label)
+	}
+	kind := latencyKindComplete
+	switch {
+	case stat.isIngest:
+		kind = latencyKindIngest
+	case stat.isPartial:
+		kind = latencyKindPartial
+	case stat.isWarm:
+		kind = latencyKindWarm
+	}
+	row := []string{
+		t.UTC().Format(time.RFC3339Nano),
+		label,
+		strconv.FormatFloat(stat.value, 'f', -1, 64),
+		kind,
+	}
+	return wrapWriteError(l.cw.Write(row))
+}
+
+// Close writes the rows still buffered and closes the file, if any.
+func (l *latencyLog) Close() error {
+	l.cw.Flush()
+	if err := l.cw.Error(); err != nil {
+		return wrapWriteError(err)
+	}
+	if err := l.w.Flush(); err != nil {
+		return wrapWriteError(err)
+	}
+	if l.f != nil {
+		return l.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package query
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLatencyLogWrite(t *testing.T) {
+	var b bytes.Buffer
+	l := newLatencyLog(&b, nil)
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	partial := GetPartialStat().Init([]byte("foo, bar"), 2.0)
+	ingest := GetStat().Init([]byte("insert"), 3.0)
+	ingest.isIngest = true
+	for _, stat := range []*Stat{GetStat().Init([]byte("foo"), 1.5), partial, ingest} {
+		if err := l.write(at, stat); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if b.Len() != 0 {
+		t.Errorf("rows written before closing, they should be buffered: %q", b.String())
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("latency log is not valid CSV: %v", err)
+	}
+	want := [][]string{
+		{"2020-01-02T03:04:05.000006Z", "foo", "1.5", latencyKindComplete},
+		{"2020-01-02T03:04:05.000006Z", "foo, bar", "2", latencyKindPartial},
+		{"2020-01-02T03:04:05.000006Z", "insert", "3", latencyKindIngest},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("incorrect rows: got %v want %v", rows, want)
+	}
+}
+
+func TestOpenLatencyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latency_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "latencies.csv")
+	anonymizer := newLabelAnonymizer([]byte("key"))
+
+	// the header is only written once when appending
+	for _, appending := range []bool{false, true} {
+		l, err := openLatencyLog(filename, appending, anonymizer)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := l.write(time.Now(), GetStat().Init([]byte("secret"), 1.0)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("latency log is not valid CSV: %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "timestamp" {
+		t.Fatalf("incorrect rows: %v", rows)
+	}
+	for _, row := range rows[1:] {
+		if row[1] != anonymizer.anonymize("secret") {
+			t.Errorf("label not anonymized: %v", row)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package query
+
+import (
+	"sync"
+	"time"
+)
+
+// liveStatsWindow is the width of the windows of time the live latency
+// quantiles are computed over.
+const liveStatsWindow = 10 * time.Second
+
+// liveStats holds the stats of the complete results per label over the
+// current and the previous window of time, so the quantiles of the latest
+// complete window can be exposed while the benchmark is running, e.g., as
+// live metrics. It is safe for concurrent use.
+type liveStats struct {
+	mu       sync.Mutex
+	clock    Clock
+	width    time.Duration
+	start    time.Time             // start is the start of the current window
+	current  map[string]*statGroup // current holds the stats of the current window, by label
+	previous map[string]*statGroup // previous holds the stats of the window before the current one, by label
+}
+
+// newLiveStats returns a liveStats whose first window starts now.
+func newLiveStats(clock Clock, width time.Duration) *liveStats {
+	return &liveStats{
+		clock:    clock,
+		width:    width,
+		start:    clock.Now(),
+		current:  map[string]*statGroup{},
+		previous: map[string]*statGroup{},
+	}
+}
+
+// push adds a value of label to the current window.
+func (ls *liveStats) push(label string, value float64) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.rotate()
+	sg, ok := ls.current[label]
+	if !ok {
+		sg = newCompactStatGroup()
+		ls.current[label] = sg
+	}
+	return sg.push(value)
+}
+
+// latest returns the stats of the latest complete window, by label. They must
+// not be modified.
+func (ls *liveStats) latest() map[string]*statGroup {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.rotate()
+	return ls.previous
+}
+
+// rotate starts a new window if the current one is over. The latest complete
+// window is empty if nothing was pushed during it.
+func (ls *liveStats) rotate() {
+	elapsed := ls.clock.Now().Sub(ls.start)
+	if elapsed < ls.width {
+		return
+	}
+	if elapsed < 2*ls.width {
+		ls.previous = ls.current
+	} else {
+		ls.previous = map[string]*statGroup{}
+	}
+	ls.current = map[string]*statGroup{}
+	ls.start = ls.start.Add(elapsed / ls.width * ls.width)
+}
@@ -0,0 +1,39 @@
+package query
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLiveStatsLatest(t *testing.T) {
+	clock := newFakeClock()
+	ls := newLiveStats(clock, time.Second)
+
+	if err := ls.push("a", 1.0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(ls.latest()); got != 0 {
+		t.Errorf("latest window before the first one is over has %d labels, want 0", got)
+	}
+
+	clock.advance(1500 * time.Millisecond)
+	if err := ls.push("b", 2.0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	latest := ls.latest()
+	if len(latest) != 1 || latest["a"] == nil || latest["a"].count != 1 {
+		t.Errorf("latest window has %v, want only 1 value of a", latest)
+	}
+
+	clock.advance(time.Second)
+	latest = ls.latest()
+	if len(latest) != 1 || latest["b"] == nil || latest["b"].count != 1 {
+		t.Errorf("latest window has %v, want only 1 value of b", latest)
+	}
+
+	// no values for two windows: the latest complete one is empty
+	clock.advance(2 * time.Second)
+	if got := len(ls.latest()); got != 0 {
+		t.Errorf("latest window after idle windows has %d labels, want 0", got)
+	}
+}
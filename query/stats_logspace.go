@@ -0,0 +1,88 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// ErrNotPositive is returned when a value that is not positive is pushed to a
+// logStatGroup, as it has no logarithm.
+var ErrNotPositive = errors.New("stats: value is not positive")
+
+// logStatGroup collects streaming statistics of the logarithm of the values
+// pushed, which suit log-normally distributed values such as latencies better
+// than the arithmetic mean and stddev: the geometric mean as central tendency
+// and the geometric stddev factor as (multiplicative) spread.
+type logStatGroup struct {
+	count       int64
+	mean        float64 // mean is the running mean of the logarithms (Welford)
+	m2          float64 // m2 is the running sum of squared differences from mean (Welford)
+	nonPositive int64   // nonPositive is the number of values that were not positive, and not recorded
+}
+
+// push updates a logStatGroup with the logarithm of a new value. Values that
+// are not positive cannot be recorded and are counted apart (ErrNotPositive).
+func (s *logStatGroup) push(n float64) error {
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return ErrNotFinite
+	}
+	if n <= 0 {
+		s.nonPositive++
+		return ErrNotPositive
+	}
+	x := math.Log(n)
+	s.count++
+	delta := x - s.mean
+	s.mean += delta / float64(s.count)
+	s.m2 += delta * (x - s.mean)
+	return nil
+}
+
+// GeometricMean returns the geometric mean of the values, 0 if there are none.
+func (s *logStatGroup) GeometricMean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return math.Exp(s.mean)
+}
+
+// GeometricStdDev returns the geometric (population) stddev factor of the
+// values: about 68% of log-normal values are within [mean / factor, mean *
+// factor] of the geometric mean. It is 1 when there is no spread.
+func (s *logStatGroup) GeometricStdDev() float64 {
+	if s.count == 0 {
+		return 1
+	}
+	return math.Exp(math.Sqrt(s.m2 / float64(s.count)))
+}
+
+// string makes a simple description of a logStatGroup.
+func (s *logStatGroup) string() string {
+	desc := fmt.Sprintf("geo mean: %8.2fms, geo stddev factor: x%.3f, count: %d", s.GeometricMean(), s.GeometricStdDev(), s.count)
+	if s.nonPositive > 0 {
+		desc += fmt.Sprintf(", not positive: %d", s.nonPositive)
+	}
+	return desc
+}
+
+// writeLogStatGroupMap writes a map of logStatGroups ordered by label.
+func writeLogStatGroupMap(w io.Writer, statGroups map[string]*logStatGroup) error {
+	keys := make([]string, 0, len(statGroups))
+	maxKeyLength := 0
+	for k := range statGroups {
+		if len(k) > maxKeyLength {
+			maxKeyLength = len(k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%-*s: %s\n", maxKeyLength, k, statGroups[k].string()); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package query
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLogStatGroup(t *testing.T) {
+	// log-normal with a geometric mean of 10ms and sigma 0.5, sampled at quantiles
+	const n = 10000
+	mu, sigma := math.Log(10), 0.5
+	lsg := &logStatGroup{}
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		z := math.Sqrt2 * math.Erfinv(2*(float64(i)+0.5)/n-1)
+		val := math.Exp(mu + sigma*z)
+		sum += val
+		if err := lsg.push(val); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := lsg.GeometricMean(); math.Abs(got-10) > 0.01 {
+		t.Errorf("incorrect geometric mean: got %f want %f", got, 10.0)
+	}
+	if got, want := lsg.GeometricStdDev(), math.Exp(sigma); math.Abs(got-want) > 0.01 {
+		t.Errorf("incorrect geometric stddev factor: got %f want %f", got, want)
+	}
+	// the arithmetic mean exp(mu + sigma^2/2) overestimates the typical latency
+	if mean := sum / n; mean < 11 {
+		t.Errorf("arithmetic mean unexpectedly close to the geometric mean: %f", mean)
+	}
+
+	for _, val := range []float64{0, -1.0} {
+		if err := lsg.push(val); err != ErrNotPositive {
+			t.Errorf("incorrect error for %f: got %v want %v", val, err, ErrNotPositive)
+		}
+	}
+	if lsg.count != n || lsg.nonPositive != 2 {
+		t.Errorf("incorrect counts: got %d, %d not positive want %d, %d", lsg.count, lsg.nonPositive, n, 2)
+	}
+	if err := lsg.push(math.Inf(1)); err != ErrNotFinite {
+		t.Errorf("incorrect error for infinity: got %v want %v", err, ErrNotFinite)
+	}
+	if !strings.Contains(lsg.string(), "not positive: 2") {
+		t.Errorf("description lacks the values not positive: %s", lsg.string())
+	}
+
+	empty := &logStatGroup{}
+	if empty.GeometricMean() != 0 || empty.GeometricStdDev() != 1 {
+		t.Errorf("incorrect stats of an empty group: %s", empty.string())
+	}
+}
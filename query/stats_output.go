@@ -0,0 +1,467 @@
+package query
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// reportedPercentiles are the percentiles included in the detailed outputs.
+var reportedPercentiles = []float64{50, 90, 95, 99, 99.9}
+
+// percentileName returns the name of percentile p as used in outputs, e.g., "p99.9".
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// labelsAndMaxLength returns the labels of statGroups and the length of the longest one.
+func labelsAndMaxLength(statGroups map[string]*statGroup) ([]string, int) {
+	maxKeyLength := 0
+	keys := make([]string, 0, len(statGroups))
+	for k := range statGroups {
+		if len(k) > maxKeyLength {
+			maxKeyLength = len(k)
+		}
+		keys = append(keys, k)
+	}
+	return keys, maxKeyLength
+}
+
+// WriteParetoByTotalTime writes the labels of r ordered by the total time
+// spent on each of them (i.e., mean * count), descending, along with each
+// label's share of the overall time and the running cumulative share, e.g., to
+// see that the top 3 labels account for 80% of the time. The totals of r are
+// left out, as they would be counted twice.
+func WriteParetoByTotalTime(w io.Writer, r BenchmarkResult) error {
+	labels := append([]LabelResult(nil), r.Labels...)
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Sum != labels[j].Sum {
+			return labels[i].Sum > labels[j].Sum
+		}
+		return labels[i].Label < labels[j].Label
+	})
+
+	total := 0.0
+	maxLabelLength := 0
+	for _, lr := range labels {
+		total += lr.Sum
+		if len(lr.Label) > maxLabelLength {
+			maxLabelLength = len(lr.Label)
+		}
+	}
+
+	cumulative := 0.0
+	for _, lr := range labels {
+		share := 0.0
+		if total > 0 {
+			share = 100 * lr.Sum / total
+		}
+		cumulative += share
+		_, err := fmt.Fprintf(w, "%-*s: total: %10.3fsec, share: %6.2f%%, cumulative: %6.2f%%\n", maxLabelLength, lr.Label, lr.Sum/1e3, share, cumulative)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// WriteLongFormat writes the labels of r, then its totals if any, as CSV in
+// long format, i.e., one (label, statistic, value) row per statistic of each
+// label, e.g., "single-groupby,mean,3.21", which is trivial to pivot. Values
+// are in milliseconds, except for count. The metadata of r, if any, is
+// written first as "# key: value" comment lines.
+func WriteLongFormat(w io.Writer, r BenchmarkResult) error {
+	labels := r.Labels
+	if r.Totals.Count > 0 {
+		labels = append(append([]LabelResult(nil), labels...), r.Totals)
+	}
+	return writeLongFormat(w, r.Metadata, labels)
+}
+
+// writeLongFormat writes the metadata then the labels like WriteLongFormat, in
+// the order of labels.
+func writeLongFormat(w io.Writer, metadata map[string]string, labels []LabelResult) error {
+	if err := writeMetadata(w, "# ", metadata); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	formatFloat := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, lr := range labels {
+		median, _ := percentileValue(lr.Percentiles, 50)
+		rows := [][]string{
+			{lr.Label, "min", formatFloat(lr.Min)},
+			{lr.Label, "median", formatFloat(median)},
+			{lr.Label, "mean", formatFloat(lr.Mean)},
+			{lr.Label, "max", formatFloat(lr.Max)},
+			{lr.Label, "stddev", formatFloat(lr.StdDev)},
+			{lr.Label, "sum", formatFloat(lr.Sum)},
+			{lr.Label, "count", strconv.FormatInt(lr.Count, 10)},
+		}
+		for _, p := range reportedPercentiles {
+			// the percentiles of a label without values are 0
+			v, _ := percentileValue(lr.Percentiles, p)
+			rows = append(rows, []string{lr.Label, percentileName(p), formatFloat(v)})
+		}
+		if err := cw.WriteAll(rows); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	cw.Flush()
+	return wrapWriteError(cw.Error())
+}
+
+// writeMetadata writes the run metadata as "key: value" lines ordered by key,
+// each prefixed with prefix.
+func writeMetadata(w io.Writer, prefix string, metadata map[string]string) error {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%s%s: %s\n", prefix, k, metadata[k]); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// writeJSON writes a result, e.g., a BenchmarkResult, as indented JSON, e.g.,
+// {"metadata": {"commit": "abc"}, "labels": [{"label": ...}], "totals": ...}.
+func writeJSON(w io.Writer, result interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return wrapWriteError(enc.Encode(result))
+}
+
+// WriteGoBenchFormat writes the labels of r in the output format of Go
+// benchmarks, one "BenchmarkLabel N M ns/op" line per label with values, in
+// order, with the count as the iterations N and the mean as M, e.g.,
+// "BenchmarkSingle-groupby-1-1-1 1000 3210000 ns/op", so runs can be compared
+// with benchstat. The whitespace in labels is replaced by underscores and their
+// first letter is upper cased, as benchmark names require. The totals of r are
+// left out.
+func WriteGoBenchFormat(w io.Writer, r BenchmarkResult) error {
+	return writeGoBenchFormat(w, sortedLabelResults(r.Labels))
+}
+
+// writeGoBenchFormat writes labels like WriteGoBenchFormat, in the order of
+// labels.
+func writeGoBenchFormat(w io.Writer, labels []LabelResult) error {
+	for _, lr := range labels {
+		if lr.Count == 0 {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "%s\t%d\t%d ns/op\n", goBenchName(lr.Label), lr.Count, int64(math.Round(lr.Mean*1e6)))
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// goBenchName returns the name of the Go benchmark of label, e.g.,
+// "BenchmarkHigh-cpu_all" for "high-cpu all".
+func goBenchName(label string) string {
+	name := []rune(strings.Join(strings.Fields(label), "_"))
+	if len(name) > 0 {
+		name[0] = unicode.ToUpper(name[0])
+	}
+	return "Benchmark" + string(name)
+}
+
+// tagExtractor extracts the dimensions encoded in a label as tags, e.g.,
+// "query-type" -> "high-cpu" and "workers" -> "8".
+type tagExtractor func(label string) map[string]string
+
+// untaggedGroup is the group of the labels that lack the tag grouped by.
+const untaggedGroup = "(none)"
+
+// groupByTag splits statGroups by the value of their tag key, as extracted by tags.
+func groupByTag(statGroups map[string]*statGroup, tags tagExtractor, key string) map[string]map[string]*statGroup {
+	groups := map[string]map[string]*statGroup{}
+	for k, sg := range statGroups {
+		value, ok := tags(k)[key]
+		if !ok {
+			value = untaggedGroup
+		}
+		if groups[value] == nil {
+			groups[value] = map[string]*statGroup{}
+		}
+		groups[value][k] = sg
+	}
+	return groups
+}
+
+// writeGroupedByTag writes the StatGroups grouped by the value of their tag
+// key, ordered by value, each group followed by its subtotal, e.g.,
+// "workers=8:", the StatGroups with that tag, then "subtotal workers=8:".
+// Labels lacking the tag are grouped under "(none)".
+func writeGroupedByTag(w io.Writer, statGroups map[string]*statGroup, tags tagExtractor, key string) error {
+	groups := groupByTag(statGroups, tags, key)
+	values := make([]string, 0, len(groups))
+	for v := range groups {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	for _, v := range values {
+		group := groups[v]
+		if _, err := fmt.Fprintf(w, "%s=%s:\n", key, v); err != nil {
+			return wrapWriteError(err)
+		}
+		if err := writeStatGroupMap(w, group); err != nil {
+			return err
+		}
+		subtotal, err := aggregateMatching(group, func(string) bool { return true })
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "subtotal %s=%s:\n", key, v); err != nil {
+			return wrapWriteError(err)
+		}
+		if err := subtotal.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// varianceBreakdown splits the variance of the values of several StatGroups
+// into the variance between the means of groups and the variance within them.
+type varianceBreakdown struct {
+	between float64 // between is the variance of the group means around the overall mean, weighted by count
+	within  float64 // within is the mean of the group variances, weighted by count
+}
+
+// explained returns the share of the total variance explained by the grouping
+// (i.e., eta squared), between 0 and 1; 0 if there is no variance at all.
+func (v varianceBreakdown) explained() float64 {
+	total := v.between + v.within
+	if total == 0 {
+		return 0
+	}
+	return v.between / total
+}
+
+// varianceByTag returns how much of the variance of the values of all the
+// StatGroups is explained by grouping them by their tag key (ANOVA style). A
+// high explained share means the tag drives the differences in latency, a low
+// one means they are mostly noise within the groups. Variances are in
+// milliseconds squared.
+func varianceByTag(statGroups map[string]*statGroup, tags tagExtractor, key string) (varianceBreakdown, error) {
+	type groupStats struct {
+		count          int64
+		mean, variance float64
+	}
+	var groups []groupStats
+	totalCount, totalSum := int64(0), 0.0
+	for _, group := range groupByTag(statGroups, tags, key) {
+		sg, err := aggregateMatching(group, func(string) bool { return true })
+		if err != nil {
+			return varianceBreakdown{}, err
+		}
+		if sg.count == 0 {
+			continue
+		}
+		stddev := sg.StdDev()
+		groups = append(groups, groupStats{count: sg.count, mean: sg.sum / float64(sg.count), variance: stddev * stddev})
+		totalCount += sg.count
+		totalSum += sg.sum
+	}
+	if totalCount == 0 {
+		return varianceBreakdown{}, nil
+	}
+
+	mean := totalSum / float64(totalCount)
+	var v varianceBreakdown
+	for _, g := range groups {
+		weight := float64(g.count) / float64(totalCount)
+		v.between += weight * (g.mean - mean) * (g.mean - mean)
+		v.within += weight * g.variance
+	}
+	return v, nil
+}
+
+// WriteFolded writes the labels of r in the folded stack format consumed by
+// flamegraph.pl, the frames of each stack being the parts of a label split by
+// delimiter (e.g., "write/batch/flush" with "/" becomes "write;batch;flush"),
+// and its count the total time spent on that label, in microseconds. Labels
+// are written in order; the totals of r are left out.
+func WriteFolded(w io.Writer, r BenchmarkResult, delimiter string) error {
+	for _, lr := range sortedLabelResults(r.Labels) {
+		if lr.Count == 0 {
+			continue
+		}
+		frames := strings.Split(lr.Label, delimiter)
+		for i, f := range frames {
+			// semicolons separate frames in the folded format
+			frames[i] = strings.Replace(f, ";", "_", -1)
+		}
+		_, err := fmt.Fprintf(w, "%s %d\n", strings.Join(frames, ";"), int64(math.Round(lr.Sum*1e3)))
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// asciiBar is a bar of an ASCII histogram: the number of values in [from,
+// to), in milliseconds.
+type asciiBar struct {
+	from, to float64
+	count    int64
+}
+
+// edgeBars returns the bars of the counts of the buckets delimited by edges,
+// [0, edges[0]), ..., [edges[len(edges)-1], +Inf).
+func edgeBars(edges []float64, counts []int64) []asciiBar {
+	bars := make([]asciiBar, len(counts))
+	for i, count := range counts {
+		bars[i] = asciiBar{from: 0, to: math.Inf(1), count: count}
+		if i > 0 {
+			bars[i].from = edges[i-1]
+		}
+		if i < len(edges) {
+			bars[i].to = edges[i]
+		}
+	}
+	return bars
+}
+
+// writeASCIIBars writes bars as an ASCII bar chart under the header "label:",
+// one line per bar, the longest bar (that of the highest count) being maxWidth
+// characters long and the others proportional to their count, and at least 1
+// character unless empty.
+func writeASCIIBars(w io.Writer, label string, bars []asciiBar, maxWidth int) error {
+	if _, err := fmt.Fprintf(w, "%s:\n", label); err != nil {
+		return wrapWriteError(err)
+	}
+	maxCount := int64(0)
+	for _, bar := range bars {
+		if bar.count > maxCount {
+			maxCount = bar.count
+		}
+	}
+	for _, bar := range bars {
+		width := 0
+		if maxCount > 0 {
+			width = int(math.Round(float64(bar.count) / float64(maxCount) * float64(maxWidth)))
+		}
+		if width < 1 && bar.count > 0 {
+			width = 1
+		}
+		_, err := fmt.Fprintf(w, "%10.3fms - %10.3fms | %-*s %d\n", bar.from, bar.to, maxWidth, strings.Repeat("#", width), bar.count)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// writeASCIIHistogram writes the histogram of the StatGroup of label as an
+// ASCII bar chart (see writeASCIIBars), in increasing order of value. Without
+// edges, there is one bar per non-empty bucket of the histogram, whose buckets
+// are narrow where values are few and wide where they are many; with edges
+// (e.g., those of adaptiveBuckets, holding roughly equal counts), there is one
+// bar per bucket they delimit (see HistogramDiff), so resolution goes where
+// the values are.
+func writeASCIIHistogram(w io.Writer, label string, sg *statGroup, maxWidth int, edges []float64) error {
+	if edges != nil {
+		counts, _ := bucketCounts(sg, edges)
+		bars := make([]asciiBar, len(counts))
+		for i, count := range counts {
+			bars[i] = asciiBar{from: 0, to: math.Inf(1), count: count}
+			if i > 0 {
+				bars[i].from = edges[i-1]
+			}
+			if i < len(edges) {
+				bars[i].to = edges[i]
+			}
+		}
+		return writeASCIIBars(w, label, bars, maxWidth)
+	}
+
+	sg.mu.Lock()
+	histogramBars := sg.nonEmptyBars()
+	sg.mu.Unlock()
+	bars := make([]asciiBar, len(histogramBars))
+	for i, bar := range histogramBars {
+		bars[i] = asciiBar{from: float64(bar.From) / sg.scaleFactor, to: float64(bar.To) / sg.scaleFactor, count: bar.Count}
+	}
+	return writeASCIIBars(w, label, bars, maxWidth)
+}
+
+// groupMetric is a metric of a StatGroup that groups are ranked by for display.
+type groupMetric func(sg *statGroup) float64
+
+// defaultDisplayOrder is the name of the metric groups are ranked by for
+// display by default, so the labels that took most of the time are shown.
+const defaultDisplayOrder = "total"
+
+// groupMetrics are the metrics groups can be ranked by for display, by name.
+var groupMetrics = map[string]groupMetric{
+	"count": func(sg *statGroup) float64 { return float64(sg.count) },
+	"total": func(sg *statGroup) float64 { return sg.sum },
+	"mean":  func(sg *statGroup) float64 { return sg.Mean() },
+	"max":   func(sg *statGroup) float64 { return sg.Max() },
+	"p99":   func(sg *statGroup) float64 { return sg.Percentile(99) },
+}
+
+// writeTruncatedStatGroupMap writes the StatGroups like writeStatGroupMap,
+// unless there are more than maxGroups of them, in which case only the top
+// maxGroups by metric are written, in decreasing order of it, followed by the
+// combined stats of the others as "... and N more (summary):". A maxGroups of
+// 0 writes all the groups.
+func writeTruncatedStatGroupMap(w io.Writer, statGroups map[string]*statGroup, maxGroups int, metric groupMetric) error {
+	if maxGroups <= 0 || len(statGroups) <= maxGroups {
+		return writeStatGroupMap(w, statGroups)
+	}
+	keys, _ := labelsAndMaxLength(statGroups)
+	values := make(map[string]float64, len(keys))
+	for _, k := range keys {
+		values[k] = metric(statGroups[k])
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := values[keys[i]], values[keys[j]]
+		if a != b {
+			return a > b
+		}
+		return keys[i] < keys[j]
+	})
+
+	shown, rest := keys[:maxGroups], keys[maxGroups:]
+	maxKeyLength := 0
+	for _, k := range shown {
+		if len(k) > maxKeyLength {
+			maxKeyLength = len(k)
+		}
+	}
+	for _, k := range shown {
+		if _, err := fmt.Fprintf(w, "%-*s:\n", maxKeyLength, k); err != nil {
+			return wrapWriteError(err)
+		}
+		if err := statGroups[k].write(w); err != nil {
+			return err
+		}
+	}
+
+	others := make(map[string]*statGroup, len(rest))
+	for _, k := range rest {
+		others[k] = statGroups[k]
+	}
+	summary, err := aggregateMatching(others, func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "... and %d more (summary):\n", len(rest)); err != nil {
+		return wrapWriteError(err)
+	}
+	return summary.write(w)
+}
@@ -0,0 +1,451 @@
+package query
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriteParetoByTotalTime(t *testing.T) {
+	m := map[string]*statGroup{}
+	// label -> values pushed; totals are 60, 30 and 10 milliseconds
+	for label, vals := range map[string][]float64{
+		"small":  {5.0, 5.0},
+		"large":  {20.0, 20.0, 20.0},
+		"medium": {30.0},
+	} {
+		sg := newStatGroup(0)
+		for _, val := range vals {
+			sg.push(val)
+		}
+		m[label] = sg
+	}
+
+	r := BenchmarkResult{Labels: labelResults(m)}
+	var buf bytes.Buffer
+	if err := WriteParetoByTotalTime(&buf, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if got := len(lines); got != 3 {
+		t.Fatalf("incorrect number of lines: got %d want %d\n%s", got, 3, buf.String())
+	}
+	wantOrder := []string{"large", "medium", "small"}
+	wantCumulative := []string{"60.00%", "90.00%", "100.00%"}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, wantOrder[i]) {
+			t.Errorf("line %d: incorrect label order: got %q want prefix %q", i, line, wantOrder[i])
+		}
+		if !strings.HasSuffix(line, "cumulative: "+wantCumulative[i]) && !strings.HasSuffix(line, "cumulative:  "+wantCumulative[i]) {
+			t.Errorf("line %d: incorrect cumulative share: got %q want %s", i, line, wantCumulative[i])
+		}
+	}
+
+	if err := WriteParetoByTotalTime(&errWriter{}, r); err == nil {
+		t.Errorf("expected error but did not get one")
+	}
+}
+
+func TestWriteLongFormat(t *testing.T) {
+	m := map[string]*statGroup{
+		"single-groupby": newStatGroup(0),
+		"lastpoint, all": newStatGroup(0),
+	}
+	for _, val := range []float64{2.0, 4.0, 6.0} {
+		m["single-groupby"].push(val)
+		m["lastpoint, all"].push(val * 2)
+	}
+
+	var buf bytes.Buffer
+	result := BenchmarkResult{Metadata: map[string]string{"commit": "abc123"}, Labels: labelResults(m)}
+	if err := WriteLongFormat(&buf, result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "# commit: abc123\n") {
+		t.Errorf("missing metadata comment in output:\n%s", buf.String())
+	}
+	r := csv.NewReader(&buf)
+	r.Comment = '#'
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid CSV: %v", err)
+	}
+	wantPerLabel := 7 + len(reportedPercentiles)
+	if got := len(rows); got != 2*wantPerLabel {
+		t.Fatalf("incorrect number of rows: got %d want %d", got, 2*wantPerLabel)
+	}
+
+	byLabel := map[string]map[string]string{}
+	for _, row := range rows {
+		if len(row) != 3 {
+			t.Fatalf("row does not have 3 columns: %v", row)
+		}
+		if byLabel[row[0]] == nil {
+			byLabel[row[0]] = map[string]string{}
+		}
+		if _, ok := byLabel[row[0]][row[1]]; ok {
+			t.Errorf("statistic %s repeated for %s", row[1], row[0])
+		}
+		byLabel[row[0]][row[1]] = row[2]
+	}
+	for label, stats := range byLabel {
+		if got := len(stats); got != wantPerLabel {
+			t.Errorf("%s: incorrect number of statistics: got %d want %d", label, got, wantPerLabel)
+		}
+	}
+	if got := byLabel["single-groupby"]["mean"]; got != "4" {
+		t.Errorf("incorrect mean: got %s want %s", got, "4")
+	}
+	if got := byLabel["lastpoint, all"]["count"]; got != "3" {
+		t.Errorf("incorrect count: got %s want %s", got, "3")
+	}
+	if _, ok := byLabel["single-groupby"]["p99.9"]; !ok {
+		t.Errorf("missing p99.9 row")
+	}
+
+	// the totals come after the labels
+	result.Totals = newLabelResult(labelAllQueries, m["single-groupby"])
+	buf.Reset()
+	if err := WriteLongFormat(&buf, result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r = csv.NewReader(&buf)
+	r.Comment = '#'
+	rows, err = r.ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid CSV: %v", err)
+	}
+	if got := len(rows); got != 3*wantPerLabel || rows[len(rows)-1][0] != labelAllQueries {
+		t.Errorf("incorrect rows with totals: got %d rows, the last %v, want %d ending with %s", got, rows[len(rows)-1], 3*wantPerLabel, labelAllQueries)
+	}
+}
+
+func TestWriteGroupedByTag(t *testing.T) {
+	// labels are "<query-type>,workers=<n>"
+	tags := func(label string) map[string]string {
+		parts := strings.Split(label, ",")
+		m := map[string]string{"query-type": parts[0]}
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(p, "=", 2)
+			m[kv[0]] = kv[1]
+		}
+		return m
+	}
+	m := map[string]*statGroup{}
+	for label, vals := range map[string][]float64{
+		"lastpoint,workers=1": {1.0, 3.0},
+		"lastpoint,workers=8": {10.0},
+		"groupby,workers=1":   {5.0},
+		"groupby,workers=8":   {20.0, 40.0},
+		"untagged":            {7.0},
+	} {
+		sg := newStatGroup(0)
+		for _, val := range vals {
+			sg.push(val)
+		}
+		m[label] = sg
+	}
+
+	var buf bytes.Buffer
+	if err := writeGroupedByTag(&buf, m, tags, "workers"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+
+	// groups are ordered by tag value, each holding its labels then its subtotal
+	wantInOrder := []string{
+		"workers=(none):\n", "untagged", "subtotal workers=(none):\n",
+		"workers=1:\n", "groupby,workers=1", "lastpoint,workers=1", "subtotal workers=1:\n",
+		"workers=8:\n", "groupby,workers=8", "lastpoint,workers=8", "subtotal workers=8:\n",
+	}
+	pos := 0
+	for _, want := range wantInOrder {
+		i := strings.Index(out[pos:], want)
+		if i < 0 {
+			t.Fatalf("missing or out of order %q in output:\n%s", want, out)
+		}
+		pos += i + len(want)
+	}
+
+	groups := groupByTag(m, tags, "workers")
+	for value, want := range map[string]struct {
+		count int64
+		sum   float64
+	}{
+		"1":           {3, 9.0},
+		"8":           {3, 70.0},
+		untaggedGroup: {1, 7.0},
+	} {
+		subtotal, err := aggregateMatching(groups[value], func(string) bool { return true })
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if subtotal.count != want.count || subtotal.sum != want.sum {
+			t.Errorf("workers=%s: incorrect subtotal: got count %d sum %f want count %d sum %f", value, subtotal.count, subtotal.sum, want.count, want.sum)
+		}
+		if line := subtotal.string(); !strings.Contains(out, "subtotal workers="+value+":\n"+line) {
+			t.Errorf("workers=%s: subtotal %q not written", value, line)
+		}
+	}
+}
+
+func TestVarianceByTag(t *testing.T) {
+	tags := func(label string) map[string]string {
+		parts := strings.Split(label, ",")
+		return map[string]string{"query-type": parts[0], "scale": parts[1]}
+	}
+	m := map[string]*statGroup{}
+	// the query type drives the latency, the scale barely changes it
+	for label, vals := range map[string][]float64{
+		"fast,100":  {1.0, 2.0, 1.0, 2.0},
+		"fast,1000": {1.0, 2.0, 2.0, 1.0},
+		"slow,100":  {100.0, 101.0, 100.0, 101.0},
+		"slow,1000": {101.0, 100.0, 100.0, 101.0},
+	} {
+		sg := newStatGroup(0)
+		for _, val := range vals {
+			sg.push(val)
+		}
+		m[label] = sg
+	}
+
+	byType, err := varianceByTag(m, tags, "query-type")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// group means are 1.5 and 100.5 around 51: between = 49.5^2, within = 0.5^2
+	if want := 49.5 * 49.5; math.Abs(byType.between-want) > 0.01*want {
+		t.Errorf("incorrect between-group variance: got %f want %f", byType.between, want)
+	}
+	if want := 0.25; math.Abs(byType.within-want) > 0.01 {
+		t.Errorf("incorrect within-group variance: got %f want %f", byType.within, want)
+	}
+	if got := byType.explained(); got < 0.99 {
+		t.Errorf("query type explains too little variance: got %f want > 0.99", got)
+	}
+
+	byScale, err := varianceByTag(m, tags, "scale")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := byScale.explained(); got > 0.01 {
+		t.Errorf("scale explains too much variance: got %f want < 0.01", got)
+	}
+
+	empty, err := varianceByTag(map[string]*statGroup{}, tags, "scale")
+	if err != nil || empty.explained() != 0 {
+		t.Errorf("incorrect empty breakdown: got %+v, %v", empty, err)
+	}
+}
+
+func TestWriteFolded(t *testing.T) {
+	m := map[string]*statGroup{}
+	for label, vals := range map[string][]float64{
+		"write/batch/flush": {1.5, 2.5},
+		"write/batch":       {0.25},
+		"read/lastpoint":    {10.0},
+		"read/empty":        {},
+	} {
+		sg := newStatGroup(0)
+		for _, val := range vals {
+			sg.push(val)
+		}
+		m[label] = sg
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFolded(&buf, BenchmarkResult{Labels: labelResults(m)}, "/"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "read;lastpoint 10000\n" +
+		"write;batch 250\n" +
+		"write;batch;flush 4000\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect folded output: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{1.0, 2.0, 3.0} {
+		sg.push(val)
+	}
+	metadata := map[string]string{"commit": "abc123", "workers": "8"}
+	result := BenchmarkResult{
+		Metadata: metadata,
+		Labels:   labelResults(map[string]*statGroup{"foo": sg, "empty": newStatGroup(0)}),
+		Totals:   newLabelResult(labelAllQueries, sg),
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got BenchmarkResult
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if len(got.Metadata) != 2 || got.Metadata["commit"] != "abc123" || got.Metadata["workers"] != "8" {
+		t.Errorf("incorrect metadata: got %v want %v", got.Metadata, metadata)
+	}
+	// the metadata comes first
+	if i, j := strings.Index(buf.String(), "metadata"), strings.Index(buf.String(), "labels"); i < 0 || i > j {
+		t.Errorf("metadata not at the top of the output:\n%s", buf.String())
+	}
+	if len(got.Labels) != 2 || got.Labels[0].Label != "empty" || got.Labels[1].Label != "foo" {
+		t.Fatalf("incorrect labels: got %+v", got.Labels)
+	}
+	if foo := got.Labels[1]; foo.Count != 3 || foo.Sum != 6.0 || len(foo.Percentiles) != len(reportedPercentiles) {
+		t.Errorf("incorrect stats for foo: got %+v", foo)
+	}
+	if !strings.Contains(buf.String(), `"percentiles": null`) || got.Labels[0].Percentiles != nil {
+		t.Errorf("percentiles of an empty group not null: got %+v", got.Labels[0].Percentiles)
+	}
+}
+
+func TestWriteASCIIHistogram(t *testing.T) {
+	sg := newCompactStatGroup()
+	// value -> count; the values fall in distinct buckets
+	counts := map[float64]int{1.0: 10, 2.0: 5, 4.0: 1, 8.0: 20}
+	for val, count := range counts {
+		for i := 0; i < count; i++ {
+			sg.push(val)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeASCIIHistogram(&buf, "foo", sg, 40, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if lines[0] != "foo:" {
+		t.Errorf("incorrect header: got %q want %q", lines[0], "foo:")
+	}
+	bars := lines[1:]
+	if got, want := len(bars), len(sg.nonEmptyBars()); got != want || got != len(counts) {
+		t.Fatalf("incorrect number of bars: got %d want %d\n%s", got, want, buf.String())
+	}
+	// in increasing value order, widths are count/20*40 (at least 1)
+	wantWidths := []int{20, 10, 2, 40}
+	wantCounts := []string{"10", "5", "1", "20"}
+	for i, bar := range bars {
+		if got := strings.Count(bar, "#"); got != wantWidths[i] {
+			t.Errorf("bar %d: incorrect width: got %d want %d: %q", i, got, wantWidths[i], bar)
+		}
+		if !strings.HasSuffix(bar, " "+wantCounts[i]) {
+			t.Errorf("bar %d: incorrect count: got %q want suffix %q", i, bar, wantCounts[i])
+		}
+	}
+}
+
+func TestWriteASCIIHistogramEdges(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, v := range []float64{1, 2, 2, 3, 3, 3, 3, 10} {
+		sg.push(v)
+	}
+
+	var buf bytes.Buffer
+	if err := writeASCIIHistogram(&buf, "foo", sg, 8, []float64{2, 5}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "foo:\n" +
+		"     0.000ms -      2.000ms | #        1\n" +
+		"     2.000ms -      5.000ms | ######## 6\n" +
+		"     5.000ms -       +Infms | #        1\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect histogram: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteTruncatedStatGroupMap(t *testing.T) {
+	m := map[string]*statGroup{}
+	// label-i gets i values of 1ms, so the largest totals are the last labels
+	for i := 1; i <= 100; i++ {
+		sg := newStatGroup(0)
+		for j := 0; j < i; j++ {
+			sg.push(1.0)
+		}
+		m[fmt.Sprintf("label-%03d", i)] = sg
+	}
+
+	var buf bytes.Buffer
+	if err := writeTruncatedStatGroupMap(&buf, m, 3, groupMetrics["total"]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if got := len(lines); got != 8 {
+		t.Fatalf("incorrect number of lines: got %d want %d\n%s", got, 8, buf.String())
+	}
+	for i, want := range []string{"label-100:", "label-099:", "label-098:", "... and 97 more (summary):"} {
+		if got := lines[2*i]; got != want {
+			t.Errorf("line %d: got %q want %q", 2*i, got, want)
+		}
+	}
+	// the others have 1 + ... + 97 values
+	others := newStatGroup(0)
+	for i := 0; i < 97*98/2; i++ {
+		others.push(1.0)
+	}
+	if got, want := lines[7], others.string(); got != want {
+		t.Errorf("incorrect summary: got %q want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := writeTruncatedStatGroupMap(&buf, m, 0, groupMetrics["total"]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 200 {
+		t.Errorf("incorrect number of lines without a limit: got %d want %d", got, 200)
+	}
+
+	if err := writeTruncatedStatGroupMap(&errWriter{}, m, 3, groupMetrics["total"]); err == nil {
+		t.Errorf("expected error but did not get one")
+	}
+}
+
+func TestWriteGoBenchFormat(t *testing.T) {
+	m := map[string]*statGroup{
+		"single-groupby-1-1-1": newStatGroup(0),
+		"high-cpu all":         newStatGroup(0),
+		"empty":                newStatGroup(0),
+	}
+	for _, val := range []float64{2.0, 4.0, 6.0} {
+		m["single-groupby-1-1-1"].push(val)
+	}
+	m["high-cpu all"].push(0.5)
+
+	var buf bytes.Buffer
+	if err := WriteGoBenchFormat(&buf, BenchmarkResult{Labels: labelResults(m)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "BenchmarkHigh-cpu_all\t1\t500000 ns/op\n" +
+		"BenchmarkSingle-groupby-1-1-1\t3\t4000000 ns/op\n"
+	if buf.String() != want {
+		t.Errorf("incorrect output: got %q want %q", buf.String(), want)
+	}
+	// the benchmark lines as parsed by benchstat: a name starting with
+	// Benchmark not followed by a lower case letter, the iterations, then
+	// value and unit pairs, separated by whitespace
+	line := regexp.MustCompile(`^Benchmark(?:[^\sa-z]\S*)?\s+\d+(?:\s+\d+(?:\.\d+)?\s+\S+)+$`)
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !line.MatchString(l) {
+			t.Errorf("line not in the Go benchmark format: %q", l)
+		}
+	}
+
+	// the Reporter writes the metadata as configuration lines first
+	buf.Reset()
+	r := &Reporter{Format: ReportGoBench, Sinks: []io.Writer{&buf}, Metadata: map[string]string{"commit": "abc123"}}
+	if err := r.report(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := buf.String(); got != "commit: abc123\n"+want {
+		t.Errorf("incorrect report: got %q want %q", got, "commit: abc123\n"+want)
+	}
+}
@@ -0,0 +1,303 @@
+package query
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// parquetMagic starts and ends Parquet files.
+var parquetMagic = []byte("PAR1")
+
+// Parquet physical types, repetitions, encodings and page types, as numbered
+// in parquet.thrift.
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetUTF8 = 0 // parquetUTF8 is the converted type of strings
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+)
+
+// Thrift compact protocol types of the fields.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftEncoder appends structs in the Thrift compact protocol to buf, the
+// encoding of the metadata of Parquet files.
+type thriftEncoder struct {
+	buf       []byte
+	lastField []int16 // lastField is the id of the last field written of each struct being written
+}
+
+func (e *thriftEncoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.buf = append(e.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *thriftEncoder) zigzag(v int64) {
+	e.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (e *thriftEncoder) fieldHeader(id int16, typ byte) {
+	last := &e.lastField[len(e.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		e.buf = append(e.buf, byte(delta)<<4|typ)
+	} else {
+		e.buf = append(e.buf, typ)
+		e.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (e *thriftEncoder) listHeader(size int, elemType byte) {
+	if size < 15 {
+		e.buf = append(e.buf, byte(size)<<4|elemType)
+		return
+	}
+	e.buf = append(e.buf, 0xf0|elemType)
+	e.varint(uint64(size))
+}
+
+func (e *thriftEncoder) i32Field(id int16, v int32) {
+	e.fieldHeader(id, thriftI32)
+	e.zigzag(int64(v))
+}
+
+func (e *thriftEncoder) i64Field(id int16, v int64) {
+	e.fieldHeader(id, thriftI64)
+	e.zigzag(v)
+}
+
+func (e *thriftEncoder) stringField(id int16, s string) {
+	e.fieldHeader(id, thriftBinary)
+	e.varint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// structBody appends the fields written by encode, then the end of the struct.
+func (e *thriftEncoder) structBody(encode func(e *thriftEncoder)) {
+	e.lastField = append(e.lastField, 0)
+	encode(e)
+	e.buf = append(e.buf, 0) // stop
+	e.lastField = e.lastField[:len(e.lastField)-1]
+}
+
+func (e *thriftEncoder) structField(id int16, encode func(e *thriftEncoder)) {
+	e.fieldHeader(id, thriftStruct)
+	e.structBody(encode)
+}
+
+// structListField appends a list of n structs, the ith written by encode(e, i).
+func (e *thriftEncoder) structListField(id int16, n int, encode func(e *thriftEncoder, i int)) {
+	e.fieldHeader(id, thriftList)
+	e.listHeader(n, thriftStruct)
+	for i := 0; i < n; i++ {
+		e.structBody(func(e *thriftEncoder) { encode(e, i) })
+	}
+}
+
+func (e *thriftEncoder) i32ListField(id int16, values ...int32) {
+	e.fieldHeader(id, thriftList)
+	e.listHeader(len(values), thriftI32)
+	for _, v := range values {
+		e.zigzag(int64(v))
+	}
+}
+
+func (e *thriftEncoder) stringListField(id int16, values ...string) {
+	e.fieldHeader(id, thriftList)
+	e.listHeader(len(values), thriftBinary)
+	for _, v := range values {
+		e.varint(uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// parquetType returns the physical type of columns of kind, see statRecordColumn.
+func parquetType(kind string) int32 {
+	switch kind {
+	case "string":
+		return parquetByteArray
+	case "int64":
+		return parquetInt64
+	default:
+		return parquetDouble
+	}
+}
+
+// parquetColumnValues returns the values of column i of records, see
+// statRecordSchema, nil for the null ones.
+func parquetColumnValues(records []statRecord, i int) []interface{} {
+	values := make([]interface{}, len(records))
+	for j, r := range records {
+		switch i {
+		case 0:
+			values[j] = r.Label
+		case 1:
+			values[j] = r.Min
+		case 2:
+			values[j] = r.Max
+		case 3:
+			values[j] = r.Mean
+		case 4:
+			values[j] = r.StdDev
+		case 5:
+			values[j] = r.Count
+		case 6:
+			values[j] = r.Sum
+		default:
+			if p := r.Percentiles[i-7]; p != nil {
+				values[j] = *p
+			}
+		}
+	}
+	return values
+}
+
+// parquetPage returns the data of a data page of values, PLAIN encoded, after
+// their definition levels, RLE encoded, if nullable.
+func parquetPage(values []interface{}, nullable bool) []byte {
+	var page []byte
+	if nullable {
+		// runs of the same definition level, 1 for a value and 0 for a null,
+		// each a header of the run length then the level on a byte
+		var levels thriftEncoder
+		for i := 0; i < len(values); {
+			j := i
+			for j < len(values) && (values[j] == nil) == (values[i] == nil) {
+				j++
+			}
+			levels.varint(uint64(j-i) << 1)
+			if values[i] == nil {
+				levels.buf = append(levels.buf, 0)
+			} else {
+				levels.buf = append(levels.buf, 1)
+			}
+			i = j
+		}
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(levels.buf)))
+		page = append(page, size[:]...)
+		page = append(page, levels.buf...)
+	}
+	var b [8]byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+			page = append(page, b[:4]...)
+			page = append(page, v...)
+		case int64:
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			page = append(page, b[:]...)
+		case float64:
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			page = append(page, b[:]...)
+		}
+	}
+	return page
+}
+
+// writeParquet writes the records of the StatGroups, see statRecords, to w as
+// a Parquet file of the columns of statRecordSchema, e.g., for an analytics
+// pipeline. The file has a single row group, of a single uncompressed page
+// per column, which suits the number of labels of a run.
+func writeParquet(w io.Writer, statGroups map[string]*statGroup) error {
+	records := statRecords(statGroups)
+	columns := statRecordSchema()
+
+	file := append([]byte(nil), parquetMagic...)
+	offsets := make([]int64, len(columns))
+	sizes := make([]int64, len(columns))
+	for i, c := range columns {
+		page := parquetPage(parquetColumnValues(records, i), c.nullable)
+		var header thriftEncoder
+		header.structBody(func(e *thriftEncoder) {
+			e.i32Field(1, parquetDataPage)
+			e.i32Field(2, int32(len(page)))
+			e.i32Field(3, int32(len(page)))
+			e.structField(5, func(e *thriftEncoder) {
+				e.i32Field(1, int32(len(records)))
+				e.i32Field(2, parquetPlain)
+				e.i32Field(3, parquetRLE)
+				e.i32Field(4, parquetRLE)
+			})
+		})
+		offsets[i] = int64(len(file))
+		sizes[i] = int64(len(header.buf) + len(page))
+		file = append(file, header.buf...)
+		file = append(file, page...)
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	var meta thriftEncoder
+	meta.structBody(func(e *thriftEncoder) {
+		e.i32Field(1, 1) // version
+		e.structListField(2, len(columns)+1, func(e *thriftEncoder, i int) {
+			if i == 0 {
+				e.stringField(4, "schema")
+				e.i32Field(5, int32(len(columns)))
+				return
+			}
+			c := columns[i-1]
+			e.i32Field(1, parquetType(c.kind))
+			repetition := int32(parquetRequired)
+			if c.nullable {
+				repetition = parquetOptional
+			}
+			e.i32Field(3, repetition)
+			e.stringField(4, c.name)
+			if c.kind == "string" {
+				e.i32Field(6, parquetUTF8)
+			}
+		})
+		e.i64Field(3, int64(len(records)))
+		e.structListField(4, 1, func(e *thriftEncoder, _ int) {
+			e.structListField(1, len(columns), func(e *thriftEncoder, i int) {
+				c := columns[i]
+				e.i64Field(2, offsets[i])
+				e.structField(3, func(e *thriftEncoder) {
+					e.i32Field(1, parquetType(c.kind))
+					e.i32ListField(2, parquetPlain, parquetRLE)
+					e.stringListField(3, c.name)
+					e.i32Field(4, 0) // uncompressed
+					e.i64Field(5, int64(len(records)))
+					e.i64Field(6, sizes[i])
+					e.i64Field(7, sizes[i])
+					e.i64Field(9, offsets[i])
+				})
+			})
+			e.i64Field(2, total)
+			e.i64Field(3, int64(len(records)))
+		})
+		e.stringField(6, "tsbs")
+	})
+	file = append(file, meta.buf...)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(meta.buf)))
+	file = append(file, size[:]...)
+	file = append(file, parquetMagic...)
+
+	_, err := w.Write(file)
+	return wrapWriteError(err)
+}
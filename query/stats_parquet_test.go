@@ -0,0 +1,182 @@
+package query
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// thriftDecoder reads values in the Thrift compact protocol: structs as maps
+// of their fields by id, lists as slices, integers as int64s and binaries as
+// strings.
+type thriftDecoder struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (d *thriftDecoder) varint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.t.Fatalf("invalid varint")
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *thriftDecoder) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		v := d.varint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftBinary:
+		n := d.varint()
+		s := string(d.buf[:n])
+		d.buf = d.buf[n:]
+		return s
+	case thriftList:
+		header := d.buf[0]
+		d.buf = d.buf[1:]
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(d.varint())
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			values[i] = d.value(header & 0x0f)
+		}
+		return values
+	case thriftStruct:
+		fields := map[int16]interface{}{}
+		id := int16(0)
+		for {
+			header := d.buf[0]
+			d.buf = d.buf[1:]
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta > 0 {
+				id += delta
+			} else {
+				id = int16(d.value(thriftI32).(int64))
+			}
+			fields[id] = d.value(header & 0x0f)
+		}
+	}
+	d.t.Fatalf("unexpected type %d", typ)
+	return nil
+}
+
+// readParquetColumns reads back the columns, by name, of the Parquet file
+// written by writeParquet, with nulls as nils.
+func readParquetColumns(t *testing.T, file []byte) (schema []map[int16]interface{}, columns map[string][]interface{}) {
+	if !bytes.HasPrefix(file, parquetMagic) || !bytes.HasSuffix(file, parquetMagic) {
+		t.Fatalf("missing magic")
+	}
+	size := binary.LittleEndian.Uint32(file[len(file)-8:])
+	d := &thriftDecoder{t: t, buf: file[len(file)-8-int(size) : len(file)-8]}
+	meta := d.value(thriftStruct).(map[int16]interface{})
+	for _, e := range meta[2].([]interface{}) {
+		schema = append(schema, e.(map[int16]interface{}))
+	}
+	numRows := int(meta[3].(int64))
+
+	columns = map[string][]interface{}{}
+	rowGroup := meta[4].([]interface{})[0].(map[int16]interface{})
+	for i, c := range rowGroup[1].([]interface{}) {
+		chunk := c.(map[int16]interface{})[3].(map[int16]interface{})
+		element := schema[i+1]
+		d := &thriftDecoder{t: t, buf: file[chunk[9].(int64):]}
+		header := d.value(thriftStruct).(map[int16]interface{})
+		page := d.buf[:header[3].(int64)]
+
+		defined := make([]bool, numRows)
+		for j := range defined {
+			defined[j] = true
+		}
+		if element[3].(int64) == parquetOptional {
+			n := binary.LittleEndian.Uint32(page)
+			levels := &thriftDecoder{t: t, buf: page[4 : 4+n]}
+			page = page[4+n:]
+			for j := 0; j < numRows; {
+				run := int(levels.varint() >> 1)
+				level := levels.buf[0]
+				levels.buf = levels.buf[1:]
+				for k := 0; k < run; k++ {
+					defined[j+k] = level == 1
+				}
+				j += run
+			}
+		}
+		values := make([]interface{}, numRows)
+		for j := range values {
+			if !defined[j] {
+				continue
+			}
+			switch element[1].(int64) {
+			case parquetByteArray:
+				n := binary.LittleEndian.Uint32(page)
+				values[j] = string(page[4 : 4+n])
+				page = page[4+n:]
+			case parquetInt64:
+				values[j] = int64(binary.LittleEndian.Uint64(page))
+				page = page[8:]
+			case parquetDouble:
+				values[j] = math.Float64frombits(binary.LittleEndian.Uint64(page))
+				page = page[8:]
+			}
+		}
+		columns[element[4].(string)] = values
+	}
+	return schema, columns
+}
+
+func TestWriteParquet(t *testing.T) {
+	statGroups := map[string]*statGroup{
+		"foo":   newStatGroup(0),
+		"bar":   newStatGroup(0),
+		"empty": newStatGroup(0),
+	}
+	for _, v := range []float64{1, 2, 3} {
+		statGroups["foo"].push(v)
+	}
+	statGroups["bar"].push(10)
+
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, statGroups); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	schema, columns := readParquetColumns(t, buf.Bytes())
+
+	want := statRecordSchema()
+	if len(schema) != len(want)+1 || schema[0][5].(int64) != int64(len(want)) {
+		t.Fatalf("incorrect schema: got %v", schema)
+	}
+	for i, c := range want {
+		element := schema[i+1]
+		if element[4] != c.name || element[1] != int64(parquetType(c.kind)) || (element[3] == int64(parquetOptional)) != c.nullable {
+			t.Errorf("incorrect column %d: got %v want %+v", i, element, c)
+		}
+	}
+
+	for name, want := range map[string][]interface{}{
+		"label": {"bar", "empty", "foo"},
+		"count": {int64(1), int64(0), int64(3)},
+		"sum":   {10.0, 0.0, 6.0},
+		"max":   {10.0, 0.0, 3.0},
+	} {
+		got := columns[name]
+		if len(got) != len(want) {
+			t.Fatalf("incorrect number of %s values: got %d want %d", name, len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("incorrect %s of row %d: got %v want %v", name, i, got[i], want[i])
+			}
+		}
+	}
+	p50 := columns[percentileName(50)]
+	if p50[0] != 10.0 || p50[1] != nil || p50[2] != 2.0 {
+		t.Errorf("incorrect p50 values: got %v, want an empty group's to be null", p50)
+	}
+}
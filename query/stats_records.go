@@ -0,0 +1,73 @@
+package query
+
+import "sort"
+
+// statRecord is the per-label stats of a StatGroup as a flat record, i.e., a
+// row of the tabular exports of the stats. Values are in milliseconds.
+// Percentiles are those of reportedPercentiles, nil (null) when the group is
+// empty and they are undefined.
+type statRecord struct {
+	Label       string
+	Min         float64
+	Max         float64
+	Mean        float64
+	StdDev      float64
+	Count       int64
+	Sum         float64
+	Percentiles []*float64
+}
+
+// statRecordColumn describes a column of the tabular exports of statRecords.
+type statRecordColumn struct {
+	name     string
+	kind     string // kind is the logical type of the column: "string", "double" or "int64"
+	nullable bool
+}
+
+// statRecordSchema returns the columns of the tabular exports of statRecords,
+// in order: label, min, max, mean, stddev, count, sum, then one nullable column
+// per reported percentile, e.g., "p99.9". It is the schema of the Parquet
+// export, see writeParquet.
+func statRecordSchema() []statRecordColumn {
+	columns := []statRecordColumn{
+		{name: "label", kind: "string"},
+		{name: "min", kind: "double"},
+		{name: "max", kind: "double"},
+		{name: "mean", kind: "double"},
+		{name: "stddev", kind: "double"},
+		{name: "count", kind: "int64"},
+		{name: "sum", kind: "double"},
+	}
+	for _, p := range reportedPercentiles {
+		columns = append(columns, statRecordColumn{name: percentileName(p), kind: "double", nullable: true})
+	}
+	return columns
+}
+
+// statRecords returns the records of the StatGroups, ordered by label.
+func statRecords(statGroups map[string]*statGroup) []statRecord {
+	keys, _ := labelsAndMaxLength(statGroups)
+	sort.Strings(keys)
+	records := make([]statRecord, 0, len(keys))
+	for _, k := range keys {
+		sg := statGroups[k]
+		r := statRecord{
+			Label:       k,
+			Min:         sg.Min(),
+			Max:         sg.Max(),
+			Mean:        sg.Mean(),
+			StdDev:      sg.StdDev(),
+			Count:       sg.count,
+			Sum:         sg.sum,
+			Percentiles: make([]*float64, len(reportedPercentiles)),
+		}
+		if sg.count > 0 {
+			for i, p := range reportedPercentiles {
+				v := sg.Percentile(p)
+				r.Percentiles[i] = &v
+			}
+		}
+		records = append(records, r)
+	}
+	return records
+}
@@ -0,0 +1,56 @@
+package query
+
+import "testing"
+
+func TestStatRecordSchema(t *testing.T) {
+	columns := statRecordSchema()
+	wantNames := []string{"label", "min", "max", "mean", "stddev", "count", "sum", "p50", "p90", "p95", "p99", "p99.9"}
+	if len(columns) != len(wantNames) {
+		t.Fatalf("incorrect number of columns: got %d want %d", len(columns), len(wantNames))
+	}
+	for i, c := range columns {
+		if c.name != wantNames[i] {
+			t.Errorf("column %d: incorrect name: got %s want %s", i, c.name, wantNames[i])
+		}
+		if wantNullable := i >= 7; c.nullable != wantNullable {
+			t.Errorf("column %s: incorrect nullability: got %v want %v", c.name, c.nullable, wantNullable)
+		}
+	}
+	if columns[0].kind != "string" || columns[5].kind != "int64" || columns[6].kind != "double" {
+		t.Errorf("incorrect column kinds: %+v", columns)
+	}
+}
+
+func TestStatRecords(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{1.0, 2.0, 3.0} {
+		sg.push(val)
+	}
+	m := map[string]*statGroup{"foo": sg, "empty": newStatGroup(0)}
+
+	records := statRecords(m)
+	if len(records) != 2 {
+		t.Fatalf("incorrect number of records: got %d want %d", len(records), 2)
+	}
+	if records[0].Label != "empty" || records[1].Label != "foo" {
+		t.Errorf("incorrect record order: got %s, %s", records[0].Label, records[1].Label)
+	}
+	for i, p := range records[0].Percentiles {
+		if p != nil {
+			t.Errorf("empty group: percentile %d not null: got %f", i, *p)
+		}
+	}
+
+	foo := records[1]
+	if foo.Min != sg.Min() || foo.Max != sg.Max() || foo.Mean != sg.Mean() || foo.StdDev != sg.StdDev() {
+		t.Errorf("incorrect stats: got %+v", foo)
+	}
+	if foo.Count != 3 || foo.Sum != 6.0 {
+		t.Errorf("incorrect count or sum: got %d, %f want %d, %f", foo.Count, foo.Sum, 3, 6.0)
+	}
+	for i, p := range reportedPercentiles {
+		if foo.Percentiles[i] == nil || *foo.Percentiles[i] != sg.Percentile(p) {
+			t.Errorf("incorrect %s: got %v want %f", percentileName(p), foo.Percentiles[i], sg.Percentile(p))
+		}
+	}
+}
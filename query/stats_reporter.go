@@ -0,0 +1,213 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// ErrUnknownReportFormat is returned when reporting in a format that is not
+// one of the ReportFormats.
+var ErrUnknownReportFormat = errors.New("stats: unknown report format")
+
+// ReportFormat is a format a Reporter writes stats in.
+type ReportFormat string
+
+// The formats a Reporter can write stats in.
+const (
+	ReportText     ReportFormat = "text"     // ReportText is the layout of the final stats, one "label:" line then its stats per label
+	ReportJSON     ReportFormat = "json"     // ReportJSON is a BenchmarkResult as indented JSON, always ordered by label
+	ReportCSV      ReportFormat = "csv"      // ReportCSV is the long format, one (label, statistic, value) row per statistic
+	ReportMarkdown ReportFormat = "markdown" // ReportMarkdown is a table with one row per label, e.g., to paste in a pull request
+	ReportGoBench  ReportFormat = "gobench"  // ReportGoBench is the output format of Go benchmarks, with the metadata as configuration lines, e.g., for benchstat
+)
+
+// defaultReportPrecision is the number of digits after the decimal point of
+// the values in milliseconds in the text and markdown formats by default.
+const defaultReportPrecision = 2
+
+// Reporter writes stats in a format to sinks, so that callers configure the
+// output once rather than choosing among the functions writing each format;
+// BenchmarkRunner.Report writes the stats of a run with it. The zero Reporter
+// writes all the labels, ordered by label, as text to stdout.
+type Reporter struct {
+	Format    ReportFormat            // Format is the format to write in, text if empty
+	Sinks     []io.Writer             // Sinks are all written the report to, stdout if empty
+	SortBy    string                  // SortBy, if set, is the metric (count, total, mean, max or p99) labels are written in decreasing order of, except in JSON
+	Filter    func(label string) bool // Filter, if set, tells which labels to write
+	Precision int                     // Precision, if positive, is the number of digits after the decimal point of the values in milliseconds in the text and markdown formats
+	Metadata  map[string]string       // Metadata describes the run (e.g., commit, database version) at the top of the report
+}
+
+// report writes the stats of statGroups as configured. A sink failing does not
+// stop the others from being written to; the error of the first one that
+// failed is returned. Aggregate groups such as "all queries" should be left out
+// of statGroups, or they are counted twice in the JSON totals.
+func (r *Reporter) report(statGroups map[string]*statGroup) error {
+	keys, err := r.labels(statGroups)
+	if err != nil {
+		return err
+	}
+	var write func(w io.Writer) error
+	switch r.Format {
+	case "", ReportText:
+		write = func(w io.Writer) error { return r.writeText(w, statGroups, keys) }
+	case ReportJSON:
+		result, err := r.result(statGroups, keys)
+		if err != nil {
+			return err
+		}
+		write = func(w io.Writer) error { return writeJSON(w, result) }
+	case ReportCSV:
+		write = func(w io.Writer) error { return writeLongFormat(w, r.Metadata, keyLabelResults(statGroups, keys)) }
+	case ReportMarkdown:
+		write = func(w io.Writer) error { return r.writeMarkdown(w, statGroups, keys) }
+	case ReportGoBench:
+		write = func(w io.Writer) error { return r.writeGoBench(w, statGroups, keys) }
+	default:
+		return ErrUnknownReportFormat
+	}
+
+	sinks := r.Sinks
+	if len(sinks) == 0 {
+		sinks = []io.Writer{os.Stdout}
+	}
+	if errs := writeToSinks(sinks, write); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// labels returns the labels of statGroups to write, in the order to write
+// them in.
+func (r *Reporter) labels(statGroups map[string]*statGroup) ([]string, error) {
+	keys := make([]string, 0, len(statGroups))
+	for k := range statGroups {
+		if r.Filter == nil || r.Filter(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(r.SortBy) == 0 {
+		return keys, nil
+	}
+	metric, ok := groupMetrics[r.SortBy]
+	if !ok {
+		return nil, fmt.Errorf("stats: unknown sort order %q", r.SortBy)
+	}
+	values := make(map[string]float64, len(keys))
+	for _, k := range keys {
+		values[k] = metric(statGroups[k])
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return values[keys[i]] > values[keys[j]] })
+	return keys, nil
+}
+
+// precision returns the number of digits after the decimal point to write the
+// values in milliseconds with.
+func (r *Reporter) precision() int {
+	if r.Precision > 0 {
+		return r.Precision
+	}
+	return defaultReportPrecision
+}
+
+// writeText writes the StatGroups of keys like writeStatGroupMap, in the order
+// of keys.
+func (r *Reporter) writeText(w io.Writer, statGroups map[string]*statGroup, keys []string) error {
+	if err := writeMetadata(w, "", r.Metadata); err != nil {
+		return err
+	}
+	maxKeyLength := 0
+	for _, k := range keys {
+		if len(k) > maxKeyLength {
+			maxKeyLength = len(k)
+		}
+	}
+	for _, k := range keys {
+		_, err := fmt.Fprintf(w, "%-*s:\n%s\n", maxKeyLength, k, statGroups[k].stringWithPrecision(r.precision()))
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// writeMarkdown writes the StatGroups of keys as a markdown table, in the
+// order of keys, preceded by the metadata as a list.
+func (r *Reporter) writeMarkdown(w io.Writer, statGroups map[string]*statGroup, keys []string) error {
+	if err := writeMetadata(w, "- ", r.Metadata); err != nil {
+		return err
+	}
+	if len(r.Metadata) > 0 {
+		if _, err := fmt.Fprintln(w); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	header, separator := "| label | count | min (ms) | mean (ms) |", "|---|---:|---:|---:|"
+	for _, p := range reportedPercentiles {
+		header += fmt.Sprintf(" %s (ms) |", percentileName(p))
+		separator += "---:|"
+	}
+	header += " max (ms) |"
+	separator += "---:|"
+	if _, err := fmt.Fprintf(w, "%s\n%s\n", header, separator); err != nil {
+		return wrapWriteError(err)
+	}
+
+	precision := r.precision()
+	for _, k := range keys {
+		sg := statGroups[k]
+		row := fmt.Sprintf("| %s | %d | %.*f | %.*f |", k, sg.count, precision, sg.Min(), precision, sg.Mean())
+		for _, p := range reportedPercentiles {
+			row += fmt.Sprintf(" %.*f |", precision, sg.Percentile(p))
+		}
+		row += fmt.Sprintf(" %.*f |", precision, sg.Max())
+		if _, err := fmt.Fprintln(w, row); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// writeGoBench writes the StatGroups of keys like WriteGoBenchFormat, in the
+// order of keys, preceded by the metadata as "key: value" configuration lines.
+func (r *Reporter) writeGoBench(w io.Writer, statGroups map[string]*statGroup, keys []string) error {
+	if err := writeMetadata(w, "", r.Metadata); err != nil {
+		return err
+	}
+	return writeGoBenchFormat(w, keyLabelResults(statGroups, keys))
+}
+
+// keyLabelResults returns the LabelResults of the StatGroups of keys, in the
+// order of keys.
+func keyLabelResults(statGroups map[string]*statGroup, keys []string) []LabelResult {
+	results := make([]LabelResult, 0, len(keys))
+	for _, k := range keys {
+		results = append(results, newLabelResult(k, statGroups[k]))
+	}
+	return results
+}
+
+// result returns the BenchmarkResult of the StatGroups of keys, their
+// combined stats as totals.
+func (r *Reporter) result(statGroups map[string]*statGroup, keys []string) (BenchmarkResult, error) {
+	selected := make(map[string]*statGroup, len(keys))
+	for _, k := range keys {
+		selected[k] = statGroups[k]
+	}
+	result := BenchmarkResult{
+		Metadata: r.Metadata,
+		Labels:   labelResults(selected),
+	}
+	if len(selected) > 0 {
+		totals, err := aggregateMatching(selected, func(string) bool { return true })
+		if err != nil {
+			return BenchmarkResult{}, err
+		}
+		result.Totals = newLabelResult(labelAllQueries, totals)
+	}
+	return result, nil
+}
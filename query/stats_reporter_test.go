@@ -0,0 +1,67 @@
+package query
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReporter(t *testing.T) {
+	m := map[string]*statGroup{
+		"fast":    newStatGroup(0),
+		"slow":    newStatGroup(0),
+		"skipped": newStatGroup(0),
+	}
+	for _, val := range []float64{1.0, 2.0, 3.0} {
+		m["fast"].push(val)
+		m["slow"].push(val * 100)
+		m["skipped"].push(val)
+	}
+
+	var first, second bytes.Buffer
+	r := &Reporter{
+		Format:    ReportMarkdown,
+		Sinks:     []io.Writer{&first, &second},
+		SortBy:    "mean",
+		Filter:    func(label string) bool { return label != "skipped" },
+		Precision: 1,
+		Metadata:  map[string]string{"commit": "abc123"},
+	}
+	if err := r.report(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(first.String()), "\n")
+	if got := len(lines); got != 6 {
+		t.Fatalf("incorrect number of lines: got %d want %d:\n%s", got, 6, first.String())
+	}
+	if lines[0] != "- commit: abc123" {
+		t.Errorf("incorrect metadata: got %q", lines[0])
+	}
+	// the slowest label first, without the filtered out one
+	if !strings.HasPrefix(lines[4], "| slow | 3 | 100.0 | 200.0 |") {
+		t.Errorf("incorrect first row: got %q", lines[4])
+	}
+	if !strings.HasPrefix(lines[5], "| fast | 3 | 1.0 | 2.0 |") {
+		t.Errorf("incorrect second row: got %q", lines[5])
+	}
+	if second.String() != first.String() {
+		t.Errorf("sinks written differently:\n%s\nvs\n%s", first.String(), second.String())
+	}
+
+	// the zero Reporter writes text like writeStatGroupMap
+	var text, want bytes.Buffer
+	if err := (&Reporter{Sinks: []io.Writer{&text}}).report(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeStatGroupMap(&want, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if text.String() != want.String() {
+		t.Errorf("incorrect text report: got\n%s\nwant\n%s", text.String(), want.String())
+	}
+
+	if err := (&Reporter{Format: "yaml"}).report(m); err != ErrUnknownReportFormat {
+		t.Errorf("incorrect error: got %v want %v", err, ErrUnknownReportFormat)
+	}
+}
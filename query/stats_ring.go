@@ -0,0 +1,163 @@
+package query
+
+import "math"
+
+// ringStatGroup is a variant of statGroup that only keeps the statistics of
+// the last size values pushed to it, e.g., to follow the recent behavior of a
+// long running (soak) test rather than its lifetime aggregate. The values are
+// kept in a ring buffer: the sum and sum of squares are maintained as values
+// come in and out, min and max are computed over the buffer when asked for.
+type ringStatGroup struct {
+	values []float64
+	next   int // next is the position the next value is written to
+	full   bool
+	sum    float64
+	sumSq  float64
+}
+
+// newRingStatGroup returns a ringStatGroup keeping the last size values.
+func newRingStatGroup(size int) *ringStatGroup {
+	if size < 1 {
+		panic("ring stat group size must be at least 1")
+	}
+	return &ringStatGroup{values: make([]float64, size)}
+}
+
+// push adds a value, evicting the oldest one if the buffer is full.
+func (r *ringStatGroup) push(n float64) error {
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return ErrNotFinite
+	}
+	if r.full {
+		evicted := r.values[r.next]
+		r.sum -= evicted
+		r.sumSq -= evicted * evicted
+	}
+	r.values[r.next] = n
+	r.sum += n
+	r.sumSq += n * n
+	r.next++
+	if r.next == len(r.values) {
+		r.next = 0
+		r.full = true
+	}
+	return nil
+}
+
+// window returns the values currently kept, in no particular order.
+func (r *ringStatGroup) window() []float64 {
+	if r.full {
+		return r.values
+	}
+	return r.values[:r.next]
+}
+
+// Count returns the number of values currently kept
+func (r *ringStatGroup) Count() int {
+	return len(r.window())
+}
+
+// Min returns the smallest of the values kept, 0 if there are none
+func (r *ringStatGroup) Min() float64 {
+	window := r.window()
+	if len(window) == 0 {
+		return 0
+	}
+	min := window[0]
+	for _, v := range window[1:] {
+		min = math.Min(min, v)
+	}
+	return min
+}
+
+// Max returns the largest of the values kept, 0 if there are none
+func (r *ringStatGroup) Max() float64 {
+	window := r.window()
+	if len(window) == 0 {
+		return 0
+	}
+	max := window[0]
+	for _, v := range window[1:] {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+// Mean returns the mean of the values kept, 0 if there are none
+func (r *ringStatGroup) Mean() float64 {
+	n := r.Count()
+	if n == 0 {
+		return 0
+	}
+	return r.sum / float64(n)
+}
+
+// StdDev returns the (population) standard deviation of the values kept
+func (r *ringStatGroup) StdDev() float64 {
+	n := r.Count()
+	if n == 0 {
+		return 0
+	}
+	mean := r.Mean()
+	variance := r.sumSq/float64(n) - mean*mean
+	if variance < 0 {
+		// rounding errors of the running sums
+		variance = 0
+	}
+	return math.Sqrt(variance)
+}
+
+// ordered returns the values currently kept, from the oldest to the newest.
+func (r *ringStatGroup) ordered() []float64 {
+	if !r.full {
+		return r.values[:r.next]
+	}
+	ordered := make([]float64, 0, len(r.values))
+	ordered = append(ordered, r.values[r.next:]...)
+	return append(ordered, r.values[:r.next]...)
+}
+
+// lag1Autocorrelation returns the correlation between each value kept and
+// the next one, 0 if it cannot be computed (fewer than 3 values, or no variance).
+func (r *ringStatGroup) lag1Autocorrelation() float64 {
+	values := r.ordered()
+	if len(values) < 3 {
+		return 0
+	}
+	mean := r.Mean()
+	num, denom := 0.0, 0.0
+	for i, v := range values {
+		denom += (v - mean) * (v - mean)
+		if i > 0 {
+			num += (values[i-1] - mean) * (v - mean)
+		}
+	}
+	if denom == 0 {
+		return 0
+	}
+	return num / denom
+}
+
+// EffectiveSampleSize returns the number of independent values carrying as
+// much information about the mean as the values kept, which are typically
+// autocorrelated in closed-loop runs (e.g., a slow query slowing down the
+// next): n * (1 - r) / (1 + r), r being the lag-1 autocorrelation. A negative
+// autocorrelation is taken as none, so it is at most the number of values kept.
+func (r *ringStatGroup) EffectiveSampleSize() float64 {
+	n := float64(r.Count())
+	rho := math.Max(0, r.lag1Autocorrelation())
+	return n * (1 - rho) / (1 + rho)
+}
+
+// MeanConfidenceInterval returns the half-width of the two-sided confidence
+// interval (e.g., 0.95) of the mean of the values kept, based on their
+// effective sample size rather than their count, so autocorrelation does not
+// make it look narrower than it is. It is +Inf when there is no information,
+// i.e., for fewer than 2 values kept, or a confidence outside of (0, 1).
+func (r *ringStatGroup) MeanConfidenceInterval(confidence float64) float64 {
+	n := r.EffectiveSampleSize()
+	if r.Count() < 2 || n < 1 || confidence <= 0 || confidence >= 1 {
+		return math.Inf(1)
+	}
+	return zScore(confidence) * r.StdDev() / math.Sqrt(n)
+}
@@ -0,0 +1,93 @@
+package query
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRingStatGroup(t *testing.T) {
+	const size = 8
+	r := newRingStatGroup(size)
+	if r.Count() != 0 || r.Mean() != 0 || r.Min() != 0 || r.Max() != 0 || r.StdDev() != 0 {
+		t.Errorf("empty ring stat group has non-zero stats")
+	}
+
+	// the first values, including the min and max, must all be evicted
+	for _, val := range []float64{1000.0, 0.5, 300.0} {
+		r.push(val)
+	}
+	for _, val := range []float64{2.0, 4.0, 4.0, 4.0, 5.0, 5.0, 7.0, 9.0} {
+		r.push(val)
+	}
+
+	if got := r.Count(); got != size {
+		t.Errorf("incorrect count: got %d want %d", got, size)
+	}
+	if got := r.Min(); got != 2.0 {
+		t.Errorf("incorrect min: got %f want %f", got, 2.0)
+	}
+	if got := r.Max(); got != 9.0 {
+		t.Errorf("incorrect max: got %f want %f", got, 9.0)
+	}
+	if got := r.Mean(); math.Abs(got-5.0) > 1e-9 {
+		t.Errorf("incorrect mean: got %f want %f", got, 5.0)
+	}
+	if got := r.StdDev(); math.Abs(got-2.0) > 1e-9 {
+		t.Errorf("incorrect stddev: got %f want %f", got, 2.0)
+	}
+}
+
+func TestRingStatGroupNotFull(t *testing.T) {
+	r := newRingStatGroup(10)
+	r.push(1.0)
+	r.push(3.0)
+	if got := r.Count(); got != 2 {
+		t.Errorf("incorrect count: got %d want %d", got, 2)
+	}
+	if got := r.Mean(); got != 2.0 {
+		t.Errorf("incorrect mean: got %f want %f", got, 2.0)
+	}
+	if err := r.push(math.NaN()); err != ErrNotFinite {
+		t.Errorf("incorrect error: got %v want %v", err, ErrNotFinite)
+	}
+}
+
+func TestRingStatGroupEffectiveSampleSize(t *testing.T) {
+	const size = 10000
+	rng := rand.New(rand.NewSource(1))
+	uncorrelated, correlated := newRingStatGroup(size), newRingStatGroup(size)
+	// AR(1) values with a lag-1 autocorrelation of 0.8, whose effective
+	// sample size is n * 0.2 / 1.8, i.e., n / 9
+	prev := 0.0
+	for i := 0; i < 2*size; i++ {
+		uncorrelated.push(10 + rng.NormFloat64())
+		prev = 0.8*prev + rng.NormFloat64()
+		correlated.push(10 + prev)
+	}
+
+	if got := uncorrelated.EffectiveSampleSize(); got < 0.95*size {
+		t.Errorf("effective sample size of uncorrelated values too small: got %f want about %d", got, size)
+	}
+	if got, want := correlated.EffectiveSampleSize(), size/9.0; math.Abs(got-want) > 0.15*want {
+		t.Errorf("incorrect effective sample size of correlated values: got %f want about %f", got, want)
+	}
+
+	// the confidence interval is widened by the square root of the ratio
+	naive := 1.959964 * correlated.StdDev() / math.Sqrt(size)
+	if got := correlated.MeanConfidenceInterval(0.95); got < 2.5*naive {
+		t.Errorf("confidence interval not widened: got %f, naive %f", got, naive)
+	}
+	if got := newRingStatGroup(10).MeanConfidenceInterval(0.95); !math.IsInf(got, 1) {
+		t.Errorf("incorrect confidence interval without values: got %f", got)
+	}
+
+	// the order of the values is kept across the ring buffer
+	r := newRingStatGroup(3)
+	for _, val := range []float64{1, 2, 3, 4} {
+		r.push(val)
+	}
+	if got := r.ordered(); got[0] != 2 || got[1] != 3 || got[2] != 4 {
+		t.Errorf("incorrect order: got %v want %v", got, []float64{2, 3, 4})
+	}
+}
@@ -0,0 +1,119 @@
+package query
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// tailSample is a single value retained by a tailSampler, with its details.
+type tailSample struct {
+	label string
+	value float64
+	at    time.Time
+}
+
+// tailSampleHeap is a min-heap of tailSamples by value, so the fastest of the
+// retained samples is the first to be evicted.
+type tailSampleHeap []tailSample
+
+func (h tailSampleHeap) Len() int            { return len(h) }
+func (h tailSampleHeap) Less(i, j int) bool  { return h[i].value < h[j].value }
+func (h tailSampleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *tailSampleHeap) Push(x interface{}) { *h = append(*h, x.(tailSample)) }
+func (h *tailSampleHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// tailSampler retains the details (label, time) of the slow values only, to
+// investigate tail latency without keeping every value. A value is slow if it
+// is above a fixed threshold, or above a percentile of the values seen so far.
+// At most maxSamples samples are retained: once full, the fastest retained
+// sample is evicted to make room for a slower one.
+type tailSampler struct {
+	clock      Clock
+	threshold  float64    // threshold is the fixed threshold, in milliseconds, when percentile is 0
+	percentile float64    // percentile, if positive, is the percentile of the values seen used as threshold
+	seen       *statGroup // seen holds the values seen, to estimate the percentile
+	maxSamples int
+	samples    tailSampleHeap
+}
+
+// newThresholdTailSampler returns a tailSampler retaining the values above
+// threshold, in milliseconds.
+func newThresholdTailSampler(clock Clock, threshold float64, maxSamples int) *tailSampler {
+	return &tailSampler{clock: clock, threshold: threshold, maxSamples: maxSamples}
+}
+
+// newPercentileTailSampler returns a tailSampler retaining the values above
+// percentile p (e.g., 95) of the values seen so far. The estimate is rough
+// until enough values have been seen, so the first values tend to be retained.
+func newPercentileTailSampler(clock Clock, p float64, maxSamples int) *tailSampler {
+	return &tailSampler{clock: clock, percentile: p, seen: newCompactStatGroup(), maxSamples: maxSamples}
+}
+
+// currentThreshold returns the value above which values are retained.
+func (ts *tailSampler) currentThreshold() float64 {
+	if ts.percentile > 0 {
+		return ts.seen.Percentile(ts.percentile)
+	}
+	return ts.threshold
+}
+
+// push retains the value if it is slow, reporting whether it was retained.
+func (ts *tailSampler) push(label []byte, value float64) bool {
+	threshold := ts.currentThreshold()
+	if ts.seen != nil {
+		ts.seen.push(value)
+	}
+	if value <= threshold || ts.maxSamples <= 0 {
+		return false
+	}
+	if len(ts.samples) == ts.maxSamples {
+		if value <= ts.samples[0].value {
+			return false
+		}
+		heap.Pop(&ts.samples)
+	}
+	heap.Push(&ts.samples, tailSample{label: string(label), value: value, at: ts.clock.Now()})
+	return true
+}
+
+// retained returns the samples retained, slowest first.
+func (ts *tailSampler) retained() []tailSample {
+	samples := make([]tailSample, len(ts.samples))
+	copy(samples, ts.samples)
+	sort.Slice(samples, func(i, j int) bool { return samples[i].value > samples[j].value })
+	return samples
+}
+
+// write writes the samples retained to w, slowest first, with their label,
+// anonymized by anonymizer if not nil, and the time they were measured at,
+// e.g., to look them up in the logs of the database.
+func (ts *tailSampler) write(w io.Writer, anonymizer *labelAnonymizer) error {
+	above := fmt.Sprintf("%vms", ts.threshold)
+	if ts.percentile > 0 {
+		above = percentileName(ts.percentile) + " of the queries so far"
+	}
+	samples := ts.retained()
+	_, err := fmt.Fprintf(w, "Slowest %d queries (above %s):\n", len(samples), above)
+	if err != nil {
+		return wrapWriteError(err)
+	}
+	for _, s := range samples {
+		label := s.label
+		if anonymizer != nil {
+			label = anonymizer.anonymize(label)
+		}
+		_, err = fmt.Fprintf(w, "%s: %0.2fms at %s\n", label, s.value, s.at.UTC().Format(time.RFC3339Nano))
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThresholdTailSampler(t *testing.T) {
+	clock := newFakeClock()
+	ts := newThresholdTailSampler(clock, 10.0, 3)
+	for i, val := range []float64{1.0, 12.0, 5.0, 10.0, 30.0, 11.0, 20.0, 2.0} {
+		clock.advance(time.Second)
+		retained := ts.push([]byte("foo"), val)
+		if want := val > 10.0; retained && !want {
+			t.Errorf("value %d (%f) retained below the threshold", i, val)
+		}
+	}
+
+	// 12, 30, 11 and 20 are above the threshold, but only the 3 slowest are kept
+	retained := ts.retained()
+	wantValues := []float64{30.0, 20.0, 12.0}
+	if len(retained) != len(wantValues) {
+		t.Fatalf("incorrect number of samples retained: got %d want %d", len(retained), len(wantValues))
+	}
+	start := newFakeClock().Now()
+	wantAt := []time.Time{start.Add(5 * time.Second), start.Add(7 * time.Second), start.Add(2 * time.Second)}
+	for i, s := range retained {
+		if s.value != wantValues[i] || s.label != "foo" || !s.at.Equal(wantAt[i]) {
+			t.Errorf("sample %d: got %+v want value %f at %v", i, s, wantValues[i], wantAt[i])
+		}
+	}
+}
+
+func TestPercentileTailSampler(t *testing.T) {
+	clock := newFakeClock()
+	ts := newPercentileTailSampler(clock, 95, 1000)
+	// warm up the estimate with 1000 values of 1 to 10ms
+	for i := 0; i < 1000; i++ {
+		ts.push([]byte("warm-up"), float64(1+i%10))
+	}
+
+	before := len(ts.retained())
+	for _, val := range []float64{2.0, 5.0, 100.0, 3.0, 200.0} {
+		ts.push([]byte("foo"), val)
+	}
+	retained := ts.retained()
+	if got := len(retained) - before; got != 2 {
+		t.Fatalf("incorrect number of samples retained: got %d want %d", got, 2)
+	}
+	if retained[0].value != 200.0 || retained[1].value != 100.0 {
+		t.Errorf("incorrect slowest samples: got %+v, %+v", retained[0], retained[1])
+	}
+}
+
+func TestTailSamplerWrite(t *testing.T) {
+	clock := newFakeClock()
+	ts := newThresholdTailSampler(clock, 10.0, 2)
+	for _, val := range []float64{12.0, 5.0, 30.0, 11.0} {
+		clock.advance(time.Second)
+		ts.push([]byte("foo"), val)
+	}
+	var buf bytes.Buffer
+	if err := ts.write(&buf, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Slowest 2 queries (above 10ms):\n" +
+		"foo: 30.00ms at 2020-01-01T00:00:03Z\n" +
+		"foo: 12.00ms at 2020-01-01T00:00:01Z\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect output:\ngot\n%s\nwant\n%s", got, want)
+	}
+
+	buf.Reset()
+	ts = newPercentileTailSampler(clock, 99, 1)
+	ts.push([]byte("foo"), 1.0)
+	if err := ts.write(&buf, newLabelAnonymizer([]byte("key"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "Slowest 1 queries (above p99 of the queries so far):\nlabel-") {
+		t.Errorf("incorrect output with a percentile and anonymized labels:\n%s", got)
+	}
+}
+
+func TestStatProcessorReportsTailSamples(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, tailSampler: newThresholdTailSampler(newFakeClock(), 10.0, 5)}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	sp.aggregate(GetStat().Init([]byte("foo"), 20.0))
+
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 2, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Slowest 1 queries (above 10ms):\nfoo: 20.00ms at ") {
+		t.Errorf("slowest queries missing from the report:\n%s", buf.String())
+	}
+}
@@ -2,10 +2,19 @@ package query
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/filipecosta90/hdrhistogram"
 )
 
 func TestGetPartialStat(t *testing.T) {
@@ -281,6 +290,31 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestStatGroupWritePercentiles(t *testing.T) {
+	sg := newStatGroup(0)
+	for i := 1; i <= 1000; i++ {
+		sg.push(float64(i))
+	}
+	var buf bytes.Buffer
+	if err := sg.write(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := buf.String()
+	if !strings.Contains(got, "count: 1000, ") {
+		t.Errorf("missing summary stats: %s", got)
+	}
+	for name, want := range map[string]float64{"med": 500, "p90": 900, "p95": 950, "p99": 990, "p99.9": 999} {
+		m := regexp.MustCompile(regexp.QuoteMeta(name) + `: +([0-9.]+)ms`).FindStringSubmatch(got)
+		if m == nil {
+			t.Errorf("missing %s: %s", name, got)
+			continue
+		}
+		if v, _ := strconv.ParseFloat(m[1], 64); math.Abs(v-want) > 0.001*want {
+			t.Errorf("incorrect %s: got %f want %f", name, v, want)
+		}
+	}
+}
+
 func TestWriteStatGroupMap(t *testing.T) {
 	cases := []struct {
 		desc           string
@@ -405,3 +439,625 @@ func TestWriteStatGroupMap(t *testing.T) {
 		}
 	}
 }
+
+func TestStatGroupSnapshotAndReset(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{1.0, 2.0, 3.0} {
+		sg.push(val)
+	}
+	snapshot := sg.SnapshotAndReset()
+	if got := snapshot.count; got != 3 {
+		t.Errorf("incorrect snapshot count: got %d want %d", got, 3)
+	}
+	if got := snapshot.sum; got != 6.0 {
+		t.Errorf("incorrect snapshot sum: got %f want %f", got, 6.0)
+	}
+	if got := snapshot.Max(); got != 3.0 {
+		t.Errorf("incorrect snapshot Max: got %f want %f", got, 3.0)
+	}
+	if sg.count != 0 || sg.sum != 0 || sg.latencyHDRHistogram.TotalCount() != 0 {
+		t.Errorf("group not reset after snapshot: count %d, sum %f", sg.count, sg.sum)
+	}
+
+	sg.push(10.0)
+	if got := sg.Min(); got != 10.0 {
+		t.Errorf("incorrect Min after reset: got %f want %f", got, 10.0)
+	}
+	if got := snapshot.count; got != 3 {
+		t.Errorf("snapshot changed by push after reset: got count %d want %d", got, 3)
+	}
+}
+
+func TestStatGroupSnapshotAndResetConcurrentPush(t *testing.T) {
+	const pushers = 4
+	const pushesPerPusher = 5000
+	sg := newStatGroup(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < pushesPerPusher; j++ {
+				sg.push(1.0)
+			}
+		}()
+	}
+
+	// Snapshot repeatedly while the pushers are running, merging each snapshot
+	// into the running total.
+	total := newStatGroup(0)
+	done := make(chan struct{})
+	merged := make(chan error)
+	go func() {
+		for {
+			if err := total.Merge(sg.SnapshotAndReset()); err != nil {
+				merged <- err
+				return
+			}
+			select {
+			case <-done:
+				merged <- nil
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	if err := <-merged; err != nil {
+		t.Fatalf("unexpected error merging snapshot: %v", err)
+	}
+	if err := total.Merge(sg.SnapshotAndReset()); err != nil {
+		t.Fatalf("unexpected error merging final snapshot: %v", err)
+	}
+
+	want := int64(pushers * pushesPerPusher)
+	if got := total.count; got != want {
+		t.Errorf("incorrect merged count: got %d want %d", got, want)
+	}
+	if got := total.sum; got != float64(want) {
+		t.Errorf("incorrect merged sum: got %f want %f", got, float64(want))
+	}
+	if got := total.latencyHDRHistogram.TotalCount(); got != want {
+		t.Errorf("incorrect merged histogram count: got %d want %d", got, want)
+	}
+}
+
+func TestStatGroupMerge(t *testing.T) {
+	a := newStatGroup(0)
+	b := newStatGroup(0)
+	all := newStatGroup(0)
+	for i, val := range []float64{2.0, 4.0, 4.0, 4.0, 5.0, 5.0, 7.0, 9.0} {
+		if i%2 == 0 {
+			a.push(val)
+		} else {
+			b.push(val)
+		}
+		all.push(val)
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a.count != all.count || a.sum != all.sum {
+		t.Errorf("incorrect merged totals: got count %d sum %f want count %d sum %f", a.count, a.sum, all.count, all.sum)
+	}
+	if a.Mean() != all.Mean() || a.StdDev() != all.StdDev() || a.Median() != all.Median() {
+		t.Errorf("merged stats differ: got %s want %s", a.string(), all.string())
+	}
+
+	incompatible := &statGroup{latencyHDRHistogram: hdrhistogram.New(1, 1000, 2)}
+	if err := a.Merge(incompatible); err == nil {
+		t.Errorf("expected error merging incompatible groups but did not get one")
+	}
+}
+
+func TestLowSampleCountWarnings(t *testing.T) {
+	m := map[string]*statGroup{
+		"well sampled":  newStatGroup(0),
+		"under sampled": newStatGroup(0),
+	}
+	for i := 0; i < 10; i++ {
+		m["well sampled"].push(1.0)
+	}
+	m["under sampled"].push(1.0)
+	m["under sampled"].push(2.0)
+
+	warnings := lowSampleCountWarnings(m, 5)
+	if got := len(warnings); got != 1 {
+		t.Fatalf("incorrect number of warnings: got %d want %d (%v)", got, 1, warnings)
+	}
+	if !strings.Contains(warnings[0], "under sampled") || !strings.Contains(warnings[0], "2 samples") {
+		t.Errorf("unexpected warning: %s", warnings[0])
+	}
+	if got := lowSampleCountWarnings(m, 2); len(got) != 0 {
+		t.Errorf("unexpected warnings at minimum met: %v", got)
+	}
+}
+
+func TestOutlierWarnings(t *testing.T) {
+	m := map[string]*statGroup{
+		"normal":  newStatGroup(0),
+		"extreme": newStatGroup(0),
+		"steady":  newStatGroup(0),
+	}
+	for i := 0; i < 100; i++ {
+		m["normal"].push(float64(10 + i%5))
+		m["extreme"].push(float64(10 + i%5))
+		m["steady"].push(10.0)
+	}
+	m["extreme"].push(1000.0)
+
+	warnings := outlierWarnings(m, 3)
+	if got := len(warnings); got != 1 {
+		t.Fatalf("incorrect number of warnings: got %d want %d (%v)", got, 1, warnings)
+	}
+	if !strings.Contains(warnings[0], "extreme has an outlier") || !strings.Contains(warnings[0], "max 1000.") {
+		t.Errorf("unexpected warning: %s", warnings[0])
+	}
+
+	sp := &defaultStatProcessor{args: &statProcessorArgs{outlierThreshold: 3}, statMapping: m}
+	var buf bytes.Buffer
+	if err := sp.writeReport(&buf, 301, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := buf.String(); !strings.Contains(got, warnings[0]) || strings.Contains(got, "normal has an outlier") {
+		t.Errorf("incorrect outlier flags in the report:\n%s", got)
+	}
+}
+
+func TestStatGroupPushNotFinite(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if err := sg.push(val); err != ErrNotFinite {
+			t.Errorf("incorrect error pushing %f: got %v want %v", val, err, ErrNotFinite)
+		}
+	}
+	if sg.count != 0 || sg.sum != 0 {
+		t.Errorf("non-finite values were recorded: count %d sum %f", sg.count, sg.sum)
+	}
+	if err := sg.push(1.0); err != nil {
+		t.Errorf("unexpected error pushing finite value: %v", err)
+	}
+}
+
+func TestWriteFailedError(t *testing.T) {
+	sg := newStatGroup(0)
+	sg.push(1.0)
+	err := sg.write(&errWriter{})
+	if !errors.Is(err, ErrWriteFailed) {
+		t.Errorf("write error does not match ErrWriteFailed: %v", err)
+	}
+	if got := err.Error(); got != errWriterNormal {
+		t.Errorf("write error message changed: got %s want %s", got, errWriterNormal)
+	}
+
+	m := map[string]*statGroup{"foo": sg}
+	if err := writeStatGroupMap(&errWriter{skipOne: true}, m); !errors.Is(err, ErrWriteFailed) {
+		t.Errorf("writeStatGroupMap error does not match ErrWriteFailed: %v", err)
+	}
+	if err := WriteParetoByTotalTime(&errWriter{}, BenchmarkResult{Labels: labelResults(m)}); !errors.Is(err, ErrWriteFailed) {
+		t.Errorf("WriteParetoByTotalTime error does not match ErrWriteFailed: %v", err)
+	}
+}
+
+func TestStatGroupMergeIncompatible(t *testing.T) {
+	sg := newStatGroup(0)
+	incompatible := &statGroup{latencyHDRHistogram: hdrhistogram.New(1, 1000, 2)}
+	if err := sg.Merge(incompatible); err != ErrIncompatibleStatGroups {
+		t.Errorf("incorrect error: got %v want %v", err, ErrIncompatibleStatGroups)
+	}
+}
+
+func TestStatGroupExportPercentileCurve(t *testing.T) {
+	sg := newStatGroup(0)
+	for i := 1; i <= 10000; i++ {
+		sg.push(float64(i) / 10)
+	}
+
+	curve := sg.ExportPercentileCurve()
+	if got := len(curve); got != len(defaultCurvePercentiles) {
+		t.Fatalf("incorrect default curve length: got %d want %d", got, len(defaultCurvePercentiles))
+	}
+	for i, point := range curve {
+		if point.Percentile != defaultCurvePercentiles[i] {
+			t.Errorf("incorrect percentile at %d: got %f want %f", i, point.Percentile, defaultCurvePercentiles[i])
+		}
+		if i > 0 && point.Value < curve[i-1].Value {
+			t.Errorf("curve is decreasing at p%v: %f < %f", point.Percentile, point.Value, curve[i-1].Value)
+		}
+	}
+	if got := curve[0].Value; got != 0.1 {
+		t.Errorf("incorrect p0: got %f want %f", got, 0.1)
+	}
+	if got := curve[len(curve)-1].Value; math.Abs(got-1000.0) > 1.0 {
+		t.Errorf("incorrect p99.99: got %f want ~%f", got, 1000.0)
+	}
+
+	custom := sg.ExportPercentileCurve(25, 75)
+	if len(custom) != 2 || custom[0].Percentile != 25 || custom[1].Percentile != 75 {
+		t.Errorf("custom percentiles not used: got %v", custom)
+	}
+	if got := custom[0].Value; math.Abs(got-250.0) > 0.5 {
+		t.Errorf("incorrect p25: got %f want ~%f", got, 250.0)
+	}
+}
+
+func TestAggregateMatching(t *testing.T) {
+	m := map[string]*statGroup{
+		"write batch": newStatGroup(0),
+		"write flush": newStatGroup(0),
+		"read point":  newStatGroup(0),
+	}
+	vals := map[string][]float64{
+		"write batch": {1.0, 2.0, 3.0},
+		"write flush": {10.0, 20.0},
+		"read point":  {100.0},
+	}
+	for k, v := range vals {
+		for _, val := range v {
+			m[k].push(val)
+		}
+	}
+
+	got, err := aggregateMatching(m, func(label string) bool { return strings.HasPrefix(label, "write") })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := newStatGroup(0)
+	want.Merge(m["write batch"])
+	want.Merge(m["write flush"])
+	if got.count != want.count || got.sum != want.sum {
+		t.Errorf("incorrect totals: got count %d sum %f want count %d sum %f", got.count, got.sum, want.count, want.sum)
+	}
+	if got.string() != want.string() {
+		t.Errorf("incorrect aggregate: got %s want %s", got.string(), want.string())
+	}
+	if got.Max() != 20.0 {
+		t.Errorf("aggregate includes non-matching groups: max %f", got.Max())
+	}
+
+	none, err := aggregateMatching(m, func(string) bool { return false })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if none.count != 0 {
+		t.Errorf("incorrect count for no matches: got %d want %d", none.count, 0)
+	}
+}
+
+func TestAggregateMatchingResult(t *testing.T) {
+	m := map[string]*statGroup{}
+	for k, v := range map[string][]float64{
+		"write batch": {1.0, 2.0, 3.0},
+		"write flush": {10.0, 20.0},
+		"read point":  {100.0},
+	} {
+		m[k] = newStatGroup(0)
+		for _, val := range v {
+			m[k].push(val)
+		}
+	}
+	r := BenchmarkResult{Labels: labelResults(m)}
+	isWrite := func(label string) bool { return strings.HasPrefix(label, "write") }
+	if _, err := AggregateMatching(r, isWrite); err != ErrNoHistogram {
+		t.Errorf("incorrect error without histograms: got %v want %v", err, ErrNoHistogram)
+	}
+
+	for i := range r.Labels {
+		r.Labels[i].Histogram = encodeHistogram(m[r.Labels[i].Label])
+	}
+	got, err := AggregateMatching(r, isWrite)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want, err := aggregateMatching(m, isWrite)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantResult := newLabelResult("", want)
+	got.Histogram = nil
+	if !reflect.DeepEqual(got, wantResult) {
+		t.Errorf("incorrect aggregate: got %+v want %+v", got, wantResult)
+	}
+}
+
+func TestStatGroupPushNegative(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{2.0, -0.001, 4.0} {
+		if err := sg.push(val); err != nil {
+			t.Fatalf("unexpected error pushing %f: %v", val, err)
+		}
+	}
+	if got := sg.skewCount; got != 1 {
+		t.Errorf("incorrect skew count: got %d want %d", got, 1)
+	}
+	if got := sg.count; got != 3 {
+		t.Errorf("incorrect count: got %d want %d", got, 3)
+	}
+	if got := sg.sum; got != 6.0 {
+		t.Errorf("negative value not clamped in sum: got %f want %f", got, 6.0)
+	}
+	for name, got := range map[string]float64{"min": sg.Min(), "mean": sg.Mean(), "stddev": sg.StdDev(), "max": sg.Max()} {
+		if math.IsNaN(got) || math.IsInf(got, 0) || got < 0 {
+			t.Errorf("%s is not a finite non-negative number: %f", name, got)
+		}
+	}
+	if !strings.Contains(sg.string(), "clock skew: 1") {
+		t.Errorf("skew count not reported: %s", sg.string())
+	}
+	if strings.Contains(newStatGroup(0).string(), "clock skew") {
+		t.Errorf("skew reported when there is none")
+	}
+}
+
+func TestRequiredSampleSize(t *testing.T) {
+	cases := []struct {
+		desc                                     string
+		stddev, mean, relativeMargin, confidence float64
+		want                                     int
+	}{
+		// z = 1.96: (1.96 * 10 / (0.05 * 100))^2 = 15.37
+		{desc: "95% within 5%", stddev: 10, mean: 100, relativeMargin: 0.05, confidence: 0.95, want: 16},
+		// z = 2.5758: (2.5758 * 20 / (0.01 * 50))^2 = 10615.8
+		{desc: "99% within 1%", stddev: 20, mean: 50, relativeMargin: 0.01, confidence: 0.99, want: 10616},
+		{desc: "zero variance", stddev: 0, mean: 100, relativeMargin: 0.05, confidence: 0.95, want: 1},
+		{desc: "zero mean", stddev: 10, mean: 0, relativeMargin: 0.05, confidence: 0.95, want: 0},
+		{desc: "zero margin", stddev: 10, mean: 100, relativeMargin: 0, confidence: 0.95, want: 0},
+		{desc: "certain confidence", stddev: 10, mean: 100, relativeMargin: 0.05, confidence: 1, want: 0},
+	}
+	for _, c := range cases {
+		got := RequiredSampleSize(c.stddev, c.mean, c.relativeMargin, c.confidence)
+		if got != c.want {
+			t.Errorf("%s: incorrect sample size: got %d want %d", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestStatGroupDebugState(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{1.0, 2.0, 3.0, -1.0} {
+		sg.push(val)
+	}
+	got := sg.DebugState()
+	if got.Sum != 6.0 || got.Count != 4 || got.SkewCount != 1 {
+		t.Errorf("incorrect accumulators: got sum %f count %d skew %d want sum %f count %d skew %d", got.Sum, got.Count, got.SkewCount, 6.0, 4, 1)
+	}
+	if got.HistogramTotalCount != 4 {
+		t.Errorf("incorrect histogram total count: got %d want %d", got.HistogramTotalCount, 4)
+	}
+	// values are recorded in microseconds: 0, 1000, 2000 and 3000
+	if want := 1500.0; math.Abs(got.HistogramMean-want) > 1 {
+		t.Errorf("incorrect histogram mean: got %f want %f", got.HistogramMean, want)
+	}
+	if got.HistogramScaleFactor != hdrScaleFactor || got.HistogramSignificantFigures != 4 {
+		t.Errorf("incorrect histogram parameters: got %+v", got)
+	}
+}
+
+func TestStatGroupPushCorrected(t *testing.T) {
+	sg := newStatGroup(0)
+	if err := sg.pushCorrected(35.0, 10.0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 35 plus the synthesized 25 and 15
+	if sg.count != 3 || sg.sum != 75.0 {
+		t.Errorf("incorrect corrected values: got count %d sum %f want count %d sum %f", sg.count, sg.sum, 3, 75.0)
+	}
+
+	sg = newStatGroup(0)
+	sg.pushCorrected(35.0, 0)
+	if sg.count != 1 {
+		t.Errorf("incorrect count without correction: got %d want %d", sg.count, 1)
+	}
+}
+
+func TestHistogramResolution(t *testing.T) {
+	for _, precise := range []bool{false, true} {
+		sg := newStatGroup(0)
+		if precise {
+			sg = newPreciseStatGroup()
+		}
+		resolution := histogramResolution(precise)
+		sg.push(float64(resolution) / float64(time.Millisecond))
+		if got := sg.Max(); got != float64(resolution)/float64(time.Millisecond) {
+			t.Errorf("precise %v: resolution %v not recorded as is: got %fms", precise, resolution, got)
+		}
+	}
+	if got := histogramResolution(false); got != time.Microsecond {
+		t.Errorf("incorrect resolution: got %v want %v", got, time.Microsecond)
+	}
+}
+
+func TestStatGroupApdex(t *testing.T) {
+	// with a target of 2ms: 60 satisfied, 30 tolerating and 10 frustrated values
+	sg := newStatGroup(0)
+	for value, count := range map[float64]int{1.0: 60, 2.0: 0, 5.0: 30, 20.0: 10} {
+		for i := 0; i < count; i++ {
+			sg.push(value)
+		}
+	}
+	if got, want := sg.Apdex(2.0), (60+30.0/2)/100; math.Abs(got-want) > 1e-9 {
+		t.Errorf("incorrect apdex: got %f want %f", got, want)
+	}
+	// the target itself is satisfied, and 4 times the target tolerating
+	sg.push(2.0)
+	sg.push(8.0)
+	if got, want := sg.Apdex(2.0), (61+31.0/2)/102; math.Abs(got-want) > 1e-9 {
+		t.Errorf("incorrect apdex at the thresholds: got %f want %f", got, want)
+	}
+	if got := sg.Apdex(100.0); got != 1 {
+		t.Errorf("incorrect apdex with all values satisfied: got %f want %f", got, 1.0)
+	}
+	if got := newStatGroup(0).Apdex(2.0); got != 0 {
+		t.Errorf("incorrect apdex of an empty group: got %f want %f", got, 0.0)
+	}
+
+	var buf bytes.Buffer
+	if err := writeApdex(&buf, map[string]*statGroup{"foo": sg, "empty": newStatGroup(0)}, 100.0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := buf.String(), "foo  : apdex: 1.000\n"; got != want {
+		t.Errorf("incorrect output: got %q want %q", got, want)
+	}
+}
+
+func TestStatGroupAbsoluteDeviations(t *testing.T) {
+	sg := newStatGroup(0)
+	for _, val := range []float64{1.0, 2.0, 3.0, 4.0, 10.0} {
+		sg.push(val)
+	}
+	// mean 4: deviations 3, 2, 1, 0 and 6
+	if got, want := sg.MeanAbsoluteDeviation(), 12.0/5; math.Abs(got-want) > 1e-9 {
+		t.Errorf("incorrect mean absolute deviation: got %f want %f", got, want)
+	}
+	// median 3: deviations 2, 1, 0, 1 and 7
+	if got, want := sg.MedianAbsoluteDeviation(), 1.0; math.Abs(got-want) > 1e-9 {
+		t.Errorf("incorrect median absolute deviation: got %f want %f", got, want)
+	}
+	empty := newStatGroup(0)
+	if empty.MeanAbsoluteDeviation() != 0 || empty.MedianAbsoluteDeviation() != 0 {
+		t.Errorf("non-zero deviations of an empty group")
+	}
+
+	var buf bytes.Buffer
+	if err := writeAbsoluteDeviations(&buf, map[string]*statGroup{"foo": sg}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := buf.String(), "foo: mean abs dev:     2.40ms, median abs dev:     1.00ms\n"; got != want {
+		t.Errorf("incorrect output: got %q want %q", got, want)
+	}
+}
+
+func TestStatGroupMergeRebucketed(t *testing.T) {
+	all := newStatGroup(0)
+	regular, precise, compact := newStatGroup(0), newPreciseStatGroup(), newCompactStatGroup()
+	for i := 1; i <= 3000; i++ {
+		value := float64(i) / 3
+		switch i % 3 {
+		case 0:
+			regular.push(value)
+		case 1:
+			precise.push(value)
+		default:
+			compact.push(value)
+		}
+		all.push(value)
+	}
+
+	merged := newStatGroup(0)
+	if relativeError, err := merged.MergeRebucketed(regular); err != nil || relativeError != 0 {
+		t.Fatalf("compatible groups re-bucketed: got %f, %v", relativeError, err)
+	}
+	relativeError := 0.0
+	for _, other := range []*statGroup{precise, compact} {
+		e, err := merged.MergeRebucketed(other)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		relativeError = math.Max(relativeError, e)
+	}
+	if relativeError <= 0 || relativeError > 0.02 {
+		t.Errorf("incorrect relative error bound: got %f", relativeError)
+	}
+	if merged.count != all.count || math.Abs(merged.sum-all.sum) > 1e-6 {
+		t.Errorf("incorrect merged count and sum: got %d and %f want %d and %f", merged.count, merged.sum, all.count, all.sum)
+	}
+	for _, p := range []float64{1, 50, 90, 99} {
+		got, want := merged.Percentile(p), all.Percentile(p)
+		if math.Abs(got-want) > relativeError*want+0.01 {
+			t.Errorf("p%v out of tolerance: got %f want %f", p, got, want)
+		}
+	}
+}
+
+func TestStatGroupOmissionCost(t *testing.T) {
+	// 990 fast queries and a stall of 10 queries of 1s, at an expected interval of 10ms
+	sg := newStatGroup(0)
+	for i := 0; i < 990; i++ {
+		sg.push(1.0)
+	}
+	for i := 0; i < 10; i++ {
+		sg.push(1000.0)
+	}
+
+	cost := sg.OmissionCost(99, 10.0)
+	if math.Abs(cost.Uncorrected-1.0) > 0.01 {
+		t.Errorf("incorrect uncorrected p99: got %f want %f", cost.Uncorrected, 1.0)
+	}
+	// each stall hides 99 queries delayed by 990ms, 980ms, ..., 10ms
+	if cost.Corrected < 900.0 || cost.Ratio() < 100 {
+		t.Errorf("correction too small: got p99 %f ratio %f", cost.Corrected, cost.Ratio())
+	}
+	if sg.count != 1000 {
+		t.Errorf("StatGroup changed: got count %d want %d", sg.count, 1000)
+	}
+
+	if got := sg.OmissionCost(99, 0).Ratio(); got != 1 {
+		t.Errorf("incorrect ratio without correction: got %f want %f", got, 1.0)
+	}
+	// without values above the interval, there is nothing to correct
+	if got := sg.OmissionCost(99, 2000.0).Ratio(); got != 1 {
+		t.Errorf("incorrect ratio without stalls: got %f want %f", got, 1.0)
+	}
+
+	// the same cost, of the result of a run exported with histograms
+	lr := newLabelResult("foo", sg)
+	lr.Histogram = encodeHistogram(sg)
+	if got, err := lr.OmissionCost(99, 10*time.Millisecond); err != nil || got != cost {
+		t.Errorf("incorrect cost of the result: got %+v, %v want %+v", got, err, cost)
+	}
+	if _, err := newLabelResult("foo", sg).OmissionCost(99, 10*time.Millisecond); err != ErrNoHistogram {
+		t.Errorf("incorrect error without histogram: got %v want %v", err, ErrNoHistogram)
+	}
+
+	var buf bytes.Buffer
+	if err := writeOmissionCosts(&buf, map[string]*statGroup{"foo": sg, "empty": newStatGroup(0)}, 10.0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := buf.String(), fmt.Sprintf("foo  : p99: 1.00ms, corrected: %0.2fms (%0.2fx)\n", cost.Corrected, cost.Ratio()); got != want {
+		t.Errorf("incorrect output: got %q want %q", got, want)
+	}
+}
+
+func TestPreciseStatGroup(t *testing.T) {
+	// durations are pushed as float milliseconds, here 500ns and 1.5us
+	took := []time.Duration{500 * time.Nanosecond, 1500 * time.Nanosecond}
+
+	precise, regular := newPreciseStatGroup(), newStatGroup(0)
+	for _, d := range took {
+		ms := float64(d.Nanoseconds()) / 1e6
+		precise.push(ms)
+		regular.push(ms)
+	}
+	if got, want := precise.Min(), 0.0005; got != want {
+		t.Errorf("500ns not preserved: got %vms want %vms", got, want)
+	}
+	if got, want := precise.Max(), 0.0015; got != want {
+		t.Errorf("1.5us not preserved: got %vms want %vms", got, want)
+	}
+	if got := precise.latencyHDRHistogram.Min(); got != 500 {
+		t.Errorf("incorrect recorded value: got %dns want %dns", got, 500)
+	}
+	// microsecond precision cannot tell 500ns apart
+	if got := regular.Min(); got == 0.0005 {
+		t.Errorf("regular StatGroup unexpectedly kept 500ns")
+	}
+	// and truncates, rather than rounds, the microseconds
+	truncated := newStatGroup(0)
+	truncated.push(0.0019)
+	if got := truncated.latencyHDRHistogram.Max(); got != 1 {
+		t.Errorf("incorrect recorded value of 1.9us: got %dus want %dus", got, 1)
+	}
+
+	if err := regular.Merge(precise); err != ErrIncompatibleStatGroups {
+		t.Errorf("incorrect error merging precise into regular: got %v want %v", err, ErrIncompatibleStatGroups)
+	}
+	aggregate, err := aggregateMatching(map[string]*statGroup{"a": precise, "b": newPreciseStatGroup()}, func(string) bool { return true })
+	if err != nil {
+		t.Fatalf("unexpected error aggregating precise StatGroups: %v", err)
+	}
+	if got := aggregate.Min(); got != 0.0005 {
+		t.Errorf("incorrect aggregate min: got %vms want %vms", got, 0.0005)
+	}
+}
@@ -0,0 +1,308 @@
+package query
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrNoWindows is returned when writing the throughput per second of a run
+// whose stats were not split into windows of time.
+var ErrNoWindows = errors.New("stats: no windows of time were kept")
+
+// statWindow holds the stats of the values pushed during one window of time.
+type statWindow struct {
+	start time.Time
+	width time.Duration
+	stats *statGroup
+}
+
+// throughput returns the number of values pushed per second during the window.
+func (w *statWindow) throughput() float64 {
+	return float64(w.stats.count) / w.width.Seconds()
+}
+
+// windowedStats splits the values pushed to it into consecutive windows of a
+// fixed width, starting from the time it was created. Windows in which nothing
+// was pushed are kept (empty), so the windows always cover the whole run.
+type windowedStats struct {
+	clock   Clock
+	width   time.Duration
+	start   time.Time
+	windows []*statWindow
+}
+
+// newWindowedStats returns a windowedStats whose first window starts now.
+func newWindowedStats(clock Clock, width time.Duration) *windowedStats {
+	if width <= 0 {
+		panic("window width must be positive")
+	}
+	return &windowedStats{
+		clock: clock,
+		width: width,
+		start: clock.Now(),
+	}
+}
+
+// push adds a value to the window of the current time.
+func (ws *windowedStats) push(n float64) error {
+	return ws.current().stats.push(n)
+}
+
+// current returns the window of the current time, creating it (and any
+// window before it) if needed. A time before the start, e.g., of a clock that
+// is not monotonic, falls in the first window.
+func (ws *windowedStats) current() *statWindow {
+	idx := int(ws.clock.Now().Sub(ws.start) / ws.width)
+	if idx < 0 {
+		idx = 0
+	}
+	for len(ws.windows) <= idx {
+		ws.windows = append(ws.windows, &statWindow{
+			start: ws.start.Add(time.Duration(len(ws.windows)) * ws.width),
+			width: ws.width,
+			stats: newCompactStatGroup(),
+		})
+	}
+	return ws.windows[idx]
+}
+
+// percentileAtThroughput returns percentile p of the latency over the complete
+// windows whose throughput is within ±tolerance (relative, e.g., 0.1 for ±10%) of
+// target, in values per second, e.g., the p99 latency while sustaining 10k
+// queries/sec. It also returns the number of windows selected; if none is
+// selected the percentile is 0.
+func (ws *windowedStats) percentileAtThroughput(p, target, tolerance float64) (float64, int, error) {
+	selected := newCompactStatGroup()
+	n := 0
+	for _, w := range ws.complete() {
+		if math.Abs(w.throughput()-target) > tolerance*target {
+			continue
+		}
+		if err := selected.Merge(w.stats); err != nil {
+			return 0, 0, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, 0, nil
+	}
+	return selected.Percentile(p), n, nil
+}
+
+// throughputQuantile returns quantile q (between 0 and 1) of the throughput of
+// the complete windows, in values per second, using the nearest-rank method: e.g., with
+// q = 0.05, 95% of the windows sustained at least the returned throughput.
+// Returns 0 if there are no complete windows.
+func (ws *windowedStats) throughputQuantile(q float64) float64 {
+	complete := ws.complete()
+	if len(complete) == 0 {
+		return 0
+	}
+	throughputs := make([]float64, len(complete))
+	for i, w := range complete {
+		throughputs[i] = w.throughput()
+	}
+	sort.Float64s(throughputs)
+	rank := int(math.Ceil(q * float64(len(throughputs))))
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(throughputs) {
+		rank = len(throughputs)
+	}
+	return throughputs[rank-1]
+}
+
+// WriteThroughputCSV writes the windows as CSV, one row per window with the
+// offset of its start from the start of the run in seconds, the number of
+// values pushed in it and their mean in milliseconds, e.g., "3,8123,1.204".
+// With 1 second windows, this is the throughput per second of the run.
+func (ws *windowedStats) WriteThroughputCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"second", "ops", "mean_latency_ms"}); err != nil {
+		return wrapWriteError(err)
+	}
+	for _, win := range ws.windows {
+		mean := 0.0
+		if win.stats.count > 0 {
+			mean = win.stats.sum / float64(win.stats.count)
+		}
+		row := []string{
+			strconv.FormatFloat(win.start.Sub(ws.start).Seconds(), 'f', -1, 64),
+			strconv.FormatInt(win.stats.count, 10),
+			strconv.FormatFloat(mean, 'f', -1, 64),
+		}
+		if err := cw.Write(row); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	cw.Flush()
+	return wrapWriteError(cw.Error())
+}
+
+// complete returns the windows, without the current one if it is still in
+// progress, as its throughput is not known yet.
+func (ws *windowedStats) complete() []*statWindow {
+	complete := ws.windows
+	if len(complete) > 0 && ws.clock.Now().Before(complete[len(complete)-1].start.Add(ws.width)) {
+		complete = complete[:len(complete)-1]
+	}
+	return complete
+}
+
+// loadPoint is the throughput sustained and the latency observed at it.
+type loadPoint struct {
+	throughput float64 // throughput is in values per second
+	latency    float64 // latency is in milliseconds
+}
+
+// latencyKnee returns the knee of the curve of the mean latency of the
+// complete windows against their throughput, i.e., the load beyond which
+// latency starts climbing sharply, a figure of the maximum sustainable load
+// (see kneePoint). Empty windows are left out. It returns false if there are
+// not enough windows of different throughputs to tell.
+func (ws *windowedStats) latencyKnee() (loadPoint, bool) {
+	var points []loadPoint
+	for _, w := range ws.complete() {
+		if w.stats.count > 0 {
+			points = append(points, loadPoint{throughput: w.throughput(), latency: w.stats.Mean()})
+		}
+	}
+	return kneePoint(points)
+}
+
+// minKneePoints is the number of distinct throughputs below which no knee is
+// looked for, as too few points make for no curve to speak of.
+const minKneePoints = 3
+
+// kneePoint returns the knee of the latency-vs-throughput curve of points with
+// the Kneedle method: the throughputs and latencies are normalized to [0, 1],
+// and the knee is the point of the curve the furthest above the diagonal from
+// the lowest to the highest throughput, i.e., maximizing the normalized
+// throughput minus the normalized latency, which suits a convex, increasing
+// curve such as latency climbing with load. Points of equal throughput are
+// averaged. It returns false if there are fewer than minKneePoints distinct
+// throughputs or the latency never increases.
+func kneePoint(points []loadPoint) (loadPoint, bool) {
+	sorted := make([]loadPoint, len(points))
+	copy(sorted, points)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].throughput < sorted[j].throughput })
+	var curve []loadPoint
+	for i := 0; i < len(sorted); {
+		j, sum := i, 0.0
+		for ; j < len(sorted) && sorted[j].throughput == sorted[i].throughput; j++ {
+			sum += sorted[j].latency
+		}
+		curve = append(curve, loadPoint{throughput: sorted[i].throughput, latency: sum / float64(j-i)})
+		i = j
+	}
+	if len(curve) < minKneePoints {
+		return loadPoint{}, false
+	}
+
+	minX, maxX := curve[0].throughput, curve[len(curve)-1].throughput
+	minY, maxY := curve[0].latency, curve[0].latency
+	for _, p := range curve {
+		minY = math.Min(minY, p.latency)
+		maxY = math.Max(maxY, p.latency)
+	}
+	if maxY == minY {
+		return loadPoint{}, false
+	}
+	knee, maxDifference := -1, 0.0
+	for i, p := range curve {
+		x := (p.throughput - minX) / (maxX - minX)
+		y := (p.latency - minY) / (maxY - minY)
+		if difference := x - y; difference > maxDifference {
+			knee, maxDifference = i, difference
+		}
+	}
+	if knee < 0 {
+		return loadPoint{}, false
+	}
+	return curve[knee], true
+}
+
+// stall is a stretch of consecutive windows whose throughput collapsed.
+type stall struct {
+	start         time.Time
+	duration      time.Duration
+	minThroughput float64 // minThroughput is the lowest throughput of its windows, in values per second
+}
+
+// stalls returns the stalls of the run, i.e., the stretches of consecutive
+// windows whose throughput dropped below fraction (e.g., 0.1) of the running
+// median throughput, that of the windows before. This surfaces transient
+// collapses, which hurt latency but barely move the averages of a long run.
+// The current window, still in progress, is not considered.
+func (ws *windowedStats) stalls(fraction float64) []stall {
+	var stalls []stall
+	var previous []float64 // previous holds the throughputs of the windows before, sorted
+	var current *stall
+	for _, w := range ws.complete() {
+		throughput := w.throughput()
+		if len(previous) > 0 && throughput < fraction*median(previous) {
+			if current == nil {
+				stalls = append(stalls, stall{start: w.start, minThroughput: throughput})
+				current = &stalls[len(stalls)-1]
+			}
+			current.duration += w.width
+			current.minThroughput = math.Min(current.minThroughput, throughput)
+		} else {
+			current = nil
+		}
+		i := sort.SearchFloat64s(previous, throughput)
+		previous = append(previous, 0)
+		copy(previous[i+1:], previous[i:])
+		previous[i] = throughput
+	}
+	return stalls
+}
+
+// belowRate returns the stretches of consecutive complete windows whose
+// throughput was below fraction of rate, e.g., those in which an offered rate
+// could not be sustained.
+func (ws *windowedStats) belowRate(rate, fraction float64) []stall {
+	var stretches []stall
+	var current *stall
+	for _, w := range ws.complete() {
+		throughput := w.throughput()
+		if throughput >= fraction*rate {
+			current = nil
+			continue
+		}
+		if current == nil {
+			stretches = append(stretches, stall{start: w.start, minThroughput: throughput})
+			current = &stretches[len(stretches)-1]
+		}
+		current.duration += w.width
+		current.minThroughput = math.Min(current.minThroughput, throughput)
+	}
+	return stretches
+}
+
+// median returns the median of sorted, which must not be empty.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// writeStalls writes the stalls, one per line, with their start as an offset
+// from the start of the run.
+func (ws *windowedStats) writeStalls(w io.Writer, stalls []stall) error {
+	for _, s := range stalls {
+		_, err := fmt.Fprintf(w, "stall at %v for %v, min throughput: %0.2f/sec\n", s.start.Sub(ws.start), s.duration, s.minThroughput)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package query
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timescale/tsbs/internal/utils"
+)
+
+// fakeClock is a Clock whose time only changes when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestWindowedStatsBoundaries(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	ws := newWindowedStats(clock, time.Second)
+
+	// offset from start -> value pushed
+	pushes := []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{0, 1.0},
+		{900 * time.Millisecond, 2.0},
+		{time.Second, 3.0}, // exactly on a boundary: belongs to the 2nd window
+		{3500 * time.Millisecond, 4.0},
+	}
+	for _, p := range pushes {
+		clock.now = start.Add(p.offset)
+		if err := ws.push(p.value); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	wantCounts := []int64{2, 1, 0, 1}
+	if got := len(ws.windows); got != len(wantCounts) {
+		t.Fatalf("incorrect number of windows: got %d want %d", got, len(wantCounts))
+	}
+	for i, w := range ws.windows {
+		if want := start.Add(time.Duration(i) * time.Second); !w.start.Equal(want) {
+			t.Errorf("window %d: incorrect start: got %v want %v", i, w.start, want)
+		}
+		if got := w.stats.count; got != wantCounts[i] {
+			t.Errorf("window %d: incorrect count: got %d want %d", i, got, wantCounts[i])
+		}
+		if got, want := w.throughput(), float64(wantCounts[i]); got != want {
+			t.Errorf("window %d: incorrect throughput: got %f want %f", i, got, want)
+		}
+	}
+	if got := ws.windows[1].stats.sum; got != 3.0 {
+		t.Errorf("incorrect value in boundary window: got %f want %f", got, 3.0)
+	}
+}
+
+func TestWindowedStatsClockBeforeStart(t *testing.T) {
+	clock := newFakeClock()
+	ws := newWindowedStats(clock, time.Second)
+	clock.advance(-2 * time.Second)
+	if err := ws.push(1.0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ws.windows) != 1 || ws.windows[0].stats.count != 1 {
+		t.Errorf("value before the start not in the first window: got %d windows", len(ws.windows))
+	}
+}
+
+func TestStatProcessorWindowsUseClock(t *testing.T) {
+	limit := uint64(0)
+	clock := newFakeClock()
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, windowWidth: time.Second}).(*defaultStatProcessor)
+	sp.clock = clock
+	sp.initStatMappings()
+
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	clock.advance(2500 * time.Millisecond)
+	sp.aggregate(GetStat().Init([]byte("foo"), 2.0))
+	sp.aggregate(GetPartialStat().Init([]byte("foo"), 3.0))
+
+	if got := len(sp.windows.windows); got != 3 {
+		t.Fatalf("incorrect number of windows: got %d want %d", got, 3)
+	}
+	if got := sp.windows.windows[2].stats.count; got != 1 {
+		t.Errorf("incorrect count in last window: got %d want %d", got, 1)
+	}
+}
+
+func TestWindowedStatsPercentileAtThroughput(t *testing.T) {
+	clock := newFakeClock()
+	ws := newWindowedStats(clock, time.Second)
+
+	// each window gets count values of the given latency
+	windows := []struct {
+		count   int
+		latency float64
+	}{
+		{100, 1.0},
+		{10, 50.0},
+		{100, 2.0},
+		{95, 3.0},
+	}
+	for _, w := range windows {
+		for i := 0; i < w.count; i++ {
+			ws.push(w.latency)
+		}
+		clock.advance(time.Second)
+	}
+
+	cases := []struct {
+		desc        string
+		target      float64
+		wantWindows int
+		wantP99     float64
+	}{
+		{desc: "near 100/sec", target: 100, wantWindows: 3, wantP99: 3.0},
+		{desc: "near 10/sec", target: 10, wantWindows: 1, wantP99: 50.0},
+		{desc: "no window near 1000/sec", target: 1000, wantWindows: 0, wantP99: 0},
+	}
+	// the window in progress is not selected, however close its throughput so far
+	for i := 0; i < 10; i++ {
+		ws.push(500.0)
+	}
+	for _, c := range cases {
+		got, n, err := ws.percentileAtThroughput(99, c.target, 0.1)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.desc, err)
+		}
+		if n != c.wantWindows {
+			t.Errorf("%s: incorrect number of windows: got %d want %d", c.desc, n, c.wantWindows)
+		}
+		if math.Abs(got-c.wantP99) > 0.05*c.wantP99 {
+			t.Errorf("%s: incorrect p99: got %f want %f", c.desc, got, c.wantP99)
+		}
+	}
+}
+
+func TestWindowedStatsThroughputQuantile(t *testing.T) {
+	clock := newFakeClock()
+	ws := newWindowedStats(clock, time.Second)
+	if got := ws.throughputQuantile(0.5); got != 0 {
+		t.Errorf("incorrect quantile without windows: got %f want %f", got, 0.0)
+	}
+
+	// windows of 1 to 20 values/sec, out of order
+	for _, count := range []int{11, 2, 20, 7, 15, 1, 9, 18, 4, 13, 6, 17, 3, 10, 19, 5, 14, 8, 16, 12} {
+		for i := 0; i < count; i++ {
+			ws.push(1.0)
+		}
+		clock.advance(time.Second)
+	}
+
+	cases := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 1},
+		{0.05, 1},
+		{0.5, 10},
+		{0.95, 19},
+		{1, 20},
+	}
+	// the window in progress does not count, its throughput not being known yet
+	ws.push(1.0)
+	for _, c := range cases {
+		if got := ws.throughputQuantile(c.q); got != c.want {
+			t.Errorf("q=%v: incorrect throughput quantile: got %f want %f", c.q, got, c.want)
+		}
+	}
+}
+
+func TestWindowedStatsWriteThroughputCSV(t *testing.T) {
+	clock := newFakeClock()
+	ws := newWindowedStats(clock, time.Second)
+	// second -> values pushed during it; the 3rd second has none
+	seconds := [][]float64{{1.0, 3.0}, {2.0, 2.0, 5.0}, {}, {4.0}}
+	for _, vals := range seconds {
+		for _, val := range vals {
+			ws.push(val)
+		}
+		clock.advance(time.Second)
+	}
+
+	var buf bytes.Buffer
+	if err := ws.WriteThroughputCSV(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid CSV: %v", err)
+	}
+	want := [][]string{
+		{"second", "ops", "mean_latency_ms"},
+		{"0", "2", "2"},
+		{"1", "3", "3"},
+		{"2", "0", "0"},
+		{"3", "1", "4"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("incorrect number of rows: got %d want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if strings.Join(rows[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("row %d: got %v want %v", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestBenchmarkRunnerWriteThroughputCSV(t *testing.T) {
+	limit := uint64(0)
+	b := &BenchmarkRunner{sp: newStatProcessor(&statProcessorArgs{limit: &limit}).(*defaultStatProcessor)}
+	if err := b.WriteThroughputCSV(&bytes.Buffer{}); err != ErrNoWindows {
+		t.Errorf("incorrect error without windows: got %v want %v", err, ErrNoWindows)
+	}
+
+	clock := newFakeClock()
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, windowWidth: time.Second}).(*defaultStatProcessor)
+	sp.clock = clock
+	sp.initStatMappings()
+	sp.aggregate(GetStat().Init([]byte("foo"), 1.0))
+	clock.advance(time.Second)
+	sp.aggregate(GetStat().Init([]byte("foo"), 3.0))
+	b.sp = sp
+
+	var buf bytes.Buffer
+	if err := b.WriteThroughputCSV(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := buf.String(), "second,ops,mean_latency_ms\n0,1,1\n1,1,3\n"; got != want {
+		t.Errorf("incorrect throughput CSV: got %q want %q", got, want)
+	}
+}
+
+func TestWindowedStatsStalls(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	ws := newWindowedStats(clock, time.Second)
+	// values per second; seconds 3 and 4 stall, so does 7 but it is in progress
+	counts := []int{100, 90, 110, 5, 2, 100, 95, 0}
+	for i, count := range counts {
+		for j := 0; j < count; j++ {
+			ws.push(1.0)
+		}
+		if i < len(counts)-1 {
+			clock.advance(time.Second)
+		}
+	}
+	ws.current()
+
+	stalls := ws.stalls(0.1)
+	if len(stalls) != 1 {
+		t.Fatalf("incorrect number of stalls: got %d want %d: %+v", len(stalls), 1, stalls)
+	}
+	s := stalls[0]
+	if !s.start.Equal(start.Add(3*time.Second)) || s.duration != 2*time.Second || s.minThroughput != 2 {
+		t.Errorf("incorrect stall: got %+v want start +3s, duration 2s, min throughput 2", s)
+	}
+
+	// once over, the last window stalled too
+	clock.advance(time.Second)
+	if got := len(ws.stalls(0.1)); got != 2 {
+		t.Errorf("incorrect number of stalls once the last window is over: got %d want %d", got, 2)
+	}
+
+	var buf bytes.Buffer
+	if err := ws.writeStalls(&buf, stalls); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "stall at 3s for 2s, min throughput: 2.00/sec\n"; buf.String() != want {
+		t.Errorf("incorrect stall report: got %q want %q", buf.String(), want)
+	}
+}
+
+func TestWindowedStatsBelowRate(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	ws := newWindowedStats(clock, time.Second)
+	// values per second at an offered rate of 100/sec; a 96/sec second is
+	// jitter, seconds 2 and 3 fall short, so does 5 but it is in progress
+	counts := []int{100, 96, 80, 60, 100, 10}
+	for i, count := range counts {
+		for j := 0; j < count; j++ {
+			ws.push(1.0)
+		}
+		if i < len(counts)-1 {
+			clock.advance(time.Second)
+		}
+	}
+
+	below := ws.belowRate(100, utils.SustainedRateFraction)
+	if len(below) != 1 {
+		t.Fatalf("incorrect number of stretches below the rate: got %d want %d: %+v", len(below), 1, below)
+	}
+	s := below[0]
+	if !s.start.Equal(start.Add(2*time.Second)) || s.duration != 2*time.Second || s.minThroughput != 60 {
+		t.Errorf("incorrect stretch below the rate: got %+v want start +2s, duration 2s, min throughput 60", s)
+	}
+}
+
+func TestWindowedStatsLatencyKnee(t *testing.T) {
+	clock := newFakeClock()
+	ws := newWindowedStats(clock, time.Second)
+	// the load ramps up by 100 queries/sec every second, latency barely moving
+	// up to 800 queries/sec and climbing steeply beyond
+	latency := func(throughput float64) float64 {
+		if throughput <= 800 {
+			return 5 + throughput/1000
+		}
+		return 5.8 + (throughput-800)/10
+	}
+	for i := 1; i <= 15; i++ {
+		for j := 0; j < 100*i; j++ {
+			ws.push(latency(float64(100 * i)))
+		}
+		clock.advance(time.Second)
+	}
+
+	knee, ok := ws.latencyKnee()
+	if !ok {
+		t.Fatalf("no knee found")
+	}
+	if math.Abs(knee.throughput-800) > 100 {
+		t.Errorf("incorrect knee throughput: got %f want about %f", knee.throughput, 800.0)
+	}
+	if math.Abs(knee.latency-latency(knee.throughput)) > 0.1 {
+		t.Errorf("incorrect knee latency: got %f want %f", knee.latency, latency(knee.throughput))
+	}
+
+	// no knee without enough throughputs, or if latency never moves
+	if _, ok := kneePoint([]loadPoint{{100, 5}, {100, 6}, {200, 50}}); ok {
+		t.Errorf("knee found with only 2 distinct throughputs")
+	}
+	if _, ok := kneePoint([]loadPoint{{100, 5}, {200, 5}, {300, 5}}); ok {
+		t.Errorf("knee found with a constant latency")
+	}
+}
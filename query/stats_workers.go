@@ -0,0 +1,181 @@
+package query
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// maxSlowCombinations is the number of slowest label/worker combinations
+	// reported.
+	maxSlowCombinations = 5
+	// minCombinationCount is the number of queries below which a label/worker
+	// combination is not ranked among the slowest, its mean being too noisy.
+	minCombinationCount = 10
+)
+
+// workerLabel is the key of the StatGroup of the queries of a label run by a
+// worker.
+type workerLabel struct {
+	label  string
+	worker int
+}
+
+// workerStats holds the StatGroups of complete results by label and worker,
+// and by worker over all labels, so a worker or a query type stalling on a
+// worker stands out, rather than being hidden in the stats over all workers.
+// The StatGroups are compact (see newCompactStatGroup), since there are as
+// many as there are labels times workers.
+type workerStats struct {
+	combinations map[workerLabel]*statGroup
+	workers      map[int]*statGroup
+}
+
+func newWorkerStats() *workerStats {
+	return &workerStats{combinations: map[workerLabel]*statGroup{}, workers: map[int]*statGroup{}}
+}
+
+// groups returns the StatGroup of the queries of label run by worker, and that
+// of all the queries run by worker, creating them if needed.
+func (ws *workerStats) groups(label string, worker int) (combination, all *statGroup) {
+	key := workerLabel{label: label, worker: worker}
+	combination, ok := ws.combinations[key]
+	if !ok {
+		combination = newCompactStatGroup()
+		ws.combinations[key] = combination
+	}
+	all, ok = ws.workers[worker]
+	if !ok {
+		all = newCompactStatGroup()
+		ws.workers[worker] = all
+	}
+	return combination, all
+}
+
+// anonymized returns the workerStats with their labels replaced by their
+// hashes by a.
+func (ws *workerStats) anonymized(a *labelAnonymizer) *workerStats {
+	anonymized := &workerStats{combinations: make(map[workerLabel]*statGroup, len(ws.combinations)), workers: ws.workers}
+	for k, sg := range ws.combinations {
+		anonymized.combinations[workerLabel{label: a.anonymize(k.label), worker: k.worker}] = sg
+	}
+	return anonymized
+}
+
+// slowCombination is a label/worker combination whose mean is ratio times
+// that of the label over all workers.
+type slowCombination struct {
+	workerLabel
+	sg        *statGroup
+	labelMean float64
+	ratio     float64
+}
+
+// slowest returns the combinations with at least minCombinationCount queries
+// whose mean is the highest relative to that of their label in labels, i.e.,
+// over all workers, up to maxSlowCombinations of them, slowest first. Only
+// those slower than their label are returned.
+func (ws *workerStats) slowest(labels map[string]*statGroup) []slowCombination {
+	var slow []slowCombination
+	for k, sg := range ws.combinations {
+		lsg, ok := labels[k.label]
+		if !ok || sg.count < minCombinationCount || exactMean(lsg) <= 0 {
+			continue
+		}
+		if ratio := exactMean(sg) / exactMean(lsg); ratio > 1 {
+			slow = append(slow, slowCombination{workerLabel: k, sg: sg, labelMean: exactMean(lsg), ratio: ratio})
+		}
+	}
+	sort.Slice(slow, func(i, j int) bool {
+		if slow[i].ratio != slow[j].ratio {
+			return slow[i].ratio > slow[j].ratio
+		}
+		if slow[i].label != slow[j].label {
+			return slow[i].label < slow[j].label
+		}
+		return slow[i].worker < slow[j].worker
+	})
+	if len(slow) > maxSlowCombinations {
+		slow = slow[:maxSlowCombinations]
+	}
+	return slow
+}
+
+// exactMean returns the mean of the values pushed to sg, computed exactly
+// rather than from its histogram, whose precision compact StatGroups lower.
+func exactMean(sg *statGroup) float64 {
+	if sg.count == 0 {
+		return 0
+	}
+	return sg.sum / float64(sg.count)
+}
+
+// write writes the throughput and latency of each worker over the run that
+// took took, the skew of their throughputs, and the slowest label/worker
+// combinations relative to the StatGroups of their labels in labels to w.
+func (ws *workerStats) write(w io.Writer, took time.Duration, labels map[string]*statGroup) error {
+	workers := make([]int, 0, len(ws.workers))
+	for worker := range ws.workers {
+		workers = append(workers, worker)
+	}
+	sort.Ints(workers)
+
+	_, err := fmt.Fprintln(w, "Per-worker stats:")
+	if err != nil {
+		return wrapWriteError(err)
+	}
+	rates := make([]float64, len(workers))
+	for i, worker := range workers {
+		sg := ws.workers[worker]
+		if took > 0 {
+			rates[i] = float64(sg.count) / took.Seconds()
+		}
+		_, err = fmt.Fprintf(w, "worker %d: %d queries (%0.2f queries/sec), mean: %0.2fms, p99: %0.2fms\n", worker, sg.count, rates[i], exactMean(sg), sg.Percentile(99))
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	if len(rates) > 1 {
+		minRate, maxRate, sum := math.Inf(1), 0.0, 0.0
+		for _, r := range rates {
+			minRate, maxRate, sum = math.Min(minRate, r), math.Max(maxRate, r), sum+r
+		}
+		mean := sum / float64(len(rates))
+		variance := 0.0
+		for _, r := range rates {
+			variance += (r - mean) * (r - mean)
+		}
+		variance /= float64(len(rates))
+		skew := math.Inf(1)
+		if minRate > 0 {
+			skew = maxRate / minRate
+		}
+		relStdDev := 0.0
+		if mean > 0 {
+			relStdDev = 100 * math.Sqrt(variance) / mean
+		}
+		_, err = fmt.Fprintf(w, "Worker throughput skew: %0.2fx from the slowest (%0.2f queries/sec) to the fastest (%0.2f queries/sec) worker, stddev: %0.2f%% of the mean\n", skew, minRate, maxRate, relStdDev)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+
+	slow := ws.slowest(labels)
+	if len(slow) == 0 {
+		return nil
+	}
+	_, err = fmt.Fprintln(w, "Slowest label/worker combinations:")
+	if err != nil {
+		return wrapWriteError(err)
+	}
+	for _, c := range slow {
+		_, err = fmt.Fprintf(w, "%s on worker %d: mean: %0.2fms, %0.2fx that of the query type over all workers (%0.2fms), count: %d\n", c.label, c.worker, exactMean(c.sg), c.ratio, c.labelMean, c.sg.count)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
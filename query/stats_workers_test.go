@@ -0,0 +1,105 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// workerStat returns a Stat of a query of label run by worker in value.
+func workerStat(label string, worker int, value float64) *Stat {
+	s := GetStat().Init([]byte(label), value)
+	s.worker = worker
+	return s
+}
+
+func TestWorkerStatsSlowest(t *testing.T) {
+	limit := uint64(0)
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, workerStats: true}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for i := 0; i < 20; i++ {
+		for worker := 0; worker < 3; worker++ {
+			sp.aggregate(workerStat("foo", worker, 10.0))
+			sp.aggregate(workerStat("bar", worker, 1.0))
+		}
+		// worker 1 stalls on bar only
+		sp.aggregate(workerStat("bar", 1, 10.0))
+	}
+	// too few queries to be ranked, however slow
+	sp.aggregate(workerStat("baz", 0, 1000.0))
+	// of an unknown worker, e.g., an insert
+	sp.aggregate(GetStat().Init([]byte("foo"), 10.0))
+
+	if got := len(sp.workers.workers); got != 3 {
+		t.Fatalf("incorrect number of workers: got %d want 3", got)
+	}
+	if got := sp.workers.workers[1].count; got != 60 {
+		t.Errorf("incorrect count of worker 1: got %d want 60", got)
+	}
+	slow := sp.workers.slowest(sp.statMapping)
+	if len(slow) != 1 || slow[0].label != "bar" || slow[0].worker != 1 {
+		t.Fatalf("incorrect slowest combinations: got %+v", slow)
+	}
+	// worker 1 has a mean of 5.5ms on bar, whose mean is 3.25ms over all workers
+	if got, want := slow[0].ratio, 5.5/3.25; got < want*0.99 || got > want*1.01 {
+		t.Errorf("incorrect ratio: got %f want %f", got, want)
+	}
+}
+
+func TestWorkerStatsWrite(t *testing.T) {
+	ws := newWorkerStats()
+	labels := map[string]*statGroup{"foo": newStatGroup(0)}
+	for i := 0; i < 40; i++ {
+		worker := 0
+		value := 1.0
+		if i%4 == 0 {
+			worker, value = 1, 4.0
+		}
+		combination, all := ws.groups("foo", worker)
+		combination.push(value)
+		all.push(value)
+		labels["foo"].push(value)
+	}
+	var buf bytes.Buffer
+	if err := ws.write(&buf, 10*time.Second, labels); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"Per-worker stats:\n",
+		"worker 0: 30 queries (3.00 queries/sec), mean: 1.00ms",
+		"worker 1: 10 queries (1.00 queries/sec), mean: 4.00ms",
+		"Worker throughput skew: 3.00x from the slowest (1.00 queries/sec) to the fastest (3.00 queries/sec) worker, stddev: 50.00% of the mean",
+		"Slowest label/worker combinations:\nfoo on worker 1: mean: 4.00ms, 2.29x",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestStatProcessorWorkerStatsReport(t *testing.T) {
+	limit := uint64(0)
+	a := newLabelAnonymizer([]byte("secret"))
+	sp := newStatProcessor(&statProcessorArgs{limit: &limit, workerStats: true, anonymizer: a}).(*defaultStatProcessor)
+	sp.initStatMappings()
+	for i := 0; i < 20; i++ {
+		sp.aggregate(workerStat("foo", 0, 1.0))
+		sp.aggregate(workerStat("foo", 1, 2.0))
+	}
+	sp.took = time.Second
+
+	var buf bytes.Buffer
+	if err := sp.exported().writeReport(&buf, 40, 2, 40); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Per-worker stats:\nworker 0: 20 queries (20.00 queries/sec)") {
+		t.Errorf("per-worker stats missing from the report:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), a.anonymize("foo")+" on worker 1:") {
+		t.Errorf("slowest combination missing from the report:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "foo") {
+		t.Errorf("label leaked into the report:\n%s", buf.String())
+	}
+}
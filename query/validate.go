@@ -0,0 +1,479 @@
+package query
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultValidateTolerance is the relative difference up to which numbers
+	// of responses are deemed equal when validating against a golden file.
+	defaultValidateTolerance = 1e-6
+	// maxMismatchExamples is the number of IDs of mismatched queries reported
+	// per label.
+	maxMismatchExamples = 5
+)
+
+// Response is the response of a query, normalized so the responses of the
+// same query by different databases, or versions of a database, compare
+// equal: numbers are float64s, times are RFC 3339 strings in UTC, and the rows,
+// which databases order differently unless told to, are sorted. The columns
+// keep their order, which runners make the canonical one (see CanonicalRows),
+// so a value under the wrong column does not compare equal.
+type Response struct {
+	ID    uint64          `json:"id"`
+	Label string          `json:"label"`
+	Rows  [][]interface{} `json:"rows"`
+}
+
+// NewResponse returns the normalized Response of q, made of rows, whose values
+// are of the types database drivers return, or JSON decoding does. The rows
+// are sorted by their values that are not numbers, e.g., times and tags (see
+// lessRowKey), so numbers differing within the tolerance do not reorder them.
+func NewResponse(q Query, rows [][]interface{}) Response {
+	normalized := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values := make([]interface{}, len(row))
+		for j, v := range row {
+			values[j] = normalizeValue(v)
+		}
+		normalized[i] = values
+	}
+	sort.SliceStable(normalized, func(a, b int) bool { return lessRowKey(normalized[a], normalized[b]) })
+	return Response{ID: q.GetID(), Label: string(q.HumanLabelName()), Rows: normalized}
+}
+
+// The kinds of the columns of responses, in their canonical order.
+const (
+	columnTime = iota
+	columnTag
+	columnValue
+)
+
+// columnKind returns the kind of a column whose first value that is not nil
+// is v, normalized: a time, a value if a number, a tag otherwise.
+func columnKind(v interface{}) int {
+	switch v := v.(type) {
+	case float64:
+		return columnValue
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return columnTime
+		}
+	}
+	return columnTag
+}
+
+// CanonicalRows returns rows, whose columns are named columns, with their
+// columns in the canonical order of responses, so the responses of databases
+// ordering columns differently compare equal: the times first, then the tags
+// sorted by name, then the values in their order. The kind of a column is
+// told by its first value that is not nil, see columnKind. Rows of another
+// number of columns are left as they are.
+func CanonicalRows(columns []string, rows [][]interface{}) [][]interface{} {
+	kinds := make([]int, len(columns))
+	for j := range columns {
+		kinds[j] = columnTag
+		for _, row := range rows {
+			if len(row) == len(columns) && row[j] != nil {
+				kinds[j] = columnKind(normalizeValue(row[j]))
+				break
+			}
+		}
+	}
+	order := make([]int, len(columns))
+	for j := range order {
+		order[j] = j
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ka, kb := kinds[order[a]], kinds[order[b]]
+		if ka != kb {
+			return ka < kb
+		}
+		return ka == columnTag && columns[order[a]] < columns[order[b]]
+	})
+
+	canonical := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			canonical[i] = row
+			continue
+		}
+		canonical[i] = make([]interface{}, len(row))
+		for j, k := range order {
+			canonical[i][j] = row[k]
+		}
+	}
+	return canonical
+}
+
+// normalizeValue returns v as a nil, a bool, a float64 or a string. Numbers
+// JSON cannot encode, i.e., NaN and the infinities, and numbers in strings,
+// as some drivers return, are float64s; times, and times in strings, are RFC
+// 3339 strings in UTC.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case json.Number:
+		return normalizeString(string(v))
+	case []byte:
+		return normalizeString(string(v))
+	case string:
+		return normalizeString(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// normalizeString returns s as a float64 if it is a number, as an RFC 3339
+// string in UTC if it is a time, as is otherwise.
+func normalizeString(s string) interface{} {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+// valueRank orders the types of the normalized values: nil, then bools, then
+// numbers, then strings.
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// lessValue reports whether the normalized value a sorts before b.
+func lessValue(a, b interface{}) bool {
+	if ra, rb := valueRank(a), valueRank(b); ra != rb {
+		return ra < rb
+	}
+	switch a := a.(type) {
+	case bool:
+		return !a && b.(bool)
+	case float64:
+		fb := b.(float64)
+		// NaN sorts first, rather than being incomparable
+		return (math.IsNaN(a) && !math.IsNaN(fb)) || a < fb
+	case string:
+		return a < b.(string)
+	default:
+		return false
+	}
+}
+
+// lessRowKey reports whether the normalized row a sorts before b, by their
+// values that are not numbers, column by column, the columns where both are
+// numbers being skipped.
+func lessRowKey(a, b []interface{}) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		_, fa := a[i].(float64)
+		_, fb := b[i].(float64)
+		if fa && fb {
+			continue
+		}
+		if lessValue(a[i], b[i]) {
+			return true
+		}
+		if lessValue(b[i], a[i]) {
+			return false
+		}
+	}
+	return len(a) < len(b)
+}
+
+// MarshalJSON encodes the Response, with the numbers JSON cannot encode as the
+// strings "NaN", "+Inf" and "-Inf", which normalization reads back as numbers.
+func (r Response) MarshalJSON() ([]byte, error) {
+	rows := make([][]interface{}, len(r.Rows))
+	for i, row := range r.Rows {
+		values := make([]interface{}, len(row))
+		for j, v := range row {
+			if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				v = strconv.FormatFloat(f, 'g', -1, 64)
+			}
+			values[j] = v
+		}
+		rows[i] = values
+	}
+	type response Response // response has no MarshalJSON method
+	return json.Marshal(response{ID: r.ID, Label: r.Label, Rows: rows})
+}
+
+// equalValues reports whether the normalized values a and b are equal, the
+// numbers being so when they differ by no more than tolerance relative to the
+// larger one.
+func equalValues(a, b interface{}, tolerance float64) bool {
+	fa, ok := a.(float64)
+	if !ok {
+		return a == b
+	}
+	fb, ok := b.(float64)
+	switch {
+	case !ok:
+		return false
+	case math.IsNaN(fa) || math.IsNaN(fb):
+		return math.IsNaN(fa) && math.IsNaN(fb)
+	case fa == fb:
+		return true
+	}
+	return math.Abs(fa-fb) <= tolerance*math.Max(math.Abs(fa), math.Abs(fb))
+}
+
+// Matches reports whether the Response has the same rows as golden, the
+// numbers being compared with tolerance, see equalValues.
+func (r Response) Matches(golden Response, tolerance float64) bool {
+	if len(r.Rows) != len(golden.Rows) {
+		return false
+	}
+	for i, row := range r.Rows {
+		if len(row) != len(golden.Rows[i]) {
+			return false
+		}
+		for j, v := range row {
+			if !equalValues(v, golden.Rows[i][j], tolerance) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// WriteResponses writes responses to w as JSON lines, ordered by ID, the
+// format of golden files.
+func WriteResponses(w io.Writer, responses []Response) error {
+	sorted := append([]Response(nil), responses...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, r := range sorted {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadResponses reads the responses of a golden file, written by
+// WriteResponses, from r, by ID.
+func ReadResponses(r io.Reader) (map[uint64]Response, error) {
+	responses := map[uint64]Response{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		var resp Response
+		err := dec.Decode(&resp)
+		if err == io.EOF {
+			return responses, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the responses: %v", err)
+		}
+		for _, row := range resp.Rows {
+			for j, v := range row {
+				row[j] = normalizeValue(v)
+			}
+		}
+		responses[resp.ID] = resp
+	}
+}
+
+// SQLRows reads all the rows of rows, as the values the driver returns, with
+// their columns in the canonical order, see CanonicalRows.
+func SQLRows(rows *sql.Rows) ([][]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	all := [][]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		all = append(all, values)
+	}
+	return CanonicalRows(cols, all), rows.Err()
+}
+
+// validator keeps the responses of the queries of a run, to write them to a
+// golden file or compare them to those of one. Only the first response of a
+// query is kept, e.g., of the cold run of a query run cold then warm. It is
+// safe for concurrent use by the workers.
+type validator struct {
+	mu        sync.Mutex
+	responses map[uint64]Response
+}
+
+func newValidator() *validator {
+	return &validator{responses: map[uint64]Response{}}
+}
+
+// record keeps the response r, unless one of the same query was kept.
+func (v *validator) record(r Response) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.responses[r.ID]; !ok {
+		v.responses[r.ID] = r
+	}
+}
+
+// all returns the responses kept.
+func (v *validator) all() []Response {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	responses := make([]Response, 0, len(v.responses))
+	for _, r := range v.responses {
+		responses = append(responses, r)
+	}
+	return responses
+}
+
+// labelValidation is the outcome of the validation of the queries of a label.
+type labelValidation struct {
+	compared   int
+	mismatched []uint64 // mismatched are the IDs of the mismatched queries, ordered
+	missing    int      // missing is the number of queries the golden file has no response of
+}
+
+// validation is the outcome of the validation of the responses of a run
+// against a golden file, by label.
+type validation map[string]*labelValidation
+
+// validate compares responses to those of golden, by ID, with tolerance.
+func validate(responses []Response, golden map[uint64]Response, tolerance float64) validation {
+	v := validation{}
+	for _, r := range responses {
+		lv, ok := v[r.Label]
+		if !ok {
+			lv = &labelValidation{}
+			v[r.Label] = lv
+		}
+		g, ok := golden[r.ID]
+		if !ok {
+			lv.missing++
+			continue
+		}
+		lv.compared++
+		if !r.Matches(g, tolerance) {
+			lv.mismatched = append(lv.mismatched, r.ID)
+		}
+	}
+	for _, lv := range v {
+		sort.Slice(lv.mismatched, func(i, j int) bool { return lv.mismatched[i] < lv.mismatched[j] })
+	}
+	return v
+}
+
+// mismatched returns the number of mismatched queries over all labels.
+func (v validation) mismatched() int {
+	n := 0
+	for _, lv := range v {
+		n += len(lv.mismatched)
+	}
+	return n
+}
+
+// write writes the outcome of the validation against the golden file named
+// golden to w, label by label, in order, with the IDs of the first mismatched
+// queries. Labels are anonymized by anonymizer, if not nil.
+func (v validation) write(w io.Writer, golden string, anonymizer *labelAnonymizer) error {
+	labels := make([]string, 0, len(v))
+	compared, missing := 0, 0
+	for label, lv := range v {
+		labels = append(labels, label)
+		compared += lv.compared
+		missing += lv.missing
+	}
+	sort.Strings(labels)
+
+	_, err := fmt.Fprintf(w, "Validation against %s: %d queries compared, %d mismatched, %d missing from the golden file\n", golden, compared, v.mismatched(), missing)
+	if err != nil {
+		return wrapWriteError(err)
+	}
+	for _, label := range labels {
+		lv := v[label]
+		if len(lv.mismatched) == 0 && lv.missing == 0 {
+			continue
+		}
+		name := label
+		if anonymizer != nil {
+			name = anonymizer.anonymize(label)
+		}
+		_, err = fmt.Fprintf(w, "%s: %d of %d mismatched, %d missing", name, len(lv.mismatched), lv.compared, lv.missing)
+		if err != nil {
+			return wrapWriteError(err)
+		}
+		if len(lv.mismatched) > 0 {
+			examples := lv.mismatched
+			if len(examples) > maxMismatchExamples {
+				examples = examples[:maxMismatchExamples]
+			}
+			_, err = fmt.Fprintf(w, " (e.g., query IDs %v)", examples)
+			if err != nil {
+				return wrapWriteError(err)
+			}
+		}
+		if _, err = fmt.Fprintln(w); err != nil {
+			return wrapWriteError(err)
+		}
+	}
+	return nil
+}
+
+// readGoldenFile reads the responses of the golden file named name.
+func readGoldenFile(name string) (map[uint64]Response, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadResponses(f)
+}
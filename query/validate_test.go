@@ -0,0 +1,195 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newValidateTestQuery(id uint64, label string) Query {
+	q := NewHTTP()
+	q.SetID(id)
+	q.HumanLabel = []byte(label)
+	return q
+}
+
+func TestNormalizeValue(t *testing.T) {
+	ts := time.Date(2016, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	cases := []struct {
+		desc  string
+		value interface{}
+		want  interface{}
+	}{
+		{desc: "nil", value: nil, want: nil},
+		{desc: "bool", value: true, want: true},
+		{desc: "int64", value: int64(3), want: 3.0},
+		{desc: "uint8", value: uint8(3), want: 3.0},
+		{desc: "float32", value: float32(1.5), want: 1.5},
+		{desc: "json number", value: json.Number("1.5"), want: 1.5},
+		{desc: "number in bytes", value: []byte("42"), want: 42.0},
+		{desc: "string", value: "host_1", want: "host_1"},
+		{desc: "time", value: ts, want: "2016-01-01T11:00:00Z"},
+		{desc: "time in string", value: "2016-01-01T12:00:00+01:00", want: "2016-01-01T11:00:00Z"},
+	}
+	for _, c := range cases {
+		if got := normalizeValue(c.value); got != c.want {
+			t.Errorf("%s: got %#v want %#v", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestNewResponseOrder(t *testing.T) {
+	q := newValidateTestQuery(7, "foo")
+	// The same rows, in another order.
+	a := NewResponse(q, [][]interface{}{{"host_2", int64(2)}, {"host_1", 1.0}})
+	b := NewResponse(q, [][]interface{}{{[]byte("host_1"), 1.0}, {"host_2", 2.0}})
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("responses not normalized the same: got %v and %v", a.Rows, b.Rows)
+	}
+	if a.ID != 7 || a.Label != "foo" {
+		t.Errorf("incorrect ID and label: got %d %s", a.ID, a.Label)
+	}
+
+	// The rows are sorted by their tags only, so numbers within the tolerance
+	// do not reorder rows of the same tags.
+	c := NewResponse(q, [][]interface{}{{"host_1", 1.0000001}, {"host_1", 5.0}})
+	d := NewResponse(q, [][]interface{}{{"host_1", 1.0}, {"host_1", 5.0}})
+	if !c.Matches(d, 1e-6) {
+		t.Errorf("numbers within the tolerance reordered the rows: got %v and %v", c.Rows, d.Rows)
+	}
+}
+
+func TestCanonicalRows(t *testing.T) {
+	ts := time.Unix(0, 0)
+	columns := []string{"max", "min", "hostname", "time", "region"}
+	rows := [][]interface{}{
+		{nil, 1.0, "host_1", ts, "west"},
+		{5.0, 2.0, "host_2", ts, "east"},
+		{1.0, 2.0},
+	}
+	want := [][]interface{}{
+		{ts, "host_1", "west", nil, 1.0},
+		{ts, "host_2", "east", 5.0, 2.0},
+		{1.0, 2.0},
+	}
+	if got := CanonicalRows(columns, rows); !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect canonical rows: got %v want %v", got, want)
+	}
+}
+
+func TestResponseMatches(t *testing.T) {
+	q := newValidateTestQuery(1, "foo")
+	golden := NewResponse(q, [][]interface{}{{"host_1", 100.0}, {"host_2", math.NaN()}})
+	cases := []struct {
+		desc string
+		rows [][]interface{}
+		want bool
+	}{
+		{desc: "same", rows: [][]interface{}{{"host_1", 100.0}, {"host_2", math.NaN()}}, want: true},
+		{desc: "within the tolerance", rows: [][]interface{}{{"host_1", 100.00001}, {"host_2", math.NaN()}}, want: true},
+		{desc: "beyond the tolerance", rows: [][]interface{}{{"host_1", 100.1}, {"host_2", math.NaN()}}},
+		{desc: "other string", rows: [][]interface{}{{"host_3", 100.0}, {"host_2", math.NaN()}}},
+		{desc: "missing row", rows: [][]interface{}{{"host_1", 100.0}}},
+		{desc: "missing value", rows: [][]interface{}{{"host_1"}, {"host_2", math.NaN()}}},
+		{desc: "swapped columns", rows: [][]interface{}{{100.0, "host_1"}, {math.NaN(), "host_2"}}},
+		{desc: "value under the wrong tag", rows: [][]interface{}{{"host_1", math.NaN()}, {"host_2", 100.0}}},
+		{desc: "number for NaN", rows: [][]interface{}{{"host_1", 100.0}, {"host_2", 0.0}}},
+	}
+	for _, c := range cases {
+		if got := NewResponse(q, c.rows).Matches(golden, 1e-6); got != c.want {
+			t.Errorf("%s: got %v want %v", c.desc, got, c.want)
+		}
+	}
+}
+
+func TestResponsesRoundTrip(t *testing.T) {
+	responses := []Response{
+		NewResponse(newValidateTestQuery(2, "bar"), [][]interface{}{{"host_1", math.Inf(1)}, {nil, false}}),
+		NewResponse(newValidateTestQuery(1, "foo"), [][]interface{}{{time.Unix(0, 0), 1.25}}),
+		NewResponse(newValidateTestQuery(3, "foo"), [][]interface{}{}),
+	}
+	var buf bytes.Buffer
+	if err := WriteResponses(&buf, responses); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], `{"id":1,`) {
+		t.Errorf("incorrect golden file, not a response per line ordered by ID:\n%s", buf.String())
+	}
+
+	got, err := ReadResponses(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != len(responses) {
+		t.Fatalf("incorrect number of responses: got %d want %d", len(got), len(responses))
+	}
+	for _, r := range responses {
+		if !got[r.ID].Matches(r, 0) || got[r.ID].Label != r.Label {
+			t.Errorf("incorrect response %d read back: got %v want %v", r.ID, got[r.ID], r)
+		}
+	}
+}
+
+func TestReadResponsesErr(t *testing.T) {
+	if _, err := ReadResponses(strings.NewReader(`{"id":1,"rows":[`)); err == nil {
+		t.Errorf("unexpected lack of error for a truncated golden file")
+	}
+}
+
+func TestValidatorRecordsFirst(t *testing.T) {
+	v := newValidator()
+	q := newValidateTestQuery(1, "foo")
+	v.record(NewResponse(q, [][]interface{}{{1}}))
+	v.record(NewResponse(q, [][]interface{}{{2}}))
+	all := v.all()
+	if len(all) != 1 || all[0].Rows[0][0] != 1.0 {
+		t.Errorf("incorrect responses kept: got %v", all)
+	}
+}
+
+func TestValidateWrite(t *testing.T) {
+	golden := map[uint64]Response{}
+	var responses []Response
+	for i := uint64(1); i <= 8; i++ {
+		q := newValidateTestQuery(i, "foo")
+		golden[i] = NewResponse(q, [][]interface{}{{1.0}})
+		row := []interface{}{1.0}
+		if i > 1 {
+			// all mismatched but the first, to list more than the examples
+			row = []interface{}{2.0}
+		}
+		responses = append(responses, NewResponse(q, [][]interface{}{row}))
+	}
+	responses = append(responses,
+		NewResponse(newValidateTestQuery(9, "bar"), [][]interface{}{{1.0}}),
+		NewResponse(newValidateTestQuery(10, "baz"), nil),
+	)
+	golden[9] = NewResponse(newValidateTestQuery(9, "bar"), [][]interface{}{{1.0}})
+
+	v := validate(responses, golden, 1e-6)
+	if got := v.mismatched(); got != 7 {
+		t.Errorf("incorrect number of mismatched queries: got %d want 7", got)
+	}
+	var buf bytes.Buffer
+	if err := v.write(&buf, "golden.json", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Validation against golden.json: 9 queries compared, 7 mismatched, 1 missing from the golden file\n" +
+		"baz: 0 of 0 mismatched, 1 missing\n" +
+		"foo: 7 of 8 mismatched, 0 missing (e.g., query IDs [2 3 4 5 6])\n"
+	if got := buf.String(); got != want {
+		t.Errorf("incorrect output:\ngot\n%s\nwant\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := v.write(&buf, "golden.json", newLabelAnonymizer([]byte("key"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(buf.String(), "foo") {
+		t.Errorf("label not anonymized:\n%s", buf.String())
+	}
+}